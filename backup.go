@@ -0,0 +1,649 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// A backup holds everything to restore a CA in another store: the configuration with
+// the certificate chain, serial state and profiles, the envelope encrypted key, the
+// certificate inventory, the revocations, the CRL number and the key rollover. The CA
+// signs it and a password optionally encrypts it.
+
+const backupFormat = "gopki-ca-backup"
+
+// BackupVersion is the version of the backups written by ExportCA, ImportCA reads this
+// and the older versions
+const BackupVersion = 1
+
+// scrypt parameters deriving the key encrypting a backup from its password
+const (
+	backupScryptN = 1 << 15
+	backupScryptR = 8
+	backupScryptP = 1
+)
+
+// backupFile is the JSON document of a backup
+type backupFile struct {
+	Format  string
+	Version int
+	// Salt derives the key from the password when Archive is encrypted, it is empty when
+	// Archive is the plain signedArchive
+	Salt    []byte `json:",omitempty"`
+	Archive []byte
+}
+
+// signedArchive is the caArchive in Content signed by the CA, see backupSignedData
+type signedArchive struct {
+	Content            []byte
+	SignatureAlgorithm x509.SignatureAlgorithm
+	Signature          []byte
+}
+
+type caArchive struct {
+	Name      string
+	CreatedAt time.Time
+	Config    map[string][]byte
+	// PrivateKey is the key of the CA when it is stored with StorePrivateKey, its data key
+	// is wrapped by the KEK of the store
+	PrivateKey   *StoredPrivateKey `json:",omitempty"`
+	Certificates []archivedCertificate
+	Revocations  []*Revocation
+	CRLNumber    string            `json:",omitempty"`
+	Rollover     *archivedRollover `json:",omitempty"`
+}
+
+// archivedCertificate is a CertificateRecord with the DER encoded certificate
+type archivedCertificate struct {
+	SerialNumber    *big.Int
+	Subject         string
+	SubjectAltNames []string
+	Profile         string
+	NotBefore       time.Time
+	NotAfter        time.Time
+	Status          CertificateStatus
+	Fingerprint     string
+	Requester       string
+	KeyID           string
+	KeyType         string
+	Certificate     []byte
+}
+
+// archivedRollover is a Rollover with the DER encoded certificates: old, new, old with
+// new and new with old
+type archivedRollover struct {
+	State        RolloverState
+	SwitchAt     time.Time
+	RetireAt     time.Time
+	Certificates [][]byte
+}
+
+// backupSignedData binds the signature to the format and the version of the backup
+func backupSignedData(version int, content []byte) (b []byte) {
+	return append([]byte(backupFormat+"\x00"+strconv.Itoa(version)+"\x00"), content...)
+}
+
+func backupKey(password []byte, salt []byte) (key []byte, e error) {
+	return scrypt.Key(password, salt, backupScryptN, backupScryptR, backupScryptP, 32)
+}
+
+// ExportCA writes a backup of the CA saved in this store to out, signed by the CA. With a
+// password the backup is encrypted with AES-256-GCM under a key derived with scrypt. A
+// key stored with StorePrivateKey stays wrapped by the KEK, a key file or remote signer
+// is only referenced by its URI.
+func (s *CAStore)ExportCA(ca *CA, password []byte, out io.Writer) (e error) {
+	config, err := s.loadConfig(ca.Name)
+	if err != nil {
+		return err
+	}
+	ca.mutex.Lock()
+	key := ca.currentKey()
+	signer, algorithm, cert := key.signer, key.algorithm, key.certificate.Raw
+	serialState, err := serialNumberState(ca.serialNumbers)
+	ca.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(config[configCertificate], cert) {
+		return errors.New("CA " + ca.Name + " changed since it was saved, save it before the backup")
+	}
+	config[configSerialNumber] = []byte(serialState)
+
+	archive := &caArchive{
+		Name:      ca.Name,
+		CreatedAt: ca.Clock().Now().UTC(),
+		Config:    config,
+	}
+	if keyID, ok := strings.CutPrefix(string(config[configKey]), keyURIDatabase); ok {
+		archive.PrivateKey, err = s.storedPrivateKey(ca.Name, keyID)
+		if err != nil {
+			return err
+		}
+	}
+	records, err := s.store.Certificates(ca.Name)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		var der []byte
+		if r.Certificate != nil {
+			der = r.Certificate.Raw
+		}
+		archive.Certificates = append(archive.Certificates, archivedCertificate{
+			SerialNumber:    r.SerialNumber,
+			Subject:         r.Subject,
+			SubjectAltNames: r.SubjectAltNames,
+			Profile:         r.Profile,
+			NotBefore:       r.NotBefore,
+			NotAfter:        r.NotAfter,
+			Status:          r.Status,
+			Fingerprint:     r.Fingerprint,
+			Requester:       r.Requester,
+			KeyID:           r.KeyID,
+			KeyType:         r.KeyType,
+			Certificate:     der,
+		})
+	}
+	archive.Revocations, err = s.store.Revocations(ca.Name)
+	if err != nil {
+		return err
+	}
+	crlNumber, err := s.store.CRLNumber(ca.Name)
+	if err != nil {
+		return err
+	}
+	if crlNumber != nil {
+		archive.CRLNumber = crlNumber.Text(16)
+	}
+	rollover, err := s.store.Rollover(ca.Name)
+	if err != nil {
+		return err
+	}
+	if rollover != nil {
+		archive.Rollover = &archivedRollover{
+			State:    rollover.State,
+			SwitchAt: rollover.SwitchAt,
+			RetireAt: rollover.RetireAt,
+			Certificates: [][]byte{
+				rollover.OldCertificate.Raw,
+				rollover.NewCertificate.Raw,
+				rollover.OldWithNew.Raw,
+				rollover.NewWithOld.Raw,
+			},
+		}
+	}
+
+	content, err := json.Marshal(archive)
+	if err != nil {
+		return err
+	}
+	_, signature, err := signData(signer, algorithm, backupSignedData(BackupVersion, content))
+	if err != nil {
+		return err
+	}
+	signed, err := json.Marshal(&signedArchive{
+		Content:            content,
+		SignatureAlgorithm: algorithm,
+		Signature:          signature,
+	})
+	if err != nil {
+		return err
+	}
+
+	file := &backupFile{
+		Format:  backupFormat,
+		Version: BackupVersion,
+		Archive: signed,
+	}
+	if len(password) > 0 {
+		file.Salt = make([]byte, 16)
+		_, err = io.ReadFull(rand.Reader, file.Salt)
+		if err != nil {
+			return err
+		}
+		key, err := backupKey(password, file.Salt)
+		if err != nil {
+			return err
+		}
+		file.Archive, err = sealAESGCM(key, signed, []byte(backupFormat))
+		if err != nil {
+			return err
+		}
+	}
+	return json.NewEncoder(out).Encode(file)
+}
+
+// ImportOptions control the restore of a backup by ImportCA
+type ImportOptions struct {
+	// Password decrypts an encrypted backup
+	Password []byte
+	// Roots must issue the certificate of the CA when set, otherwise the signature is only
+	// verified with the certificate in the backup, see ImportCA
+	Roots *x509.CertPool
+}
+
+// ImportCA restores a CA from a backup written by ExportCA and returns its name, LoadCA
+// loads it afterwards. It verifies the signature of the backup and refuses to replace a
+// CA by an older state: the sequential serial number can't go back and the certificates
+// and revocations in the store must all be in the backup. A CA already in the store is
+// only replaced by a backup of its own key, or of the other key of its key rollover. The
+// configuration is protected with the integrity key of this store. The data key of a
+// stored private key is rewrapped with the KEK of this store, which needs the KEK of the
+// backup as current or previous KEK.
+//
+// Without Roots a CA which is not in the store yet is only verified with the CA
+// certificate inside the backup: that proves the backup is intact, not who made it. Anyone
+// can sign a backup of their own CA, so restore a backup from an untrusted place with Roots.
+func (s *CAStore)ImportCA(in io.Reader, options ImportOptions) (caname string, e error) {
+	if s.integrityKey == nil {
+		return "", errors.New("no integrity key to protect the CA configuration")
+	}
+	archive, cert, err := readBackup(in, options)
+	if err != nil {
+		return "", err
+	}
+	err = s.checkRestore(archive, cert)
+	if err != nil {
+		return "", err
+	}
+
+	state := &CAState{
+		Config:      s.configEntries(archive.Name, archive.Config),
+		Certificate: cert,
+		Revocations: archive.Revocations,
+	}
+	for _, a := range archive.Certificates {
+		state.Certificates = append(state.Certificates, a.record())
+	}
+	if archive.PrivateKey != nil {
+		state.PrivateKey, err = s.rewrapArchivedKey(archive, cert)
+		if err != nil {
+			return "", err
+		}
+	}
+	if archive.Rollover != nil {
+		state.Rollover, err = archive.Rollover.parse()
+		if err != nil {
+			return "", err
+		}
+	}
+	if archive.CRLNumber != "" {
+		var ok bool
+		state.CRLNumber, ok = new(big.Int).SetString(archive.CRLNumber, 16)
+		if !ok {
+			return "", errors.New("invalid CRL number in the backup: " + archive.CRLNumber)
+		}
+	}
+
+	err = s.store.RestoreCA(archive.Name, state)
+	if err != nil {
+		return "", err
+	}
+	return archive.Name, nil
+}
+
+func (d *DB)RestoreCA(caname string, state *CAState) (e error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = d.replaceConfig(tx, caname, state.Config)
+	if err != nil {
+		return err
+	}
+	err = d.replaceCA(tx, caname, state.Certificate)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"CERTIFICATE", "REVOCATION", "ROLLOVER"} {
+		_, err = tx.Exec(d.rebind("DELETE FROM "+table+" WHERE caname = ?"), caname)
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range state.Certificates {
+		err = d.insertCertificate(tx, caname, r)
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range state.Revocations {
+		err = d.insertRevocation(tx, caname, r)
+		if err != nil {
+			return err
+		}
+	}
+	if state.PrivateKey != nil {
+		err = d.replacePrivateKey(tx, caname, state.PrivateKey)
+		if err != nil {
+			return err
+		}
+	}
+	if state.Rollover != nil {
+		err = d.replaceRollover(tx, caname, state.Rollover)
+		if err != nil {
+			return err
+		}
+	}
+	if state.CRLNumber != nil {
+		err = d.restoreCRLNumber(tx, caname, state.CRLNumber)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// readBackup decrypts the backup and verifies its signature, it returns the archive and
+// the certificate of the CA
+func readBackup(in io.Reader, options ImportOptions) (a *caArchive, cert *x509.Certificate, e error) {
+	var file backupFile
+	err := json.NewDecoder(in).Decode(&file)
+	if err != nil {
+		return nil, nil, errors.New("invalid backup: " + err.Error())
+	}
+	if file.Format != backupFormat {
+		return nil, nil, errors.New("not a gopki CA backup")
+	}
+	if file.Version < 1 || file.Version > BackupVersion {
+		return nil, nil, errors.New("unsupported backup version " + strconv.Itoa(file.Version))
+	}
+
+	signed := file.Archive
+	if len(file.Salt) > 0 {
+		if len(options.Password) == 0 {
+			return nil, nil, errors.New("backup is encrypted, a password is required")
+		}
+		key, err := backupKey(options.Password, file.Salt)
+		if err != nil {
+			return nil, nil, err
+		}
+		signed, err = openAESGCM(key, file.Archive, []byte(backupFormat))
+		if err != nil {
+			return nil, nil, errors.New("wrong password or corrupted backup")
+		}
+	}
+	var archive signedArchive
+	err = json.Unmarshal(signed, &archive)
+	if err != nil {
+		return nil, nil, errors.New("invalid backup: " + err.Error())
+	}
+	a = &caArchive{}
+	err = json.Unmarshal(archive.Content, a)
+	if err != nil {
+		return nil, nil, errors.New("invalid backup: " + err.Error())
+	}
+	for _, key := range requiredConfig {
+		if _, ok := a.Config[key]; !ok {
+			return nil, nil, errors.New("configuration " + key + " of CA " + a.Name + " is missing in the backup")
+		}
+	}
+
+	cert, err = x509.ParseCertificate(a.Config[configCertificate])
+	if err != nil {
+		return nil, nil, err
+	}
+	err = cert.CheckSignature(archive.SignatureAlgorithm, backupSignedData(file.Version, archive.Content), archive.Signature)
+	if err != nil {
+		return nil, nil, errors.New("signature of the backup of CA " + a.Name + " is invalid: " + err.Error())
+	}
+	if options.Roots != nil {
+		intermediates := x509.NewCertPool()
+		chain, err := x509.ParseCertificates(a.Config[configChain])
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, issuer := range chain {
+			intermediates.AddCert(issuer)
+		}
+		_, err = cert.Verify(x509.VerifyOptions{
+			Roots:         options.Roots,
+			Intermediates: intermediates,
+			CurrentTime:   a.CreatedAt,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return nil, nil, errors.New("CA " + a.Name + " of the backup is not trusted: " + err.Error())
+		}
+	}
+	return a, cert, nil
+}
+
+// checkRestore refuses a backup of another CA with the same name or with an older state
+// than the store
+func (s *CAStore)checkRestore(archive *caArchive, cert *x509.Certificate) (e error) {
+	entries, err := s.store.Config(archive.Name)
+	if err != nil {
+		return err
+	}
+	var existingState string
+	if len(entries) > 0 {
+		config, err := s.loadConfig(archive.Name)
+		if err != nil {
+			return err
+		}
+		existing, err := x509.ParseCertificate(config[configCertificate])
+		if err != nil {
+			return err
+		}
+		if !archive.hasKeyOf(cert, existing) {
+			return errors.New("backup is of another CA named " + archive.Name)
+		}
+		existingState = string(config[configSerialNumber])
+	}
+
+	archived := map[string]bool{}
+	var archivedSerials []*big.Int
+	for _, a := range archive.Certificates {
+		archived[a.SerialNumber.Text(16)] = true
+		archivedSerials = append(archivedSerials, a.SerialNumber)
+	}
+	records, err := s.store.Certificates(archive.Name)
+	if err != nil {
+		return err
+	}
+	var existingSerials []*big.Int
+	for _, r := range records {
+		if !archived[r.SerialNumber.Text(16)] {
+			return errors.New("backup would drop certificate " + r.SerialNumber.Text(16) + " of CA " + archive.Name)
+		}
+		existingSerials = append(existingSerials, r.SerialNumber)
+	}
+
+	revoked := map[string]bool{}
+	for _, r := range archive.Revocations {
+		revoked[r.SerialNumber.Text(16)] = true
+	}
+	revocations, err := s.store.Revocations(archive.Name)
+	if err != nil {
+		return err
+	}
+	for _, r := range revocations {
+		if !revoked[r.SerialNumber.Text(16)] {
+			return errors.New("backup would drop the revocation of certificate " + r.SerialNumber.Text(16) + " of CA " + archive.Name)
+		}
+	}
+
+	if existingState == "" {
+		return nil
+	}
+	existingNext, err := nextSequentialSerialNumber(existingState, existingSerials)
+	if err != nil {
+		return err
+	}
+	archivedNext, err := nextSequentialSerialNumber(string(archive.Config[configSerialNumber]), archivedSerials)
+	if err != nil {
+		return err
+	}
+	if existingNext != nil && archivedNext != nil && archivedNext.Cmp(existingNext) < 0 {
+		return errors.New("backup would roll back the serial number of CA " + archive.Name + " from " + existingNext.Text(16) + " to " + archivedNext.Text(16))
+	}
+	return nil
+}
+
+// nextSequentialSerialNumber returns the next serial number of a sequential serial state
+// after the issued serial numbers, nil for random serial numbers
+func nextSequentialSerialNumber(state string, issued []*big.Int) (n *big.Int, e error) {
+	g, err := parseSerialNumberState(state)
+	if err != nil {
+		return nil, err
+	}
+	sequential, ok := g.(*SequentialSerialNumberGenerator)
+	if !ok {
+		return nil, nil
+	}
+	n = sequential.next
+	for _, serial := range issued {
+		if serial.Cmp(n) >= 0 {
+			n = new(big.Int).Add(serial, big.NewInt(1))
+		}
+	}
+	return n, nil
+}
+
+// hasKeyOf tells if the existing CA certificate certifies the key of the archived CA.
+// During a key rollover that is the other key of the rollover, which the backup only
+// shows with one of its cross certificates, OldWithNew or NewWithOld: a CA certificate
+// for the subject of the existing CA and the key of the archived CA, signed by the
+// existing key.
+func (a *caArchive)hasKeyOf(cert *x509.Certificate, existing *x509.Certificate) (b bool) {
+	if bytes.Equal(cert.RawSubjectPublicKeyInfo, existing.RawSubjectPublicKeyInfo) {
+		return true
+	}
+	if a.Rollover == nil || len(a.Rollover.Certificates) != 4 {
+		return false
+	}
+	for _, der := range a.Rollover.Certificates[2:] {
+		cross, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		if cross.BasicConstraintsValid && cross.IsCA && bytes.Equal(cross.RawSubject, existing.RawSubject) &&
+			bytes.Equal(cross.RawSubjectPublicKeyInfo, cert.RawSubjectPublicKeyInfo) && cross.CheckSignatureFrom(existing) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// rewrapArchivedKey checks the archived key is the key of the CA and rewraps its data key
+// with the KEK of this store
+func (s *CAStore)rewrapArchivedKey(archive *caArchive, cert *x509.Certificate) (k *StoredPrivateKey, e error) {
+	if s.kek == nil {
+		return nil, errors.New("no key-encryption key to protect the private key")
+	}
+	stored := archive.PrivateKey
+	if string(archive.Config[configKey]) != keyURIDatabase+stored.KeyID {
+		return nil, errors.New("private key in the backup is not the key of CA " + archive.Name)
+	}
+	kek, err := s.keyEncryptionKey(stored.KEKID)
+	if err != nil {
+		return nil, err
+	}
+	pkcs8, err := kek.openPrivateKey(archive.Name, stored.KeyID, stored.DataKey, stored.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(pkcs8)
+	clear(pkcs8)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := NewMemorySigner(priv)
+	if err != nil {
+		return nil, err
+	}
+	err = checkSignerMatches(signer, cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := kek.unwrap(archive.Name, stored.KeyID, stored.DataKey)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(dataKey)
+	wrappedKey, err := s.kek.wrap(archive.Name, stored.KeyID, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	rewrapped := *stored
+	rewrapped.KEKID = s.kek.ID
+	rewrapped.DataKey = wrappedKey
+	return &rewrapped, nil
+}
+
+// restoreCRLNumber keeps the highest of the CRL numbers of the database and the backup
+func (d *DB)restoreCRLNumber(tx *sql.Tx, caname string, archived *big.Int) (e error) {
+	var number string
+	err := tx.QueryRow(d.rebind("SELECT number FROM CRLNUMBER WHERE caname = ?{forupdate}"), caname).Scan(&number)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(d.rebind("INSERT INTO CRLNUMBER (caname, number) VALUES (?, ?)"), caname, archived.Text(16))
+		return err
+	case err != nil:
+		return err
+	}
+	existing, ok := new(big.Int).SetString(number, 16)
+	if ok && existing.Cmp(archived) >= 0 {
+		return nil
+	}
+	_, err = tx.Exec(d.rebind("UPDATE CRLNUMBER SET number = ? WHERE caname = ?"), archived.Text(16), caname)
+	return err
+}
+
+func (a archivedCertificate)record() (r *CertificateRecord) {
+	r = &CertificateRecord{
+		SerialNumber:    a.SerialNumber,
+		Subject:         a.Subject,
+		SubjectAltNames: a.SubjectAltNames,
+		Profile:         a.Profile,
+		NotBefore:       a.NotBefore,
+		NotAfter:        a.NotAfter,
+		Status:          a.Status,
+		Fingerprint:     a.Fingerprint,
+		Requester:       a.Requester,
+		KeyID:           a.KeyID,
+		KeyType:         a.KeyType,
+	}
+	if a.Certificate != nil {
+		r.Certificate, _ = x509.ParseCertificate(a.Certificate)
+	}
+	return r
+}
+
+func (a *archivedRollover)parse() (r *Rollover, e error) {
+	if len(a.Certificates) != 4 {
+		return nil, errors.New("invalid key rollover in the backup")
+	}
+	var certs [4]*x509.Certificate
+	for i, der := range a.Certificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs[i] = cert
+	}
+	return &Rollover{
+		State:          a.State,
+		SwitchAt:       a.SwitchAt,
+		RetireAt:       a.RetireAt,
+		OldCertificate: certs[0],
+		NewCertificate: certs[1],
+		OldWithNew:     certs[2],
+		NewWithOld:     certs[3],
+	}, nil
+}
@@ -0,0 +1,302 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newBackupTestCA saves a CA with its key in the store, issues three certificates,
+// revokes the second and creates a CRL number
+func newBackupTestCA(t *testing.T, db caStore, kek *KeyEncryptionKey) (ca *CA, issued []*x509.Certificate) {
+	db.SetIntegrityKey(testIntegrityKey)
+	db.SetKeyEncryptionKey(kek)
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ = NewCA("CN=GoPKI Backup,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	ca.SetStore(db)
+	ca.SetSerialNumberGenerator(NewSequentialSerialNumberGenerator(big.NewInt(1)))
+	err := db.SaveCAWithKey(ca, caKey)
+	if err != nil {
+		t.Fatal("SaveCAWithKey failed: ", err)
+	}
+	issued = issueBackupTestCertificates(t, ca, 3)
+	err = ca.Revoke(issued[1].SerialNumber, ReasonKeyCompromise, time.Time{})
+	if err != nil {
+		t.Fatal("Revoke failed: ", err)
+	}
+	db.NextCRLNumber(ca.Name)
+	db.NextCRLNumber(ca.Name)
+	return ca, issued
+}
+
+func issueBackupTestCertificates(t *testing.T, ca *CA, n int) (issued []*x509.Certificate) {
+	for i := 0; i < n; i++ {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		certBytes, err := ca.CreateTLSClientCertificate("CN=backup", key.Public())
+		if err != nil {
+			t.Fatal("CreateTLSClientCertificate failed: ", err)
+		}
+		cert, _ := x509.ParseCertificate(certBytes)
+		issued = append(issued, cert)
+	}
+	return issued
+}
+
+func exportTestCA(t *testing.T, db caStore, ca *CA, password []byte) (backup []byte) {
+	var out bytes.Buffer
+	err := db.ExportCA(ca, password, &out)
+	if err != nil {
+		t.Fatal("ExportCA failed: ", err)
+	}
+	return out.Bytes()
+}
+
+// ---------- Testing Module ----------
+
+func TestDB_ExportImportCA(t *testing.T) {
+	// Arrange
+	source := newTestDB(t)
+	defer source.CloseDB()
+	sourceKEK, targetKEK := newTestKEK(t), newTestKEK(t)
+	ca, issued := newBackupTestCA(t, source, sourceKEK)
+	backup := exportTestCA(t, source, ca, []byte("backup"))
+	target := newTestDB(t)
+	defer target.CloseDB()
+	target.SetIntegrityKey(bytes.Repeat([]byte{0x24}, 32))
+	target.SetKeyEncryptionKey(targetKEK, sourceKEK)
+
+	// Act
+	caname, err := target.ImportCA(bytes.NewReader(backup), ImportOptions{Password: []byte("backup")})
+	target.SetKeyEncryptionKey(targetKEK)
+	loaded, errLoad := target.LoadCA(caname, nil)
+	if errLoad != nil {
+		t.Fatal("LoadCA failed: ", errLoad)
+	}
+	next := issueBackupTestCertificates(t, loaded, 1)[0]
+	revoked, _ := target.Revocation(caname, issued[1].SerialNumber)
+	inventory, _ := target.CertificatesBySubject(caname, "CN=backup")
+	crlNumber, _ := target.NextCRLNumber(caname)
+
+	// Assert
+	if err != nil || caname != ca.Name {
+		t.Error("ImportCA() failed: ", err)
+	}
+	if !loaded.Certificate.Equal(ca.Certificate) {
+		t.Error("wrong CA certificate restored")
+	}
+	if next.SerialNumber.Cmp(big.NewInt(4)) != 0 {
+		t.Error("serial number not continued: ", next.SerialNumber)
+	}
+	if revoked == nil || revoked.Reason != ReasonKeyCompromise {
+		t.Error("revocation not restored")
+	}
+	if len(inventory) != 4 || inventory[1].Status != CertificateRevoked {
+		t.Error("inventory not restored: ", len(inventory))
+	}
+	if crlNumber == nil || crlNumber.Cmp(big.NewInt(3)) != 0 {
+		t.Error("CRL number not continued: ", crlNumber)
+	}
+}
+
+func TestDB_ImportCASignature(t *testing.T) {
+	// Arrange
+	source := newTestDB(t)
+	defer source.CloseDB()
+	kek := newTestKEK(t)
+	ca, _ := newBackupTestCA(t, source, kek)
+	encrypted := exportTestCA(t, source, ca, []byte("backup"))
+	var file backupFile
+	json.Unmarshal(exportTestCA(t, source, ca, nil), &file)
+	var signed signedArchive
+	json.Unmarshal(file.Archive, &signed)
+	signed.Content = bytes.Replace(signed.Content, []byte(`"CRLNumber":"2"`), []byte(`"CRLNumber":"1"`), 1)
+	file.Archive, _ = json.Marshal(&signed)
+	tampered, _ := json.Marshal(&file)
+	newTarget := func() *DB {
+		target := newTestDB(t)
+		target.SetIntegrityKey(testIntegrityKey)
+		target.SetKeyEncryptionKey(kek)
+		return target
+	}
+
+	// Act
+	_, errTampered := newTarget().ImportCA(bytes.NewReader(tampered), ImportOptions{})
+	_, errNoPassword := newTarget().ImportCA(bytes.NewReader(encrypted), ImportOptions{})
+	_, errPassword := newTarget().ImportCA(bytes.NewReader(encrypted), ImportOptions{Password: []byte("wrong")})
+	untrusted := x509.NewCertPool()
+	_, errUntrusted := newTarget().ImportCA(bytes.NewReader(encrypted), ImportOptions{Password: []byte("backup"), Roots: untrusted})
+	trusted := x509.NewCertPool()
+	trusted.AddCert(ca.Certificate)
+	_, errTrusted := newTarget().ImportCA(bytes.NewReader(encrypted), ImportOptions{Password: []byte("backup"), Roots: trusted})
+
+	// Assert
+	if errTampered == nil || !strings.Contains(errTampered.Error(), "signature") {
+		t.Error("tampered backup imported: ", errTampered)
+	}
+	if errNoPassword == nil || errPassword == nil {
+		t.Error("encrypted backup imported without its password")
+	}
+	if errUntrusted == nil {
+		t.Error("backup of an untrusted CA imported")
+	}
+	if errTrusted != nil {
+		t.Error("backup of a trusted CA refused: ", errTrusted)
+	}
+}
+
+func TestDB_ImportCARollback(t *testing.T) {
+	// Arrange
+	db := newTestDB(t)
+	defer db.CloseDB()
+	ca, issued := newBackupTestCA(t, db, newTestKEK(t))
+	backup := exportTestCA(t, db, ca, nil)
+	current := exportTestCA(t, db, ca, nil)
+
+	// Act
+	_, errCurrent := db.ImportCA(bytes.NewReader(current), ImportOptions{})
+	ca.Revoke(issued[0].SerialNumber, ReasonSuperseded, time.Time{})
+	_, errRevocation := db.ImportCA(bytes.NewReader(backup), ImportOptions{})
+	issueBackupTestCertificates(t, ca, 1)
+	_, errCertificate := db.ImportCA(bytes.NewReader(backup), ImportOptions{})
+	ca.SetSerialNumberGenerator(NewSequentialSerialNumberGenerator(big.NewInt(100)))
+	db.SaveCA(ca, keyURIDatabase+Fingerprint(ca.Certificate.RawSubjectPublicKeyInfo))
+	latest := exportTestCA(t, db, ca, nil)
+	ca.SetSerialNumberGenerator(NewSequentialSerialNumberGenerator(big.NewInt(200)))
+	db.SaveCA(ca, keyURIDatabase+Fingerprint(ca.Certificate.RawSubjectPublicKeyInfo))
+	_, errSerial := db.ImportCA(bytes.NewReader(latest), ImportOptions{})
+	revocations, _ := db.Revocations(ca.Name)
+
+	// Assert
+	if errCurrent != nil {
+		t.Error("current backup refused: ", errCurrent)
+	}
+	if errRevocation == nil || !strings.Contains(errRevocation.Error(), "revocation") {
+		t.Error("backup dropping a revocation imported: ", errRevocation)
+	}
+	if errCertificate == nil || !strings.Contains(errCertificate.Error(), "drop certificate") {
+		t.Error("backup dropping a certificate imported: ", errCertificate)
+	}
+	if errSerial == nil || !strings.Contains(errSerial.Error(), "roll back the serial number") {
+		t.Error("backup rolling back the serial number imported: ", errSerial)
+	}
+	if len(revocations) != 2 {
+		t.Error("revocations lost by a refused import: ", len(revocations))
+	}
+}
+
+func TestDB_ImportCAOtherCA(t *testing.T) {
+	// Arrange
+	source := newTestDB(t)
+	defer source.CloseDB()
+	kek := newTestKEK(t)
+	ca, _ := newBackupTestCA(t, source, kek)
+	backup := exportTestCA(t, source, ca, nil)
+	target := newTestDB(t)
+	defer target.CloseDB()
+	newBackupTestCA(t, target, kek)
+
+	// Act
+	_, err := target.ImportCA(bytes.NewReader(backup), ImportOptions{})
+
+	// Assert
+	if err == nil || !strings.Contains(err.Error(), "another CA") {
+		t.Error("backup of another CA with the same name imported: ", err)
+	}
+}
+
+func TestDB_ImportCAForgedRollover(t *testing.T) {
+	// Arrange
+	kek := newTestKEK(t)
+	target := newTestDB(t)
+	defer target.CloseDB()
+	ca, _ := newBackupTestCA(t, target, kek)
+	attacker := newTestDB(t)
+	defer attacker.CloseDB()
+	forged, _ := newBackupTestCA(t, attacker, kek)
+	var file backupFile
+	json.Unmarshal(exportTestCA(t, attacker, forged, nil), &file)
+	var signed signedArchive
+	json.Unmarshal(file.Archive, &signed)
+	// the real CA issues an ordinary client certificate for the key of the forged CA
+	leafDER, _ := ca.CreateTLSClientCertificate("CN=GoPKI Backup,O=Cryptable,C=BE", forged.Certificate.PublicKey)
+	// and copies the inventory and revocations of the real CA, which include that certificate
+	var realFile backupFile
+	json.Unmarshal(exportTestCA(t, target, ca, nil), &realFile)
+	var realSigned signedArchive
+	json.Unmarshal(realFile.Archive, &realSigned)
+	var real caArchive
+	json.Unmarshal(realSigned.Content, &real)
+	rollovers := []struct {
+		name         string
+		certificates [][]byte
+	}{
+		// the real CA certificate pretends to be the other key of a key rollover
+		{"real CA certificate", [][]byte{ca.Certificate.Raw, forged.Certificate.Raw, forged.Certificate.Raw, forged.Certificate.Raw}},
+		{"leaf certificate", [][]byte{forged.Certificate.Raw, leafDER, leafDER, leafDER}},
+	}
+
+	for _, rollover := range rollovers {
+		var archive caArchive
+		json.Unmarshal(signed.Content, &archive)
+		archive.Certificates, archive.Revocations = real.Certificates, real.Revocations
+		archive.Rollover = &archivedRollover{State: RolloverSwitched, Certificates: rollover.certificates}
+		forgedSigned := signed
+		forgedSigned.Content, _ = json.Marshal(&archive)
+		_, forgedSigned.Signature, _ = signData(forged.priv, signed.SignatureAlgorithm, backupSignedData(file.Version, forgedSigned.Content))
+		forgedFile := file
+		forgedFile.Archive, _ = json.Marshal(&forgedSigned)
+		backup, _ := json.Marshal(&forgedFile)
+
+		// Act
+		_, err := target.ImportCA(bytes.NewReader(backup), ImportOptions{})
+		loaded, _ := target.LoadCA(ca.Name, nil)
+
+		// Assert
+		if err == nil || !strings.Contains(err.Error(), "another CA") {
+			t.Error("forged backup with a ", rollover.name, " imported: ", err)
+		}
+		if loaded == nil || !loaded.Certificate.Equal(ca.Certificate) {
+			t.Error("CA replaced by a forged backup with a ", rollover.name)
+		}
+	}
+}
+
+func TestDB_ImportCARollover(t *testing.T) {
+	// Arrange
+	kek := newTestKEK(t)
+	source := newTestDB(t)
+	defer source.CloseDB()
+	ca, _ := newBackupTestCA(t, source, kek)
+	target := newTestDB(t)
+	defer target.CloseDB()
+	target.SetIntegrityKey(testIntegrityKey)
+	target.SetKeyEncryptionKey(kek)
+	_, err := target.ImportCA(bytes.NewReader(exportTestCA(t, source, ca, nil)), ImportOptions{})
+	if err != nil {
+		t.Fatal("ImportCA failed: ", err)
+	}
+	now := time.Now()
+	rollover, newKey := beginTestRollover(t, ca, now)
+	ca.AdvanceRollover(now.Add(25 * time.Hour))
+	source.SaveCAWithKey(ca, newKey)
+
+	// Act
+	_, err = target.ImportCA(bytes.NewReader(exportTestCA(t, source, ca, nil)), ImportOptions{})
+	loaded, _ := target.LoadCA(ca.Name, nil)
+
+	// Assert
+	if err != nil {
+		t.Error("backup with the new key of the key rollover refused: ", err)
+		return
+	}
+	if issuer, _ := loaded.Issuer(); !issuer.Equal(rollover.NewCertificate) {
+		t.Error("CA not restored with the new key")
+	}
+}
@@ -4,81 +4,859 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"math/big"
+	"sort"
+	"sync"
 	"time"
 )
 
+// CA issues certificates. A CA is safe for concurrent use by multiple goroutines once it
+// is created: every certificate it issues gets a distinct serial number.
 type CA struct {
-	priv crypto.PrivateKey
+	// Name identifies the CA in the Store, it defaults to the common name of the CA
+	Name string
+	// priv signs on behalf of the CA, it is an in-memory key or one of the Signer backends
+	priv crypto.Signer
+	signatureAlgorithm x509.SignatureAlgorithm
+	// Bytes, Certificate and Chain are the CA certificate the CA was created or loaded
+	// with, they never change. Issuer returns the one it issues under after a key rollover.
 	Bytes []byte
 	Certificate *x509.Certificate
-	certificateSerialNumber *big.Int
+	// Chain contains the DER encoded certificates from this CA up to the root,
+	// Chain[0] is the certificate of the CA itself
+	Chain [][]byte
+	// mutex protects the serial number generator and the reserved serial numbers
+	mutex sync.Mutex
+	serialNumbers SerialNumberGenerator
+	// reserved holds the serial numbers handed out, but not yet stored
+	reserved map[string]bool
+	store Store
+	profiles map[string]*Profile
+	crlValidity time.Duration
+	deltaCRLURL string
+	crlPartitions []*CRLPartition
+	urls CAURLs
+	skiMethod SKIMethod
+	// rollover is the key rollover in progress, protected by mutex
+	rollover *keyRollover
+	// issuing replaces the certificate, chain and key the CA was created with once a key
+	// rollover switched to the new key, protected by mutex
+	issuing *issuingKey
+	// clock tells the time of issuance, nil is the SystemClock
+	clock Clock
+	// backdate and rounding shape the validity of the issued certificates, see CAOptions
+	backdate time.Duration
+	rounding time.Duration
+}
+
+// issuingKey is the CA certificate, chain and key the CA issues with. Certificate, Bytes
+// and Chain of the CA never change, a key rollover replaces the issuingKey as a whole.
+type issuingKey struct {
+	certificate *x509.Certificate
+	chain       [][]byte
+	signer      crypto.Signer
+	algorithm   x509.SignatureAlgorithm
+}
+
+// currentKey returns what the CA issues with, the caller holds the mutex. A key rollover
+// moves to the stage its schedule reached on the clock of the CA first.
+func (ca *CA)currentKey() (k issuingKey) {
+	ca.scheduleRollover()
+	if ca.issuing != nil {
+		return *ca.issuing
+	}
+	return issuingKey{ca.Certificate, ca.Chain, ca.priv, ca.signatureAlgorithm}
+}
+
+// now returns the time on the clock of the CA, the caller holds the mutex
+func (ca *CA)now() (t time.Time) {
+	if ca.clock == nil {
+		return SystemClock.Now()
+	}
+	return ca.clock.Now()
+}
+
+// issuingKey returns a snapshot of what the CA issues with, so a concurrent key rollover
+// doesn't mix the certificate of one key with the signer of another. A stage of the key
+// rollover reached meanwhile is recorded in the Store.
+func (ca *CA)issuingKey() (k issuingKey, e error) {
+	ca.mutex.Lock()
+	k = ca.currentKey()
+	ca.mutex.Unlock()
+
+	err := ca.saveRollover()
+	if err != nil {
+		return k, err
+	}
+	return k, nil
+}
+
+// Issuer returns the CA certificate and the chain the CA currently issues under. They are
+// Certificate and Chain until a key rollover switches to the new key.
+func (ca *CA)Issuer() (cert *x509.Certificate, chain [][]byte) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	k := ca.currentKey()
+	return k.certificate, k.chain
+}
+
+// CAURLs are the locations where clients find the CA, they are embedded in the
+// certificates the CA issues
+type CAURLs struct {
+	// IssuingCertificateURL locates the certificate of the CA, the caIssuers of the AIA
+	IssuingCertificateURL []string
+	// OCSPServer locates the OCSP responders of the CA, the ocsp of the AIA
+	OCSPServer []string
+	// CRLDistributionPoints locates the CRLs of the CA
+	CRLDistributionPoints []string
+}
+
+// Names under which CA certificates are stored, they are not issued through profiles
+const (
+	ProfileRootCA           = "root-ca"
+	ProfileSubordinateCA    = "subordinate-ca"
+	ProfileCrossCertificate = "cross-certificate"
+)
+
+// maxSerialNumberAttempts limits the retries when a serial number is already in use
+const maxSerialNumberAttempts = 10
+
+// CAOptions are the settings used when a CA certificate is created. The zero value
+// creates a CA which can only issue end-entity certificates.
+type CAOptions struct {
+	// MaxPathLen is the maximum number of subordinate CAs allowed below this CA,
+	// a negative value removes the limit
+	MaxPathLen int
+	// SignatureAlgorithm is the algorithm the CA signs with, it must match the key of the
+	// CA. The zero value selects DefaultSignatureAlgorithm.
+	SignatureAlgorithm x509.SignatureAlgorithm
+	// URLs are embedded in the certificates issued by the CA
+	URLs CAURLs
+	// SKIMethod derives the key identifiers of the CA and the certificates it issues
+	SKIMethod SKIMethod
+	// Policies are the certificate policies of the CA certificate
+	Policies []PolicyInformation
+	// PolicyConstraints are added to the CA certificate when they are set
+	PolicyConstraints *PolicyConstraints
+	// NameConstraints technically constrain the CA when they are set, the CA refuses to
+	// issue certificates for names outside of them
+	NameConstraints *NameConstraints
+	// Clock tells the CA the time, nil is the SystemClock. A subordinate CA without clock
+	// uses the one of its issuer.
+	Clock Clock
+	// Backdate moves the NotBefore of the certificates the CA creates into the past, so
+	// peers whose clocks are a bit behind accept them right after issuance
+	Backdate time.Duration
+	// ValidityRounding truncates NotBefore and NotAfter to a multiple of the duration,
+	// like time.Minute or 24 * time.Hour, zero keeps the second of issuance
+	ValidityRounding time.Duration
+}
+
+func (opts *CAOptions)checkValidity() (e error) {
+	if opts.Backdate < 0 {
+		return errors.New("backdate must not be negative")
+	}
+	if opts.ValidityRounding < 0 {
+		return errors.New("validity rounding must not be negative")
+	}
+	return nil
+}
+
+// validityPeriod backdates the start of a validity from now until end and rounds both
+func validityPeriod(now time.Time, end time.Time, backdate time.Duration, rounding time.Duration) (notBefore time.Time, notAfter time.Time) {
+	notBefore, notAfter = now.Add(-backdate), end
+	if rounding > 0 {
+		notBefore, notAfter = notBefore.Truncate(rounding), notAfter.Truncate(rounding)
+	}
+	return notBefore, notAfter
 }
 
 func NewCA(dn string, years int, pub crypto.PublicKey, priv crypto.PrivateKey) (c *CA, e error) {
+	return NewCAWithOptions(dn, years, pub, priv, CAOptions{})
+}
+
+// NewCAWithOptions creates a self-signed root CA. The private key is any crypto.Signer,
+// like the ones returned by OpenSigner.
+func NewCAWithOptions(dn string, years int, pub crypto.PublicKey, priv crypto.PrivateKey, opts CAOptions) (c *CA, e error) {
+
+	err := opts.checkValidity()
+	if err != nil {
+		return nil, err
+	}
+	signer, err := NewMemorySigner(priv)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := selectSignatureAlgorithm(signer.Public(), opts.SignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
 
 	pkixName, err := ConvertDNToPKIXName(dn)
 	if err != nil {
 		return nil, err
 	}
 
+	serialNumbers := NewRandomSerialNumberGenerator()
+	serial, err := serialNumbers.NextSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	ski, err := SubjectKeyIdentifier(pub, opts.SKIMethod)
+	if err != nil {
+		return nil, err
+	}
+	policyExtensions, err := caPolicyExtensions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	clock := opts.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	now := clock.Now()
+	notBefore, notAfter := validityPeriod(now, now.AddDate(years, 0, 0), opts.Backdate, opts.ValidityRounding)
+
 	caTemplate := x509.Certificate{
-		SerialNumber:                big.NewInt(2019),
+		SerialNumber:                serial,
 		Subject:                     *pkixName,
-		NotBefore:                   time.Now(),
-		NotAfter:                    time.Now().AddDate(years,0,0),
+		NotBefore:                   notBefore,
+		NotAfter:                    notAfter,
 		KeyUsage:                    x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid:       true,
 		IsCA:                        true,
-		MaxPathLenZero:              true,
+		SignatureAlgorithm:          algorithm,
+		SubjectKeyId:                ski,
+		AuthorityKeyId:              ski,
+		ExtraExtensions:             policyExtensions,
 	}
-	caTmp, err := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, pub, priv)
+	setMaxPathLen(&caTemplate, opts.MaxPathLen)
+	caTmp, err := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, pub, signer)
 
 	if err != nil {
 		return nil, err
 	}
 
 	certif, _ := x509.ParseCertificate(caTmp)
-	return &CA{priv,caTmp, certif, big.NewInt(1)}, nil
+	ca := &CA{
+		Name:               certif.Subject.CommonName,
+		priv:               signer,
+		signatureAlgorithm: algorithm,
+		Bytes:              caTmp,
+		Certificate:        certif,
+		Chain:              [][]byte{caTmp},
+		serialNumbers:      serialNumbers,
+		store:              NewMemoryStore(),
+		profiles:           defaultProfileMap(),
+		urls:               opts.URLs,
+		skiMethod:          opts.SKIMethod,
+		clock:              opts.Clock,
+		backdate:           opts.Backdate,
+		rounding:           opts.ValidityRounding,
+	}
+	err = ca.store.AddCertificate(ca.Name, newCertificateRecord(ProfileRootCA, "", certif))
+	if err != nil {
+		return nil, err
+	}
+	err = ca.store.SetCA(ca.Name, certif)
+	if err != nil {
+		return nil, err
+	}
+
+	return ca, nil
 }
 
+// LoadCA loads an existing CA, which issues random serial numbers like NewCA.
+// serialNumber is not used anymore, SetSerialNumberGenerator with a
+// SequentialSerialNumberGenerator continues from it, which is meant for tests. The
+// private key is any crypto.Signer matching the CA certificate. The CA signs with the
+// DefaultSignatureAlgorithm of its key, see LoadCAWithSignatureAlgorithm. CAStore.LoadCA
+// restores a CA saved with CAStore.SaveCA, including its serial numbers, profiles and
+// signature algorithm.
 func LoadCA(cacert []byte, priv crypto.PrivateKey, serialNumber big.Int) (c *CA, e error) {
+	return LoadCAWithSignatureAlgorithm(cacert, priv, serialNumber, x509.UnknownSignatureAlgorithm)
+}
+
+// LoadCAWithSignatureAlgorithm loads an existing CA like LoadCA, which signs with the
+// algorithm, like RSA-PSS. It must match the key of the CA, the zero value selects
+// DefaultSignatureAlgorithm.
+func LoadCAWithSignatureAlgorithm(cacert []byte, priv crypto.PrivateKey, serialNumber big.Int, algorithm x509.SignatureAlgorithm) (c *CA, e error) {
 
 	certif, err := x509.ParseCertificate(cacert)
 	if err != nil {
 		return nil, err
 	}
+	signer, err := NewMemorySigner(priv)
+	if err != nil {
+		return nil, err
+	}
+	err = checkSignerMatches(signer, certif.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err = selectSignatureAlgorithm(signer.Public(), algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := &CA{
+		Name:               certif.Subject.CommonName,
+		priv:               signer,
+		signatureAlgorithm: algorithm,
+		Bytes:              cacert,
+		Certificate:        certif,
+		Chain:              [][]byte{cacert},
+		serialNumbers:      NewRandomSerialNumberGenerator(),
+		store:              NewMemoryStore(),
+		profiles:           defaultProfileMap(),
+	}
+	err = ca.store.SetCA(ca.Name, certif)
+	if err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// SetSerialNumberGenerator replaces the way the CA creates serial numbers. The generator
+// is only called by one goroutine at a time.
+func (ca *CA)SetSerialNumberGenerator(g SerialNumberGenerator) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.serialNumbers = g
+}
+
+// SetStore replaces the store where the CA keeps track of its issued certificates and
+// records the CA in it. The store must be safe for concurrent use.
+func (ca *CA)SetStore(s Store) (e error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	err := s.SetCA(ca.Name, ca.currentKey().certificate)
+	if err != nil {
+		return err
+	}
+	ca.store = s
+	return nil
+}
+
+// SetClock replaces the clock telling the CA the time, tests use a FakeClock
+func (ca *CA)SetClock(c Clock) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.clock = c
+}
+
+// Clock returns the clock of the CA
+func (ca *CA)Clock() (c Clock) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	if ca.clock == nil {
+		return SystemClock
+	}
+	return ca.clock
+}
+
+// SetBackdate moves the NotBefore of the certificates the CA issues into the past
+func (ca *CA)SetBackdate(d time.Duration) (e error) {
+	if d < 0 {
+		return errors.New("backdate must not be negative")
+	}
+
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.backdate = d
+	return nil
+}
+
+// SetValidityRounding truncates the validity of the certificates the CA issues to a
+// multiple of the duration, zero disables the rounding
+func (ca *CA)SetValidityRounding(d time.Duration) (e error) {
+	if d < 0 {
+		return errors.New("validity rounding must not be negative")
+	}
+
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.rounding = d
+	return nil
+}
+
+// validity returns the validity of a certificate the CA creates now, backdated and
+// rounded. end computes the NotAfter from the current time, it is capped to the NotAfter
+// of the issuer. A nil issuer is a self-signed certificate.
+func (ca *CA)validity(issuer *x509.Certificate, end func(now time.Time) time.Time) (notBefore time.Time, notAfter time.Time, e error) {
+	ca.mutex.Lock()
+	clock, backdate, rounding := ca.clock, ca.backdate, ca.rounding
+	ca.mutex.Unlock()
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	now := clock.Now()
+	if issuer != nil && !now.Before(issuer.NotAfter) {
+		return time.Time{}, time.Time{}, errors.New("CA " + ca.Name + " expired at " + issuer.NotAfter.UTC().Format(time.RFC3339))
+	}
+	notBefore, notAfter = validityPeriod(now, end(now), backdate, rounding)
+	if issuer != nil && notAfter.After(issuer.NotAfter) {
+		notAfter = issuer.NotAfter
+	}
+	if !notAfter.After(notBefore) {
+		return time.Time{}, time.Time{}, errors.New("validity ends before it starts, it is shorter than the rounding")
+	}
+	return notBefore, notAfter, nil
+}
+
+// SetSignatureAlgorithm changes the algorithm the CA signs with, like RSA-PSS instead of
+// PKCS#1 v1.5, it must match the key of the CA
+func (ca *CA)SetSignatureAlgorithm(algorithm x509.SignatureAlgorithm) (e error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	algorithm, err := selectSignatureAlgorithm(ca.currentKey().signer.Public(), algorithm)
+	if err != nil {
+		return err
+	}
+	if ca.issuing != nil {
+		issuing := *ca.issuing
+		issuing.algorithm = algorithm
+		ca.issuing = &issuing
+		return nil
+	}
+	ca.signatureAlgorithm = algorithm
+	return nil
+}
+
+// SetURLs sets the locations of the CA embedded in the certificates it issues
+func (ca *CA)SetURLs(urls CAURLs) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.urls = urls
+}
+
+// URLs returns the locations of the CA embedded in the certificates it issues
+func (ca *CA)URLs() (urls CAURLs) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	return ca.urls
+}
+
+// SetSKIMethod sets how the subject key identifiers of the issued certificates are derived
+func (ca *CA)SetSKIMethod(method SKIMethod) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.skiMethod = method
+}
+
+// SignatureAlgorithm returns the algorithm the CA signs certificates, CRLs and OCSP responses with
+func (ca *CA)SignatureAlgorithm() (a x509.SignatureAlgorithm) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	return ca.currentKey().algorithm
+}
+
+// AddProfile adds the profile to the CA, it replaces a profile with the same name
+func (ca *CA)AddProfile(p *Profile) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.profiles[p.Name] = p
+}
+
+// Profile returns the profile of the CA with the name, or nil when it is unknown
+func (ca *CA)Profile(name string) (p *Profile) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	return ca.profiles[name]
+}
+
+// Profiles returns all the profiles of the CA
+func (ca *CA)Profiles() (p []*Profile) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	for _, profile := range ca.profiles {
+		p = append(p, profile)
+	}
+	sort.Slice(p, func(i, j int) bool { return p[i].Name < p[j].Name })
+	return p
+}
 
-	return &CA{priv, cacert, certif, &serialNumber}, nil
+func defaultProfileMap() (m map[string]*Profile) {
+	m = map[string]*Profile{}
+	for _, profile := range DefaultProfiles() {
+		m[profile.Name] = profile
+	}
+	return m
 }
 
-func (ca *CA)createTLSCertificate(dn string, pub crypto.PublicKey, extKeyUsage []x509.ExtKeyUsage) (cert []byte, err error) {
+// NewSubordinateCA lets the CA issue a subordinate CA. The validity is capped to the
+// NotAfter of the issuing CA and the path length must fit within the one of the issuer.
+// The returned chain starts with the subordinate CA certificate and ends with the root.
+func (ca *CA)NewSubordinateCA(dn string, years int, pub crypto.PublicKey, priv crypto.PrivateKey, opts CAOptions) (c *CA, chain [][]byte, e error) {
+
+	signer, err := NewMemorySigner(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = checkSignerMatches(signer, pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = opts.checkValidity()
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ca.issuingKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = key.checkPathLen(opts.MaxPathLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	algorithm, err := selectSignatureAlgorithm(signer.Public(), opts.SignatureAlgorithm)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	pkixName, err := ConvertDNToPKIXName(dn)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = key.checkNameConstraints(&IssuanceRequest{Subject: *pkixName})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notBefore, notAfter, err := ca.validity(key.certificate, func(now time.Time) time.Time {
+		return now.AddDate(years, 0, 0)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ski, err := SubjectKeyIdentifier(pub, opts.SKIMethod)
+	if err != nil {
+		return nil, nil, err
+	}
+	policyExtensions, err := caPolicyExtensions(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := ca.nextSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caTemplate := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               *pkixName,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          ski,
+		ExtraExtensions:       policyExtensions,
+	}
+	setMaxPathLen(&caTemplate, opts.MaxPathLen)
+
+	caTmp, certif, err := ca.signCertificate(key, ProfileSubordinateCA, "", &caTemplate, pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = ca.store.SetCA(certif.Subject.CommonName, certif)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clock := opts.Clock
+	if clock == nil {
+		clock = ca.Clock()
+	}
+	chain = append([][]byte{caTmp}, key.chain...)
+	return &CA{
+		Name:               certif.Subject.CommonName,
+		priv:               signer,
+		signatureAlgorithm: algorithm,
+		Bytes:              caTmp,
+		Certificate:        certif,
+		Chain:              chain,
+		serialNumbers:      NewRandomSerialNumberGenerator(),
+		store:              ca.store,
+		profiles:           defaultProfileMap(),
+		urls:               opts.URLs,
+		skiMethod:          opts.SKIMethod,
+		clock:              clock,
+		backdate:           opts.Backdate,
+		rounding:           opts.ValidityRounding,
+	}, chain, nil
+}
+
+// checkPathLen verifies the CA can issue a subordinate CA with the path length
+func (k *issuingKey)checkPathLen(maxPathLen int) (e error) {
+	if !k.certificate.IsCA {
+		return errors.New("issuer is not a CA")
+	}
+	if k.certificate.MaxPathLenZero {
+		return errors.New("path length of the CA does not allow subordinate CAs")
+	}
+	if k.certificate.MaxPathLen > 0 &&
+		(maxPathLen < 0 || maxPathLen >= k.certificate.MaxPathLen) {
+		return errors.New("path length of the subordinate CA exceeds the one of the issuer")
+	}
+	return nil
+}
+
+func setMaxPathLen(template *x509.Certificate, maxPathLen int) {
+	if maxPathLen < 0 {
+		template.MaxPathLen = -1
+		return
+	}
+	template.MaxPathLen = maxPathLen
+	template.MaxPathLenZero = maxPathLen == 0
+}
+
+// nextSerialNumber reserves a serial number which is not yet used by the CA, the
+// reservation ends with signCertificate or releaseSerialNumber
+func (ca *CA)nextSerialNumber() (serial *big.Int, e error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	for i := 0; i < maxSerialNumberAttempts; i++ {
+		serial, err := ca.serialNumbers.NextSerialNumber()
+		if err != nil {
+			return nil, err
+		}
+		if ca.reserved[serial.Text(16)] {
+			continue
+		}
+		exists, err := ca.store.SerialNumberExists(ca.Name, serial)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			if ca.reserved == nil {
+				ca.reserved = map[string]bool{}
+			}
+			ca.reserved[serial.Text(16)] = true
+			return serial, nil
+		}
+	}
+
+	return nil, errors.New("unable to find an unused serial number")
+}
+
+func (ca *CA)releaseSerialNumber(serial *big.Int) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	delete(ca.reserved, serial.Text(16))
+}
+
+// signCertificate signs the template with the key and a reserved serial number and stores
+// the result together with the name of the profile and the requester
+func (ca *CA)signCertificate(key issuingKey, profileName string, requester string, template *x509.Certificate, pub crypto.PublicKey) (cert []byte, certif *x509.Certificate, err error) {
+	defer ca.releaseSerialNumber(template.SerialNumber)
+
+	ca.mutex.Lock()
+	store, urls, skiMethod := ca.store, ca.urls, ca.skiMethod
+	crlDistributionPoints := ca.crlDistributionPoints(template.SerialNumber, profileName)
+	ca.mutex.Unlock()
+	template.SignatureAlgorithm = key.algorithm
+
+	if template.SubjectKeyId == nil {
+		template.SubjectKeyId, err = SubjectKeyIdentifier(pub, skiMethod)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	template.IssuingCertificateURL = urls.IssuingCertificateURL
+	template.OCSPServer = urls.OCSPServer
+	template.CRLDistributionPoints = crlDistributionPoints
+
+	cert, err = x509.CreateCertificate(rand.Reader, template, key.certificate, pub, key.signer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certif, err = x509.ParseCertificate(cert)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the names of the signed certificate are checked again, an extension of the profile
+	// can carry subject alternative names which the template doesn't have
+	err = key.checkNameConstraints(&IssuanceRequest{
+		Subject:        template.Subject,
+		DNSNames:       certif.DNSNames,
+		IPAddresses:    certif.IPAddresses,
+		URIs:           certif.URIs,
+		EmailAddresses: certif.EmailAddresses,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	err = store.AddCertificate(ca.Name, newCertificateRecord(profileName, requester, certif))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, certif, nil
+}
+
+// checkDuplicateExtensions refuses a second extension with the same OID, RFC 5280 allows
+// an extension only once in a certificate
+func checkDuplicateExtensions(extensions []pkix.Extension) (e error) {
+	for i := range extensions {
+		for j := 0; j < i; j++ {
+			if extensions[i].Id.Equal(extensions[j].Id) {
+				return errors.New("duplicate extension " + extensions[i].Id.String())
+			}
+		}
+	}
+	return nil
+}
+
+// Issue creates a certificate for the request according to the profile of the CA
+func (ca *CA)Issue(profileName string, request *IssuanceRequest) (cert []byte, err error) {
+
+	profile := ca.Profile(profileName)
+	if profile == nil {
+		return nil, errors.New("unknown profile: " + profileName)
+	}
+	err = profile.checkKeyAlgorithm(request.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	normalized := *request
+	request = &normalized
+	err = request.normalizeSubjectAltNames()
+	if err != nil {
+		return nil, err
+	}
+	if profile.Name == ProfileX509SVID {
+		err = checkX509SVID(request)
+		if err != nil {
+			return nil, err
+		}
+	}
+	key, err := ca.issuingKey()
+	if err != nil {
+		return nil, err
+	}
+	err = key.checkNameConstraints(request)
+	if err != nil {
+		return nil, err
+	}
+	if profile.IsCA {
+		err = key.checkPathLen(profile.MaxPathLen)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	extensions := append([]pkix.Extension{}, profile.ExtraExtensions...)
+	if len(profile.Policies) > 0 {
+		policies, err := certificatePoliciesExtension(profile.Policies)
+		if err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, policies)
+	}
+	for _, extension := range request.Extensions {
+		if isProtectedExtension(extension.Id) {
+			return nil, errors.New("extension " + extension.Id.String() + " is set by the CA, it can't be requested")
+		}
+	}
+	extensions = append(extensions, request.Extensions...)
+	err = checkDuplicateExtensions(extensions)
+	if err != nil {
+		return nil, err
+	}
+
+	validity := profile.Validity
+	if request.Validity > 0 {
+		if request.Validity > profile.Validity {
+			return nil, errors.New("requested validity exceeds the one of profile " + profile.Name)
+		}
+		validity = request.Validity
+	}
+	notBefore, notAfter, err := ca.validity(key.certificate, func(now time.Time) time.Time {
+		return now.Add(validity)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := ca.nextSerialNumber()
 	if err != nil {
 		return nil, err
 	}
 
 	certTemplate := x509.Certificate{
-		SerialNumber:                ca.certificateSerialNumber,
-		Subject:                     *pkixName,
-		NotBefore:                   time.Now(),
-		NotAfter:                    time.Now().AddDate(1,0,0),
-		KeyUsage:                    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:                 extKeyUsage,
-		BasicConstraintsValid:       true,
-		IsCA:                        false,
+		SerialNumber:          serial,
+		Subject:               request.Subject,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              profile.keyUsage(request.PublicKey),
+		ExtKeyUsage:           profile.ExtKeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  profile.IsCA,
+		ExtraExtensions:       extensions,
+		DNSNames:              request.DNSNames,
+		IPAddresses:           request.IPAddresses,
+		URIs:                  request.URIs,
+		EmailAddresses:        request.EmailAddresses,
+	}
+	if profile.IsCA {
+		setMaxPathLen(&certTemplate, profile.MaxPathLen)
+	}
+
+	cert, _, err = ca.signCertificate(key, profile.Name, request.Requester, &certTemplate, request.PublicKey)
+	return cert, err
+}
+
+func (ca *CA)createTLSCertificate(profileName string, dn string, pub crypto.PublicKey, sans []string) (cert []byte, err error) {
+
+	pkixName, err := ConvertDNToPKIXName(dn)
+	if err != nil {
+		return nil, err
 	}
 
-	ca.certificateSerialNumber.Add(ca.certificateSerialNumber, big.NewInt(1))
+	request := IssuanceRequest{
+		Subject:   *pkixName,
+		PublicKey: pub,
+	}
+	err = request.AddSubjectAltNames(sans...)
+	if err != nil {
+		return nil, err
+	}
 
-	return x509.CreateCertificate(rand.Reader, &certTemplate, ca.Certificate, pub, ca.priv)
+	return ca.Issue(profileName, &request)
 }
 
-func (ca *CA)CreateTLSClientCertificate(dn string, pub crypto.PublicKey) (cert []byte, err error) {
-	return ca.createTLSCertificate(dn, pub, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth})
+// CreateTLSClientCertificate issues a client certificate, see AddSubjectAltNames for
+// the supported subject alternative names
+func (ca *CA)CreateTLSClientCertificate(dn string, pub crypto.PublicKey, sans ...string) (cert []byte, err error) {
+	return ca.createTLSCertificate(ProfileTLSClient, dn, pub, sans)
 }
 
-func (ca *CA)CreateTLSServerCertificate(dn string, pub crypto.PublicKey) (cert []byte, err error) {
-	return ca.createTLSCertificate(dn, pub, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth})
-}
\ No newline at end of file
+// CreateTLSServerCertificate issues a server certificate, the host names and IP
+// addresses of the server are passed as subject alternative names
+func (ca *CA)CreateTLSServerCertificate(dn string, pub crypto.PublicKey, sans ...string) (cert []byte, err error) {
+	return ca.createTLSCertificate(ProfileTLSServer, dn, pub, sans)
+}
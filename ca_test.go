@@ -1,12 +1,18 @@
 package gopki
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"math/big"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // ---------- Testing Module ----------
@@ -36,8 +42,69 @@ func TestNewCA(t *testing.T) {
 		t.Error("empty ca.priv")
 	}
 
-	if ca.certificateSerialNumber.Cmp(big.NewInt(1)) != 0 {
-		t.Error("Serial number is not 1: ", ca.certificateSerialNumber)
+	if _, ok := ca.serialNumbers.(*RandomSerialNumberGenerator); !ok {
+		t.Error("CA does not use random serial numbers")
+	}
+
+	if ca.Certificate.SerialNumber.Sign() <= 0 {
+		t.Error("Serial number is not positive: ", ca.Certificate.SerialNumber)
+	}
+}
+
+func TestCA_NewSubordinateCA(t *testing.T) {
+	// Arrange
+	rootKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	root, err := NewCAWithOptions("CN=GoPKI Root,O=Cryptable,C=BE", 10, rootKey.Public(), rootKey, CAOptions{MaxPathLen: 1})
+	if err != nil {
+		t.Error("NewCAWithOptions() Failed", err)
+		return
+	}
+	subKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	// Act
+	sub, chain, err := root.NewSubordinateCA("CN=GoPKI Issuing,O=Cryptable,C=BE", 20, subKey.Public(), subKey, CAOptions{})
+
+	// Assert
+	if err != nil {
+		t.Error("NewSubordinateCA() Failed", err)
+		return
+	}
+	if len(chain) != 2 {
+		t.Error("Chain length is not 2: ", len(chain))
+		return
+	}
+	if sub.Certificate.NotAfter.After(root.Certificate.NotAfter) {
+		t.Error("Subordinate CA outlives the root CA")
+	}
+	if !sub.Certificate.MaxPathLenZero {
+		t.Error("Subordinate CA must have a path length of 0")
+	}
+
+	tlsKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	cert, err := sub.CreateTLSServerCertificate("CN=SSL Server, O=Cryptable, C=BE", tlsKey.Public())
+	if err != nil {
+		t.Error("CA.CreateTLSServerCertificate failed: ", err)
+		return
+	}
+	leaf, _ := x509.ParseCertificate(cert)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root.Certificate)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(sub.Certificate)
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		t.Error("Verify failed: ", err)
+	}
+
+	// a CA with path length 0 cannot issue a subordinate CA
+	_, _, err = sub.NewSubordinateCA("CN=GoPKI Too Deep,O=Cryptable,C=BE", 1, tlsKey.Public(), tlsKey, CAOptions{})
+	if err == nil {
+		t.Error("NewSubordinateCA() must fail on a CA with path length 0")
 	}
 }
 
@@ -146,6 +213,26 @@ func TestCA_CreateTLSServerCertificate(t *testing.T) {
 	}
 }
 
+func TestCA_NewSubordinateCAKeyMismatch(t *testing.T) {
+	// Arrange
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	root, _ := NewCAWithOptions("CN=GoPKI Root,O=Cryptable,C=BE", 10, rootKey.Public(), rootKey, CAOptions{MaxPathLen: 1})
+	subKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Act
+	_, _, err := root.NewSubordinateCA("CN=GoPKI Issuing,O=Cryptable,C=BE", 5, subKey.Public(), otherKey, CAOptions{})
+
+	// Assert
+	if err == nil {
+		t.Error("NewSubordinateCA() accepted a private key of another public key")
+	}
+	issued, _ := root.store.CertificatesBySubject(root.Name, "CN=GoPKI Issuing,O=Cryptable,C=BE")
+	if len(issued) != 0 {
+		t.Error("subordinate CA certificate issued for a mismatching key pair")
+	}
+}
+
 func TestLoadCA(t *testing.T) {
 	// Arrange
 	cacert := `-----BEGIN CERTIFICATE-----
@@ -247,4 +334,162 @@ j6D1pJp1jVVYmDXGDGGegW9LKDVEzk8=
 		t.Error("LoadCA failed: " + err.Error())
 		return
 	}
-}
\ No newline at end of file
+}
+
+func TestLoadCARandomSerialNumbers(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	created, _ := NewCA("CN=GoPKI Loaded,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	ca, err := LoadCA(created.Bytes, caKey, *big.NewInt(100))
+	if err != nil {
+		t.Fatal("LoadCA failed: ", err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Act
+	first, _ := ca.CreateTLSClientCertificate("CN=first", key.Public())
+	second, _ := ca.CreateTLSClientCertificate("CN=second", key.Public())
+
+	// Assert
+	firstCert, _ := x509.ParseCertificate(first)
+	secondCert, _ := x509.ParseCertificate(second)
+	if firstCert == nil || secondCert == nil {
+		t.Fatal("loaded CA does not issue")
+	}
+	if firstCert.SerialNumber.BitLen() < 64 || new(big.Int).Sub(secondCert.SerialNumber, firstCert.SerialNumber).Cmp(big.NewInt(1)) == 0 {
+		t.Error("loaded CA issues sequential serial numbers: ", firstCert.SerialNumber, secondCert.SerialNumber)
+	}
+}
+
+func TestCA_ConcurrentIssuance(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, err := NewCA("CN=GoPKI Concurrent,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	if err != nil {
+		t.Error("NewCA() Failed", err)
+		return
+	}
+	tlsKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	workers := 16
+	perWorker := 250
+	serials := make(chan string, workers*perWorker)
+	var wg sync.WaitGroup
+
+	// Act
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				cert, err := ca.CreateTLSServerCertificate("CN=SSL Server, O=Cryptable, C=BE", tlsKey.Public())
+				if err != nil {
+					t.Error("CA.CreateTLSServerCertificate failed: ", err)
+					return
+				}
+				certif, _ := x509.ParseCertificate(cert)
+				serials <- certif.SerialNumber.String()
+			}
+		}()
+	}
+	wg.Wait()
+	close(serials)
+
+	// Assert
+	seen := map[string]bool{}
+	for serial := range serials {
+		if seen[serial] {
+			t.Error("Serial number issued twice: ", serial)
+		}
+		seen[serial] = true
+	}
+	if len(seen) != workers*perWorker {
+		t.Error("Unexpected number of certificates: ", len(seen))
+	}
+}
+
+func TestCA_ConcurrentSequentialIssuance(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI Concurrent,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	ca.SetSerialNumberGenerator(NewSequentialSerialNumberGenerator(big.NewInt(1)))
+	tlsKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	workers := 8
+	perWorker := 250
+	var wg sync.WaitGroup
+
+	// Act
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				_, err := ca.CreateTLSClientCertificate("CN=SSL Client, O=Cryptable, C=BE", tlsKey.Public())
+				if err != nil {
+					t.Error("CA.CreateTLSClientCertificate failed: ", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Assert
+	for i := 1; i <= workers*perWorker; i++ {
+		exists, _ := ca.store.SerialNumberExists(ca.Name, big.NewInt(int64(i)))
+		if !exists {
+			t.Error("Serial number not issued: ", i)
+		}
+	}
+}
+
+func TestCA_Validity(t *testing.T) {
+	// Arrange
+	start := time.Date(2024, 3, 1, 12, 34, 56, 0, time.UTC)
+	clock := NewFakeClock(start)
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, err := NewCAWithOptions("CN=GoPKI Validity,O=Cryptable,C=BE", 1, caKey.Public(), caKey, CAOptions{
+		MaxPathLen:       1,
+		Clock:            clock,
+		Backdate:         5 * time.Minute,
+		ValidityRounding: time.Minute,
+	})
+	if err != nil {
+		t.Fatal("NewCAWithOptions failed: ", err)
+	}
+	ca.AddProfile(&Profile{Name: "long", Validity: 2 * 365 * 24 * time.Hour})
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	request := &IssuanceRequest{Subject: pkix.Name{CommonName: "validity"}, PublicKey: key.Public()}
+
+	// Act
+	leafBytes, errLeaf := ca.Issue(ProfileTLSClient, request)
+	leaf, _ := x509.ParseCertificate(leafBytes)
+	cappedBytes, errCapped := ca.Issue("long", request)
+	capped, _ := x509.ParseCertificate(cappedBytes)
+	sub, _, errSub := ca.NewSubordinateCA("CN=GoPKI Validity Issuing,O=Cryptable,C=BE", 5, key.Public(), key, CAOptions{})
+	errBackdate := ca.SetBackdate(-time.Minute)
+	_, errOptions := NewCAWithOptions("CN=GoPKI Validity,O=Cryptable,C=BE", 1, caKey.Public(), caKey, CAOptions{ValidityRounding: -time.Second})
+	clock.Advance(2 * 365 * 24 * time.Hour)
+	_, errExpired := ca.Issue(ProfileTLSClient, request)
+
+	// Assert
+	if !ca.Certificate.NotBefore.Equal(time.Date(2024, 3, 1, 12, 29, 0, 0, time.UTC)) ||
+		!ca.Certificate.NotAfter.Equal(time.Date(2025, 3, 1, 12, 34, 0, 0, time.UTC)) {
+		t.Error("wrong CA validity: ", ca.Certificate.NotBefore, ca.Certificate.NotAfter)
+	}
+	if errLeaf != nil || !leaf.NotBefore.Equal(ca.Certificate.NotBefore) ||
+		!leaf.NotAfter.Equal(start.Add(ca.Profile(ProfileTLSClient).Validity).Truncate(time.Minute)) {
+		t.Error("wrong leaf validity: ", errLeaf)
+	}
+	if errCapped != nil || !capped.NotAfter.Equal(ca.Certificate.NotAfter) {
+		t.Error("leaf outlives its issuer: ", errCapped)
+	}
+	if errSub != nil || sub.Clock() != clock || !sub.Certificate.NotAfter.Equal(ca.Certificate.NotAfter) {
+		t.Error("subordinate CA doesn't follow its issuer: ", errSub)
+	}
+	if errBackdate == nil || errOptions == nil {
+		t.Error("negative backdate or rounding accepted")
+	}
+	if errExpired == nil || !strings.Contains(errExpired.Error(), "expired") {
+		t.Error("expired CA issued a certificate: ", errExpired)
+	}
+}
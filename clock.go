@@ -0,0 +1,96 @@
+package gopki
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time to the CA and to its renewal scheduler, tests replace the system
+// clock by a FakeClock to simulate months in milliseconds
+type Clock interface {
+	Now() time.Time
+	// After waits for the duration to elapse and then sends the time, like time.After
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock)Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock)After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SystemClock is the clock of the operating system
+var SystemClock Clock = systemClock{}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// FakeClock only moves when it is advanced
+type FakeClock struct {
+	mutex   sync.Mutex
+	changed *sync.Cond
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+func NewFakeClock(now time.Time) (c *FakeClock) {
+	c = &FakeClock{now: now}
+	c.changed = sync.NewCond(&c.mutex)
+	return c
+}
+
+func (c *FakeClock)Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock)After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{c.now.Add(d), ch})
+	c.changed.Broadcast()
+	return ch
+}
+
+// Advance moves the clock forward and wakes up the waiters whose time has come
+func (c *FakeClock)Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = waiting
+	c.changed.Broadcast()
+}
+
+// BlockUntil returns once n callers of After are waiting, so a test advances the clock
+// only after the goroutine under test went to sleep
+func (c *FakeClock)BlockUntil(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for len(c.waiters) < n {
+		c.changed.Wait()
+	}
+}
@@ -0,0 +1,89 @@
+// gopki-signerd is the reference signer daemon: it holds the private key of a CA and
+// signs for the CA over a Unix socket, so the key never enters the CA process.
+//
+//	GOPKI_KEY_PASSWORD=secret gopki-signerd -key ca-key.pem -socket /run/gopki/signer.sock
+//
+// The CA connects to it with OpenSigner("unix:/run/gopki/signer.sock", nil).
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/cryptable/gopki"
+)
+
+func main() {
+	socket := flag.String("socket", "gopki-signer.sock", "Unix socket to listen on")
+	key := flag.String("key", "", "PEM encoded private key file")
+	passwordEnv := flag.String("password-env", "GOPKI_KEY_PASSWORD", "environment variable with the password of the key file")
+	flag.Parse()
+
+	if *key == "" {
+		log.Fatal("E: no key file, use -key")
+	}
+
+	var password []byte
+	if p, ok := os.LookupEnv(*passwordEnv); ok {
+		password = []byte(p)
+		os.Unsetenv(*passwordEnv)
+	}
+	signer, err := gopki.LoadKeyFileSigner(*key, password)
+	if err != nil {
+		log.Fatal("E: ", err)
+	}
+	server, err := gopki.NewSignerServer(signer)
+	if err != nil {
+		log.Fatal("E: ", err)
+	}
+
+	l, err := listen(*socket)
+	if err != nil {
+		log.Fatal("E: ", err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		l.Close()
+	}()
+
+	log.Print("I: signing on ", *socket)
+	server.Serve(l)
+}
+
+// listen creates the socket with only owner access from the start, the daemon has no
+// other client authentication. A stale socket is removed, any other file is left alone.
+func listen(socket string) (l net.Listener, e error) {
+	info, err := os.Lstat(socket)
+	if err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("refusing to replace " + socket + ", it is not a socket")
+		}
+		err = os.Remove(socket)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	umask := syscall.Umask(0077)
+	l, err = net.Listen("unix", socket)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(socket, 0600)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
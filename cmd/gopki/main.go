@@ -0,0 +1,106 @@
+// gopki administers the database of the CAs:
+//
+//	gopki db migrate -driver postgres -connect "postgres://gopki@db/gopki"
+//	gopki db status -driver sqlite3 -connect gopki.db
+//	GOPKI_KEK=... GOPKI_PREVIOUS_KEK=... gopki db rewrap -connect gopki.db
+//
+// migrate upgrades the schema to the version of this gopki, status lists the applied
+// and pending migrations. rewrap rotates the key-encryption key: the data keys of the
+// private keys wrapped by the previous KEK are rewrapped with the new one. The KEKs are
+// base64 encoded, read from the environment or from the -kek-file and
+// -previous-kek-file files.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cryptable/gopki"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gopki db migrate|status|rewrap [-driver sqlite3|postgres|mysql] [-connect dsn]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 3 || os.Args[1] != "db" {
+		usage()
+	}
+	command := os.Args[2]
+	flags := flag.NewFlagSet("gopki db "+command, flag.ExitOnError)
+	driver := flags.String("driver", "sqlite3", "database/sql driver: sqlite3, postgres or mysql")
+	connect := flags.String("connect", "gopki.db", "data source name of the database")
+	kekFile := flags.String("kek-file", "", "file with the new key-encryption key, instead of GOPKI_KEK")
+	previousKEKFile := flags.String("previous-kek-file", "", "file with the previous key-encryption key, instead of GOPKI_PREVIOUS_KEK")
+	flags.Parse(os.Args[3:])
+
+	db, err := gopki.NewDB(*driver, *connect)
+	if err != nil {
+		log.Fatal("E: ", err)
+	}
+	defer db.CloseDB()
+
+	switch command {
+	case "migrate":
+		applied, err := db.Migrate()
+		if err != nil {
+			log.Fatal("E: ", err)
+		}
+		version, err := db.SchemaVersion()
+		if err != nil {
+			log.Fatal("E: ", err)
+		}
+		log.Print("I: applied ", applied, " migrations, schema version ", version)
+	case "status":
+		status, err := db.MigrationStatus()
+		if err != nil {
+			log.Fatal("E: ", err)
+		}
+		for _, s := range status {
+			applied := "pending"
+			if !s.AppliedAt.IsZero() {
+				applied = s.AppliedAt.UTC().Format("2006-01-02T15:04:05Z")
+			}
+			fmt.Printf("%4d  %-20s  %s\n", s.Version, applied, s.Description)
+		}
+		if err = db.CheckSchema(); err != nil {
+			log.Fatal("E: ", err)
+		}
+	case "rewrap":
+		kek, err := loadKEK(*kekFile, "GOPKI_KEK")
+		if err != nil {
+			log.Fatal("E: ", err)
+		}
+		previous, err := loadKEK(*previousKEKFile, "GOPKI_PREVIOUS_KEK")
+		if err != nil {
+			log.Fatal("E: ", err)
+		}
+		if err = db.CheckSchema(); err != nil {
+			log.Fatal("E: ", err)
+		}
+		db.SetKeyEncryptionKey(kek, previous)
+		n, err := db.RewrapKeys()
+		if err != nil {
+			log.Fatal("E: ", err)
+		}
+		log.Print("I: rewrapped ", n, " data keys with key-encryption key ", kek.ID)
+	default:
+		usage()
+	}
+}
+
+// loadKEK reads the key-encryption key from the file, or from the environment variable
+// without file
+func loadKEK(filename string, variable string) (k *gopki.KeyEncryptionKey, e error) {
+	if filename != "" {
+		return gopki.LoadKeyEncryptionKey(filename)
+	}
+	kek, err := gopki.KeyEncryptionKeyFromEnv(variable)
+	os.Unsetenv(variable)
+	return kek, err
+}
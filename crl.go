@@ -0,0 +1,293 @@
+package gopki
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"time"
+)
+
+// DefaultCRLValidity is the time between thisUpdate and nextUpdate of a CRL
+var DefaultCRLValidity = 24 * time.Hour
+
+var (
+	oidDeltaCRLIndicator        = asn1.ObjectIdentifier{2, 5, 29, 27}
+	oidIssuingDistributionPoint = asn1.ObjectIdentifier{2, 5, 29, 28}
+	oidFreshestCRL              = asn1.ObjectIdentifier{2, 5, 29, 46}
+)
+
+// CRLPartition selects part of the revocations of a CA, so a big fleet doesn't need to
+// download every revocation. A partitioned CRL carries an issuing distribution point.
+type CRLPartition struct {
+	// Name identifies the partition, the base CRL of a partition is kept under it
+	Name string
+	// URL is where the CRL of the partition is published
+	URL string
+	// DeltaURL is where the delta CRLs are published, it ends up in the freshest CRL
+	// extension of the base CRL. Empty means no delta CRLs are published.
+	DeltaURL string
+	// MinSerialNumber and MaxSerialNumber limit the serial numbers (inclusive), nil is unbounded
+	MinSerialNumber *big.Int
+	MaxSerialNumber *big.Int
+	// Profile limits the partition to certificates issued with the profile
+	Profile string
+}
+
+type distributionPointName struct {
+	FullName []asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+type distributionPoint struct {
+	DistributionPoint distributionPointName `asn1:"optional,tag:0"`
+}
+
+type issuingDistributionPoint struct {
+	DistributionPoint distributionPointName `asn1:"optional,tag:0"`
+}
+
+func uriGeneralNames(uris ...string) (n []asn1.RawValue) {
+	for _, uri := range uris {
+		n = append(n, asn1.RawValue{Tag: 6, Class: asn1.ClassContextSpecific, Bytes: []byte(uri)})
+	}
+	return n
+}
+
+// covers tells whether the certificate with the serial number and profile belongs to the
+// partition
+func (p *CRLPartition)covers(serialNumber *big.Int, profile string) (b bool) {
+	if p.MinSerialNumber != nil && serialNumber.Cmp(p.MinSerialNumber) < 0 {
+		return false
+	}
+	if p.MaxSerialNumber != nil && serialNumber.Cmp(p.MaxSerialNumber) > 0 {
+		return false
+	}
+	if p.Profile != "" && profile != p.Profile {
+		return false
+	}
+	return true
+}
+
+func (p *CRLPartition)contains(revocation *Revocation) (b bool) {
+	return p.covers(revocation.SerialNumber, revocation.Profile)
+}
+
+func (p *CRLPartition)extensions(delta bool) (e []pkix.Extension, err error) {
+	if p.URL != "" {
+		value, err := asn1.Marshal(issuingDistributionPoint{
+			DistributionPoint: distributionPointName{FullName: uriGeneralNames(p.URL)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		e = append(e, pkix.Extension{Id: oidIssuingDistributionPoint, Critical: true, Value: value})
+	}
+	if p.DeltaURL != "" && !delta {
+		value, err := asn1.Marshal([]distributionPoint{
+			{DistributionPoint: distributionPointName{FullName: uriGeneralNames(p.DeltaURL)}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		e = append(e, pkix.Extension{Id: oidFreshestCRL, Value: value})
+	}
+	return e, nil
+}
+
+// SetCRLValidity sets the time until the next update of the CRLs created by the CA
+func (ca *CA)SetCRLValidity(validity time.Duration) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.crlValidity = validity
+}
+
+// SetDeltaCRLURL sets where the delta CRLs of the complete CRL are published
+func (ca *CA)SetDeltaCRLURL(url string) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.deltaCRLURL = url
+}
+
+// SetCRLPartitions sets the partitions the CA publishes CRLs for. An issued certificate
+// gets the URL of the first partition covering it as CRL distribution point, instead of
+// the CRLDistributionPoints of the CAURLs.
+func (ca *CA)SetCRLPartitions(partitions []*CRLPartition) (e error) {
+	copied := make([]*CRLPartition, 0, len(partitions))
+	for _, partition := range partitions {
+		if partition.Name == "" || partition.URL == "" {
+			return errors.New("CRL partition needs a name and a URL")
+		}
+		p := *partition
+		copied = append(copied, &p)
+	}
+
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.crlPartitions = copied
+	return nil
+}
+
+// CRLPartitions returns the partitions the CA publishes CRLs for, see SetCRLPartitions
+func (ca *CA)CRLPartitions() (partitions []*CRLPartition) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	for _, partition := range ca.crlPartitions {
+		p := *partition
+		partitions = append(partitions, &p)
+	}
+	return partitions
+}
+
+// crlDistributionPoints returns where the CRL covering the certificate is published, the
+// caller holds the mutex
+func (ca *CA)crlDistributionPoints(serialNumber *big.Int, profile string) (urls []string) {
+	for _, partition := range ca.crlPartitions {
+		if partition.covers(serialNumber, profile) {
+			return []string{partition.URL}
+		}
+	}
+	return ca.urls.CRLDistributionPoints
+}
+
+// CreateCRL creates a signed X.509 v2 CRL with all the revocations of the CA. The CRL
+// carries an incrementing CRL number and the authority key identifier of the CA.
+func (ca *CA)CreateCRL() (crl []byte, e error) {
+	ca.mutex.Lock()
+	partition := &CRLPartition{DeltaURL: ca.deltaCRLURL}
+	ca.mutex.Unlock()
+
+	return ca.createCRL(nil, partition, false)
+}
+
+// CreateRolloverCRL creates the complete CRL signed by the old key of a key rollover,
+// from the switch to the new key until the old key is retired. Relying parties check the
+// certificates issued by the old key against it. Both keys share the name and the serial
+// numbers of the CA, so the CRL holds all the revocations of the CA.
+func (ca *CA)CreateRolloverCRL() (crl []byte, e error) {
+	ca.mutex.Lock()
+	old := ca.retiringKey()
+	ca.mutex.Unlock()
+	if old == nil {
+		return nil, errors.New("CA " + ca.Name + " has no old key of a key rollover to sign a CRL")
+	}
+
+	return ca.createCRL(old, &CRLPartition{}, false)
+}
+
+// CreateDeltaCRL creates a delta CRL of the complete CRL, with the revocations since
+// the last CRL created by CreateCRL
+func (ca *CA)CreateDeltaCRL() (crl []byte, e error) {
+	return ca.createCRL(nil, &CRLPartition{}, true)
+}
+
+// CreatePartitionCRL creates the base CRL of the partition
+func (ca *CA)CreatePartitionCRL(partition *CRLPartition) (crl []byte, e error) {
+	if partition.Name == "" {
+		return nil, errors.New("CRL partition without name")
+	}
+	return ca.createCRL(nil, partition, false)
+}
+
+// CreatePartitionDeltaCRL creates a delta CRL of the partition, with the revocations
+// since its last base CRL
+func (ca *CA)CreatePartitionDeltaCRL(partition *CRLPartition) (crl []byte, e error) {
+	if partition.Name == "" {
+		return nil, errors.New("CRL partition without name")
+	}
+	return ca.createCRL(nil, partition, true)
+}
+
+// createCRL signs the CRL with the key, nil is the current key of the CA. Only the CRLs of
+// the current key are base CRLs of the delta CRLs.
+func (ca *CA)createCRL(key *issuingKey, partition *CRLPartition, delta bool) (crl []byte, e error) {
+	ca.mutex.Lock()
+	store := ca.store
+	validity := ca.crlValidity
+	base := key == nil
+	if base {
+		current := ca.currentKey()
+		key = &current
+	}
+	ca.mutex.Unlock()
+	if validity <= 0 {
+		validity = DefaultCRLValidity
+	}
+
+	// thisUpdate precedes reading the revocations, so a revocation recorded meanwhile is
+	// not older than the base CRL and ends up in the next delta CRL
+	now := ca.Clock().Now().UTC().Truncate(time.Second)
+	var baseNumber *big.Int
+	var baseThisUpdate time.Time
+	if delta {
+		var err error
+		baseNumber, baseThisUpdate, err = store.BaseCRL(ca.Name, partition.Name)
+		if err != nil {
+			return nil, err
+		}
+		if baseNumber == nil {
+			return nil, errors.New("no base CRL to create a delta CRL from")
+		}
+	}
+
+	revocations, err := store.Revocations(ca.Name)
+	if err != nil {
+		return nil, err
+	}
+	number, err := store.NextCRLNumber(ca.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	template := x509.RevocationList{
+		SignatureAlgorithm: key.algorithm,
+		Number:             number,
+		ThisUpdate:         now,
+		NextUpdate:         now.Add(validity),
+	}
+	template.ExtraExtensions, err = partition.extensions(delta)
+	if err != nil {
+		return nil, err
+	}
+	if delta {
+		value, err := asn1.Marshal(baseNumber)
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: oidDeltaCRLIndicator, Critical: true, Value: value})
+	}
+
+	for _, revocation := range revocations {
+		if !partition.contains(revocation) {
+			continue
+		}
+		// revocation times have a precision of seconds, so a revocation in the second of
+		// the base CRL is repeated in the delta CRL
+		if delta && revocation.RevocationTime.Before(baseThisUpdate) {
+			continue
+		}
+		entry, err := revocation.revocationListEntry()
+		if err != nil {
+			return nil, err
+		}
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, entry)
+	}
+
+	crl, err = x509.CreateRevocationList(rand.Reader, &template, key.certificate, key.signer)
+	if err != nil {
+		return nil, err
+	}
+
+	if base && !delta {
+		err = store.SetBaseCRL(ca.Name, partition.Name, number, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return crl, nil
+}
@@ -0,0 +1,182 @@
+package gopki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func crlExtension(crl *x509.RevocationList, oid asn1.ObjectIdentifier) (critical bool, value []byte) {
+	for _, extension := range crl.Extensions {
+		if extension.Id.Equal(oid) {
+			return extension.Critical, extension.Value
+		}
+	}
+	return false, nil
+}
+
+func TestCA_CreateDeltaCRL(t *testing.T) {
+	// Arrange
+	ca, serials := newRevocationTestCA(t)
+	ca.SetDeltaCRLURL("http://pki.cryptable.org/delta.crl")
+	ca.store.AddRevocation(ca.Name, &Revocation{
+		SerialNumber:   serials[0],
+		RevocationTime: time.Now().Add(-time.Hour).UTC().Truncate(time.Second),
+		Reason:         ReasonSuperseded,
+	})
+	_, err := ca.CreateDeltaCRL()
+	if err == nil {
+		t.Error("CreateDeltaCRL must fail without base CRL")
+	}
+
+	// Act
+	baseDER, err := ca.CreateCRL()
+	if err != nil {
+		t.Error("CreateCRL failed: ", err)
+		return
+	}
+	ca.Revoke(serials[1], ReasonKeyCompromise, time.Time{})
+	deltaDER, err := ca.CreateDeltaCRL()
+	if err != nil {
+		t.Error("CreateDeltaCRL failed: ", err)
+		return
+	}
+
+	// Assert
+	base, _ := x509.ParseRevocationList(baseDER)
+	delta, err := x509.ParseRevocationList(deltaDER)
+	if err != nil {
+		t.Error("ParseRevocationList of delta CRL failed: ", err)
+		return
+	}
+	if err = delta.CheckSignatureFrom(ca.Certificate); err != nil {
+		t.Error("Delta CRL signature is invalid: ", err)
+	}
+	if _, value := crlExtension(base, oidFreshestCRL); value == nil {
+		t.Error("Base CRL has no freshest CRL extension")
+	}
+	critical, value := crlExtension(delta, oidDeltaCRLIndicator)
+	var baseNumber *big.Int
+	asn1.Unmarshal(value, &baseNumber)
+	if !critical || baseNumber == nil || baseNumber.Cmp(base.Number) != 0 {
+		t.Error("Delta CRL indicator does not refer to the base CRL: ", baseNumber)
+	}
+	if delta.Number.Cmp(base.Number) <= 0 {
+		t.Error("Delta CRL number is not higher than the base CRL number")
+	}
+	if _, value := crlExtension(delta, oidFreshestCRL); value != nil {
+		t.Error("Delta CRL must not have a freshest CRL extension")
+	}
+	if len(delta.RevokedCertificateEntries) != 1 ||
+		delta.RevokedCertificateEntries[0].SerialNumber.Cmp(serials[1]) != 0 {
+		t.Error("Delta CRL must only contain the revocation after the base CRL")
+	}
+}
+
+func TestCA_CreatePartitionCRL(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI CRL,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	ca.SetSerialNumberGenerator(NewSequentialSerialNumberGenerator(big.NewInt(1)))
+	tlsKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	for i := 0; i < 4; i++ {
+		if i%2 == 0 {
+			ca.CreateTLSServerCertificate("CN=SSL Server", tlsKey.Public())
+		} else {
+			ca.CreateTLSClientCertificate("CN=SSL Client", tlsKey.Public())
+		}
+		ca.Revoke(big.NewInt(int64(i+1)), ReasonCessationOfOperation, time.Time{})
+	}
+	servers := &CRLPartition{Name: "servers", URL: "http://pki.cryptable.org/servers.crl", Profile: ProfileTLSServer}
+	low := &CRLPartition{Name: "low", URL: "http://pki.cryptable.org/low.crl", MaxSerialNumber: big.NewInt(2)}
+
+	// Act
+	serversDER, err := ca.CreatePartitionCRL(servers)
+	if err != nil {
+		t.Error("CreatePartitionCRL failed: ", err)
+		return
+	}
+	lowDER, err := ca.CreatePartitionCRL(low)
+	if err != nil {
+		t.Error("CreatePartitionCRL failed: ", err)
+		return
+	}
+
+	// Assert
+	serversCRL, _ := x509.ParseRevocationList(serversDER)
+	if len(serversCRL.RevokedCertificateEntries) != 2 {
+		t.Error("Profile partition has wrong number of entries: ", len(serversCRL.RevokedCertificateEntries))
+	}
+	for _, entry := range serversCRL.RevokedCertificateEntries {
+		if entry.SerialNumber.Bit(0) != 1 {
+			t.Error("Client certificate in the server partition: ", entry.SerialNumber)
+		}
+	}
+	critical, value := crlExtension(serversCRL, oidIssuingDistributionPoint)
+	var idp issuingDistributionPoint
+	asn1.Unmarshal(value, &idp)
+	if !critical || len(idp.DistributionPoint.FullName) != 1 ||
+		string(idp.DistributionPoint.FullName[0].Bytes) != servers.URL {
+		t.Error("Issuing distribution point is wrong")
+	}
+	lowCRL, _ := x509.ParseRevocationList(lowDER)
+	if len(lowCRL.RevokedCertificateEntries) != 2 {
+		t.Error("Serial number partition has wrong number of entries: ", len(lowCRL.RevokedCertificateEntries))
+	}
+	for _, entry := range lowCRL.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(big.NewInt(2)) > 0 {
+			t.Error("Serial number outside the partition: ", entry.SerialNumber)
+		}
+	}
+
+	// every partition has its own base for delta CRLs
+	deltaDER, err := ca.CreatePartitionDeltaCRL(servers)
+	if err != nil {
+		t.Error("CreatePartitionDeltaCRL failed: ", err)
+		return
+	}
+	deltaCRL, _ := x509.ParseRevocationList(deltaDER)
+	_, value = crlExtension(deltaCRL, oidDeltaCRLIndicator)
+	var baseNumber *big.Int
+	asn1.Unmarshal(value, &baseNumber)
+	if baseNumber.Cmp(serversCRL.Number) != 0 {
+		t.Error("Delta CRL of the partition refers to the wrong base: ", baseNumber)
+	}
+}
+
+func TestCA_CRLPartitionDistributionPoint(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI CRL,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	ca.SetSerialNumberGenerator(NewSequentialSerialNumberGenerator(big.NewInt(1)))
+	ca.SetURLs(CAURLs{CRLDistributionPoints: []string{"http://pki.cryptable.org/ca.crl"}})
+	servers := &CRLPartition{Name: "servers", URL: "http://pki.cryptable.org/servers.crl", Profile: ProfileTLSServer}
+	err := ca.SetCRLPartitions([]*CRLPartition{servers})
+	if err != nil {
+		t.Error("SetCRLPartitions failed: ", err)
+		return
+	}
+	tlsKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Act
+	serverDER, _ := ca.CreateTLSServerCertificate("CN=SSL Server", tlsKey.Public())
+	clientDER, _ := ca.CreateTLSClientCertificate("CN=SSL Client", tlsKey.Public())
+
+	// Assert
+	server, _ := x509.ParseCertificate(serverDER)
+	if len(server.CRLDistributionPoints) != 1 || server.CRLDistributionPoints[0] != servers.URL {
+		t.Error("Certificate in a partition must point to the partition CRL: ", server.CRLDistributionPoints)
+	}
+	client, _ := x509.ParseCertificate(clientDER)
+	if len(client.CRLDistributionPoints) != 1 || client.CRLDistributionPoints[0] != "http://pki.cryptable.org/ca.crl" {
+		t.Error("Certificate outside the partitions must point to the CRL of the CA: ", client.CRLDistributionPoints)
+	}
+	if ca.SetCRLPartitions([]*CRLPartition{{Name: "no-url"}}) == nil {
+		t.Error("SetCRLPartitions must fail without a URL")
+	}
+}
@@ -0,0 +1,112 @@
+package gopki
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+)
+
+// protectedExtensions are set by the CA itself from the profile and the request, Issue
+// refuses them in the extensions of a request and they are never copied from a CSR
+var protectedExtensions = []asn1.ObjectIdentifier{
+	{2, 5, 29, 14}, // subject key identifier
+	{2, 5, 29, 15}, // key usage
+	{2, 5, 29, 17}, // subject alternative name
+	{2, 5, 29, 19}, // basic constraints
+	{2, 5, 29, 30}, // name constraints
+	{2, 5, 29, 31}, // CRL distribution points
+	{2, 5, 29, 32}, // certificate policies
+	{2, 5, 29, 35}, // authority key identifier
+	{2, 5, 29, 36}, // policy constraints
+	{2, 5, 29, 37}, // extended key usage
+	{2, 5, 29, 54}, // inhibit any policy
+	{1, 3, 6, 1, 5, 5, 7, 1, 1}, // authority information access
+}
+
+func isProtectedExtension(oid asn1.ObjectIdentifier) (b bool) {
+	for _, protected := range protectedExtensions {
+		if protected.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// nonStandardAttributes returns the attributes of a parsed name which pkix.Name has no
+// field for. Only ExtraNames gets marshalled, Names just holds the parsed attributes.
+func nonStandardAttributes(names []pkix.AttributeTypeAndValue) (n []pkix.AttributeTypeAndValue) {
+	for _, name := range names {
+		oid := name.Type
+		if len(oid) == 4 && oid[0] == 2 && oid[1] == 5 && oid[2] == 4 {
+			switch oid[3] {
+			case 3, 5, 6, 7, 8, 9, 10, 11, 17:
+				continue
+			}
+		}
+		n = append(n, name)
+	}
+	return n
+}
+
+// newIssuanceRequestFromCSR verifies the proof of possession of the CSR and keeps the
+// requested values which the policy allows
+func newIssuanceRequestFromCSR(csr *x509.CertificateRequest, policy *CSRPolicy) (r *IssuanceRequest, e error) {
+	err := csr.CheckSignature()
+	if err != nil {
+		return nil, errors.New("invalid CSR signature: " + err.Error())
+	}
+
+	request := &IssuanceRequest{
+		PublicKey: csr.PublicKey,
+	}
+	if policy.Subject {
+		request.Subject = csr.Subject
+		request.Subject.ExtraNames = nonStandardAttributes(csr.Subject.Names)
+	}
+	if policy.DNSNames {
+		request.DNSNames = csr.DNSNames
+	}
+	if policy.IPAddresses {
+		request.IPAddresses = csr.IPAddresses
+	}
+	if policy.URIs {
+		request.URIs = csr.URIs
+	}
+	if policy.EmailAddresses {
+		request.EmailAddresses = csr.EmailAddresses
+	}
+	for _, extension := range csr.Extensions {
+		if isProtectedExtension(extension.Id) {
+			continue
+		}
+		for _, allowed := range policy.Extensions {
+			if allowed.Equal(extension.Id) {
+				request.Extensions = append(request.Extensions, extension)
+			}
+		}
+	}
+
+	return request, nil
+}
+
+// SignCSR issues a certificate for the DER encoded PKCS#10 certificate signing request.
+// The CSR policy of the profile decides which requested values are honored.
+func (ca *CA)SignCSR(csrDER []byte, profileName string) (cert []byte, err error) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := ca.Profile(profileName)
+	if profile == nil {
+		return nil, errors.New("unknown profile: " + profileName)
+	}
+
+	request, err := newIssuanceRequestFromCSR(csr, &profile.CSRPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	return ca.Issue(profileName, request)
+}
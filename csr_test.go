@@ -0,0 +1,162 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net"
+	"testing"
+)
+
+var testCSRExtension = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}
+
+func createTestCSR(t *testing.T) (csr []byte, key *ecdsa.PrivateKey) {
+	key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	basicConstraints, _ := asn1.Marshal(struct {
+		IsCA bool
+	}{true})
+	template := x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   "web",
+			Organization: []string{"Cryptable"},
+			ExtraNames:   []pkix.AttributeTypeAndValue{{Type: UID, Value: "web-01"}},
+		},
+		DNSNames:       []string{"web.default.svc.cluster.local"},
+		IPAddresses:    []net.IP{net.ParseIP("10.96.0.10")},
+		EmailAddresses: []string{"web@cryptable.org"},
+		ExtraExtensions: []pkix.Extension{
+			{Id: testCSRExtension, Value: []byte{0x05, 0x00}},
+			{Id: asn1.ObjectIdentifier{2, 5, 29, 19}, Critical: true, Value: basicConstraints},
+		},
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+	if err != nil {
+		t.Fatal("CreateCertificateRequest failed: ", err)
+	}
+	return csr, key
+}
+
+func TestCA_SignCSR(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI CSR,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	csr, key := createTestCSR(t)
+
+	// Act
+	cert, err := ca.SignCSR(csr, ProfileTLSServer)
+
+	// Assert
+	if err != nil {
+		t.Error("SignCSR failed: ", err)
+		return
+	}
+	certif, _ := x509.ParseCertificate(cert)
+	if !key.PublicKey.Equal(certif.PublicKey) {
+		t.Error("Certificate does not contain the public key of the CSR")
+	}
+	if certif.Subject.CommonName != "web" || len(certif.Subject.Organization) != 1 {
+		t.Error("Subject is not copied: ", certif.Subject)
+	}
+	uid := 0
+	for _, name := range certif.Subject.Names {
+		if name.Type.Equal(UID) {
+			uid++
+		}
+	}
+	if uid != 1 {
+		t.Error("UID attribute is not copied once: ", certif.Subject.Names)
+	}
+	if len(certif.DNSNames) != 1 || len(certif.IPAddresses) != 1 {
+		t.Error("DNS names and IP addresses are not copied: ", certif.DNSNames, certif.IPAddresses)
+	}
+	if len(certif.EmailAddresses) != 0 {
+		t.Error("Email addresses are not allowed by the tls-server profile: ", certif.EmailAddresses)
+	}
+	if certif.IsCA {
+		t.Error("Requested basic constraints must never be honored")
+	}
+	for _, extension := range certif.Extensions {
+		if extension.Id.Equal(testCSRExtension) {
+			t.Error("Requested extension is not allowed by the profile")
+		}
+	}
+}
+
+func TestCA_SignCSRAllowedExtension(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI CSR,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	profile := DefaultProfiles()[0]
+	profile.Name = "with-extension"
+	profile.CSRPolicy.Extensions = []asn1.ObjectIdentifier{testCSRExtension}
+	ca.AddProfile(profile)
+	csr, _ := createTestCSR(t)
+
+	// Act
+	cert, err := ca.SignCSR(csr, "with-extension")
+
+	// Assert
+	if err != nil {
+		t.Error("SignCSR failed: ", err)
+		return
+	}
+	certif, _ := x509.ParseCertificate(cert)
+	found := false
+	for _, extension := range certif.Extensions {
+		if extension.Id.Equal(testCSRExtension) {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Allowed extension is not copied")
+	}
+}
+
+func TestCA_SignCSRInvalidSignature(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI CSR,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	csr, _ := createTestCSR(t)
+	// flip a bit in the signature
+	csr[len(csr)-1] ^= 0x01
+
+	// Act
+	_, err := ca.SignCSR(csr, ProfileTLSServer)
+
+	// Assert
+	if err == nil {
+		t.Error("SignCSR must refuse a CSR with an invalid signature")
+	}
+}
+
+func TestStoreCertificateRequest(t *testing.T) {
+	// Arrange
+	csr, _ := createTestCSR(t)
+	var out bytes.Buffer
+
+	// Act
+	err := StoreCertificateRequest(&out, csr)
+	if err != nil {
+		t.Error("StoreCertificateRequest failed: ", err)
+		return
+	}
+	loaded, err := LoadCertificateRequest(&out)
+
+	// Assert
+	if err != nil {
+		t.Error("LoadCertificateRequest failed: ", err)
+		return
+	}
+	if !bytes.Equal(loaded, csr) {
+		t.Error("CSR changed after store and load")
+	}
+
+	_, err = LoadCertificateRequest(bytes.NewReader(pemCertificate(csr)))
+	if err == nil {
+		t.Error("LoadCertificateRequest must refuse a CERTIFICATE block")
+	}
+}
@@ -1,33 +1,1094 @@
 package gopki
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
 	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var CREATE_CA_CONFIG_TABLE = "CREATE TABLE IF NOT EXISTS CACONFIG (id INTEGER PRIMARY KEY AUTOINCREMENT, caname VARCHAR(32), key VARCHAR(256), value BLOB, integrity CHAR(64))"
+// The statements are written for SQLite, the dialect of the driver adapts them. They
+// describe the current schema, the migrations hold the statements as they were released.
+var CREATE_CA_CONFIG_TABLE = "CREATE TABLE IF NOT EXISTS CACONFIG (id {id}, caname VARCHAR(64), {key} VARCHAR(256), value {blob}, integrity CHAR(64))"
+var CREATE_CA_TABLE = "CREATE TABLE IF NOT EXISTS CA (caname VARCHAR(64) PRIMARY KEY, subject TEXT, serial VARCHAR(40), notbefore BIGINT, notafter BIGINT, fingerprint CHAR(64), keyid CHAR(64), keytype VARCHAR(16), certificate {blob})"
+var CREATE_CERTIFICATE_TABLE = "CREATE TABLE IF NOT EXISTS CERTIFICATE (id {id}, caname VARCHAR(64), serial VARCHAR(40), profile VARCHAR(64), certificate {blob}, subject TEXT, sans TEXT, notbefore BIGINT, notafter BIGINT, status INTEGER, fingerprint CHAR(64), requester VARCHAR(128), keyid CHAR(64), keytype VARCHAR(16), UNIQUE (caname, serial))"
+var CREATE_REVOCATION_TABLE = "CREATE TABLE IF NOT EXISTS REVOCATION (id {id}, caname VARCHAR(64), serial VARCHAR(40), profile VARCHAR(64), revocationtime BIGINT, reason INTEGER, invaliditydate BIGINT, UNIQUE (caname, serial))"
+var CREATE_CRL_NUMBER_TABLE = "CREATE TABLE IF NOT EXISTS CRLNUMBER (caname VARCHAR(64) PRIMARY KEY, number VARCHAR(40))"
+var CREATE_BASE_CRL_TABLE = "CREATE TABLE IF NOT EXISTS BASECRL (caname VARCHAR(64), crlpartition VARCHAR(64), number VARCHAR(40), thisupdate BIGINT, PRIMARY KEY (caname, crlpartition))"
+var CREATE_PRIVATE_KEY_TABLE = "CREATE TABLE IF NOT EXISTS PRIVATEKEY (id {id}, caname VARCHAR(64), keyid CHAR(64), keytype VARCHAR(16), kekid CHAR(16), datakey {blob}, privatekey {blob}, UNIQUE (caname, keyid))"
+var CREATE_ROLLOVER_TABLE = "CREATE TABLE IF NOT EXISTS ROLLOVER (caname VARCHAR(64) PRIMARY KEY, state INTEGER, switchat BIGINT, retireat BIGINT, oldcertificate {blob}, newcertificate {blob}, oldwithnew {blob}, newwithold {blob})"
+
+type tableIndex struct {
+	name    string
+	table   string
+	columns string
+}
 
+// DB is the Store in an SQL database, SQLite for a single node or PostgreSQL and MySQL
+// shared by several nodes. Its CAStore saves, loads and backs up the CAs in it.
 type DB struct {
-	db *sql.DB
+	CAStore
+	db      *sql.DB
+	dialect *dialect
 }
 
+var _ Store = (*DB)(nil)
+var _ KeyStore = (*DB)(nil)
+
+// NewDB opens the database with the database/sql driver: sqlite3, postgres or pgx, or
+// mysql. The SQLite driver is included, the application imports the other ones.
 func NewDB(dbtype string, connect string) (d *DB, e error) {
+	dialect, ok := dialects[dbtype]
+	if !ok {
+		return nil, errors.New("unsupported database driver: " + dbtype)
+	}
 	db, err := sql.Open(dbtype, connect)
 	if err != nil {
-		return _, err
+		return nil, err
 	}
 
-	return &DB{db}, nil
+	d = &DB{db: db, dialect: dialect}
+	d.store = d
+	return d, nil
+}
+
+// rebind adapts the statement to the dialect of the database
+func (d *DB)rebind(statement string) (s string) {
+	return d.dialect.rebind(statement)
 }
 
+// CreateDB creates the schema of a new database or upgrades an existing one, like
+// Migrate
 func (d *DB)CreateDB() (e error) {
-	_, err := d.db.Exec(CREATE_CA_CONFIG_TABLE)
-	if err != nil {
+	_, err := d.Migrate()
+	return err
+}
+
+// executor is a *sql.DB or a *sql.Tx
+type executor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (d *DB)createIndex(db executor, index tableIndex) (e error) {
+	columns := d.rebind(index.columns)
+	if d.dialect.indexIfNotExists {
+		_, err := db.Exec("CREATE INDEX IF NOT EXISTS " + index.name + " ON " + index.table + " (" + columns + ")")
 		return err
 	}
-	return nil
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?",
+		index.table, index.name).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = db.Exec("CREATE INDEX " + index.name + " ON " + index.table + " (" + columns + ")")
+	return err
 }
 
 func (d *DB)CloseDB() {
 	d.db.Close()
-}
\ No newline at end of file
+}
+
+func (d *DB)SerialNumberExists(caname string, serial *big.Int) (b bool, e error) {
+	var count int
+	err := d.db.QueryRow(d.rebind("SELECT COUNT(*) FROM CERTIFICATE WHERE caname = ? AND serial = ?"), caname, serial.Text(16)).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (d *DB)SetCA(caname string, cert *x509.Certificate) (e error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = d.replaceCA(tx, caname, cert)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *DB)replaceCA(tx executor, caname string, cert *x509.Certificate) (e error) {
+	record := newCertificateRecord(ProfileRootCA, "", cert)
+	_, err := tx.Exec(d.rebind("DELETE FROM CA WHERE caname = ?"), caname)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(d.rebind("INSERT INTO CA (caname, subject, serial, notbefore, notafter, fingerprint, keyid, keytype, certificate) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		caname, record.Subject, record.SerialNumber.Text(16), unixTime(record.NotBefore), unixTime(record.NotAfter),
+		record.Fingerprint, record.KeyID, record.KeyType, cert.Raw)
+	return err
+}
+
+func (d *DB)CACertificate(caname string) (cert *x509.Certificate, e error) {
+	var der []byte
+	err := d.db.QueryRow(d.rebind("SELECT certificate FROM CA WHERE caname = ?"), caname).Scan(&der)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func (d *DB)AddCertificate(caname string, r *CertificateRecord) (e error) {
+	return d.insertCertificate(d.db, caname, r)
+}
+
+func (d *DB)insertCertificate(db executor, caname string, r *CertificateRecord) (e error) {
+	var der []byte
+	if r.Certificate != nil {
+		der = r.Certificate.Raw
+	}
+	_, err := db.Exec(d.rebind("INSERT INTO CERTIFICATE (caname, serial, profile, certificate, subject, sans, notbefore, notafter, status, fingerprint, requester, keyid, keytype) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		caname, r.SerialNumber.Text(16), r.Profile, der, r.Subject, strings.Join(r.SubjectAltNames, "\n"),
+		unixTime(r.NotBefore), unixTime(r.NotAfter), int(r.Status), r.Fingerprint, r.Requester, r.KeyID, r.KeyType)
+	return err
+}
+
+func (d *DB)CertificateProfile(caname string, serial *big.Int) (p string, e error) {
+	err := d.db.QueryRow(d.rebind("SELECT profile FROM CERTIFICATE WHERE caname = ? AND serial = ?"), caname, serial.Text(16)).Scan(&p)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return p, err
+}
+
+// selectCertificates queries the CERTIFICATE table with the condition
+func (d *DB)selectCertificates(condition string, args ...interface{}) (r []*CertificateRecord, e error) {
+	rows, err := d.db.Query(d.rebind("SELECT serial, profile, certificate, subject, sans, notbefore, notafter, status, fingerprint, requester, keyid, keytype FROM CERTIFICATE WHERE "+
+		condition+" ORDER BY id"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var serial, sans string
+		var der []byte
+		var notBefore, notAfter int64
+		var status int
+		record := &CertificateRecord{}
+		err = rows.Scan(&serial, &record.Profile, &der, &record.Subject, &sans, &notBefore, &notAfter, &status,
+			&record.Fingerprint, &record.Requester, &record.KeyID, &record.KeyType)
+		if err != nil {
+			return nil, err
+		}
+		serialNumber, ok := new(big.Int).SetString(serial, 16)
+		if !ok {
+			return nil, errors.New("invalid serial number in database: " + serial)
+		}
+		record.SerialNumber = serialNumber
+		if sans != "" {
+			record.SubjectAltNames = strings.Split(sans, "\n")
+		}
+		record.NotBefore = fromUnixTime(notBefore)
+		record.NotAfter = fromUnixTime(notAfter)
+		record.Status = CertificateStatus(status)
+		record.Certificate, err = x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, record)
+	}
+	return r, rows.Err()
+}
+
+// selectCertificate returns the first certificate matching the condition, or nil
+func (d *DB)selectCertificate(condition string, args ...interface{}) (r *CertificateRecord, e error) {
+	records, err := d.selectCertificates(condition, args...)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return records[0], nil
+}
+
+func (d *DB)Certificate(caname string, serial *big.Int) (r *CertificateRecord, e error) {
+	return d.selectCertificate("caname = ? AND serial = ?", caname, serial.Text(16))
+}
+
+func (d *DB)Certificates(caname string) (r []*CertificateRecord, e error) {
+	return d.selectCertificates("caname = ?", caname)
+}
+
+func (d *DB)CertificatesBySubject(caname string, subject string) (r []*CertificateRecord, e error) {
+	return d.selectCertificates("caname = ? AND subject = ?", caname, subject)
+}
+
+func (d *DB)CertificateByFingerprint(fingerprint string) (r *CertificateRecord, e error) {
+	return d.selectCertificate("fingerprint = ?", fingerprint)
+}
+
+func (d *DB)CertificatesByStatus(caname string, status CertificateStatus, now time.Time) (r []*CertificateRecord, e error) {
+	switch status {
+	case CertificateValid:
+		return d.selectCertificates("caname = ? AND status = ? AND notafter >= ?", caname, int(CertificateValid), now.Unix())
+	case CertificateExpired:
+		return d.selectCertificates("caname = ? AND status = ? AND notafter < ?", caname, int(CertificateValid), now.Unix())
+	}
+	return d.selectCertificates("caname = ? AND status = ?", caname, int(status))
+}
+
+func (d *DB)SupersedeCertificate(caname string, serial *big.Int) (e error) {
+	result, err := d.db.Exec(d.rebind("UPDATE CERTIFICATE SET status = ? WHERE caname = ? AND serial = ? AND status = ?"),
+		int(CertificateSuperseded), caname, serial.Text(16), int(CertificateValid))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		exists, err := d.SerialNumberExists(caname, serial)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.New("certificate " + serial.Text(16) + " of " + caname + " is unknown")
+		}
+	}
+	return nil
+}
+
+// unixTime stores a zero time as 0
+func unixTime(t time.Time) (i int64) {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnixTime(i int64) (t time.Time) {
+	if i == 0 {
+		return time.Time{}
+	}
+	return time.Unix(i, 0).UTC()
+}
+
+func (d *DB)Revocation(caname string, serial *big.Int) (r *Revocation, e error) {
+	var profile string
+	var revocationTime, invalidityDate int64
+	var reason int
+	err := d.db.QueryRow(d.rebind("SELECT profile, revocationtime, reason, invaliditydate FROM REVOCATION WHERE caname = ? AND serial = ?"),
+		caname, serial.Text(16)).Scan(&profile, &revocationTime, &reason, &invalidityDate)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Revocation{
+		SerialNumber:   new(big.Int).Set(serial),
+		Profile:        profile,
+		RevocationTime: fromUnixTime(revocationTime),
+		Reason:         RevocationReason(reason),
+		InvalidityDate: fromUnixTime(invalidityDate),
+	}, nil
+}
+
+func (d *DB)AddRevocation(caname string, r *Revocation) (e error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = d.insertRevocation(tx, caname, r)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(d.rebind("UPDATE CERTIFICATE SET status = ? WHERE caname = ? AND serial = ?"), int(CertificateRevoked), caname, r.SerialNumber.Text(16))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *DB)insertRevocation(db executor, caname string, r *Revocation) (e error) {
+	_, err := db.Exec(d.rebind("INSERT INTO REVOCATION (caname, serial, profile, revocationtime, reason, invaliditydate) VALUES (?, ?, ?, ?, ?, ?)"),
+		caname, r.SerialNumber.Text(16), r.Profile, unixTime(r.RevocationTime), int(r.Reason), unixTime(r.InvalidityDate))
+	return err
+}
+
+func (d *DB)Revocations(caname string) (r []*Revocation, e error) {
+	rows, err := d.db.Query(d.rebind("SELECT serial, profile, revocationtime, reason, invaliditydate FROM REVOCATION WHERE caname = ? ORDER BY id"), caname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var serial, profile string
+		var revocationTime, invalidityDate int64
+		var reason int
+		err = rows.Scan(&serial, &profile, &revocationTime, &reason, &invalidityDate)
+		if err != nil {
+			return nil, err
+		}
+		serialNumber, ok := new(big.Int).SetString(serial, 16)
+		if !ok {
+			return nil, errors.New("invalid serial number in database: " + serial)
+		}
+		r = append(r, &Revocation{
+			SerialNumber:   serialNumber,
+			Profile:        profile,
+			RevocationTime: fromUnixTime(revocationTime),
+			Reason:         RevocationReason(reason),
+			InvalidityDate: fromUnixTime(invalidityDate),
+		})
+	}
+	return r, rows.Err()
+}
+
+func (d *DB)NextCRLNumber(caname string) (n *big.Int, e error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var number string
+	n = big.NewInt(0)
+	err = tx.QueryRow(d.rebind("SELECT number FROM CRLNUMBER WHERE caname = ?{forupdate}"), caname).Scan(&number)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(d.rebind("INSERT INTO CRLNUMBER (caname, number) VALUES (?, ?)"), caname, "1")
+	case err == nil:
+		_, ok := n.SetString(number, 16)
+		if !ok {
+			return nil, errors.New("invalid CRL number in database: " + number)
+		}
+		_, err = tx.Exec(d.rebind("UPDATE CRLNUMBER SET number = ? WHERE caname = ?"), new(big.Int).Add(n, big.NewInt(1)).Text(16), caname)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return n.Add(n, big.NewInt(1)), nil
+}
+
+func (d *DB)CRLNumber(caname string) (n *big.Int, e error) {
+	var number string
+	err := d.db.QueryRow(d.rebind("SELECT number FROM CRLNUMBER WHERE caname = ?"), caname).Scan(&number)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	n, ok := new(big.Int).SetString(number, 16)
+	if !ok {
+		return nil, errors.New("invalid CRL number in database: " + number)
+	}
+	return n, nil
+}
+
+func (d *DB)SetBaseCRL(caname string, partition string, number *big.Int, thisUpdate time.Time) (e error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(d.rebind("DELETE FROM BASECRL WHERE caname = ? AND crlpartition = ?"), caname, partition)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(d.rebind("INSERT INTO BASECRL (caname, crlpartition, number, thisupdate) VALUES (?, ?, ?, ?)"),
+		caname, partition, number.Text(16), unixTime(thisUpdate))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *DB)BaseCRL(caname string, partition string) (number *big.Int, thisUpdate time.Time, e error) {
+	var hexNumber string
+	var unix int64
+	err := d.db.QueryRow(d.rebind("SELECT number, thisupdate FROM BASECRL WHERE caname = ? AND crlpartition = ?"), caname, partition).Scan(&hexNumber, &unix)
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	number, ok := new(big.Int).SetString(hexNumber, 16)
+	if !ok {
+		return nil, time.Time{}, errors.New("invalid CRL number in database: " + hexNumber)
+	}
+	return number, fromUnixTime(unix), nil
+}
+
+func (d *DB)SetRollover(caname string, r *Rollover) (e error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = d.replaceRollover(tx, caname, r)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *DB)replaceRollover(tx executor, caname string, r *Rollover) (e error) {
+	_, err := tx.Exec(d.rebind("DELETE FROM ROLLOVER WHERE caname = ?"), caname)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(d.rebind("INSERT INTO ROLLOVER (caname, state, switchat, retireat, oldcertificate, newcertificate, oldwithnew, newwithold) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"),
+		caname, int(r.State), unixTime(r.SwitchAt), unixTime(r.RetireAt), r.OldCertificate.Raw, r.NewCertificate.Raw, r.OldWithNew.Raw, r.NewWithOld.Raw)
+	return err
+}
+
+func (d *DB)Rollover(caname string) (r *Rollover, e error) {
+	var state int
+	var switchAt, retireAt int64
+	var certs [4][]byte
+	err := d.db.QueryRow(d.rebind("SELECT state, switchat, retireat, oldcertificate, newcertificate, oldwithnew, newwithold FROM ROLLOVER WHERE caname = ?"),
+		caname).Scan(&state, &switchAt, &retireAt, &certs[0], &certs[1], &certs[2], &certs[3])
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed [4]*x509.Certificate
+	for i, cert := range certs {
+		parsed[i], err = x509.ParseCertificate(cert)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Rollover{
+		State:          RolloverState(state),
+		SwitchAt:       fromUnixTime(switchAt),
+		RetireAt:       fromUnixTime(retireAt),
+		OldCertificate: parsed[0],
+		NewCertificate: parsed[1],
+		OldWithNew:     parsed[2],
+		NewWithOld:     parsed[3],
+	}, nil
+}
+
+// ---------- CA configuration ----------
+
+// Keys of the CA configuration in CACONFIG
+const (
+	configCertificate        = "certificate"
+	configChain              = "chain"
+	configKey                = "key"
+	configSerialNumber       = "serialnumber"
+	configSignatureAlgorithm = "signaturealgorithm"
+	configSKIMethod          = "skimethod"
+	configURLs               = "urls"
+	configProfiles           = "profiles"
+	configBackdate           = "backdate"
+	configValidityRounding   = "validityrounding"
+	configCRLValidity        = "crlvalidity"
+	configDeltaCRLURL        = "deltacrlurl"
+	configCRLPartitions      = "crlpartitions"
+)
+
+var requiredConfig = []string{
+	configCertificate,
+	configChain,
+	configKey,
+	configSerialNumber,
+	configSignatureAlgorithm,
+	configSKIMethod,
+	configURLs,
+	configProfiles,
+	configBackdate,
+	configValidityRounding,
+	configCRLValidity,
+	configDeltaCRLURL,
+	configCRLPartitions,
+}
+
+// CAStore saves, loads and backs up CAs in a Store. It protects the configuration of a
+// CA with an integrity key and the private keys it stores with a KEK, both are kept
+// outside of the Store.
+type CAStore struct {
+	store Store
+	// integrityKey authenticates the configuration entries
+	integrityKey []byte
+	// kek wraps the data keys of the private keys, previousKEKs unwrap the data keys which
+	// are not rewrapped yet
+	kek          *KeyEncryptionKey
+	previousKEKs []*KeyEncryptionKey
+}
+
+// NewCAStore returns the CAStore of another Store implementation, DB and MemoryStore
+// already embed one
+func NewCAStore(store Store) (s *CAStore) {
+	return &CAStore{store: store}
+}
+
+// SetIntegrityKey sets the key of the HMAC-SHA256 protecting the CA configuration, it is
+// at least 32 bytes and kept outside of the store
+func (s *CAStore)SetIntegrityKey(key []byte) (e error) {
+	if len(key) < 32 {
+		return errors.New("integrity key must be at least 32 bytes")
+	}
+	s.integrityKey = append([]byte{}, key...)
+	return nil
+}
+
+// configIntegrity is the HMAC of the whole configuration of the CA, every entry carries
+// it. An entry can't be swapped, nor put back from another save of the CA, without
+// failing the check of all the entries. Putting back the complete configuration of an
+// older save goes unnoticed, LoadCA continues the serial numbers after the certificates
+// in the store.
+func (s *CAStore)configIntegrity(caname string, config map[string][]byte) (integrity string) {
+	mac := hmac.New(sha256.New, s.integrityKey)
+	fields := [][]byte{[]byte(caname)}
+	for _, key := range requiredConfig {
+		fields = append(fields, []byte(key), config[key])
+	}
+	for _, field := range fields {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+		mac.Write(length[:])
+		mac.Write(field)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// configEntries returns the entries of the configuration with their integrity
+func (s *CAStore)configEntries(caname string, config map[string][]byte) (entries []ConfigEntry) {
+	integrity := s.configIntegrity(caname, config)
+	for _, key := range requiredConfig {
+		entries = append(entries, ConfigEntry{Key: key, Value: config[key], Integrity: integrity})
+	}
+	return entries
+}
+
+// SaveCA stores the configuration of the CA, it replaces the previous one.
+// keyURI references the private key of the CA as accepted by OpenSigner, like an
+// encrypted key file, the key itself is not stored. The CA is saved with the key it
+// issues with, once a key rollover switched that is the new key.
+func (s *CAStore)SaveCA(ca *CA, keyURI string) (e error) {
+	if s.integrityKey == nil {
+		return errors.New("no integrity key to protect the CA configuration")
+	}
+	if keyURI == "" {
+		return errors.New("no reference to the key of CA " + ca.Name)
+	}
+
+	ca.mutex.Lock()
+	key := ca.currentKey()
+	cert, chain, algorithm, skiMethod, urls := key.certificate.Raw, key.chain, key.algorithm, ca.skiMethod, ca.urls
+	backdate, rounding := ca.backdate, ca.rounding
+	crlValidity, deltaCRLURL, crlPartitions := ca.crlValidity, ca.deltaCRLURL, ca.crlPartitions
+	serialState, err := serialNumberState(ca.serialNumbers)
+	ca.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	var profiles bytes.Buffer
+	err = StoreProfiles(&profiles, ca.Profiles())
+	if err != nil {
+		return err
+	}
+	urlsJSON, err := json.Marshal(urls)
+	if err != nil {
+		return err
+	}
+	partitionsJSON, err := json.Marshal(crlPartitions)
+	if err != nil {
+		return err
+	}
+
+	config := map[string][]byte{
+		configCertificate:        cert,
+		configChain:              bytes.Join(chain[1:], nil),
+		configKey:                []byte(keyURI),
+		configSerialNumber:       []byte(serialState),
+		configSignatureAlgorithm: []byte(strconv.Itoa(int(algorithm))),
+		configSKIMethod:          []byte(strconv.Itoa(int(skiMethod))),
+		configURLs:               urlsJSON,
+		configProfiles:           profiles.Bytes(),
+		configBackdate:           []byte(backdate.String()),
+		configValidityRounding:   []byte(rounding.String()),
+		configCRLValidity:        []byte(crlValidity.String()),
+		configDeltaCRLURL:        []byte(deltaCRLURL),
+		configCRLPartitions:      partitionsJSON,
+	}
+	return s.store.SetConfig(ca.Name, s.configEntries(ca.Name, config))
+}
+
+func (d *DB)SetConfig(caname string, config []ConfigEntry) (e error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = d.replaceConfig(tx, caname, config)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *DB)replaceConfig(tx executor, caname string, config []ConfigEntry) (e error) {
+	_, err := tx.Exec(d.rebind("DELETE FROM CACONFIG WHERE caname = ?"), caname)
+	if err != nil {
+		return err
+	}
+	for _, entry := range config {
+		_, err = tx.Exec(d.rebind("INSERT INTO CACONFIG (caname, {key}, value, integrity) VALUES (?, ?, ?, ?)"),
+			caname, entry.Key, entry.Value, entry.Integrity)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DB)Config(caname string) (config []ConfigEntry, e error) {
+	rows, err := d.db.Query(d.rebind("SELECT {key}, value, integrity FROM CACONFIG WHERE caname = ? ORDER BY id"), caname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry ConfigEntry
+		err = rows.Scan(&entry.Key, &entry.Value, &entry.Integrity)
+		if err != nil {
+			return nil, err
+		}
+		config = append(config, entry)
+	}
+	return config, rows.Err()
+}
+
+// loadConfig reads the CA configuration and verifies its integrity, it fails when an entry
+// is tampered with, missing or of another save
+func (s *CAStore)loadConfig(caname string) (config map[string][]byte, e error) {
+	if s.integrityKey == nil {
+		return nil, errors.New("no integrity key to verify the CA configuration")
+	}
+	entries, err := s.store.Config(caname)
+	if err != nil {
+		return nil, err
+	}
+
+	config = map[string][]byte{}
+	integrities := map[string]string{}
+	for _, entry := range entries {
+		if _, ok := config[entry.Key]; ok {
+			return nil, errors.New("duplicate configuration " + entry.Key + " of CA " + caname)
+		}
+		integrities[entry.Key] = entry.Integrity
+		config[entry.Key] = entry.Value
+	}
+
+	if len(config) == 0 {
+		return nil, errors.New("no configuration for CA " + caname)
+	}
+	for _, key := range requiredConfig {
+		if _, ok := config[key]; !ok {
+			return nil, errors.New("configuration " + key + " of CA " + caname + " is missing")
+		}
+	}
+	if len(config) != len(requiredConfig) {
+		return nil, errors.New("unknown configuration of CA " + caname)
+	}
+	integrity := s.configIntegrity(caname, config)
+	for key, entryIntegrity := range integrities {
+		if !hmac.Equal([]byte(entryIntegrity), []byte(integrity)) {
+			return nil, errors.New("integrity check of configuration " + key + " of CA " + caname + " failed")
+		}
+	}
+	return config, nil
+}
+
+// skipIssuedSerialNumbers continues a sequential generator after the serial numbers
+// issued since the CA was saved
+func (s *CAStore)skipIssuedSerialNumbers(caname string, g *SequentialSerialNumberGenerator) (e error) {
+	records, err := s.store.Certificates(caname)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.SerialNumber.Cmp(g.next) >= 0 {
+			g.next.Add(r.SerialNumber, big.NewInt(1))
+		}
+	}
+	return nil
+}
+
+// LoadCA loads the CA saved by SaveCA or SaveCAWithKey, the password unlocks a key file
+// and is not used for a key stored with StorePrivateKey. The loaded CA keeps track of its
+// certificates in this store, which must have the schema of this version of gopki.
+// It continues the key rollover recorded for the CA, it fails when the saved key no
+// longer issues according to the rollover.
+func (s *CAStore)LoadCA(caname string, password []byte) (c *CA, e error) {
+	err := s.store.CheckSchema()
+	if err != nil {
+		return nil, err
+	}
+	config, err := s.loadConfig(caname)
+	if err != nil {
+		return nil, err
+	}
+
+	certif, err := x509.ParseCertificate(config[configCertificate])
+	if err != nil {
+		return nil, err
+	}
+	chain := [][]byte{certif.Raw}
+	issuers, err := x509.ParseCertificates(config[configChain])
+	if err != nil {
+		return nil, err
+	}
+	for _, issuer := range issuers {
+		chain = append(chain, issuer.Raw)
+	}
+
+	var signer crypto.Signer
+	if keyID, ok := strings.CutPrefix(string(config[configKey]), keyURIDatabase); ok {
+		signer, err = s.PrivateKey(caname, keyID)
+	} else {
+		signer, err = OpenSigner(string(config[configKey]), password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = checkSignerMatches(signer, certif.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := strconv.Atoi(string(config[configSignatureAlgorithm]))
+	if err != nil {
+		return nil, err
+	}
+	signatureAlgorithm, err := selectSignatureAlgorithm(signer.Public(), x509.SignatureAlgorithm(algorithm))
+	if err != nil {
+		return nil, err
+	}
+	skiMethod, err := strconv.Atoi(string(config[configSKIMethod]))
+	if err != nil {
+		return nil, err
+	}
+	var urls CAURLs
+	err = json.Unmarshal(config[configURLs], &urls)
+	if err != nil {
+		return nil, err
+	}
+
+	backdate, err := time.ParseDuration(string(config[configBackdate]))
+	if err != nil {
+		return nil, err
+	}
+	rounding, err := time.ParseDuration(string(config[configValidityRounding]))
+	if err != nil {
+		return nil, err
+	}
+	crlValidity, err := time.ParseDuration(string(config[configCRLValidity]))
+	if err != nil {
+		return nil, err
+	}
+	var crlPartitions []*CRLPartition
+	err = json.Unmarshal(config[configCRLPartitions], &crlPartitions)
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumbers, err := parseSerialNumberState(string(config[configSerialNumber]))
+	if err != nil {
+		return nil, err
+	}
+	if sequential, ok := serialNumbers.(*SequentialSerialNumberGenerator); ok {
+		err = s.skipIssuedSerialNumbers(caname, sequential)
+		if err != nil {
+			return nil, err
+		}
+	}
+	profiles, err := LoadProfiles(bytes.NewReader(config[configProfiles]))
+	if err != nil {
+		return nil, err
+	}
+	profileMap := map[string]*Profile{}
+	for _, profile := range profiles {
+		profileMap[profile.Name] = profile
+	}
+
+	ca := &CA{
+		Name:               caname,
+		priv:               signer,
+		signatureAlgorithm: signatureAlgorithm,
+		Bytes:              certif.Raw,
+		Certificate:        certif,
+		Chain:              chain,
+		serialNumbers:      serialNumbers,
+		store:              s.store,
+		profiles:           profileMap,
+		urls:               urls,
+		skiMethod:          SKIMethod(skiMethod),
+		backdate:           backdate,
+		rounding:           rounding,
+		crlValidity:        crlValidity,
+		deltaCRLURL:        string(config[configDeltaCRLURL]),
+		crlPartitions:      crlPartitions,
+	}
+	rollover, err := s.store.Rollover(caname)
+	if err != nil {
+		return nil, err
+	}
+	if rollover != nil {
+		err = ca.restoreRollover(rollover)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ca, nil
+}
+
+// ---------- Private keys ----------
+
+// keyURIDatabase references a key stored with StorePrivateKey from the CA configuration
+const keyURIDatabase = "db:"
+
+// SetKeyEncryptionKey sets the KEK wrapping the data keys of the private keys, the
+// previous KEKs still unwrap the data keys until RewrapKeys rewrapped them with kek
+func (s *CAStore)SetKeyEncryptionKey(kek *KeyEncryptionKey, previous ...*KeyEncryptionKey) {
+	s.kek = kek
+	s.previousKEKs = previous
+}
+
+// keyEncryptionKey returns the KEK with the identifier
+func (s *CAStore)keyEncryptionKey(id string) (k *KeyEncryptionKey, e error) {
+	for _, kek := range append([]*KeyEncryptionKey{s.kek}, s.previousKEKs...) {
+		if kek != nil && kek.ID == id {
+			return kek, nil
+		}
+	}
+	return nil, errors.New("unknown key-encryption key " + id)
+}
+
+// StorePrivateKey encrypts the private key of the CA or of one of its certificates with
+// a new data key and stores it, it replaces the key stored before. The key is referenced
+// by its key identifier, the KeyID of its CertificateRecord.
+func (s *CAStore)StorePrivateKey(caname string, priv crypto.PrivateKey) (keyID string, e error) {
+	if s.kek == nil {
+		return "", errors.New("no key-encryption key to protect the private key")
+	}
+	signer, err := NewMemorySigner(priv)
+	if err != nil {
+		return "", err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return "", err
+	}
+	spec, err := PublicKeySpec(signer.Public())
+	if err != nil {
+		return "", err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	defer clear(pkcs8)
+
+	keyID = Fingerprint(spki)
+	wrappedKey, encryptedKey, err := s.kek.sealPrivateKey(caname, keyID, pkcs8)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.store.SetPrivateKey(caname, &StoredPrivateKey{
+		KeyID:      keyID,
+		KeyType:    spec.String(),
+		KEKID:      s.kek.ID,
+		DataKey:    wrappedKey,
+		PrivateKey: encryptedKey,
+	})
+	if err != nil {
+		return "", err
+	}
+	return keyID, nil
+}
+
+func (d *DB)SetPrivateKey(caname string, k *StoredPrivateKey) (e error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = d.replacePrivateKey(tx, caname, k)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *DB)replacePrivateKey(tx executor, caname string, k *StoredPrivateKey) (e error) {
+	_, err := tx.Exec(d.rebind("DELETE FROM PRIVATEKEY WHERE caname = ? AND keyid = ?"), caname, k.KeyID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(d.rebind("INSERT INTO PRIVATEKEY (caname, keyid, keytype, kekid, datakey, privatekey) VALUES (?, ?, ?, ?, ?, ?)"),
+		caname, k.KeyID, k.KeyType, k.KEKID, k.DataKey, k.PrivateKey)
+	return err
+}
+
+func (d *DB)StoredPrivateKey(caname string, keyID string) (k *StoredPrivateKey, e error) {
+	k = &StoredPrivateKey{KeyID: keyID}
+	err := d.db.QueryRow(d.rebind("SELECT keytype, kekid, datakey, privatekey FROM PRIVATEKEY WHERE caname = ? AND keyid = ?"), caname, keyID).
+		Scan(&k.KeyType, &k.KEKID, &k.DataKey, &k.PrivateKey)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// storedPrivateKey returns the encrypted private key, it fails when the key is unknown
+func (s *CAStore)storedPrivateKey(caname string, keyID string) (k *StoredPrivateKey, e error) {
+	k, err := s.store.StoredPrivateKey(caname, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		return nil, errors.New("no private key " + keyID + " for CA " + caname)
+	}
+	return k, nil
+}
+
+// PrivateKey decrypts the private key with the key identifier
+func (s *CAStore)PrivateKey(caname string, keyID string) (signer crypto.Signer, e error) {
+	stored, err := s.storedPrivateKey(caname, keyID)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := s.keyEncryptionKey(stored.KEKID)
+	if err != nil {
+		return nil, err
+	}
+	pkcs8, err := kek.openPrivateKey(caname, keyID, stored.DataKey, stored.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(pkcs8)
+
+	priv, err := x509.ParsePKCS8PrivateKey(pkcs8)
+	if err != nil {
+		return nil, err
+	}
+	return NewMemorySigner(priv)
+}
+
+// RewrapKeys rewraps the data keys wrapped by a previous KEK with the current KEK and
+// returns how many were rewrapped. The encrypted private keys are not touched.
+func (s *CAStore)RewrapKeys() (n int, e error) {
+	if s.kek == nil {
+		return 0, errors.New("no key-encryption key to rewrap the data keys")
+	}
+	return s.store.RewrapDataKeys(s.kek.ID, func(caname string, k *StoredPrivateKey) (dataKey []byte, e error) {
+		kek, err := s.keyEncryptionKey(k.KEKID)
+		if err != nil {
+			return nil, err
+		}
+		plain, err := kek.unwrap(caname, k.KeyID, k.DataKey)
+		if err != nil {
+			return nil, err
+		}
+		defer clear(plain)
+		return s.kek.wrap(caname, k.KeyID, plain)
+	})
+}
+
+func (d *DB)RewrapDataKeys(kekID string, rewrap func(caname string, k *StoredPrivateKey) (dataKey []byte, e error)) (n int, e error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	type dataKey struct {
+		caname string
+		key    StoredPrivateKey
+	}
+	rows, err := tx.Query(d.rebind("SELECT caname, keyid, kekid, datakey FROM PRIVATEKEY WHERE kekid <> ?{forupdate}"), kekID)
+	if err != nil {
+		return 0, err
+	}
+	var dataKeys []dataKey
+	for rows.Next() {
+		var k dataKey
+		err = rows.Scan(&k.caname, &k.key.KeyID, &k.key.KEKID, &k.key.DataKey)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		dataKeys = append(dataKeys, k)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, k := range dataKeys {
+		wrappedKey, err := rewrap(k.caname, &k.key)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(d.rebind("UPDATE PRIVATEKEY SET kekid = ?, datakey = ? WHERE caname = ? AND keyid = ?"),
+			kekID, wrappedKey, k.caname, k.key.KeyID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(dataKeys), tx.Commit()
+}
+
+// SaveCAWithKey stores the private key of the CA encrypted in the store and saves the
+// configuration of the CA referencing it, see SaveCA
+func (s *CAStore)SaveCAWithKey(ca *CA, priv crypto.PrivateKey) (e error) {
+	signer, err := NewMemorySigner(priv)
+	if err != nil {
+		return err
+	}
+	cert, _ := ca.Issuer()
+	err = checkSignerMatches(signer, cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	keyID, err := s.StorePrivateKey(ca.Name, priv)
+	if err != nil {
+		return err
+	}
+	return s.SaveCA(ca, keyURIDatabase+keyID)
+}
@@ -0,0 +1,314 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) (d *DB) {
+	db, err := NewDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal("NewDB failed: ", err)
+	}
+	// every connection to :memory: is a new database
+	db.db.SetMaxOpenConns(1)
+	err = db.CreateDB()
+	if err != nil {
+		t.Fatal("CreateDB failed: ", err)
+	}
+	return db
+}
+
+func TestDB_SerialNumberExists(t *testing.T) {
+	// Arrange
+	db := newTestDB(t)
+	defer db.CloseDB()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ca, _ := NewCA("CN=GoPKI,O=Cryptable,C=BE", 1, rsaKey.Public(), rsaKey)
+	ca.SetStore(db)
+	ca.SetSerialNumberGenerator(NewSequentialSerialNumberGenerator(big.NewInt(1)))
+	_, err := ca.CreateTLSClientCertificate("CN=Client", rsaKey.Public())
+	if err != nil {
+		t.Error("CreateTLSClientCertificate failed: ", err)
+		return
+	}
+
+	// Act
+	used, err := db.SerialNumberExists(ca.Name, big.NewInt(1))
+	unused, _ := db.SerialNumberExists(ca.Name, big.NewInt(2))
+
+	// Assert
+	if err != nil {
+		t.Error("SerialNumberExists failed: ", err)
+		return
+	}
+	if !used || unused {
+		t.Error("SerialNumberExists returned wrong result: ", used, unused)
+	}
+
+	// a restarted sequential counter skips the serial numbers in the database
+	ca.SetSerialNumberGenerator(NewSequentialSerialNumberGenerator(big.NewInt(1)))
+	_, err = ca.CreateTLSClientCertificate("CN=Client", rsaKey.Public())
+	if err != nil {
+		t.Error("CreateTLSClientCertificate after restart failed: ", err)
+	}
+}
+
+func TestDB_Revocations(t *testing.T) {
+	// Arrange
+	db := newTestDB(t)
+	defer db.CloseDB()
+	ca, serials := newRevocationTestCA(t)
+	for _, serial := range serials {
+		db.AddCertificate(ca.Name, newCertificateRecord(ProfileTLSClient, "", &x509.Certificate{SerialNumber: serial}))
+	}
+	ca.SetStore(db)
+	invalidityDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+
+	// Act
+	err := ca.Revoke(serials[1], ReasonCessationOfOperation, invalidityDate)
+	if err != nil {
+		t.Error("Revoke failed: ", err)
+		return
+	}
+	revocation, err := db.Revocation(ca.Name, serials[1])
+	notRevoked, _ := db.Revocation(ca.Name, serials[0])
+	first, _ := db.NextCRLNumber(ca.Name)
+	second, _ := db.NextCRLNumber(ca.Name)
+
+	// Assert
+	if err != nil || revocation == nil {
+		t.Error("Revocation not found: ", err)
+		return
+	}
+	if revocation.Reason != ReasonCessationOfOperation || !revocation.InvalidityDate.Equal(invalidityDate) {
+		t.Error("Revocation not stored correctly: ", revocation)
+	}
+	if notRevoked != nil {
+		t.Error("Certificate which is not revoked has a revocation")
+	}
+	if first.Cmp(big.NewInt(1)) != 0 || second.Cmp(big.NewInt(2)) != 0 {
+		t.Error("CRL numbers are wrong: ", first, second)
+	}
+	crl, err := ca.CreateCRL()
+	if err != nil {
+		t.Error("CreateCRL failed: ", err)
+		return
+	}
+	parsed, _ := x509.ParseRevocationList(crl)
+	if len(parsed.RevokedCertificateEntries) != 1 || parsed.Number.Cmp(big.NewInt(3)) != 0 {
+		t.Error("CRL from database is wrong")
+	}
+}
+
+var testIntegrityKey = bytes.Repeat([]byte{0x42}, 32)
+
+// newSavedTestCA saves a CA with sequential serial numbers and an encrypted key file in the store
+func newSavedTestCA(t *testing.T, db caStore) (ca *CA) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ = NewCAWithOptions("CN=GoPKI Saved,O=Cryptable,C=BE", 1, caKey.Public(), caKey, CAOptions{
+		MaxPathLen:       1,
+		URLs:             CAURLs{OCSPServer: []string{"http://ocsp.cryptable.org"}},
+		SKIMethod:        SKIMethodSHA256,
+		Backdate:         time.Minute,
+		ValidityRounding: time.Second,
+	})
+	ca.SetStore(db)
+	ca.SetSerialNumberGenerator(NewSequentialSerialNumberGenerator(big.NewInt(1)))
+	ca.AddProfile(&Profile{Name: "device", Validity: 24 * time.Hour, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	ca.SetCRLValidity(6 * time.Hour)
+	ca.SetDeltaCRLURL("http://crl.cryptable.org/delta.crl")
+	ca.SetCRLPartitions([]*CRLPartition{{Name: "devices", URL: "http://crl.cryptable.org/devices.crl", Profile: "device"}})
+	filename := filepath.Join(t.TempDir(), "ca-key.pem")
+	var keyPem bytes.Buffer
+	StorePrivateKeyPem(&keyPem, caKey, []byte("system"))
+	os.WriteFile(filename, keyPem.Bytes(), 0600)
+
+	db.SetIntegrityKey(testIntegrityKey)
+	err := db.SaveCA(ca, "file:"+filename)
+	if err != nil {
+		t.Fatal("SaveCA failed: ", err)
+	}
+	return ca
+}
+
+func TestDB_SaveCA(t *testing.T) {
+	// Arrange
+	db := newTestDB(t)
+	defer db.CloseDB()
+	ca := newSavedTestCA(t, db)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	// issued after the save, the loaded CA continues after it
+	first, _ := ca.CreateTLSClientCertificate("CN=first", key.Public())
+	firstCert, _ := x509.ParseCertificate(first)
+
+	// Act
+	loaded, err := db.LoadCA(ca.Name, []byte("system"))
+	if err != nil {
+		t.Error("LoadCA() failed: ", err)
+		return
+	}
+	second, err := loaded.Issue("device", &IssuanceRequest{Subject: pkix.Name{CommonName: "second"}, PublicKey: key.Public()})
+
+	// Assert
+	if err != nil {
+		t.Error("Issue() with a saved profile failed: ", err)
+		return
+	}
+	secondCert, _ := x509.ParseCertificate(second)
+	if !loaded.Certificate.Equal(ca.Certificate) || len(loaded.Chain) != 1 {
+		t.Error("wrong CA certificate")
+	}
+	if secondCert.SerialNumber.Cmp(new(big.Int).Add(firstCert.SerialNumber, big.NewInt(1))) != 0 {
+		t.Error("serial numbers do not continue: ", firstCert.SerialNumber, secondCert.SerialNumber)
+	}
+	if err := secondCert.CheckSignatureFrom(ca.Certificate); err != nil {
+		t.Error("certificate not signed by the CA key: ", err)
+	}
+	ski, _ := SubjectKeyIdentifier(key.Public(), SKIMethodSHA256)
+	if !bytes.Equal(secondCert.SubjectKeyId, ski) || len(secondCert.OCSPServer) != 1 {
+		t.Error("key identifier method or URLs not loaded")
+	}
+	if profile, _ := db.CertificateProfile(ca.Name, secondCert.SerialNumber); profile != "device" {
+		t.Error("loaded CA does not record in the database: ", profile)
+	}
+	if loaded.backdate != time.Minute || loaded.rounding != time.Second ||
+		secondCert.NotAfter.Sub(secondCert.NotBefore) != 24*time.Hour+time.Minute {
+		t.Error("backdate or validity rounding not loaded: ", loaded.backdate, loaded.rounding)
+	}
+	crlBytes, err := loaded.CreateCRL()
+	if err != nil {
+		t.Fatal("CreateCRL() failed: ", err)
+	}
+	crl, _ := x509.ParseRevocationList(crlBytes)
+	if _, freshest := crlExtension(crl, oidFreshestCRL); crl.NextUpdate.Sub(crl.ThisUpdate) != 6*time.Hour || freshest == nil {
+		t.Error("CRL validity or delta CRL URL not loaded")
+	}
+	if len(secondCert.CRLDistributionPoints) != 1 || secondCert.CRLDistributionPoints[0] != "http://crl.cryptable.org/devices.crl" {
+		t.Error("CRL partitions not loaded: ", secondCert.CRLDistributionPoints)
+	}
+}
+
+func TestDB_SaveCASubordinate(t *testing.T) {
+	// Arrange
+	db := newTestDB(t)
+	defer db.CloseDB()
+	root := newSavedTestCA(t, db)
+	issuingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	issuing, _, _ := root.NewSubordinateCA("CN=GoPKI Saved Issuing,O=Cryptable,C=BE", 1, issuingKey.Public(), issuingKey, CAOptions{})
+	filename := filepath.Join(t.TempDir(), "issuing-key.pem")
+	var keyPem bytes.Buffer
+	StorePrivateKeyPem(&keyPem, issuingKey, []byte("issuing"))
+	os.WriteFile(filename, keyPem.Bytes(), 0600)
+
+	// Act
+	err := db.SaveCA(issuing, "file:"+filename)
+	if err != nil {
+		t.Error("SaveCA() failed: ", err)
+		return
+	}
+	loaded, err := db.LoadCA(issuing.Name, []byte("issuing"))
+	_, errPassword := db.LoadCA(issuing.Name, []byte("system"))
+
+	// Assert
+	if err != nil {
+		t.Error("LoadCA() failed: ", err)
+		return
+	}
+	if len(loaded.Chain) != 2 || !bytes.Equal(loaded.Chain[1], root.Bytes) {
+		t.Error("chain not loaded")
+	}
+	if errPassword == nil {
+		t.Error("CA loaded with the wrong password")
+	}
+}
+
+func TestDB_LoadCATampered(t *testing.T) {
+	tamperings := []struct {
+		name      string
+		statement string
+	}{
+		{"value", "UPDATE CACONFIG SET value = 'sequential:ff' WHERE key = 'serialnumber'"},
+		{"key", "UPDATE CACONFIG SET key = 'chain' WHERE key = 'urls'"},
+		{"integrity", "UPDATE CACONFIG SET integrity = '" + strings.Repeat("0", 64) + "' WHERE key = 'profiles'"},
+		{"missing row", "DELETE FROM CACONFIG WHERE key = 'profiles'"},
+		{"other CA", "UPDATE CACONFIG SET caname = 'other'"},
+	}
+
+	for _, tampering := range tamperings {
+		// Arrange
+		db := newTestDB(t)
+		ca := newSavedTestCA(t, db)
+		db.db.Exec(tampering.statement)
+
+		// Act
+		loaded, err := db.LoadCA(ca.Name, []byte("system"))
+
+		// Assert
+		if err == nil || loaded != nil {
+			t.Error("tampered CA configuration loaded: ", tampering.name)
+		}
+		db.CloseDB()
+	}
+}
+
+func TestDB_LoadCAMixedSaves(t *testing.T) {
+	// Arrange
+	db := newTestDB(t)
+	defer db.CloseDB()
+	ca := newSavedTestCA(t, db)
+	var oldSerialNumber []byte
+	var oldIntegrity string
+	db.db.QueryRow(db.rebind("SELECT value, integrity FROM CACONFIG WHERE {key} = ?"), configSerialNumber).Scan(&oldSerialNumber, &oldIntegrity)
+	ca.SetSerialNumberGenerator(NewSequentialSerialNumberGenerator(big.NewInt(100)))
+	config, _ := db.loadConfig(ca.Name)
+	db.SaveCA(ca, string(config[configKey]))
+
+	// Act
+	_, errSaved := db.LoadCA(ca.Name, []byte("system"))
+	db.db.Exec(db.rebind("UPDATE CACONFIG SET value = ?, integrity = ? WHERE {key} = ?"), oldSerialNumber, oldIntegrity, configSerialNumber)
+	loaded, err := db.LoadCA(ca.Name, []byte("system"))
+
+	// Assert
+	if errSaved != nil {
+		t.Error("LoadCA() failed: ", errSaved)
+	}
+	if err == nil || loaded != nil {
+		t.Error("CA configuration loaded with the serial number of an older save")
+	}
+}
+
+func TestDB_LoadCAIntegrityKey(t *testing.T) {
+	// Arrange
+	db := newTestDB(t)
+	defer db.CloseDB()
+	ca := newSavedTestCA(t, db)
+
+	// Act
+	errShort := db.SetIntegrityKey([]byte("short"))
+	db.SetIntegrityKey(bytes.Repeat([]byte{0x24}, 32))
+	_, errWrongKey := db.LoadCA(ca.Name, []byte("system"))
+	errSave := newTestDB(t).SaveCA(ca, "file:/tmp/ca-key.pem")
+
+	// Assert
+	if errShort == nil {
+		t.Error("short integrity key accepted")
+	}
+	if errWrongKey == nil {
+		t.Error("CA configuration loaded with another integrity key")
+	}
+	if errSave == nil {
+		t.Error("CA configuration saved without integrity key")
+	}
+}
@@ -0,0 +1,87 @@
+package gopki
+
+import (
+	"strconv"
+	"strings"
+)
+
+// dialect adapts the SQL statements of DB to the database behind the driver
+type dialect struct {
+	name string
+	// id is the type of the auto-incremented primary keys
+	id   string
+	blob string
+	// quote encloses the column names which are reserved words, like key in MySQL
+	quote string
+	// numbered placeholders are $1, $2, ... instead of ?
+	numbered bool
+	// forUpdate locks the rows read in a transaction, SQLite locks the whole database
+	forUpdate string
+	// indexIfNotExists is supported by CREATE INDEX, otherwise the index is looked up
+	indexIfNotExists bool
+	// textPrefix is the length of a TEXT column in an index, MySQL only indexes a prefix
+	textPrefix string
+}
+
+var (
+	dialectSQLite = &dialect{
+		name:             "sqlite",
+		id:               "INTEGER PRIMARY KEY AUTOINCREMENT",
+		blob:             "BLOB",
+		quote:            `"`,
+		indexIfNotExists: true,
+	}
+	dialectPostgreSQL = &dialect{
+		name:             "postgresql",
+		id:               "BIGSERIAL PRIMARY KEY",
+		blob:             "BYTEA",
+		quote:            `"`,
+		numbered:         true,
+		forUpdate:        " FOR UPDATE",
+		indexIfNotExists: true,
+	}
+	dialectMySQL = &dialect{
+		name:      "mysql",
+		id:        "BIGINT PRIMARY KEY AUTO_INCREMENT",
+		blob:      "LONGBLOB",
+		quote:      "`",
+		forUpdate:  " FOR UPDATE",
+		textPrefix: "(255)",
+	}
+)
+
+// dialects maps the names of the database/sql drivers to their dialect, the drivers
+// themselves are imported by the application
+var dialects = map[string]*dialect{
+	"sqlite3":  dialectSQLite,
+	"postgres": dialectPostgreSQL,
+	"pgx":      dialectPostgreSQL,
+	"mysql":    dialectMySQL,
+}
+
+// rebind converts a statement written for SQLite, with ? placeholders and the {id},
+// {blob}, {key}, {forupdate} and {textprefix} markers, to the dialect
+func (d *dialect)rebind(statement string) (s string) {
+	statement = strings.NewReplacer(
+		"{id}", d.id,
+		"{blob}", d.blob,
+		"{key}", d.quote+"key"+d.quote,
+		"{forupdate}", d.forUpdate,
+		"{textprefix}", d.textPrefix,
+	).Replace(statement)
+	if !d.numbered {
+		return statement
+	}
+
+	var numbered strings.Builder
+	n := 0
+	for _, c := range statement {
+		if c == '?' {
+			n++
+			numbered.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		numbered.WriteRune(c)
+	}
+	return numbered.String()
+}
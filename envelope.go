@@ -0,0 +1,160 @@
+package gopki
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// Private keys at rest are envelope encrypted: every key is encrypted with its own random
+// data key, the data key is wrapped by the key-encryption key (KEK). The KEK stays
+// outside of the database; rotating it rewraps the data keys only.
+
+// KeyEncryptionKey is an AES-256 master key wrapping the data keys
+type KeyEncryptionKey struct {
+	// ID identifies the KEK which wrapped a data key, it doesn't reveal the KEK
+	ID  string
+	key []byte
+}
+
+// NewKeyEncryptionKey creates a KEK from 32 random bytes
+func NewKeyEncryptionKey(key []byte) (k *KeyEncryptionKey, e error) {
+	if len(key) != 32 {
+		return nil, errors.New("key-encryption key must be 32 bytes")
+	}
+	id := sha256.Sum256(append([]byte("gopki kek\x00"), key...))
+	return &KeyEncryptionKey{
+		ID:  hex.EncodeToString(id[:8]),
+		key: append([]byte{}, key...),
+	}, nil
+}
+
+// GenerateKeyEncryptionKey returns a new KEK encoded like LoadKeyEncryptionKey expects it
+func GenerateKeyEncryptionKey() (encoded string, e error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func decodeKeyEncryptionKey(encoded string) (k *KeyEncryptionKey, e error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errors.New("key-encryption key is not base64: " + err.Error())
+	}
+	return NewKeyEncryptionKey(key)
+}
+
+// LoadKeyEncryptionKey reads the base64 encoded KEK from a file
+func LoadKeyEncryptionKey(filename string) (k *KeyEncryptionKey, e error) {
+	encoded, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return decodeKeyEncryptionKey(string(encoded))
+}
+
+// KeyEncryptionKeyFromEnv reads the base64 encoded KEK from the environment variable
+func KeyEncryptionKeyFromEnv(variable string) (k *KeyEncryptionKey, e error) {
+	encoded, ok := os.LookupEnv(variable)
+	if !ok {
+		return nil, errors.New("no key-encryption key in " + variable)
+	}
+	return decodeKeyEncryptionKey(encoded)
+}
+
+// sealAESGCM encrypts with AES-GCM, the random nonce precedes the ciphertext
+func sealAESGCM(key []byte, plaintext []byte, additionalData []byte) (sealed []byte, e error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openAESGCM(key []byte, sealed []byte, additionalData []byte) (plaintext []byte, e error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("encrypted data too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData)
+}
+
+// envelopeAD binds the encrypted key and its data key to the CA and the key identifier,
+// so records can't be swapped
+func envelopeAD(purpose string, caname string, keyID string) (ad []byte) {
+	return []byte("gopki " + purpose + "\x00" + caname + "\x00" + keyID)
+}
+
+// sealPrivateKey encrypts the PKCS #8 encoded key with a new data key and returns the
+// data key wrapped by the KEK
+func (k *KeyEncryptionKey)sealPrivateKey(caname string, keyID string, pkcs8 []byte) (wrappedKey []byte, encryptedKey []byte, e error) {
+	dataKey := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer clear(dataKey)
+
+	encryptedKey, err = sealAESGCM(dataKey, pkcs8, envelopeAD("private key", caname, keyID))
+	if err != nil {
+		return nil, nil, err
+	}
+	wrappedKey, err = k.wrap(caname, keyID, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return wrappedKey, encryptedKey, nil
+}
+
+func (k *KeyEncryptionKey)wrap(caname string, keyID string, dataKey []byte) (wrappedKey []byte, e error) {
+	return sealAESGCM(k.key, dataKey, envelopeAD("data key", caname, keyID))
+}
+
+func (k *KeyEncryptionKey)unwrap(caname string, keyID string, wrappedKey []byte) (dataKey []byte, e error) {
+	dataKey, err := openAESGCM(k.key, wrappedKey, envelopeAD("data key", caname, keyID))
+	if err != nil {
+		return nil, errors.New("cannot unwrap the data key of " + keyID + ": " + err.Error())
+	}
+	return dataKey, nil
+}
+
+// openPrivateKey unwraps the data key and decrypts the PKCS #8 encoded key
+func (k *KeyEncryptionKey)openPrivateKey(caname string, keyID string, wrappedKey []byte, encryptedKey []byte) (pkcs8 []byte, e error) {
+	dataKey, err := k.unwrap(caname, keyID, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(dataKey)
+
+	pkcs8, err = openAESGCM(dataKey, encryptedKey, envelopeAD("private key", caname, keyID))
+	if err != nil {
+		return nil, errors.New("cannot decrypt private key " + keyID + ": " + err.Error())
+	}
+	return pkcs8, nil
+}
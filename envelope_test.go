@@ -0,0 +1,213 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestKEK(t *testing.T) (k *KeyEncryptionKey) {
+	encoded, err := GenerateKeyEncryptionKey()
+	if err != nil {
+		t.Fatal("GenerateKeyEncryptionKey failed: ", err)
+	}
+	key, _ := base64.StdEncoding.DecodeString(encoded)
+	kek, err := NewKeyEncryptionKey(key)
+	if err != nil {
+		t.Fatal("NewKeyEncryptionKey failed: ", err)
+	}
+	return kek
+}
+
+// secrets returns the encodings of the private key which may not appear in the database
+func secrets(t *testing.T, priv interface{}) (s [][]byte) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal("MarshalPKCS8PrivateKey failed: ", err)
+	}
+	s = append(s, pkcs8)
+	switch key := priv.(type) {
+	case *ecdsa.PrivateKey:
+		s = append(s, key.D.FillBytes(make([]byte, 32)))
+	case ed25519.PrivateKey:
+		s = append(s, key.Seed())
+	}
+	return s
+}
+
+// ---------- Testing Module ----------
+
+func TestKeyEncryptionKey_Load(t *testing.T) {
+	// Arrange
+	encoded, _ := GenerateKeyEncryptionKey()
+	filename := filepath.Join(t.TempDir(), "kek")
+	os.WriteFile(filename, []byte(encoded+"\n"), 0600)
+	t.Setenv("GOPKI_TEST_KEK", encoded)
+
+	// Act
+	fromFile, err := LoadKeyEncryptionKey(filename)
+	fromEnv, errEnv := KeyEncryptionKeyFromEnv("GOPKI_TEST_KEK")
+	_, errShort := NewKeyEncryptionKey(make([]byte, 16))
+	_, errMissing := KeyEncryptionKeyFromEnv("GOPKI_TEST_NO_KEK")
+
+	// Assert
+	if err != nil || errEnv != nil {
+		t.Error("loading the KEK failed: ", err, errEnv)
+		return
+	}
+	if fromFile.ID != fromEnv.ID || len(fromFile.ID) != 16 {
+		t.Error("wrong KEK identifiers: ", fromFile.ID, fromEnv.ID)
+	}
+	if errShort == nil {
+		t.Error("short KEK accepted")
+	}
+	if errMissing == nil {
+		t.Error("missing KEK accepted")
+	}
+}
+
+func TestDB_StorePrivateKey(t *testing.T) {
+	// Arrange
+	db := newTestDB(t)
+	defer db.CloseDB()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, errNoKEK := db.StorePrivateKey("GoPKI", key)
+	db.SetKeyEncryptionKey(newTestKEK(t))
+
+	// Act
+	keyID, err := db.StorePrivateKey("GoPKI", key)
+	signer, errLoad := db.PrivateKey("GoPKI", keyID)
+	_, errOtherCA := db.PrivateKey("Other", keyID)
+	db.db.Exec("UPDATE PRIVATEKEY SET caname = 'Other'")
+	_, errSwapped := db.PrivateKey("Other", keyID)
+	db.SetKeyEncryptionKey(newTestKEK(t))
+	db.db.Exec("UPDATE PRIVATEKEY SET caname = 'GoPKI'")
+	_, errWrongKEK := db.PrivateKey("GoPKI", keyID)
+
+	// Assert
+	if errNoKEK == nil {
+		t.Error("private key stored without KEK")
+	}
+	if err != nil || errLoad != nil || !key.PublicKey.Equal(signer.Public()) {
+		t.Error("private key not restored: ", err, errLoad)
+	}
+	if errOtherCA == nil {
+		t.Error("private key found for another CA")
+	}
+	if errSwapped == nil {
+		t.Error("private key moved to another CA decrypted")
+	}
+	if errWrongKEK == nil {
+		t.Error("private key decrypted without its KEK")
+	}
+}
+
+func TestDB_PrivateKeysNotPlaintext(t *testing.T) {
+	// Arrange
+	filename := filepath.Join(t.TempDir(), "gopki.db")
+	db, _ := NewDB("sqlite3", filename)
+	db.CreateDB()
+	db.SetIntegrityKey(testIntegrityKey)
+	kek := newTestKEK(t)
+	db.SetKeyEncryptionKey(kek)
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI Envelope,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	ca.SetStore(db)
+	generator := NewKeyGenerator(ca, nil)
+	generator.SetKeyStore(db)
+
+	// Act
+	err := db.SaveCAWithKey(ca, caKey)
+	var bundles []*KeyBundle
+	for _, spec := range []KeySpec{KeySpecP256, KeySpecEd25519} {
+		bundle, err := generator.Generate(ProfileTLSServer, &IssuanceRequest{Subject: pkix.Name{CommonName: "workload"}}, spec, []byte("system"))
+		if err != nil {
+			t.Fatal("Generate failed: ", err)
+		}
+		bundles = append(bundles, bundle)
+	}
+	var workloadKeys []interface{}
+	for _, bundle := range bundles {
+		signer, err := db.PrivateKey(ca.Name, bundle.KeyID)
+		if err != nil {
+			t.Fatal("PrivateKey failed: ", err)
+		}
+		workloadKeys = append(workloadKeys, signer)
+	}
+	db.CloseDB()
+	content, _ := os.ReadFile(filename)
+	reopened, _ := NewDB("sqlite3", filename)
+	defer reopened.CloseDB()
+	reopened.SetIntegrityKey(testIntegrityKey)
+	reopened.SetKeyEncryptionKey(kek)
+	loaded, errLoad := reopened.LoadCA(ca.Name, nil)
+
+	// Assert
+	if err != nil {
+		t.Error("SaveCAWithKey() failed: ", err)
+	}
+	if !bytes.Contains(content, ca.Bytes) {
+		t.Error("database file not written")
+	}
+	for i, priv := range append([]interface{}{caKey}, workloadKeys...) {
+		for _, secret := range secrets(t, priv) {
+			if bytes.Contains(content, secret) {
+				t.Error("private key ", i, " in plaintext in the database")
+			}
+		}
+	}
+	if bytes.Contains(content, []byte("PRIVATE KEY")) {
+		t.Error("PEM encoded private key in the database")
+	}
+	if errLoad != nil || !loaded.Certificate.Equal(ca.Certificate) {
+		t.Error("LoadCA() with stored key failed: ", errLoad)
+	}
+}
+
+func TestDB_RewrapKeys(t *testing.T) {
+	// Arrange
+	db := newTestDB(t)
+	defer db.CloseDB()
+	oldKEK, newKEK := newTestKEK(t), newTestKEK(t)
+	db.SetKeyEncryptionKey(oldKEK)
+	var keyIDs []string
+	for i := 0; i < 2; i++ {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		keyID, _ := db.StorePrivateKey("GoPKI", key)
+		keyIDs = append(keyIDs, keyID)
+	}
+	var before []byte
+	db.db.QueryRow("SELECT privatekey FROM PRIVATEKEY WHERE keyid = ?", keyIDs[0]).Scan(&before)
+
+	// Act
+	db.SetKeyEncryptionKey(newKEK, oldKEK)
+	n, err := db.RewrapKeys()
+	again, _ := db.RewrapKeys()
+	db.SetKeyEncryptionKey(newKEK)
+	_, errLoad := db.PrivateKey("GoPKI", keyIDs[1])
+	var after []byte
+	var kekID string
+	db.db.QueryRow("SELECT kekid, privatekey FROM PRIVATEKEY WHERE keyid = ?", keyIDs[0]).Scan(&kekID, &after)
+
+	// Assert
+	if err != nil || n != 2 || again != 0 {
+		t.Error("RewrapKeys() failed: ", n, again, err)
+	}
+	if errLoad != nil {
+		t.Error("rewrapped key not decrypted with the new KEK: ", errLoad)
+	}
+	if kekID != newKEK.ID {
+		t.Error("data key not wrapped by the new KEK: ", kekID)
+	}
+	if len(before) == 0 || !bytes.Equal(before, after) {
+		t.Error("encrypted private key changed by the rewrap")
+	}
+}
@@ -0,0 +1,108 @@
+package gopki
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// CertificateStatus is the status of an issued certificate in the Store
+type CertificateStatus int
+
+const (
+	CertificateValid CertificateStatus = iota
+	CertificateRevoked
+	// CertificateExpired is not stored, it is a valid certificate after its NotAfter
+	CertificateExpired
+	// CertificateSuperseded is a certificate replaced by its renewal, it stays usable
+	// until its NotAfter
+	CertificateSuperseded
+)
+
+func (s CertificateStatus)String() string {
+	switch s {
+	case CertificateValid:
+		return "valid"
+	case CertificateRevoked:
+		return "revoked"
+	case CertificateExpired:
+		return "expired"
+	case CertificateSuperseded:
+		return "superseded"
+	}
+	return "CertificateStatus(" + strconv.Itoa(int(s)) + ")"
+}
+
+// CertificateRecord is a certificate issued by a CA as it is kept in the Store
+type CertificateRecord struct {
+	SerialNumber *big.Int
+	// Subject is the subject of the certificate as returned by pkix.Name.String
+	Subject string
+	// SubjectAltNames are the names in the form accepted by AddSubjectAltNames
+	SubjectAltNames []string
+	// Profile is the name of the profile the certificate was issued with
+	Profile   string
+	NotBefore time.Time
+	NotAfter  time.Time
+	// Status is CertificateValid, CertificateRevoked or CertificateSuperseded, expiration
+	// is not stored
+	Status CertificateStatus
+	// Fingerprint is the hex encoded SHA-256 of the certificate
+	Fingerprint string
+	// Requester identifies who requested the certificate, it may be empty
+	Requester string
+	// KeyID is the hex encoded SHA-256 of the SubjectPublicKeyInfo, it links the
+	// certificates of the same key
+	KeyID string
+	// KeyType is the KeySpec of the key, like P-256 or RSA-3072
+	KeyType     string
+	Certificate *x509.Certificate
+}
+
+// Fingerprint returns the hex encoded SHA-256 of the DER encoded certificate
+func Fingerprint(cert []byte) (f string) {
+	sum := sha256.Sum256(cert)
+	return hex.EncodeToString(sum[:])
+}
+
+// newCertificateRecord describes a certificate which has just been issued
+func newCertificateRecord(profile string, requester string, cert *x509.Certificate) (r *CertificateRecord) {
+	r = &CertificateRecord{
+		SerialNumber: cert.SerialNumber,
+		Subject:      cert.Subject.String(),
+		Profile:      profile,
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		Status:       CertificateValid,
+		Fingerprint:  Fingerprint(cert.Raw),
+		Requester:    requester,
+		Certificate:  cert,
+	}
+	r.SubjectAltNames = append(r.SubjectAltNames, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		r.SubjectAltNames = append(r.SubjectAltNames, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		r.SubjectAltNames = append(r.SubjectAltNames, uri.String())
+	}
+	r.SubjectAltNames = append(r.SubjectAltNames, cert.EmailAddresses...)
+	if len(cert.RawSubjectPublicKeyInfo) > 0 {
+		r.KeyID = Fingerprint(cert.RawSubjectPublicKeyInfo)
+	}
+	if spec, err := PublicKeySpec(cert.PublicKey); err == nil {
+		r.KeyType = spec.String()
+	}
+	return r
+}
+
+// StatusAt returns the status of the certificate at the time, a valid certificate
+// expires after its NotAfter
+func (r *CertificateRecord)StatusAt(now time.Time) (s CertificateStatus) {
+	if r.Status == CertificateValid && now.After(r.NotAfter) {
+		return CertificateExpired
+	}
+	return r.Status
+}
@@ -0,0 +1,87 @@
+package gopki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+)
+
+// issueInventoryTestCertificates issues two certificates for www and one for api, and
+// revokes the api certificate
+func issueInventoryTestCertificates(t *testing.T, store Store) (ca *CA, issued []*x509.Certificate) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ = NewCA("CN=GoPKI,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	err := ca.SetStore(store)
+	if err != nil {
+		t.Fatal("SetStore failed: ", err)
+	}
+	for _, name := range []string{"www", "www", "api"} {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		request := &IssuanceRequest{
+			Subject:   pkix.Name{CommonName: name, Organization: []string{"Cryptable"}},
+			PublicKey: key.Public(),
+			Requester: "operator-" + name,
+		}
+		request.AddSubjectAltNames(name+".cryptable.org", "10.0.0.1")
+		certBytes, err := ca.Issue(ProfileTLSServer, request)
+		if err != nil {
+			t.Fatal("Issue failed: ", err)
+		}
+		cert, _ := x509.ParseCertificate(certBytes)
+		issued = append(issued, cert)
+	}
+	err = ca.Revoke(issued[2].SerialNumber, ReasonKeyCompromise, time.Time{})
+	if err != nil {
+		t.Fatal("Revoke failed: ", err)
+	}
+	return ca, issued
+}
+
+func testInventory(t *testing.T, store Store) {
+	// Arrange
+	ca, issued := issueInventoryTestCertificates(t, store)
+
+	// Act
+	record, err := store.Certificate(ca.Name, issued[0].SerialNumber)
+	bySubject, _ := store.CertificatesBySubject(ca.Name, issued[0].Subject.String())
+	byFingerprint, _ := store.CertificateByFingerprint(Fingerprint(issued[2].Raw))
+	valid, _ := store.CertificatesByStatus(ca.Name, CertificateValid, time.Now())
+	revoked, _ := store.CertificatesByStatus(ca.Name, CertificateRevoked, time.Now())
+	expired, _ := store.CertificatesByStatus(ca.Name, CertificateExpired, time.Now().AddDate(2, 0, 0))
+	caCert, _ := store.CACertificate(ca.Name)
+
+	// Assert
+	if err != nil || record == nil {
+		t.Error("Certificate() failed: ", err)
+		return
+	}
+	if record.Subject != "CN=www,O=Cryptable" || record.Profile != ProfileTLSServer || record.Requester != "operator-www" ||
+		record.Status != CertificateValid || !record.Certificate.Equal(issued[0]) {
+		t.Error("wrong certificate record: ", record)
+	}
+	if len(record.SubjectAltNames) != 2 || record.SubjectAltNames[0] != "www.cryptable.org" || record.SubjectAltNames[1] != "10.0.0.1" {
+		t.Error("wrong subject alternative names: ", record.SubjectAltNames)
+	}
+	if !record.NotAfter.Equal(issued[0].NotAfter) || record.KeyType != "P-256" || record.KeyID != Fingerprint(issued[0].RawSubjectPublicKeyInfo) {
+		t.Error("wrong validity or key metadata: ", record.NotAfter, record.KeyType)
+	}
+	if len(bySubject) != 2 || bySubject[1].SerialNumber.Cmp(issued[1].SerialNumber) != 0 {
+		t.Error("wrong certificates by subject: ", len(bySubject))
+	}
+	if byFingerprint == nil || byFingerprint.SerialNumber.Cmp(issued[2].SerialNumber) != 0 || byFingerprint.Status != CertificateRevoked {
+		t.Error("wrong certificate by fingerprint: ", byFingerprint)
+	}
+	if len(valid) != 2 || len(revoked) != 1 || len(expired) != 2 {
+		t.Error("wrong certificates by status: ", len(valid), len(revoked), len(expired))
+	}
+	if caCert == nil || !caCert.Equal(ca.Certificate) {
+		t.Error("CA not recorded")
+	}
+	if unknown, err := store.CertificateByFingerprint("00"); unknown != nil || err != nil {
+		t.Error("unknown fingerprint found: ", err)
+	}
+}
@@ -0,0 +1,384 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KeySpec describes a key pair to generate
+type KeySpec struct {
+	Algorithm x509.PublicKeyAlgorithm
+	// Bits is the size of RSA keys
+	Bits int
+	// Curve is the curve of ECDSA keys
+	Curve elliptic.Curve
+}
+
+// Key pairs generated by the CA
+var (
+	KeySpecRSA2048 = KeySpec{Algorithm: x509.RSA, Bits: 2048}
+	KeySpecRSA3072 = KeySpec{Algorithm: x509.RSA, Bits: 3072}
+	KeySpecRSA4096 = KeySpec{Algorithm: x509.RSA, Bits: 4096}
+	KeySpecP256    = KeySpec{Algorithm: x509.ECDSA, Curve: elliptic.P256()}
+	KeySpecP384    = KeySpec{Algorithm: x509.ECDSA, Curve: elliptic.P384()}
+	KeySpecEd25519 = KeySpec{Algorithm: x509.Ed25519}
+)
+
+// ParseKeySpec parses the names returned by KeySpec.String, like RSA-3072, P-256 or Ed25519
+func ParseKeySpec(name string) (s KeySpec, e error) {
+	switch name {
+	case "P-256":
+		return KeySpecP256, nil
+	case "P-384":
+		return KeySpecP384, nil
+	case "P-521":
+		return KeySpec{Algorithm: x509.ECDSA, Curve: elliptic.P521()}, nil
+	case "Ed25519":
+		return KeySpecEd25519, nil
+	}
+	if strings.HasPrefix(name, "RSA-") {
+		bits, err := strconv.Atoi(strings.TrimPrefix(name, "RSA-"))
+		if err == nil && bits > 0 {
+			return KeySpec{Algorithm: x509.RSA, Bits: bits}, nil
+		}
+	}
+	return s, errors.New("unknown key type: " + name)
+}
+
+func (s KeySpec)String() string {
+	switch s.Algorithm {
+	case x509.RSA:
+		return "RSA-" + strconv.Itoa(s.Bits)
+	case x509.ECDSA:
+		if s.Curve == nil {
+			return "ECDSA"
+		}
+		return s.Curve.Params().Name
+	}
+	return s.Algorithm.String()
+}
+
+func (s KeySpec)check() (e error) {
+	switch s.Algorithm {
+	case x509.RSA:
+		if s.Bits <= 0 {
+			return errors.New("no size for RSA key")
+		}
+	case x509.ECDSA:
+		if s.Curve == nil {
+			return errors.New("no curve for ECDSA key")
+		}
+	case x509.Ed25519:
+	default:
+		return errors.New("unsupported key algorithm: " + s.Algorithm.String())
+	}
+	return nil
+}
+
+// GenerateKey generates a key pair according to the spec
+func GenerateKey(spec KeySpec) (k crypto.Signer, e error) {
+	err := spec.check()
+	if err != nil {
+		return nil, err
+	}
+
+	switch spec.Algorithm {
+	case x509.RSA:
+		return rsa.GenerateKey(rand.Reader, spec.Bits)
+	case x509.ECDSA:
+		return ecdsa.GenerateKey(spec.Curve, rand.Reader)
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+// PublicKeySpec returns the KeySpec of the public key
+func PublicKeySpec(pub crypto.PublicKey) (s KeySpec, e error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return KeySpec{Algorithm: x509.RSA, Bits: key.N.BitLen()}, nil
+	case *ecdsa.PublicKey:
+		return KeySpec{Algorithm: x509.ECDSA, Curve: key.Curve}, nil
+	case ed25519.PublicKey:
+		return KeySpecEd25519, nil
+	}
+	return s, errors.New("unsupported public key")
+}
+
+// ---------- Key policy ----------
+
+// KeyPolicy restricts the key pairs the CA generates
+type KeyPolicy struct {
+	// Algorithms lists the allowed key algorithms, empty allows all of them
+	Algorithms []x509.PublicKeyAlgorithm
+	// MinRSABits is the minimum size of RSA keys
+	MinRSABits int
+	// Curves lists the allowed ECDSA curves, empty allows all of them
+	Curves []elliptic.Curve
+}
+
+// DefaultKeyPolicy allows RSA keys of at least 2048 bits, ECDSA keys on P-256 and P-384
+// and Ed25519 keys
+func DefaultKeyPolicy() (p *KeyPolicy) {
+	return &KeyPolicy{
+		Algorithms: []x509.PublicKeyAlgorithm{x509.RSA, x509.ECDSA, x509.Ed25519},
+		MinRSABits: 2048,
+		Curves:     []elliptic.Curve{elliptic.P256(), elliptic.P384()},
+	}
+}
+
+func (p *KeyPolicy)check(spec KeySpec) (e error) {
+	allowed := len(p.Algorithms) == 0
+	for _, algorithm := range p.Algorithms {
+		allowed = allowed || algorithm == spec.Algorithm
+	}
+	if !allowed {
+		return errors.New("key algorithm not allowed by the key policy: " + spec.Algorithm.String())
+	}
+
+	switch spec.Algorithm {
+	case x509.RSA:
+		if spec.Bits < p.MinRSABits {
+			return errors.New("RSA key size below the minimum of the key policy: " + strconv.Itoa(spec.Bits))
+		}
+	case x509.ECDSA:
+		allowed = len(p.Curves) == 0
+		for _, curve := range p.Curves {
+			allowed = allowed || curve == spec.Curve
+		}
+		if !allowed {
+			return errors.New("curve not allowed by the key policy: " + spec.String())
+		}
+	}
+	return nil
+}
+
+// ---------- Pre-generation pool ----------
+
+// KeyPool generates key pairs of one spec in the background, so slow RSA key generation
+// is not on the path of the requests
+type KeyPool struct {
+	spec KeySpec
+	keys chan crypto.Signer
+	stop chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+// NewKeyPool starts filling a pool with up to size pre-generated key pairs
+func NewKeyPool(spec KeySpec, size int) (p *KeyPool, e error) {
+	if size <= 0 {
+		return nil, errors.New("key pool without size")
+	}
+	err := spec.check()
+	if err != nil {
+		return nil, err
+	}
+
+	p = &KeyPool{
+		spec: spec,
+		keys: make(chan crypto.Signer, size),
+		stop: make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.fill()
+	return p, nil
+}
+
+func (p *KeyPool)fill() {
+	defer p.wg.Done()
+
+	for {
+		key, err := GenerateKey(p.spec)
+		if err != nil {
+			return
+		}
+		select {
+		case p.keys <- key:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Spec returns the spec of the keys in the pool
+func (p *KeyPool)Spec() (s KeySpec) {
+	return p.spec
+}
+
+// Available returns the number of pre-generated keys in the pool
+func (p *KeyPool)Available() (n int) {
+	return len(p.keys)
+}
+
+// Get takes a pre-generated key from the pool, or generates one when the pool is empty
+func (p *KeyPool)Get() (k crypto.Signer, e error) {
+	select {
+	case key := <-p.keys:
+		return key, nil
+	default:
+		return GenerateKey(p.spec)
+	}
+}
+
+// Close stops the background generation of keys
+func (p *KeyPool)Close() {
+	p.once.Do(func() { close(p.stop) })
+	p.wg.Wait()
+}
+
+// ---------- Key generation service ----------
+
+// KeyBundle is the result of a server-side key generation. The private key is PEM encoded
+// and encrypted with the password of the request, see StorePrivateKeyPem.
+type KeyBundle struct {
+	Certificate []byte
+	// Chain contains the certificates of the CA up to the root
+	Chain [][]byte
+	// EncryptedKey is the private key as a PEM encrypted PKCS#8 key, see StorePrivateKeyPem
+	EncryptedKey []byte
+	// KeyID references the key in the KeyStore of the generator, empty without one
+	KeyID string
+}
+
+// KeyStore keeps private keys encrypted at rest, like DB with a key-encryption key
+type KeyStore interface {
+	StorePrivateKey(caname string, priv crypto.PrivateKey) (keyID string, e error)
+	PrivateKey(caname string, keyID string) (s crypto.Signer, e error)
+}
+
+// KeyGenerator generates key pairs for the callers of the CA and issues their certificates
+// in the same operation
+type KeyGenerator struct {
+	ca     *CA
+	policy *KeyPolicy
+	mutex  sync.Mutex
+	pools  map[string]*KeyPool
+	keys   KeyStore
+}
+
+// NewKeyGenerator creates a key generator for the CA, a nil policy is the DefaultKeyPolicy
+func NewKeyGenerator(ca *CA, policy *KeyPolicy) (g *KeyGenerator) {
+	if policy == nil {
+		policy = DefaultKeyPolicy()
+	}
+	return &KeyGenerator{
+		ca:     ca,
+		policy: policy,
+		pools:  map[string]*KeyPool{},
+	}
+}
+
+// AddPool lets the generator take keys of the spec of the pool from the pool
+func (g *KeyGenerator)AddPool(p *KeyPool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.pools[p.Spec().String()] = p
+}
+
+// SetKeyStore lets the generator keep every generated key in the key store, so it can be
+// pushed again to the workload
+func (g *KeyGenerator)SetKeyStore(ks KeyStore) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.keys = ks
+}
+
+func (g *KeyGenerator)generateKey(spec KeySpec) (k crypto.Signer, e error) {
+	g.mutex.Lock()
+	pool := g.pools[spec.String()]
+	g.mutex.Unlock()
+
+	if pool != nil {
+		return pool.Get()
+	}
+	return GenerateKey(spec)
+}
+
+// Generate generates a key pair allowed by the policy, issues a certificate for it with the
+// profile and returns the key encrypted with the password. The public key of the request
+// is ignored. Every bundle is encrypted with its own salt, so bundles with the same password
+// can't be told apart.
+func (g *KeyGenerator)Generate(profileName string, request *IssuanceRequest, spec KeySpec, password []byte) (b *KeyBundle, e error) {
+	if len(password) == 0 {
+		return nil, errors.New("no password to encrypt the generated key")
+	}
+	err := spec.check()
+	if err != nil {
+		return nil, err
+	}
+	err = g.policy.check(spec)
+	if err != nil {
+		return nil, err
+	}
+	profile := g.ca.Profile(profileName)
+	if profile == nil {
+		return nil, errors.New("unknown profile: " + profileName)
+	}
+
+	key, err := g.generateKey(spec)
+	if err != nil {
+		return nil, err
+	}
+	err = profile.checkKeyAlgorithm(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	passwordKey, err := derivePBES2Key(password)
+	if err != nil {
+		return nil, err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var encryptedKey bytes.Buffer
+	err = storeEncryptedPrivateKeyPem(&encryptedKey, pkcs8, passwordKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key is kept before its certificate is issued, so no certificate is left
+	// without its key
+	g.mutex.Lock()
+	keys := g.keys
+	g.mutex.Unlock()
+	var keyID string
+	if keys != nil {
+		keyID, err = keys.StorePrivateKey(g.ca.Name, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	withKey := *request
+	withKey.PublicKey = key.Public()
+	cert, err := g.ca.Issue(profileName, &withKey)
+	if err != nil {
+		return nil, err
+	}
+	_, chain := g.ca.Issuer()
+
+	return &KeyBundle{
+		Certificate:  cert,
+		Chain:        chain,
+		EncryptedKey: encryptedKey.Bytes(),
+		KeyID:        keyID,
+	}, nil
+}
@@ -0,0 +1,239 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newKeyGenTestCA(t *testing.T) (ca *CA) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, err := NewCA("CN=GoPKI KeyGen,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal("NewCA failed: ", err)
+	}
+	return ca
+}
+
+// failingKeyStore refuses to store keys
+type failingKeyStore struct{}
+
+func (failingKeyStore)StorePrivateKey(caname string, priv crypto.PrivateKey) (keyID string, e error) {
+	return "", errors.New("key store unavailable")
+}
+
+func (failingKeyStore)PrivateKey(caname string, keyID string) (s crypto.Signer, e error) {
+	return nil, errors.New("key store unavailable")
+}
+
+// pbkdf2Salt returns the PBKDF2 salt of a PEM encrypted PKCS#8 key
+func pbkdf2Salt(t *testing.T, encryptedKey []byte) (salt []byte) {
+	block, _ := pem.Decode(encryptedKey)
+	if block == nil {
+		t.Fatal("no PEM block in the bundle")
+	}
+	var info encryptedPrivateKeyInfo
+	var params pbes2Params
+	var kdf pbkdf2Params
+	asn1.Unmarshal(block.Bytes, &info)
+	asn1.Unmarshal(info.EncryptionAlgorithm.Parameters.FullBytes, &params)
+	asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf)
+	return kdf.Salt
+}
+
+// ---------- Testing Module ----------
+
+func TestParseKeySpec(t *testing.T) {
+	for _, name := range []string{"RSA-3072", "P-256", "P-384", "P-521", "Ed25519"} {
+		// Act
+		spec, err := ParseKeySpec(name)
+
+		// Assert
+		if err != nil {
+			t.Error("ParseKeySpec() failed: ", err)
+			continue
+		}
+		if spec.String() != name {
+			t.Error("KeySpec does not round trip: ", name, spec.String())
+		}
+	}
+	if _, err := ParseKeySpec("RSA-abc"); err == nil {
+		t.Error("invalid RSA key type accepted")
+	}
+}
+
+func TestKeyGenerator_Generate(t *testing.T) {
+	// Arrange
+	ca := newKeyGenTestCA(t)
+	generator := NewKeyGenerator(ca, nil)
+	request := &IssuanceRequest{
+		Subject:  pkix.Name{CommonName: "www.cryptable.org"},
+		DNSNames: []string{"www.cryptable.org"},
+	}
+
+	for _, spec := range []KeySpec{KeySpecRSA2048, KeySpecP384, KeySpecEd25519} {
+		// Act
+		bundle, err := generator.Generate(ProfileTLSServer, request, spec, []byte("system"))
+		if err != nil {
+			t.Error(spec, ": Generate() failed: ", err)
+			continue
+		}
+
+		// Assert
+		cert, _ := x509.ParseCertificate(bundle.Certificate)
+		if err := cert.CheckSignatureFrom(ca.Certificate); err != nil {
+			t.Error(spec, ": certificate not issued by the CA: ", err)
+		}
+		key, err := LoadPrivateKeyPem(bytes.NewReader(bundle.EncryptedKey), []byte("system"))
+		if err != nil {
+			t.Error(spec, ": cannot decrypt the key: ", err)
+			continue
+		}
+		signer, _ := NewMemorySigner(key)
+		if err := checkSignerMatches(signer, cert.PublicKey); err != nil {
+			t.Error(spec, ": key does not match the certificate: ", err)
+		}
+		if publicKeyAlgorithm(cert.PublicKey) != spec.Algorithm {
+			t.Error(spec, ": wrong key algorithm: ", cert.PublicKeyAlgorithm)
+		}
+		if len(bundle.Chain) != 1 {
+			t.Error(spec, ": wrong chain length: ", len(bundle.Chain))
+		}
+	}
+	if request.PublicKey != nil {
+		t.Error("request was modified")
+	}
+}
+
+func TestKeyGenerator_GenerateKeyStoreFails(t *testing.T) {
+	// Arrange
+	ca := newKeyGenTestCA(t)
+	store := NewMemoryStore()
+	ca.SetStore(store)
+	generator := NewKeyGenerator(ca, nil)
+	generator.SetKeyStore(failingKeyStore{})
+	request := &IssuanceRequest{Subject: pkix.Name{CommonName: "orphan"}}
+
+	// Act
+	_, err := generator.Generate(ProfileTLSClient, request, KeySpecP256, []byte("system"))
+	issued, _ := store.CertificatesBySubject(ca.Name, "CN=orphan")
+
+	// Assert
+	if err == nil {
+		t.Error("Generate() succeeded without storing the key")
+	}
+	if len(issued) != 0 {
+		t.Error("certificate issued for a key which was not stored")
+	}
+}
+
+func TestKeyGenerator_Policy(t *testing.T) {
+	// Arrange
+	ca := newKeyGenTestCA(t)
+	generator := NewKeyGenerator(ca, &KeyPolicy{
+		Algorithms: []x509.PublicKeyAlgorithm{x509.RSA, x509.ECDSA},
+		MinRSABits: 3072,
+		Curves:     []elliptic.Curve{elliptic.P384()},
+	})
+	request := &IssuanceRequest{Subject: pkix.Name{CommonName: "client"}}
+
+	for _, spec := range []KeySpec{KeySpecRSA2048, KeySpecP256, KeySpecEd25519} {
+		// Act
+		_, err := generator.Generate(ProfileTLSClient, request, spec, []byte("system"))
+
+		// Assert
+		if err == nil {
+			t.Error(spec, ": key type allowed against the policy")
+		}
+	}
+	if _, err := generator.Generate(ProfileTLSClient, request, KeySpecP384, nil); err == nil {
+		t.Error("key returned without encryption")
+	}
+}
+
+func TestKeyGenerator_SaltPerBundle(t *testing.T) {
+	// Arrange
+	generator := NewKeyGenerator(newKeyGenTestCA(t), nil)
+	request := &IssuanceRequest{Subject: pkix.Name{CommonName: "client"}}
+
+	// Act
+	bundles := make([]*KeyBundle, 2)
+	for i := range bundles {
+		bundle, err := generator.Generate(ProfileTLSClient, request, KeySpecP256, []byte("system"))
+		if err != nil {
+			t.Error("Generate() failed: ", err)
+			return
+		}
+		bundles[i] = bundle
+	}
+
+	// Assert
+	salts := make([][]byte, len(bundles))
+	for i, bundle := range bundles {
+		if _, err := LoadPrivateKeyPem(bytes.NewReader(bundle.EncryptedKey), []byte("system")); err != nil {
+			t.Error("cannot decrypt the key: ", err)
+		}
+		salts[i] = pbkdf2Salt(t, bundle.EncryptedKey)
+	}
+	if len(salts[0]) == 0 || bytes.Equal(salts[0], salts[1]) {
+		t.Error("bundles with the same password share the salt")
+	}
+}
+
+func TestKeyPool(t *testing.T) {
+	// Arrange
+	pool, err := NewKeyPool(KeySpecP256, 3)
+	if err != nil {
+		t.Error("NewKeyPool() failed: ", err)
+		return
+	}
+	for i := 0; i < 100 && pool.Available() < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// stop refilling, so the pool shrinks by the key taken
+	pool.Close()
+	generator := NewKeyGenerator(newKeyGenTestCA(t), nil)
+	generator.AddPool(pool)
+	request := &IssuanceRequest{Subject: pkix.Name{CommonName: "client"}}
+
+	// Act
+	available := pool.Available()
+	bundle, err := generator.Generate(ProfileTLSClient, request, KeySpecP256, []byte("system"))
+
+	// Assert
+	if available != 3 {
+		t.Error("pool not filled: ", available)
+	}
+	if err != nil || bundle == nil {
+		t.Error("Generate() failed: ", err)
+	}
+	if pool.Available() != available-1 {
+		t.Error("key not taken from the pool")
+	}
+}
+
+func TestKeyPool_Close(t *testing.T) {
+	// Arrange
+	pool, _ := NewKeyPool(KeySpecEd25519, 1)
+
+	// Act
+	pool.Close()
+	key, err := pool.Get()
+
+	// Assert
+	if err != nil || key == nil {
+		t.Error("Get() on a closed pool failed: ", err)
+	}
+	if _, err := NewKeyPool(KeySpec{Algorithm: x509.ECDSA}, 1); err == nil {
+		t.Error("pool created for ECDSA without curve")
+	}
+}
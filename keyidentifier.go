@@ -0,0 +1,69 @@
+package gopki
+
+import (
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"strconv"
+)
+
+// SKIMethod selects how the subject key identifier of a certificate is derived from its
+// public key
+type SKIMethod int
+
+const (
+	// SKIMethodSHA1 is method 1 of RFC 5280: the SHA-1 hash of the subjectPublicKey
+	SKIMethodSHA1 SKIMethod = iota
+	// SKIMethodSHA256 is method 1 of RFC 7093: the leftmost 160 bits of the SHA-256 hash
+	// of the subjectPublicKey
+	SKIMethodSHA256
+	// SKIMethodSHA384 is method 2 of RFC 7093: the leftmost 160 bits of the SHA-384 hash
+	// of the subjectPublicKey
+	SKIMethodSHA384
+	// SKIMethodSHA512 is method 3 of RFC 7093: the leftmost 160 bits of the SHA-512 hash
+	// of the subjectPublicKey
+	SKIMethodSHA512
+	// SKIMethodSPKISHA256 is method 4 of RFC 7093: the SHA-256 hash of the DER encoded
+	// SubjectPublicKeyInfo
+	SKIMethodSPKISHA256
+)
+
+// skiLength is the length of the truncated key identifiers of RFC 7093
+const skiLength = 20
+
+// SubjectKeyIdentifier derives the key identifier of the public key with the method
+func SubjectKeyIdentifier(pub crypto.PublicKey, method SKIMethod) (ski []byte, e error) {
+	spkiBytes, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	var spki subjectPublicKeyInfo
+	_, err = asn1.Unmarshal(spkiBytes, &spki)
+	if err != nil {
+		return nil, err
+	}
+	subjectPublicKey := spki.SubjectPublicKey.RightAlign()
+
+	switch method {
+	case SKIMethodSHA1:
+		sum := sha1.Sum(subjectPublicKey)
+		return sum[:], nil
+	case SKIMethodSHA256:
+		sum := sha256.Sum256(subjectPublicKey)
+		return sum[:skiLength], nil
+	case SKIMethodSHA384:
+		sum := sha512.Sum384(subjectPublicKey)
+		return sum[:skiLength], nil
+	case SKIMethodSHA512:
+		sum := sha512.Sum512(subjectPublicKey)
+		return sum[:skiLength], nil
+	case SKIMethodSPKISHA256:
+		sum := sha256.Sum256(spkiBytes)
+		return sum[:], nil
+	}
+	return nil, errors.New("unsupported subject key identifier method: " + strconv.Itoa(int(method)))
+}
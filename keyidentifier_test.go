@@ -0,0 +1,143 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"reflect"
+	"testing"
+)
+
+// ---------- Testing Module ----------
+
+func TestSubjectKeyIdentifier(t *testing.T) {
+	// Arrange
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	spkiBytes, _ := x509.MarshalPKIXPublicKey(key.Public())
+	var spki subjectPublicKeyInfo
+	asn1.Unmarshal(spkiBytes, &spki)
+	sha1Sum := sha1.Sum(spki.SubjectPublicKey.RightAlign())
+	sha256Sum := sha256.Sum256(spki.SubjectPublicKey.RightAlign())
+	spkiSum := sha256.Sum256(spkiBytes)
+	tests := []struct {
+		method SKIMethod
+		ski    []byte
+	}{
+		{SKIMethodSHA1, sha1Sum[:]},
+		{SKIMethodSHA256, sha256Sum[:20]},
+		{SKIMethodSPKISHA256, spkiSum[:]},
+	}
+
+	for _, test := range tests {
+		// Act
+		ski, err := SubjectKeyIdentifier(key.Public(), test.method)
+
+		// Assert
+		if err != nil {
+			t.Error("SubjectKeyIdentifier() failed: ", err)
+			continue
+		}
+		if !bytes.Equal(ski, test.ski) {
+			t.Error("wrong key identifier for method ", test.method)
+		}
+	}
+	for _, method := range []SKIMethod{SKIMethodSHA384, SKIMethodSHA512} {
+		ski, _ := SubjectKeyIdentifier(key.Public(), method)
+		if len(ski) != 20 {
+			t.Error("key identifier is not truncated to 160 bits: ", len(ski))
+		}
+	}
+	for _, method := range []SKIMethod{-1, SKIMethodSPKISHA256 + 1} {
+		_, err := SubjectKeyIdentifier(key.Public(), method)
+		if err == nil {
+			t.Error("SubjectKeyIdentifier() must refuse unknown method ", method)
+		}
+	}
+}
+
+func TestCA_KeyIdentifiersAndURLs(t *testing.T) {
+	// Arrange
+	rootURLs := CAURLs{
+		IssuingCertificateURL: []string{"http://pki.cryptable.org/root.crt"},
+		OCSPServer:            []string{"http://ocsp.cryptable.org/root"},
+		CRLDistributionPoints: []string{"http://pki.cryptable.org/root.crl"},
+	}
+	issuingURLs := CAURLs{
+		IssuingCertificateURL: []string{"http://pki.cryptable.org/issuing.crt"},
+		OCSPServer:            []string{"http://ocsp.cryptable.org/issuing"},
+		CRLDistributionPoints: []string{"http://pki.cryptable.org/issuing.crl"},
+	}
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	root, err := NewCAWithOptions("CN=GoPKI Root,O=Cryptable,C=BE", 10, rootKey.Public(), rootKey, CAOptions{MaxPathLen: 1, URLs: rootURLs})
+	if err != nil {
+		t.Error("NewCAWithOptions() failed: ", err)
+		return
+	}
+	issuingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	issuing, _, err := root.NewSubordinateCA("CN=GoPKI Issuing,O=Cryptable,C=BE", 5, issuingKey.Public(), issuingKey, CAOptions{URLs: issuingURLs, SKIMethod: SKIMethodSHA256})
+	if err != nil {
+		t.Error("NewSubordinateCA() failed: ", err)
+		return
+	}
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Act
+	leafBytes, err := issuing.CreateTLSServerCertificate("CN=www.cryptable.org", leafKey.Public(), "www.cryptable.org")
+	if err != nil {
+		t.Error("CreateTLSServerCertificate() failed: ", err)
+		return
+	}
+	leaf, _ := x509.ParseCertificate(leafBytes)
+
+	// Assert
+	rootSKI, _ := SubjectKeyIdentifier(rootKey.Public(), SKIMethodSHA1)
+	if !bytes.Equal(root.Certificate.SubjectKeyId, rootSKI) || !bytes.Equal(root.Certificate.AuthorityKeyId, rootSKI) {
+		t.Error("wrong key identifiers of the root")
+	}
+	if len(root.Certificate.OCSPServer) != 0 || len(root.Certificate.CRLDistributionPoints) != 0 {
+		t.Error("root contains its own locations")
+	}
+	issuingSKI, _ := SubjectKeyIdentifier(issuingKey.Public(), SKIMethodSHA256)
+	if !bytes.Equal(issuing.Certificate.SubjectKeyId, issuingSKI) || !bytes.Equal(issuing.Certificate.AuthorityKeyId, rootSKI) {
+		t.Error("wrong key identifiers of the issuing CA")
+	}
+	if !reflect.DeepEqual(issuing.Certificate.IssuingCertificateURL, rootURLs.IssuingCertificateURL) ||
+		!reflect.DeepEqual(issuing.Certificate.OCSPServer, rootURLs.OCSPServer) ||
+		!reflect.DeepEqual(issuing.Certificate.CRLDistributionPoints, rootURLs.CRLDistributionPoints) {
+		t.Error("issuing CA does not contain the locations of the root")
+	}
+	leafSKI, _ := SubjectKeyIdentifier(leafKey.Public(), SKIMethodSHA256)
+	if !bytes.Equal(leaf.SubjectKeyId, leafSKI) || !bytes.Equal(leaf.AuthorityKeyId, issuingSKI) {
+		t.Error("wrong key identifiers of the leaf")
+	}
+	if !reflect.DeepEqual(leaf.IssuingCertificateURL, issuingURLs.IssuingCertificateURL) ||
+		!reflect.DeepEqual(leaf.OCSPServer, issuingURLs.OCSPServer) ||
+		!reflect.DeepEqual(leaf.CRLDistributionPoints, issuingURLs.CRLDistributionPoints) {
+		t.Error("leaf does not contain the locations of the issuing CA")
+	}
+}
+
+func TestCA_SetURLs(t *testing.T) {
+	// Arrange
+	ca := newKeyGenTestCA(t)
+	urls := CAURLs{OCSPServer: []string{"http://ocsp.cryptable.org"}}
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Act
+	ca.SetURLs(urls)
+	certBytes, _ := ca.CreateTLSClientCertificate("CN=client", clientKey.Public())
+
+	// Assert
+	cert, _ := x509.ParseCertificate(certBytes)
+	if !reflect.DeepEqual(cert.OCSPServer, urls.OCSPServer) || !reflect.DeepEqual(ca.URLs(), urls) {
+		t.Error("OCSP location not embedded: ", cert.OCSPServer)
+	}
+	if cert.CRLDistributionPoints != nil {
+		t.Error("unexpected CRL distribution points: ", cert.CRLDistributionPoints)
+	}
+}
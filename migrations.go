@@ -0,0 +1,268 @@
+package gopki
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var CREATE_SCHEMA_VERSION_TABLE = "CREATE TABLE IF NOT EXISTS SCHEMA_VERSION (version INTEGER PRIMARY KEY, description VARCHAR(128), appliedat BIGINT)"
+
+// migration upgrades the schema from the previous version to version. The statements
+// are rebound to the dialect and create their tables IF NOT EXISTS, so a database
+// created before the migrations were introduced is taken over as is.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+	// dialectStatements replace the statements for the dialects with another SQL, by the
+	// name of the dialect
+	dialectStatements map[string][]string
+	indexes           []tableIndex
+}
+
+// migrations are ordered by version, a released migration is never changed: a change of
+// the schema is a new migration at the end. The statements are copies frozen at the
+// release of the migration, the CREATE_ statements may change with later migrations.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "configuration of the CAs",
+		statements: []string{
+			"CREATE TABLE IF NOT EXISTS CACONFIG (id {id}, caname VARCHAR(32), {key} VARCHAR(256), value {blob}, integrity CHAR(64))",
+		},
+	},
+	{
+		version:     2,
+		description: "certificate inventory, revocations, CRLs and key rollovers",
+		statements: []string{
+			"CREATE TABLE IF NOT EXISTS CA (caname VARCHAR(32) PRIMARY KEY, subject VARCHAR(256), serial VARCHAR(40), notbefore BIGINT, notafter BIGINT, fingerprint CHAR(64), keyid CHAR(64), keytype VARCHAR(16), certificate {blob})",
+			"CREATE TABLE IF NOT EXISTS CERTIFICATE (id {id}, caname VARCHAR(32), serial VARCHAR(40), profile VARCHAR(64), certificate {blob}, subject VARCHAR(256), sans TEXT, notbefore BIGINT, notafter BIGINT, status INTEGER, fingerprint CHAR(64), requester VARCHAR(128), keyid CHAR(64), keytype VARCHAR(16), UNIQUE (caname, serial))",
+			"CREATE TABLE IF NOT EXISTS REVOCATION (id {id}, caname VARCHAR(32), serial VARCHAR(40), profile VARCHAR(64), revocationtime BIGINT, reason INTEGER, invaliditydate BIGINT, UNIQUE (caname, serial))",
+			"CREATE TABLE IF NOT EXISTS CRLNUMBER (caname VARCHAR(32) PRIMARY KEY, number VARCHAR(40))",
+			"CREATE TABLE IF NOT EXISTS BASECRL (caname VARCHAR(32), crlpartition VARCHAR(64), number VARCHAR(40), thisupdate BIGINT, PRIMARY KEY (caname, crlpartition))",
+			"CREATE TABLE IF NOT EXISTS ROLLOVER (caname VARCHAR(32) PRIMARY KEY, state INTEGER, switchat BIGINT, retireat BIGINT, oldcertificate {blob}, newcertificate {blob}, oldwithnew {blob}, newwithold {blob})",
+		},
+		indexes: []tableIndex{
+			{"CERTIFICATE_SUBJECT", "CERTIFICATE", "caname, subject"},
+			{"CERTIFICATE_FINGERPRINT", "CERTIFICATE", "fingerprint"},
+			{"CERTIFICATE_STATUS", "CERTIFICATE", "caname, status, notafter"},
+		},
+	},
+	{
+		version:     3,
+		description: "envelope encrypted private keys",
+		statements: []string{
+			"CREATE TABLE IF NOT EXISTS PRIVATEKEY (id {id}, caname VARCHAR(32), keyid CHAR(64), keytype VARCHAR(16), kekid CHAR(16), datakey {blob}, privatekey {blob}, UNIQUE (caname, keyid))",
+		},
+	},
+	{
+		version:     4,
+		description: "CA names of 64 characters and subjects of any length",
+		statements: []string{
+			"ALTER TABLE CACONFIG ALTER COLUMN caname TYPE VARCHAR(64)",
+			"ALTER TABLE CA ALTER COLUMN caname TYPE VARCHAR(64)",
+			"ALTER TABLE CA ALTER COLUMN subject TYPE TEXT",
+			"ALTER TABLE CERTIFICATE ALTER COLUMN caname TYPE VARCHAR(64)",
+			"ALTER TABLE CERTIFICATE ALTER COLUMN subject TYPE TEXT",
+			"ALTER TABLE REVOCATION ALTER COLUMN caname TYPE VARCHAR(64)",
+			"ALTER TABLE CRLNUMBER ALTER COLUMN caname TYPE VARCHAR(64)",
+			"ALTER TABLE BASECRL ALTER COLUMN caname TYPE VARCHAR(64)",
+			"ALTER TABLE PRIVATEKEY ALTER COLUMN caname TYPE VARCHAR(64)",
+			"ALTER TABLE ROLLOVER ALTER COLUMN caname TYPE VARCHAR(64)",
+		},
+		dialectStatements: map[string][]string{
+			// the index on the subject is created again on a prefix of the TEXT column
+			"mysql": {
+				"DROP INDEX CERTIFICATE_SUBJECT ON CERTIFICATE",
+				"ALTER TABLE CACONFIG MODIFY caname VARCHAR(64)",
+				"ALTER TABLE CA MODIFY caname VARCHAR(64), MODIFY subject TEXT",
+				"ALTER TABLE CERTIFICATE MODIFY caname VARCHAR(64), MODIFY subject TEXT",
+				"ALTER TABLE REVOCATION MODIFY caname VARCHAR(64)",
+				"ALTER TABLE CRLNUMBER MODIFY caname VARCHAR(64)",
+				"ALTER TABLE BASECRL MODIFY caname VARCHAR(64)",
+				"ALTER TABLE PRIVATEKEY MODIFY caname VARCHAR(64)",
+				"ALTER TABLE ROLLOVER MODIFY caname VARCHAR(64)",
+			},
+			"sqlite": rebuildTables(
+				"CREATE TABLE IF NOT EXISTS CACONFIG (id {id}, caname VARCHAR(64), {key} VARCHAR(256), value {blob}, integrity CHAR(64))",
+				"CREATE TABLE IF NOT EXISTS CA (caname VARCHAR(64) PRIMARY KEY, subject TEXT, serial VARCHAR(40), notbefore BIGINT, notafter BIGINT, fingerprint CHAR(64), keyid CHAR(64), keytype VARCHAR(16), certificate {blob})",
+				"CREATE TABLE IF NOT EXISTS CERTIFICATE (id {id}, caname VARCHAR(64), serial VARCHAR(40), profile VARCHAR(64), certificate {blob}, subject TEXT, sans TEXT, notbefore BIGINT, notafter BIGINT, status INTEGER, fingerprint CHAR(64), requester VARCHAR(128), keyid CHAR(64), keytype VARCHAR(16), UNIQUE (caname, serial))",
+				"CREATE TABLE IF NOT EXISTS REVOCATION (id {id}, caname VARCHAR(64), serial VARCHAR(40), profile VARCHAR(64), revocationtime BIGINT, reason INTEGER, invaliditydate BIGINT, UNIQUE (caname, serial))",
+				"CREATE TABLE IF NOT EXISTS CRLNUMBER (caname VARCHAR(64) PRIMARY KEY, number VARCHAR(40))",
+				"CREATE TABLE IF NOT EXISTS BASECRL (caname VARCHAR(64), crlpartition VARCHAR(64), number VARCHAR(40), thisupdate BIGINT, PRIMARY KEY (caname, crlpartition))",
+				"CREATE TABLE IF NOT EXISTS PRIVATEKEY (id {id}, caname VARCHAR(64), keyid CHAR(64), keytype VARCHAR(16), kekid CHAR(16), datakey {blob}, privatekey {blob}, UNIQUE (caname, keyid))",
+				"CREATE TABLE IF NOT EXISTS ROLLOVER (caname VARCHAR(64) PRIMARY KEY, state INTEGER, switchat BIGINT, retireat BIGINT, oldcertificate {blob}, newcertificate {blob}, oldwithnew {blob}, newwithold {blob})",
+			),
+		},
+		// the rebuilt tables of SQLite and MySQL lost these indexes, the others keep them
+		indexes: []tableIndex{
+			{"CERTIFICATE_SUBJECT", "CERTIFICATE", "caname, subject{textprefix}"},
+			{"CERTIFICATE_FINGERPRINT", "CERTIFICATE", "fingerprint"},
+			{"CERTIFICATE_STATUS", "CERTIFICATE", "caname, status, notafter"},
+		},
+	},
+}
+
+// rebuildTables creates the tables again with the statements and copies their rows, for
+// SQLite which can't change the type of a column. The new table has the columns of the
+// old one in the same order.
+func rebuildTables(statements ...string) (s []string) {
+	for _, statement := range statements {
+		table := strings.Fields(statement)[5]
+		s = append(s,
+			"ALTER TABLE "+table+" RENAME TO "+table+"_OLD",
+			statement,
+			"INSERT INTO "+table+" SELECT * FROM "+table+"_OLD",
+			"DROP TABLE "+table+"_OLD",
+		)
+	}
+	return s
+}
+
+// MigrationStatus is a version of the schema, AppliedAt is zero while it is pending
+type MigrationStatus struct {
+	Version     int
+	Description string
+	AppliedAt   time.Time
+}
+
+// LatestSchemaVersion is the version of the schema this package works with
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the version of the schema of the database, 0 for an empty
+// database. It creates the SCHEMA_VERSION table when it is missing.
+func (d *DB)SchemaVersion() (version int, e error) {
+	_, err := d.db.Exec(d.rebind(CREATE_SCHEMA_VERSION_TABLE))
+	if err != nil {
+		return 0, err
+	}
+	var max sql.NullInt64
+	err = d.db.QueryRow("SELECT MAX(version) FROM SCHEMA_VERSION").Scan(&max)
+	if err != nil {
+		return 0, err
+	}
+	return int(max.Int64), nil
+}
+
+// CheckSchema returns an error unless the database has the schema of this package
+func (d *DB)CheckSchema() (e error) {
+	version, err := d.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := LatestSchemaVersion()
+	if version > latest {
+		return errors.New("database schema version " + strconv.Itoa(version) + " is newer than version " + strconv.Itoa(latest) + " of gopki")
+	}
+	if version < latest {
+		return errors.New("database schema version " + strconv.Itoa(version) + " is older than version " + strconv.Itoa(latest) + " of gopki, run gopki db migrate")
+	}
+	return nil
+}
+
+// Migrate applies the pending migrations in order and returns how many were applied.
+// It refuses a database with a schema newer than this package knows. Every migration
+// runs in its own transaction together with its SCHEMA_VERSION row; MySQL commits
+// DDL statements implicitly, so there a failed migration can leave tables behind,
+// which the next run takes over because they are created IF NOT EXISTS.
+func (d *DB)Migrate() (applied int, e error) {
+	version, err := d.SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	latest := LatestSchemaVersion()
+	if version > latest {
+		return 0, errors.New("database schema version " + strconv.Itoa(version) + " is newer than version " + strconv.Itoa(latest) + " of gopki")
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		err = d.migrate(m)
+		if err != nil {
+			return applied, errors.New("migration " + strconv.Itoa(m.version) + " failed: " + err.Error())
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+func (d *DB)migrate(m migration) (e error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := m.statements
+	if dialectStatements, ok := m.dialectStatements[d.dialect.name]; ok {
+		statements = dialectStatements
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(d.rebind(statement))
+		if err != nil {
+			return err
+		}
+	}
+	for _, index := range m.indexes {
+		err = d.createIndex(tx, index)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(d.rebind("INSERT INTO SCHEMA_VERSION (version, description, appliedat) VALUES (?, ?, ?)"),
+		m.version, m.description, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MigrationStatus returns the known migrations, applied or pending, and the versions
+// applied by a newer gopki, ordered by version
+func (d *DB)MigrationStatus() (s []MigrationStatus, e error) {
+	_, err := d.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := d.db.Query("SELECT version, description, appliedat FROM SCHEMA_VERSION")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]MigrationStatus)
+	for rows.Next() {
+		var status MigrationStatus
+		var appliedAt int64
+		err = rows.Scan(&status.Version, &status.Description, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		status.AppliedAt = time.Unix(appliedAt, 0)
+		applied[status.Version] = status
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, m := range migrations {
+		status, ok := applied[m.version]
+		if !ok {
+			status = MigrationStatus{Version: m.version, Description: m.description}
+		}
+		delete(applied, m.version)
+		s = append(s, status)
+	}
+	for _, status := range applied {
+		s = append(s, status)
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i].Version < s[j].Version })
+	return s, nil
+}
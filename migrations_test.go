@@ -0,0 +1,207 @@
+package gopki
+
+import (
+	"testing"
+)
+
+// newEmptyTestDB opens an in-memory database without schema
+func newEmptyTestDB(t *testing.T) (d *DB) {
+	db, err := NewDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal("NewDB failed: ", err)
+	}
+	// every connection to :memory: is a new database
+	db.db.SetMaxOpenConns(1)
+	t.Cleanup(db.CloseDB)
+	return db
+}
+
+// tableSchemas returns the CREATE TABLE statements of the tables in the SQLite database
+func tableSchemas(t *testing.T, db *DB) (schemas map[string]string) {
+	rows, err := db.db.Query("SELECT name, sql FROM sqlite_master WHERE type = 'table' AND name != 'SCHEMA_VERSION' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		t.Fatal("reading the schema failed: ", err)
+	}
+	defer rows.Close()
+	schemas = map[string]string{}
+	for rows.Next() {
+		var name, sql string
+		rows.Scan(&name, &sql)
+		schemas[name] = sql
+	}
+	return schemas
+}
+
+// ---------- Testing Module ----------
+
+func TestDB_Migrate(t *testing.T) {
+	// Arrange
+	db := newEmptyTestDB(t)
+	errBefore := db.CheckSchema()
+
+	// Act
+	applied, err := db.Migrate()
+	again, errAgain := db.Migrate()
+	version, _ := db.SchemaVersion()
+
+	// Assert
+	if errBefore == nil {
+		t.Error("empty database passes CheckSchema()")
+	}
+	if err != nil || applied != len(migrations) {
+		t.Error("Migrate() failed: ", applied, err)
+	}
+	if errAgain != nil || again != 0 {
+		t.Error("Migrate() is not idempotent: ", again, errAgain)
+	}
+	if version != LatestSchemaVersion() {
+		t.Error("wrong schema version: ", version)
+	}
+	if err = db.CheckSchema(); err != nil {
+		t.Error("CheckSchema() failed: ", err)
+	}
+}
+
+func TestDB_MigrateMatchesSchema(t *testing.T) {
+	// Arrange: the frozen migrations must end in the schema of the CREATE_ statements
+	migrated := newEmptyTestDB(t)
+	created := newEmptyTestDB(t)
+	for _, statement := range []string{CREATE_CA_CONFIG_TABLE, CREATE_CA_TABLE, CREATE_CERTIFICATE_TABLE,
+		CREATE_REVOCATION_TABLE, CREATE_CRL_NUMBER_TABLE, CREATE_BASE_CRL_TABLE, CREATE_PRIVATE_KEY_TABLE, CREATE_ROLLOVER_TABLE} {
+		_, err := created.db.Exec(created.rebind(statement))
+		if err != nil {
+			t.Fatal("creating the schema failed: ", err)
+		}
+	}
+
+	// Act
+	_, err := migrated.Migrate()
+
+	// Assert
+	if err != nil {
+		t.Error("Migrate() failed: ", err)
+		return
+	}
+	want := tableSchemas(t, created)
+	got := tableSchemas(t, migrated)
+	if len(got) != len(want) {
+		t.Error("migrations create other tables: ", len(got), len(want))
+	}
+	for name, sql := range want {
+		if got[name] != sql {
+			t.Error("migrated table " + name + " differs: " + got[name])
+		}
+	}
+}
+
+func TestDB_MigrateExistingDatabase(t *testing.T) {
+	// Arrange: the schema of gopki before the migrations
+	db := newEmptyTestDB(t)
+	db.db.Exec("CREATE TABLE IF NOT EXISTS CACONFIG (id INTEGER PRIMARY KEY AUTOINCREMENT, caname VARCHAR(32), key VARCHAR(256), value BLOB, integrity CHAR(64))")
+	db.db.Exec("INSERT INTO CACONFIG (caname, key, value, integrity) VALUES ('GoPKI', 'certificate', x'00', '')")
+
+	// Act
+	applied, err := db.Migrate()
+	var count int
+	db.db.QueryRow("SELECT COUNT(*) FROM CACONFIG").Scan(&count)
+	status, errStatus := db.MigrationStatus()
+
+	// Assert
+	if err != nil || applied != len(migrations) {
+		t.Error("Migrate() failed: ", applied, err)
+	}
+	if count != 1 {
+		t.Error("existing configuration lost: ", count)
+	}
+	if errStatus != nil || len(status) != len(migrations) {
+		t.Error("MigrationStatus() failed: ", errStatus)
+		return
+	}
+	for _, s := range status {
+		if s.AppliedAt.IsZero() || s.Description == "" {
+			t.Error("migration not applied: ", s)
+		}
+	}
+}
+
+func TestDB_MigrateNewerSchema(t *testing.T) {
+	// Arrange
+	db := newTestDB(t)
+	newer := LatestSchemaVersion() + 1
+	db.db.Exec("INSERT INTO SCHEMA_VERSION (version, description, appliedat) VALUES (?, 'from the future', 0)", newer)
+	ca := newSavedTestCA(t, db)
+
+	// Act
+	_, err := db.Migrate()
+	errCheck := db.CheckSchema()
+	_, errLoad := db.LoadCA(ca.Name, []byte("system"))
+	status, _ := db.MigrationStatus()
+
+	// Assert
+	if err == nil || errCheck == nil {
+		t.Error("newer schema accepted")
+	}
+	if errLoad == nil {
+		t.Error("CA loaded from a newer schema")
+	}
+	if len(status) != len(migrations)+1 || status[len(status)-1].Version != newer {
+		t.Error("newer version missing in the status: ", status)
+	}
+}
+
+func TestDB_MigratePending(t *testing.T) {
+	// Arrange
+	db := newEmptyTestDB(t)
+	saved := migrations
+	defer func() { migrations = saved }()
+	migrations = migrations[:1]
+	db.Migrate()
+	migrations = saved
+
+	// Act
+	errCheck := db.CheckSchema()
+	pending, _ := db.MigrationStatus()
+	applied, err := db.Migrate()
+
+	// Assert
+	if errCheck == nil {
+		t.Error("older schema passes CheckSchema()")
+	}
+	if len(pending) != len(migrations) || pending[0].AppliedAt.IsZero() || !pending[1].AppliedAt.IsZero() {
+		t.Error("wrong pending migrations: ", pending)
+	}
+	if err != nil || applied != len(migrations)-1 {
+		t.Error("Migrate() failed: ", applied, err)
+	}
+}
+
+func TestDB_MigrateRollback(t *testing.T) {
+	// Arrange
+	db := newTestDB(t)
+	saved := migrations
+	defer func() { migrations = saved }()
+	migrations = append(migrations[:len(migrations):len(migrations)], migration{
+		version:     LatestSchemaVersion() + 1,
+		description: "broken",
+		statements: []string{
+			"CREATE TABLE BROKEN (id INTEGER)",
+			"INSERT INTO MISSING VALUES (1)",
+		},
+	})
+
+	// Act
+	applied, err := db.Migrate()
+	version, _ := db.SchemaVersion()
+	_, errBroken := db.db.Exec("SELECT COUNT(*) FROM BROKEN")
+
+	// Assert
+	if err == nil || applied != 0 {
+		t.Error("broken migration applied: ", applied)
+	}
+	if version != saved[len(saved)-1].version {
+		t.Error("wrong schema version after a failed migration: ", version)
+	}
+	if errBroken == nil {
+		t.Error("failed migration not rolled back")
+	}
+}
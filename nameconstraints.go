@@ -0,0 +1,338 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"net"
+	"strings"
+)
+
+var oidNameConstraints = asn1.ObjectIdentifier{2, 5, 29, 30}
+
+// Tags of the GeneralName choices of RFC 5280 which can be constrained
+const (
+	generalNameEmail         = 1
+	generalNameDNS           = 2
+	generalNameDirectoryName = 4
+	generalNameURI           = 6
+	generalNameIP            = 7
+)
+
+// NameConstraints technically constrain a CA to the names it may issue certificates for.
+// DNS and URI constraints starting with a period only match subdomains, otherwise the domain
+// itself matches as well for DNS and only the host itself for URIs. Email constraints are a
+// mailbox, a host or a domain starting with a period.
+type NameConstraints struct {
+	PermittedDNSDomains     []string
+	ExcludedDNSDomains      []string
+	PermittedIPRanges       []*net.IPNet
+	ExcludedIPRanges        []*net.IPNet
+	PermittedEmailAddresses []string
+	ExcludedEmailAddresses  []string
+	PermittedURIDomains     []string
+	ExcludedURIDomains      []string
+	// PermittedDirectoryNames constrain the subject to start with one of the names, note
+	// that crypto/x509 does not verify chains with directory name constraints
+	PermittedDirectoryNames []pkix.Name
+	ExcludedDirectoryNames  []pkix.Name
+}
+
+// ---------- Encoding ----------
+
+type generalSubtree struct {
+	Base asn1.RawValue
+}
+
+type nameConstraintsSubtrees struct {
+	Permitted []generalSubtree `asn1:"optional,tag:0"`
+	Excluded  []generalSubtree `asn1:"optional,tag:1"`
+}
+
+func generalSubtrees(dns []string, ips []*net.IPNet, emails []string, uris []string, dirNames []pkix.Name) (s []generalSubtree, e error) {
+	name := func(tag int, b []byte) generalSubtree {
+		return generalSubtree{asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, Bytes: b}}
+	}
+	for _, domain := range dns {
+		s = append(s, name(generalNameDNS, []byte(strings.ToLower(domain))))
+	}
+	for _, ipNet := range ips {
+		ip, mask := ipNet.IP.To4(), ipNet.Mask
+		if ip == nil {
+			ip = ipNet.IP.To16()
+		}
+		if len(mask) == net.IPv6len && len(ip) == net.IPv4len {
+			mask = mask[12:]
+		}
+		if ip == nil || len(mask) != len(ip) {
+			return nil, errors.New("invalid IP range in name constraints: " + ipNet.String())
+		}
+		s = append(s, name(generalNameIP, append(append([]byte{}, ip...), mask...)))
+	}
+	for _, email := range emails {
+		s = append(s, name(generalNameEmail, []byte(email)))
+	}
+	for _, domain := range uris {
+		s = append(s, name(generalNameURI, []byte(strings.ToLower(domain))))
+	}
+	for _, dirName := range dirNames {
+		b, err := asn1.Marshal(dirName.ToRDNSequence())
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, generalSubtree{asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: generalNameDirectoryName, IsCompound: true, Bytes: b}})
+	}
+	return s, nil
+}
+
+// extension returns the critical name constraints extension
+func (c *NameConstraints)extension() (ext pkix.Extension, e error) {
+	var subtrees nameConstraintsSubtrees
+	var err error
+	subtrees.Permitted, err = generalSubtrees(c.PermittedDNSDomains, c.PermittedIPRanges, c.PermittedEmailAddresses, c.PermittedURIDomains, c.PermittedDirectoryNames)
+	if err != nil {
+		return ext, err
+	}
+	subtrees.Excluded, err = generalSubtrees(c.ExcludedDNSDomains, c.ExcludedIPRanges, c.ExcludedEmailAddresses, c.ExcludedURIDomains, c.ExcludedDirectoryNames)
+	if err != nil {
+		return ext, err
+	}
+	if subtrees.Permitted == nil && subtrees.Excluded == nil {
+		return ext, errors.New("empty name constraints")
+	}
+
+	value, err := asn1.Marshal(subtrees)
+	if err != nil {
+		return ext, err
+	}
+	return pkix.Extension{Id: oidNameConstraints, Critical: true, Value: value}, nil
+}
+
+// ---------- Decoding ----------
+
+// parseNameConstraints returns the name constraints of a CA certificate, nil when it has none
+func parseNameConstraints(cert *x509.Certificate) (c *NameConstraints, e error) {
+	ext := findExtension(cert, oidNameConstraints)
+	if ext == nil {
+		return nil, nil
+	}
+	var subtrees nameConstraintsSubtrees
+	rest, err := asn1.Unmarshal(ext.Value, &subtrees)
+	if err != nil || len(rest) != 0 {
+		return nil, errors.New("invalid name constraints extension")
+	}
+
+	c = &NameConstraints{}
+	err = c.addSubtrees(subtrees.Permitted, &c.PermittedDNSDomains, &c.PermittedIPRanges, &c.PermittedEmailAddresses, &c.PermittedURIDomains, &c.PermittedDirectoryNames)
+	if err != nil {
+		return nil, err
+	}
+	err = c.addSubtrees(subtrees.Excluded, &c.ExcludedDNSDomains, &c.ExcludedIPRanges, &c.ExcludedEmailAddresses, &c.ExcludedURIDomains, &c.ExcludedDirectoryNames)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *NameConstraints)addSubtrees(subtrees []generalSubtree, dns *[]string, ips *[]*net.IPNet, emails *[]string, uris *[]string, dirNames *[]pkix.Name) (e error) {
+	for _, subtree := range subtrees {
+		base := subtree.Base
+		switch base.Tag {
+		case generalNameDNS:
+			*dns = append(*dns, string(base.Bytes))
+		case generalNameEmail:
+			*emails = append(*emails, string(base.Bytes))
+		case generalNameURI:
+			*uris = append(*uris, string(base.Bytes))
+		case generalNameIP:
+			if len(base.Bytes) != 2*net.IPv4len && len(base.Bytes) != 2*net.IPv6len {
+				return errors.New("invalid IP range in name constraints")
+			}
+			half := len(base.Bytes) / 2
+			*ips = append(*ips, &net.IPNet{IP: net.IP(base.Bytes[:half]), Mask: net.IPMask(base.Bytes[half:])})
+		case generalNameDirectoryName:
+			var rdns pkix.RDNSequence
+			_, err := asn1.Unmarshal(base.Bytes, &rdns)
+			if err != nil {
+				return errors.New("invalid directory name in name constraints")
+			}
+			// the attributes are kept in order, so the RDN sequence of the name is the same
+			var name pkix.Name
+			for _, rdn := range rdns {
+				name.ExtraNames = append(name.ExtraNames, rdn...)
+			}
+			*dirNames = append(*dirNames, name)
+		default:
+			return errors.New("unsupported name type in name constraints")
+		}
+	}
+	return nil
+}
+
+// ---------- Matching ----------
+
+// matchDNSConstraint follows the rules of RFC 5280, a leading period only matches subdomains
+func matchDNSConstraint(domain string, constraint string) bool {
+	domain, constraint = strings.ToLower(domain), strings.ToLower(constraint)
+	if constraint == "" {
+		return true
+	}
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(domain, constraint)
+	}
+	return domain == constraint || strings.HasSuffix(domain, "."+constraint)
+}
+
+// matchURIConstraint matches the host of the URI, only subdomains when the constraint starts
+// with a period and the host itself otherwise
+func matchURIConstraint(host string, constraint string) bool {
+	host, constraint = strings.ToLower(host), strings.ToLower(constraint)
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(host, constraint)
+	}
+	return host == constraint
+}
+
+func matchEmailConstraint(email string, constraint string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	host := strings.ToLower(email[at+1:])
+	switch {
+	case strings.Contains(constraint, "@"):
+		return email[:at] == constraint[:strings.LastIndex(constraint, "@")] &&
+			host == strings.ToLower(constraint[strings.LastIndex(constraint, "@")+1:])
+	case strings.HasPrefix(constraint, "."):
+		return strings.HasSuffix(host, strings.ToLower(constraint))
+	}
+	return host == strings.ToLower(constraint)
+}
+
+func matchIPConstraint(ip net.IP, constraint *net.IPNet) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return len(ip) == len(constraint.IP) && constraint.Contains(ip)
+}
+
+// matchDirectoryNameConstraint tells if the subject starts with the RDNs of the constraint
+func matchDirectoryNameConstraint(subject pkix.RDNSequence, constraint pkix.Name) bool {
+	prefix := constraint.ToRDNSequence()
+	if len(prefix) > len(subject) {
+		return false
+	}
+	for i := range prefix {
+		expected, err := asn1.Marshal(prefix[i])
+		if err != nil {
+			return false
+		}
+		actual, err := asn1.Marshal(subject[i])
+		if err != nil || !bytes.Equal(expected, actual) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkNames verifies all names against the permitted and excluded constraints of one type
+func checkNames(kind string, names []string, permitted []string, excluded []string, match func(string, string) bool) (e error) {
+	for _, name := range names {
+		for _, constraint := range excluded {
+			if match(name, constraint) {
+				return errors.New(kind + " " + name + " is excluded by the name constraints of the CA")
+			}
+		}
+		allowed := len(permitted) == 0
+		for _, constraint := range permitted {
+			allowed = allowed || match(name, constraint)
+		}
+		if !allowed {
+			return errors.New(kind + " " + name + " is not permitted by the name constraints of the CA")
+		}
+	}
+	return nil
+}
+
+// check verifies the names of the request are allowed by the constraints
+func (c *NameConstraints)check(request *IssuanceRequest) (e error) {
+	err := checkNames("DNS name", request.DNSNames, c.PermittedDNSDomains, c.ExcludedDNSDomains, matchDNSConstraint)
+	if err != nil {
+		return err
+	}
+	err = checkNames("email address", request.EmailAddresses, c.PermittedEmailAddresses, c.ExcludedEmailAddresses, matchEmailConstraint)
+	if err != nil {
+		return err
+	}
+	var hosts []string
+	for _, uri := range request.URIs {
+		if uri.Hostname() == "" {
+			return errors.New("URI " + uri.String() + " has no host to check against the name constraints of the CA")
+		}
+		hosts = append(hosts, uri.Hostname())
+	}
+	if len(request.URIs) > 0 {
+		err = checkNames("URI host", hosts, c.PermittedURIDomains, c.ExcludedURIDomains, matchURIConstraint)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, ip := range request.IPAddresses {
+		for _, constraint := range c.ExcludedIPRanges {
+			if matchIPConstraint(ip, constraint) {
+				return errors.New("IP address " + ip.String() + " is excluded by the name constraints of the CA")
+			}
+		}
+		allowed := len(c.PermittedIPRanges) == 0
+		for _, constraint := range c.PermittedIPRanges {
+			allowed = allowed || matchIPConstraint(ip, constraint)
+		}
+		if !allowed {
+			return errors.New("IP address " + ip.String() + " is not permitted by the name constraints of the CA")
+		}
+	}
+
+	subject := request.Subject.ToRDNSequence()
+	if len(subject) == 0 {
+		return nil
+	}
+	for _, constraint := range c.ExcludedDirectoryNames {
+		if matchDirectoryNameConstraint(subject, constraint) {
+			return errors.New("subject " + request.Subject.String() + " is excluded by the name constraints of the CA")
+		}
+	}
+	allowed := len(c.PermittedDirectoryNames) == 0
+	for _, constraint := range c.PermittedDirectoryNames {
+		allowed = allowed || matchDirectoryNameConstraint(subject, constraint)
+	}
+	if !allowed {
+		return errors.New("subject " + request.Subject.String() + " is not permitted by the name constraints of the CA")
+	}
+	return nil
+}
+
+// checkNameConstraints verifies the request against the name constraints of the CA and the
+// CAs above it, so a constrained CA refuses to sign names its relying parties reject
+func (k *issuingKey)checkNameConstraints(request *IssuanceRequest) (e error) {
+	for _, der := range k.chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		constraints, err := parseNameConstraints(cert)
+		if err != nil {
+			return err
+		}
+		if constraints == nil {
+			continue
+		}
+		err = constraints.check(request)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package gopki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newConstrainedTestCA(t *testing.T, constraints *NameConstraints) (root *CA, constrained *CA, key *ecdsa.PrivateKey) {
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	root, err := NewCAWithOptions("CN=GoPKI Root,O=Cryptable,C=BE", 10, rootKey.Public(), rootKey, CAOptions{MaxPathLen: 1})
+	if err != nil {
+		t.Fatal("NewCAWithOptions failed: ", err)
+	}
+	key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	constrained, _, err = root.NewSubordinateCA("CN=GoPKI Team A,O=Cryptable,C=BE", 5, key.Public(), key, CAOptions{NameConstraints: constraints})
+	if err != nil {
+		t.Fatal("NewSubordinateCA failed: ", err)
+	}
+	return root, constrained, key
+}
+
+func verifyWithGo(root *CA, issuing *CA, cert *x509.Certificate) (e error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(root.Certificate)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(issuing.Certificate)
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+func teamAConstraints() (c *NameConstraints) {
+	_, ipRange, _ := net.ParseCIDR("10.1.0.0/16")
+	return &NameConstraints{
+		PermittedDNSDomains:     []string{"team-a.svc.cluster.local"},
+		ExcludedDNSDomains:      []string{"secret.team-a.svc.cluster.local"},
+		PermittedIPRanges:       []*net.IPNet{ipRange},
+		PermittedEmailAddresses: []string{"team-a.cryptable.org"},
+		PermittedURIDomains:     []string{".cryptable.org"},
+	}
+}
+
+// ---------- Testing Module ----------
+
+func TestNameConstraints_Extension(t *testing.T) {
+	// Arrange
+	constraints := teamAConstraints()
+	constraints.ExcludedDirectoryNames = []pkix.Name{{Country: []string{"BE"}, Organization: []string{"Other"}}}
+
+	// Act
+	_, ca, _ := newConstrainedTestCA(t, constraints)
+	parsed, err := parseNameConstraints(ca.Certificate)
+
+	// Assert
+	if err != nil {
+		t.Error("parseNameConstraints() failed: ", err)
+		return
+	}
+	if len(parsed.PermittedDNSDomains) != 1 || parsed.PermittedDNSDomains[0] != "team-a.svc.cluster.local" ||
+		len(parsed.ExcludedDNSDomains) != 1 || len(parsed.PermittedEmailAddresses) != 1 || len(parsed.PermittedURIDomains) != 1 {
+		t.Error("wrong name constraints: ", parsed)
+	}
+	if len(parsed.PermittedIPRanges) != 1 || parsed.PermittedIPRanges[0].String() != "10.1.0.0/16" {
+		t.Error("wrong IP ranges: ", parsed.PermittedIPRanges)
+	}
+	if len(parsed.ExcludedDirectoryNames) != 1 || parsed.ExcludedDirectoryNames[0].String() != "O=Other,C=BE" {
+		t.Error("wrong directory names: ", parsed.ExcludedDirectoryNames)
+	}
+	if !findExtension(ca.Certificate, oidNameConstraints).Critical {
+		t.Error("name constraints are not critical")
+	}
+}
+
+func TestNameConstraints_PermittedNames(t *testing.T) {
+	// Arrange
+	root, ca, _ := newConstrainedTestCA(t, teamAConstraints())
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Act
+	certBytes, err := ca.CreateTLSClientCertificate("CN=api", key.Public(),
+		"api.team-a.svc.cluster.local", "10.1.2.3", "spiffe://team-a.cryptable.org/ns/team-a/sa/api",
+		"api@team-a.cryptable.org")
+
+	// Assert
+	if err != nil {
+		t.Error("CreateTLSClientCertificate() failed: ", err)
+		return
+	}
+	cert, _ := x509.ParseCertificate(certBytes)
+	if err := verifyWithGo(root, ca, cert); err != nil {
+		t.Error("crypto/x509 rejects the certificate: ", err)
+	}
+}
+
+func TestNameConstraints_RefusedNames(t *testing.T) {
+	// Arrange
+	root, ca, caKey := newConstrainedTestCA(t, teamAConstraints())
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	names := []string{
+		"api.team-b.svc.cluster.local",
+		"db.secret.team-a.svc.cluster.local",
+		"10.2.0.1",
+		"spiffe://evil.org/ns/team-a/sa/api",
+		"api@team-b.cryptable.org",
+	}
+
+	for _, name := range names {
+		// Act
+		_, err := ca.CreateTLSClientCertificate("CN=api", key.Public(), name)
+
+		// Assert
+		if err == nil {
+			t.Error("constrained CA issued a certificate for ", name)
+		}
+
+		// crypto/x509 rejects the same name when the CA would have signed it
+		request := IssuanceRequest{}
+		request.AddSubjectAltNames(name)
+		template := &x509.Certificate{
+			SerialNumber:   big.NewInt(1),
+			Subject:        pkix.Name{CommonName: "api"},
+			NotBefore:      time.Now(),
+			NotAfter:       time.Now().Add(time.Hour),
+			DNSNames:       request.DNSNames,
+			IPAddresses:    request.IPAddresses,
+			URIs:           request.URIs,
+			EmailAddresses: request.EmailAddresses,
+		}
+		forged, _ := x509.CreateCertificate(rand.Reader, template, ca.Certificate, key.Public(), caKey)
+		cert, _ := x509.ParseCertificate(forged)
+		if err := verifyWithGo(root, ca, cert); err == nil {
+			t.Error("crypto/x509 accepts ", name)
+		}
+	}
+}
+
+func TestNameConstraints_SubjectAltNameExtension(t *testing.T) {
+	// Arrange
+	_, ca, _ := newConstrainedTestCA(t, teamAConstraints())
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	subjectAltName, _ := asn1.Marshal([]asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte("evil.org")}})
+	ca.AddProfile(&Profile{
+		Name:            "with-names",
+		Validity:        time.Hour,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: subjectAltName}},
+	})
+
+	// Act
+	_, requestErr := ca.Issue(ProfileTLSClient, &IssuanceRequest{Subject: pkix.Name{CommonName: "api"}, PublicKey: key.Public(),
+		Extensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: subjectAltName}}})
+	_, profileErr := ca.Issue("with-names", &IssuanceRequest{Subject: pkix.Name{CommonName: "api"}, PublicKey: key.Public()})
+	issued, _ := ca.store.CertificatesBySubject(ca.Name, "CN=api")
+
+	// Assert
+	if requestErr == nil || profileErr == nil {
+		t.Error("constrained CA issued a certificate for evil.org: ", requestErr, profileErr)
+	}
+	if len(issued) != 0 {
+		t.Error("refused certificate stored: ", len(issued))
+	}
+}
+
+func TestNameConstraints_DirectoryNames(t *testing.T) {
+	// Arrange
+	_, ca, _ := newConstrainedTestCA(t, &NameConstraints{
+		PermittedDirectoryNames: []pkix.Name{{Country: []string{"BE"}, Organization: []string{"Cryptable"}}},
+	})
+	ca.AddProfile(&Profile{Name: "sub-ca", Validity: time.Hour, IsCA: true})
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	uri, _ := url.Parse("spiffe://cryptable.org/api")
+
+	// Act
+	_, errPermitted := ca.CreateTLSClientCertificate("CN=api,O=Cryptable,C=BE", key.Public())
+	_, errOther := ca.CreateTLSClientCertificate("CN=api,O=Other,C=BE", key.Public())
+	_, errSubCA := ca.Issue("sub-ca", &IssuanceRequest{
+		Subject:   pkix.Name{Country: []string{"NL"}, CommonName: "GoPKI Sub"},
+		PublicKey: key.Public(),
+		URIs:      []*url.URL{uri},
+	})
+
+	// Assert
+	if errPermitted != nil {
+		t.Error("permitted subject refused: ", errPermitted)
+	}
+	if errOther == nil {
+		t.Error("subject outside the directory name constraints issued")
+	}
+	if errSubCA == nil {
+		t.Error("subordinate CA outside the directory name constraints issued")
+	}
+}
+
+func TestNameConstraints_Inherited(t *testing.T) {
+	// Arrange
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	root, _ := NewCAWithOptions("CN=GoPKI Root,O=Cryptable,C=BE", 10, rootKey.Public(), rootKey, CAOptions{
+		MaxPathLen:      1,
+		NameConstraints: &NameConstraints{PermittedDNSDomains: []string{"cluster.local"}},
+	})
+	issuingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	issuing, _, _ := root.NewSubordinateCA("CN=GoPKI Issuing,O=Cryptable,C=BE", 5, issuingKey.Public(), issuingKey, CAOptions{})
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Act
+	_, errInside := issuing.CreateTLSServerCertificate("CN=api", key.Public(), "api.cluster.local")
+	_, errOutside := issuing.CreateTLSServerCertificate("CN=api", key.Public(), "www.cryptable.org")
+
+	// Assert
+	if errInside != nil {
+		t.Error("permitted name refused: ", errInside)
+	}
+	if errOutside == nil {
+		t.Error("issuing CA ignores the name constraints of the root")
+	}
+}
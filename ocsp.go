@@ -0,0 +1,557 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ProfileOCSPSigning = "ocsp-signing"
+
+// DefaultOCSPValidity is the time between thisUpdate and nextUpdate of an OCSP response
+var DefaultOCSPValidity = time.Hour
+
+// DefaultOCSPCacheSize is the maximum number of responses an OCSPResponder caches
+var DefaultOCSPCacheSize = 10000
+
+// maxOCSPNonceLength is the limit of RFC 8954
+const maxOCSPNonceLength = 32
+
+var (
+	oidOCSPBasic   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidOCSPNonce   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+	oidOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+)
+
+var ocspHashes = []struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+}{
+	{asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}, crypto.SHA1},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}, crypto.SHA256},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}, crypto.SHA384},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}, crypto.SHA512},
+}
+
+// OCSP response status of RFC 6960
+const (
+	ocspSuccessful       = 0
+	ocspMalformedRequest = 1
+	ocspInternalError    = 2
+	ocspUnauthorized     = 6
+)
+
+// ocspHashOID returns the algorithm identifier of the hash
+func ocspHashOID(hash crypto.Hash) (oid asn1.ObjectIdentifier) {
+	for _, h := range ocspHashes {
+		if h.hash == hash {
+			return h.oid
+		}
+	}
+	return nil
+}
+
+// ---------- ASN.1 structures of RFC 6960 ----------
+
+type ocspCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspSingleRequest struct {
+	CertID     ocspCertID
+	Extensions []pkix.Extension `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspTBSRequest struct {
+	Version       int           `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	RequestList   []ocspSingleRequest
+	Extensions    []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type ocspRequest struct {
+	TBSRequest        ocspTBSRequest
+	OptionalSignature asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID           ocspCertID
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          ocspRevokedInfo  `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspResponseData struct {
+	Version            int `asn1:"explicit,tag:0,default:0,optional"`
+	ResponderID        asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []ocspSingleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm        pkix.AlgorithmIdentifier
+	SubjectPublicKey asn1.BitString
+}
+
+// ---------- Responder ----------
+
+type cachedOCSPResponse struct {
+	response []byte
+	refresh  time.Time
+}
+
+// OCSPResponder answers OCSP requests (RFC 6960) for the certificates of a CA, based on
+// the revocations in the store of the CA. Responses for good certificates without a
+// nonce are cached until half of their validity has passed, up to a maximum number of
+// responses. During the overlap window of
+// a key rollover it also answers for the certificates issued by the old key.
+type OCSPResponder struct {
+	ca *CA
+	// signer, signatureAlgorithm and certificate belong to a delegated responder, which
+	// is certified by issuer. Without certificate the key of the CA signs.
+	signer             crypto.Signer
+	signatureAlgorithm x509.SignatureAlgorithm
+	certificate        *x509.Certificate
+	issuer             *x509.Certificate
+	validity           time.Duration
+	mutex              sync.Mutex
+	cache              map[string]*cachedOCSPResponse
+	cacheSize          int
+}
+
+// NewOCSPResponder creates a responder which signs with the key and signature algorithm
+// of the CA that issued the certificate in the request
+func NewOCSPResponder(ca *CA) (r *OCSPResponder, e error) {
+	return newOCSPResponder(ca, nil, nil, nil, x509.UnknownSignatureAlgorithm), nil
+}
+
+// NewDelegatedOCSPResponder creates a responder which signs with a delegated OCSP signing
+// certificate issued by the CA, see CreateOCSPSigningCertificate
+func NewDelegatedOCSPResponder(ca *CA, cert []byte, signer crypto.Signer) (r *OCSPResponder, e error) {
+	certif, err := x509.ParseCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+	var issuer *x509.Certificate
+	for _, key := range ca.revocationKeys() {
+		err = certif.CheckSignatureFrom(key.certificate)
+		if err == nil {
+			issuer = key.certificate
+			break
+		}
+	}
+	if issuer == nil {
+		return nil, errors.New("OCSP signing certificate is not issued by the CA: " + err.Error())
+	}
+	delegated := false
+	for _, usage := range certif.ExtKeyUsage {
+		delegated = delegated || usage == x509.ExtKeyUsageOCSPSigning
+	}
+	if !delegated {
+		return nil, errors.New("certificate has no OCSP signing extended key usage")
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(certif.PublicKey) {
+		return nil, errors.New("signer does not match the OCSP signing certificate")
+	}
+	return newOCSPResponder(ca, certif, issuer, signer, DefaultSignatureAlgorithm(signer.Public())), nil
+}
+
+func newOCSPResponder(ca *CA, certificate *x509.Certificate, issuer *x509.Certificate, signer crypto.Signer, algorithm x509.SignatureAlgorithm) (r *OCSPResponder) {
+	return &OCSPResponder{
+		ca:                 ca,
+		signer:             signer,
+		signatureAlgorithm: algorithm,
+		certificate:        certificate,
+		issuer:             issuer,
+		validity:           DefaultOCSPValidity,
+		cache:              map[string]*cachedOCSPResponse{},
+		cacheSize:          DefaultOCSPCacheSize,
+	}
+}
+
+// ocspSigningProfile is the profile of delegated OCSP responders, which are not checked
+// for revocation themselves
+func ocspSigningProfile() (p *Profile) {
+	return &Profile{
+		Name:        ProfileOCSPSigning,
+		Validity:    30 * 24 * time.Hour,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidOCSPNoCheck, Value: asn1.NullBytes},
+		},
+	}
+}
+
+// CreateOCSPSigningCertificate issues a certificate for a delegated OCSP responder
+func (ca *CA)CreateOCSPSigningCertificate(dn string, pub crypto.PublicKey) (cert []byte, err error) {
+	return ca.createTLSCertificate(ProfileOCSPSigning, dn, pub, nil)
+}
+
+// SetValidity sets the time between thisUpdate and nextUpdate of the responses
+func (r *OCSPResponder)SetValidity(validity time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.validity = validity
+	r.cache = map[string]*cachedOCSPResponse{}
+}
+
+// SetCacheSize sets the maximum number of cached responses, 0 disables the cache
+func (r *OCSPResponder)SetCacheSize(size int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.cacheSize = size
+	r.cache = map[string]*cachedOCSPResponse{}
+}
+
+// cacheResponse adds the response to the cache, the caller holds the mutex. A full cache
+// first drops the responses to refresh, then the one closest to its refresh.
+func (r *OCSPResponder)cacheResponse(key string, response *cachedOCSPResponse, now time.Time) {
+	if r.cacheSize <= 0 {
+		return
+	}
+	if _, ok := r.cache[key]; !ok && len(r.cache) >= r.cacheSize {
+		for k, cached := range r.cache {
+			if !now.Before(cached.refresh) {
+				delete(r.cache, k)
+			}
+		}
+		for len(r.cache) >= r.cacheSize {
+			var oldest string
+			for k, cached := range r.cache {
+				if oldest == "" || cached.refresh.Before(r.cache[oldest].refresh) {
+					oldest = k
+				}
+			}
+			delete(r.cache, oldest)
+		}
+	}
+	r.cache[key] = response
+}
+
+func ocspHash(algorithm pkix.AlgorithmIdentifier) (h crypto.Hash, e error) {
+	for _, known := range ocspHashes {
+		if known.oid.Equal(algorithm.Algorithm) {
+			return known.hash, nil
+		}
+	}
+	return 0, errors.New("unsupported hash algorithm in OCSP request")
+}
+
+// issuedBy verifies the issuer name and key hash of the CertID against the CA certificate
+func issuedBy(certID *ocspCertID, cert *x509.Certificate) (b bool, e error) {
+	hash, err := ocspHash(certID.HashAlgorithm)
+	if err != nil {
+		return false, err
+	}
+
+	var spki subjectPublicKeyInfo
+	_, err = asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki)
+	if err != nil {
+		return false, err
+	}
+
+	h := hash.New()
+	h.Write(cert.RawSubject)
+	nameHash := h.Sum(nil)
+	h.Reset()
+	h.Write(spki.SubjectPublicKey.RightAlign())
+	keyHash := h.Sum(nil)
+
+	return bytes.Equal(nameHash, certID.IssuerNameHash) && bytes.Equal(keyHash, certID.IssuerKeyHash), nil
+}
+
+// issuingKey returns the key of the CA which issued the certificate of the CertID, nil
+// when the CertID is not of this CA or its key is not answered for by the responder
+func (r *OCSPResponder)issuingKey(certID *ocspCertID, keys []issuingKey) (k *issuingKey, e error) {
+	for i := range keys {
+		ours, err := issuedBy(certID, keys[i].certificate)
+		if err != nil {
+			return nil, err
+		}
+		if !ours {
+			continue
+		}
+		if r.certificate != nil && !r.issuer.Equal(keys[i].certificate) {
+			return nil, nil
+		}
+		return &keys[i], nil
+	}
+	return nil, nil
+}
+
+func ocspErrorResponse(status int) (b []byte) {
+	response, _ := asn1.Marshal(ocspResponse{Status: asn1.Enumerated(status)})
+	return response
+}
+
+func ocspNonce(request *ocspRequest) (n *pkix.Extension, e error) {
+	for _, extension := range request.TBSRequest.Extensions {
+		if !extension.Id.Equal(oidOCSPNonce) {
+			continue
+		}
+		var nonce []byte
+		_, err := asn1.Unmarshal(extension.Value, &nonce)
+		if err != nil || len(nonce) == 0 || len(nonce) > maxOCSPNonceLength {
+			return nil, errors.New("invalid OCSP nonce")
+		}
+		return &pkix.Extension{Id: oidOCSPNonce, Value: extension.Value}, nil
+	}
+	return nil, nil
+}
+
+// singleResponse returns the status of the certificate in the CertID
+func (r *OCSPResponder)singleResponse(certID *ocspCertID, now time.Time, validity time.Duration) (s ocspSingleResponse, good bool, e error) {
+	s = ocspSingleResponse{
+		CertID:     *certID,
+		ThisUpdate: now,
+		NextUpdate: now.Add(validity),
+	}
+
+	r.ca.mutex.Lock()
+	store := r.ca.store
+	r.ca.mutex.Unlock()
+
+	revocation, err := store.Revocation(r.ca.Name, certID.SerialNumber)
+	if err != nil {
+		return s, false, err
+	}
+	if revocation != nil {
+		s.Revoked = ocspRevokedInfo{
+			RevocationTime: revocation.RevocationTime.UTC(),
+			Reason:         asn1.Enumerated(revocation.Reason),
+		}
+		return s, false, nil
+	}
+
+	issued, err := store.SerialNumberExists(r.ca.Name, certID.SerialNumber)
+	if err != nil {
+		return s, false, err
+	}
+	if !issued {
+		s.Unknown = true
+		return s, false, nil
+	}
+
+	s.Good = true
+	return s, true, nil
+}
+
+// signResponse creates a successful OCSP response signed by the delegated responder or
+// else by the key of the CA
+func (r *OCSPResponder)signResponse(key *issuingKey, responses []ocspSingleResponse, now time.Time, nonce *pkix.Extension) (b []byte, e error) {
+	certificate, signer, algorithm := key.certificate, key.signer, key.algorithm
+	if r.certificate != nil {
+		certificate, signer, algorithm = r.certificate, r.signer, r.signatureAlgorithm
+	}
+	var spki subjectPublicKeyInfo
+	_, err := asn1.Unmarshal(certificate.RawSubjectPublicKeyInfo, &spki)
+	if err != nil {
+		return nil, err
+	}
+	keyHash := sha1.Sum(spki.SubjectPublicKey.RightAlign())
+	responderID, err := asn1.Marshal(keyHash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	data := ocspResponseData{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: responderID},
+		ProducedAt:  now,
+		Responses:   responses,
+	}
+	if nonce != nil {
+		data.ResponseExtensions = []pkix.Extension{*nonce}
+	}
+	tbs, err := asn1.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithmIdentifier, signature, err := signData(signer, algorithm, tbs)
+	if err != nil {
+		return nil, err
+	}
+	basic := ocspBasicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: algorithmIdentifier,
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	}
+	if r.certificate != nil {
+		basic.Certificates = []asn1.RawValue{{FullBytes: r.certificate.Raw}}
+	}
+	basicDER, err := asn1.Marshal(basic)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(ocspResponse{
+		Status:   ocspSuccessful,
+		Response: ocspResponseBytes{ResponseType: oidOCSPBasic, Response: basicDER},
+	})
+}
+
+// Respond answers the DER encoded OCSP request with a DER encoded OCSP response. Errors
+// in the request are reported in the response status.
+func (r *OCSPResponder)Respond(requestDER []byte) (response []byte) {
+	response, _ = r.respond(requestDER)
+	return response
+}
+
+// respond also returns whether the response may be cached by HTTP caches
+func (r *OCSPResponder)respond(requestDER []byte) (response []byte, cacheable bool) {
+	var request ocspRequest
+	rest, err := asn1.Unmarshal(requestDER, &request)
+	if err != nil || len(rest) > 0 || len(request.TBSRequest.RequestList) == 0 {
+		return ocspErrorResponse(ocspMalformedRequest), false
+	}
+	nonce, err := ocspNonce(&request)
+	if err != nil {
+		return ocspErrorResponse(ocspMalformedRequest), false
+	}
+
+	// one response is signed by one key, so all the certificates are of the same key
+	keys := r.ca.revocationKeys()
+	var signingKey *issuingKey
+	for i := range request.TBSRequest.RequestList {
+		issuer, err := r.issuingKey(&request.TBSRequest.RequestList[i].CertID, keys)
+		if err != nil {
+			return ocspErrorResponse(ocspMalformedRequest), false
+		}
+		if issuer == nil || signingKey != nil && signingKey != issuer {
+			return ocspErrorResponse(ocspUnauthorized), false
+		}
+		signingKey = issuer
+	}
+
+	r.mutex.Lock()
+	validity := r.validity
+	r.mutex.Unlock()
+	now := r.ca.Clock().Now().UTC().Truncate(time.Second)
+
+	var responses []ocspSingleResponse
+	allGood := true
+	for i := range request.TBSRequest.RequestList {
+		single, good, err := r.singleResponse(&request.TBSRequest.RequestList[i].CertID, now, validity)
+		if err != nil {
+			return ocspErrorResponse(ocspInternalError), false
+		}
+		allGood = allGood && good
+		responses = append(responses, single)
+	}
+
+	// pre-signed responses only for a single good certificate without nonce
+	cacheable = allGood && len(responses) == 1 && nonce == nil
+	var key string
+	if cacheable {
+		certID, _ := asn1.Marshal(request.TBSRequest.RequestList[0].CertID)
+		key = string(certID)
+		r.mutex.Lock()
+		cached := r.cache[key]
+		r.mutex.Unlock()
+		if cached != nil && now.Before(cached.refresh) {
+			return cached.response, true
+		}
+	}
+
+	response, err = r.signResponse(signingKey, responses, now, nonce)
+	if err != nil {
+		return ocspErrorResponse(ocspInternalError), false
+	}
+
+	if cacheable {
+		r.mutex.Lock()
+		r.cacheResponse(key, &cachedOCSPResponse{response, now.Add(validity / 2)}, now)
+		r.mutex.Unlock()
+	}
+	return response, cacheable
+}
+
+// ServeHTTP answers OCSP requests sent with GET (base64 encoded in the path) or POST
+func (r *OCSPResponder)ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var request []byte
+	var err error
+
+	switch req.Method {
+	case http.MethodGet:
+		// the base64 request may contain slashes, so the whole path is the request
+		encoded := strings.TrimPrefix(req.URL.Path, "/")
+		if req.URL.RawPath != "" {
+			encoded, err = url.PathUnescape(strings.TrimPrefix(req.URL.RawPath, "/"))
+		}
+		if err == nil {
+			request, err = base64.StdEncoding.DecodeString(encoded)
+		}
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != "application/ocsp-request" {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		request, err = ioutil.ReadAll(http.MaxBytesReader(w, req.Body, 64*1024))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response, cacheable := ocspErrorResponse(ocspMalformedRequest), false
+	if err == nil {
+		response, cacheable = r.respond(request)
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	if cacheable && req.Method == http.MethodGet {
+		r.mutex.Lock()
+		maxAge := int(r.validity / 2 / time.Second)
+		r.mutex.Unlock()
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(maxAge)+", public, no-transform, must-revalidate")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Write(response)
+}
@@ -0,0 +1,326 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func newOCSPTestCA(t *testing.T) (ca *CA, certs []*x509.Certificate) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, err := NewCA("CN=GoPKI OCSP,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal("NewCA failed: ", err)
+	}
+	tlsKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	for i := 0; i < 2; i++ {
+		cert, err := ca.CreateTLSServerCertificate("CN=SSL Server", tlsKey.Public())
+		if err != nil {
+			t.Fatal("CreateTLSServerCertificate failed: ", err)
+		}
+		certif, _ := x509.ParseCertificate(cert)
+		certs = append(certs, certif)
+	}
+	return ca, certs
+}
+
+func postOCSP(t *testing.T, server *httptest.Server, request []byte) (response []byte) {
+	resp, err := http.Post(server.URL, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		t.Fatal("POST failed: ", err)
+	}
+	defer resp.Body.Close()
+	response, _ = ioutil.ReadAll(resp.Body)
+	return response
+}
+
+func TestOCSPResponder(t *testing.T) {
+	// Arrange
+	ca, certs := newOCSPTestCA(t)
+	ca.Revoke(certs[1].SerialNumber, ReasonKeyCompromise, time.Time{})
+	responder, err := NewOCSPResponder(ca)
+	if err != nil {
+		t.Error("NewOCSPResponder failed: ", err)
+		return
+	}
+	server := httptest.NewServer(responder)
+	defer server.Close()
+
+	goodRequest, _ := ocsp.CreateRequest(certs[0], ca.Certificate, &ocsp.RequestOptions{})
+	revokedRequest, _ := ocsp.CreateRequest(certs[1], ca.Certificate, nil)
+
+	// Act
+	good, err := ocsp.ParseResponseForCert(postOCSP(t, server, goodRequest), certs[0], ca.Certificate)
+	if err != nil {
+		t.Error("ParseResponse of good certificate failed: ", err)
+		return
+	}
+	revoked, err := ocsp.ParseResponseForCert(postOCSP(t, server, revokedRequest), certs[1], ca.Certificate)
+	if err != nil {
+		t.Error("ParseResponse of revoked certificate failed: ", err)
+		return
+	}
+
+	// Assert
+	if good.Status != ocsp.Good {
+		t.Error("Certificate is not good: ", good.Status)
+	}
+	if good.NextUpdate.Sub(good.ThisUpdate) != DefaultOCSPValidity {
+		t.Error("Unexpected next update: ", good.NextUpdate)
+	}
+	if revoked.Status != ocsp.Revoked || revoked.RevocationReason != ocsp.KeyCompromise {
+		t.Error("Certificate is not revoked: ", revoked.Status, revoked.RevocationReason)
+	}
+}
+
+func TestOCSPResponderGET(t *testing.T) {
+	// Arrange
+	ca, certs := newOCSPTestCA(t)
+	responder, _ := NewOCSPResponder(ca)
+	server := httptest.NewServer(http.StripPrefix("/ocsp", responder))
+	defer server.Close()
+	request, _ := ocsp.CreateRequest(certs[0], ca.Certificate, nil)
+
+	// Act
+	resp, err := http.Get(server.URL + "/ocsp/" + base64.StdEncoding.EncodeToString(request))
+	if err != nil {
+		t.Error("GET failed: ", err)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	// Assert
+	if resp.Header.Get("Content-Type") != "application/ocsp-response" {
+		t.Error("Unexpected content type: ", resp.Header.Get("Content-Type"))
+	}
+	response, err := ocsp.ParseResponseForCert(body, certs[0], ca.Certificate)
+	if err != nil || response.Status != ocsp.Good {
+		t.Error("GET response is not good: ", err)
+	}
+}
+
+func TestOCSPResponderCache(t *testing.T) {
+	// Arrange
+	ca, certs := newOCSPTestCA(t)
+	responder, _ := NewOCSPResponder(ca)
+	request, _ := ocsp.CreateRequest(certs[0], ca.Certificate, nil)
+
+	// Act
+	first := responder.Respond(request)
+	second := responder.Respond(request)
+	ca.Revoke(certs[0].SerialNumber, ReasonSuperseded, time.Time{})
+	afterRevocation := responder.Respond(request)
+
+	// Assert
+	if !bytes.Equal(first, second) {
+		t.Error("Response of good certificate is not cached")
+	}
+	response, err := ocsp.ParseResponseForCert(afterRevocation, certs[0], ca.Certificate)
+	if err != nil || response.Status != ocsp.Revoked {
+		t.Error("Cached response is used after revocation: ", err)
+	}
+}
+
+func TestOCSPResponderCacheSize(t *testing.T) {
+	// Arrange
+	ca, certs := newOCSPTestCA(t)
+	responder, _ := NewOCSPResponder(ca)
+	responder.SetCacheSize(1)
+	first, _ := ocsp.CreateRequest(certs[0], ca.Certificate, nil)
+	second, _ := ocsp.CreateRequest(certs[1], ca.Certificate, nil)
+
+	// Act
+	responder.Respond(first)
+	responder.Respond(second)
+	again := responder.Respond(second)
+
+	// Assert
+	if len(responder.cache) != 1 {
+		t.Error("Cache exceeds its size: ", len(responder.cache))
+	}
+	response, err := ocsp.ParseResponseForCert(again, certs[1], ca.Certificate)
+	if err != nil || response.Status != ocsp.Good {
+		t.Error("Response of a full cache is wrong: ", err)
+	}
+	responder.SetCacheSize(0)
+	responder.Respond(first)
+	if len(responder.cache) != 0 {
+		t.Error("Disabled cache holds responses: ", len(responder.cache))
+	}
+}
+
+// ocspRawResponseData keeps the encoding of the single responses
+type ocspRawResponseData struct {
+	Version     int `asn1:"explicit,tag:0,default:0,optional"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []asn1.RawValue
+}
+
+func TestOCSPResponderEncoding(t *testing.T) {
+	// Arrange
+	ca, certs := newOCSPTestCA(t)
+	tlsKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	unspecified, _ := ca.CreateTLSServerCertificate("CN=SSL Server", tlsKey.Public())
+	unspecifiedCert, _ := x509.ParseCertificate(unspecified)
+	ca.Revoke(certs[1].SerialNumber, ReasonKeyCompromise, time.Time{})
+	ca.Revoke(unspecifiedCert.SerialNumber, ReasonUnspecified, time.Time{})
+	unknownCert := *certs[0]
+	unknownCert.SerialNumber = big.NewInt(424242)
+	responder, _ := NewOCSPResponder(ca)
+	var spki subjectPublicKeyInfo
+	asn1.Unmarshal(ca.Certificate.RawSubjectPublicKeyInfo, &spki)
+	keyHash := sha1.Sum(spki.SubjectPublicKey.RightAlign())
+
+	for _, cert := range []*x509.Certificate{certs[0], certs[1], unspecifiedCert, &unknownCert} {
+		request, _ := ocsp.CreateRequest(cert, ca.Certificate, nil)
+
+		// Act
+		responseDER := responder.Respond(request)
+
+		// Assert
+		response, err := ocsp.ParseResponse(responseDER, ca.Certificate)
+		if err != nil {
+			t.Error("ParseResponse failed: ", err)
+			return
+		}
+		referenceDER, err := ocsp.CreateResponse(ca.Certificate, ca.Certificate, ocsp.Response{
+			Status:           response.Status,
+			SerialNumber:     cert.SerialNumber,
+			ThisUpdate:       response.ThisUpdate,
+			NextUpdate:       response.NextUpdate,
+			RevokedAt:        response.RevokedAt,
+			RevocationReason: response.RevocationReason,
+		}, ca.priv)
+		if err != nil {
+			t.Error("CreateResponse failed: ", err)
+			return
+		}
+		reference, _ := ocsp.ParseResponse(referenceDER, ca.Certificate)
+		var data, referenceData ocspRawResponseData
+		asn1.Unmarshal(response.TBSResponseData, &data)
+		asn1.Unmarshal(reference.TBSResponseData, &referenceData)
+		if len(data.Responses) != 1 || len(referenceData.Responses) != 1 ||
+			!bytes.Equal(data.Responses[0].FullBytes, referenceData.Responses[0].FullBytes) {
+			t.Error("Single response differs from x/crypto/ocsp for serial number ", cert.SerialNumber)
+		}
+		// x/crypto/ocsp identifies the responder by name, the responder by key hash
+		if !bytes.Equal(response.ResponderKeyHash, keyHash[:]) {
+			t.Error("Responder ID is not the key hash of the CA: ", response.ResponderKeyHash)
+		}
+	}
+}
+
+func TestOCSPResponderUnknown(t *testing.T) {
+	// Arrange
+	ca, certs := newOCSPTestCA(t)
+	other, otherCerts := newOCSPTestCA(t)
+	responder, _ := NewOCSPResponder(ca)
+	// same issuer, but a serial number the CA never issued
+	unknownCert := *certs[0]
+	unknownCert.SerialNumber = otherCerts[0].SerialNumber
+	unknownRequest, _ := ocsp.CreateRequest(&unknownCert, ca.Certificate, nil)
+	otherRequest, _ := ocsp.CreateRequest(otherCerts[0], other.Certificate, nil)
+
+	// Act
+	unknown, err := ocsp.ParseResponse(responder.Respond(unknownRequest), ca.Certificate)
+	otherResponse := responder.Respond(otherRequest)
+	malformedResponse := responder.Respond([]byte("garbage"))
+
+	// Assert
+	if err != nil || unknown.Status != ocsp.Unknown {
+		t.Error("Serial number is not unknown: ", err)
+	}
+	if !bytes.Equal(otherResponse, ocsp.UnauthorizedErrorResponse) {
+		t.Error("Request for another CA is not unauthorized")
+	}
+	if !bytes.Equal(malformedResponse, ocsp.MalformedRequestErrorResponse) {
+		t.Error("Garbage is not a malformed request")
+	}
+}
+
+func TestOCSPResponderNonce(t *testing.T) {
+	// Arrange
+	ca, certs := newOCSPTestCA(t)
+	responder, _ := NewOCSPResponder(ca)
+	plain, _ := ocsp.CreateRequest(certs[0], ca.Certificate, nil)
+	var request ocspRequest
+	asn1.Unmarshal(plain, &request)
+	nonce, _ := asn1.Marshal([]byte("0123456789abcdef"))
+	request.TBSRequest.Extensions = []pkix.Extension{{Id: oidOCSPNonce, Value: nonce}}
+	withNonce, _ := asn1.Marshal(request)
+
+	// Act
+	first := responder.Respond(withNonce)
+	second := responder.Respond(withNonce)
+
+	// Assert
+	if _, err := ocsp.ParseResponseForCert(first, certs[0], ca.Certificate); err != nil {
+		t.Error("ParseResponse failed: ", err)
+		return
+	}
+	var response ocspResponse
+	var basic ocspBasicResponse
+	var data ocspResponseData
+	asn1.Unmarshal(first, &response)
+	asn1.Unmarshal(response.Response.Response, &basic)
+	asn1.Unmarshal(basic.TBSResponseData.FullBytes, &data)
+	if len(data.ResponseExtensions) != 1 || !bytes.Equal(data.ResponseExtensions[0].Value, nonce) {
+		t.Error("Nonce is not in the response: ", data.ResponseExtensions)
+	}
+	if bytes.Equal(first, second) {
+		t.Error("Responses with a nonce must not be cached")
+	}
+}
+
+func TestDelegatedOCSPResponder(t *testing.T) {
+	// Arrange
+	ca, certs := newOCSPTestCA(t)
+	ocspKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ocspCert, err := ca.CreateOCSPSigningCertificate("CN=GoPKI OCSP Responder", ocspKey.Public())
+	if err != nil {
+		t.Error("CreateOCSPSigningCertificate failed: ", err)
+		return
+	}
+	responder, err := NewDelegatedOCSPResponder(ca, ocspCert, ocspKey)
+	if err != nil {
+		t.Error("NewDelegatedOCSPResponder failed: ", err)
+		return
+	}
+	request, _ := ocsp.CreateRequest(certs[0], ca.Certificate, nil)
+
+	// Act
+	response, err := ocsp.ParseResponseForCert(responder.Respond(request), certs[0], ca.Certificate)
+
+	// Assert
+	if err != nil {
+		t.Error("ParseResponse failed: ", err)
+		return
+	}
+	if response.Certificate == nil || !bytes.Equal(response.Certificate.Raw, ocspCert) {
+		t.Error("Response does not contain the delegated responder certificate")
+	}
+
+	// a TLS certificate cannot be used as delegated responder
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tlsCert, _ := ca.CreateTLSServerCertificate("CN=SSL Server", otherKey.Public())
+	_, err = NewDelegatedOCSPResponder(ca, tlsCert, otherKey)
+	if err == nil {
+		t.Error("NewDelegatedOCSPResponder must refuse a certificate without OCSP signing usage")
+	}
+}
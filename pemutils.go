@@ -2,14 +2,206 @@ package gopki
 
 import (
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
+	"errors"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
+	"strconv"
+
+	"golang.org/x/crypto/pbkdf2"
 )
 
+// ---------- Encrypted PKCS#8 (RFC 5958, PBES2 of RFC 8018) ----------
+
+// PKCS8Iterations is the PBKDF2 iteration count of the private keys encrypted by
+// StorePrivateKeyPem, at most maxPKCS8Iterations
+var PKCS8Iterations = 600000
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// maxPKCS8Iterations bounds the PBKDF2 iteration count of the keys decrypted, so a crafted
+// key file can't keep the CPU busy for hours
+const maxPKCS8Iterations = 10000000
+
+// pbes2Key is an AES-256 key derived from a password with PBKDF2 and HMAC-SHA256 and a
+// fresh salt, it encrypts a single private key so no two outputs share the salt
+type pbes2Key struct {
+	salt       []byte
+	iterations int
+	key        []byte
+}
+
+func derivePBES2Key(password []byte) (k *pbes2Key, e error) {
+	if PKCS8Iterations <= 0 || PKCS8Iterations > maxPKCS8Iterations {
+		return nil, errors.New("PKCS8Iterations out of range: " + strconv.Itoa(PKCS8Iterations))
+	}
+	salt := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &pbes2Key{
+		salt:       salt,
+		iterations: PKCS8Iterations,
+		key:        pbkdf2.Key(password, salt, PKCS8Iterations, 32, sha256.New),
+	}, nil
+}
+
+// encryptPKCS8 encrypts the PKCS#8 private key with PBES2, PBKDF2 with HMAC-SHA256 and
+// AES-256-CBC, the scheme OpenSSL uses by default
+func (k *pbes2Key)encryptPKCS8(der []byte) (b []byte, e error) {
+	iv := make([]byte, aes.BlockSize)
+	_, err := io.ReadFull(rand.Reader, iv)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k.key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	encrypted := append(append([]byte{}, der...), make([]byte, padding)...)
+	for i := len(der); i < len(encrypted); i++ {
+		encrypted[i] = byte(padding)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           k.salt,
+		IterationCount: k.iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		EncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData:       encrypted,
+	})
+}
+
+// decryptPKCS8 decrypts an encrypted PKCS#8 private key with PBES2, PBKDF2 with HMAC-SHA1
+// or HMAC-SHA256 and AES-CBC
+func decryptPKCS8(der []byte, password []byte) (b []byte, e error) {
+	var info encryptedPrivateKeyInfo
+	rest, err := asn1.Unmarshal(der, &info)
+	if err != nil || len(rest) > 0 {
+		return nil, errors.New("invalid encrypted private key")
+	}
+	if !info.EncryptionAlgorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.New("unsupported private key encryption, only PBES2 is supported")
+	}
+	var params pbes2Params
+	_, err = asn1.Unmarshal(info.EncryptionAlgorithm.Parameters.FullBytes, &params)
+	if err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, errors.New("unsupported key derivation of the private key, only PBKDF2 is supported")
+	}
+	var kdf pbkdf2Params
+	_, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf)
+	if err != nil {
+		return nil, err
+	}
+	if kdf.IterationCount <= 0 || kdf.IterationCount > maxPKCS8Iterations {
+		return nil, errors.New("invalid PBKDF2 iteration count of the private key: " + strconv.Itoa(kdf.IterationCount))
+	}
+	var prf func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil || kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	default:
+		return nil, errors.New("unsupported PBKDF2 pseudorandom function of the private key")
+	}
+	var keyLength int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLength = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLength = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLength = 32
+	default:
+		return nil, errors.New("unsupported cipher of the private key, only AES-CBC is supported")
+	}
+	var iv []byte
+	_, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid IV of the private key")
+	}
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted private key")
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(password, kdf.Salt, kdf.IterationCount, keyLength, prf))
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, info.EncryptedData)
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("private key decryption failed, wrong password")
+	}
+	for _, b := range decrypted[len(decrypted)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("private key decryption failed, wrong password")
+		}
+	}
+	return decrypted[:len(decrypted)-padding], nil
+}
+
+// ---------- PEM files ----------
+
 func LoadPrivateKeyPem(in io.Reader, password []byte) (p crypto.PrivateKey, e error) {
 
 	encPrivateKey, err := ioutil.ReadAll(in)
@@ -18,10 +210,19 @@ func LoadPrivateKeyPem(in io.Reader, password []byte) (p crypto.PrivateKey, e er
 	}
 
 	block, _ := pem.Decode(encPrivateKey)
+	if block == nil {
+		return nil, errors.New("no PRIVATE KEY PEM block found")
+	}
 
 	var bytesPrivateKey []byte
 	var privateKey crypto.PrivateKey
-	if x509.IsEncryptedPEMBlock(block) {
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		bytesPrivateKey, err = decryptPKCS8(block.Bytes, password)
+		if err != nil {
+			return nil, err
+		}
+	} else if x509.IsEncryptedPEMBlock(block) {
+		// legacy RFC 1423 encryption, only read
 		bytesPrivateKey, err = x509.DecryptPEMBlock(block, password)
 		if err != nil {
 			return nil, err
@@ -49,6 +250,8 @@ func LoadPrivateKeyPem(in io.Reader, password []byte) (p crypto.PrivateKey, e er
 	return nil, err
 }
 
+// StorePrivateKeyPem writes the private key as PKCS#8, with a password it is an encrypted
+// PKCS#8 key (PBES2 with PBKDF2 and AES-256-CBC)
 func StorePrivateKeyPem(out io.Writer, p crypto.PrivateKey, password []byte) ( e error) {
 
 	bytesPrivateKey, err := x509.MarshalPKCS8PrivateKey(p)
@@ -57,11 +260,11 @@ func StorePrivateKeyPem(out io.Writer, p crypto.PrivateKey, password []byte) ( e
 	}
 
 	if password != nil {
-		block, err := x509.EncryptPEMBlock(rand.Reader, "PRIVATE KEY", bytesPrivateKey, password, x509.PEMCipherAES256)
+		key, err := derivePBES2Key(password)
 		if err != nil {
 			return err
 		}
-		return pem.Encode(out, block)
+		return storeEncryptedPrivateKeyPem(out, bytesPrivateKey, key)
 	}
 
 	block := pem.Block{
@@ -72,6 +275,15 @@ func StorePrivateKeyPem(out io.Writer, p crypto.PrivateKey, password []byte) ( e
 	return pem.Encode(out, &block)
 }
 
+// storeEncryptedPrivateKeyPem writes the PKCS#8 key encrypted with a key derived for it
+func storeEncryptedPrivateKeyPem(out io.Writer, pkcs8 []byte, key *pbes2Key) (e error) {
+	encrypted, err := key.encryptPKCS8(pkcs8)
+	if err != nil {
+		return err
+	}
+	return pem.Encode(out, &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: encrypted})
+}
+
 func LoadCertificate(in io.Reader) (c []byte, e error) {
 	buf, err := ioutil.ReadAll(in)
 	if err != nil {
@@ -79,6 +291,9 @@ func LoadCertificate(in io.Reader) (c []byte, e error) {
 	}
 
 	cert, _ := pem.Decode(buf)
+	if cert == nil || cert.Type != "CERTIFICATE" {
+		return nil, errors.New("no CERTIFICATE PEM block found")
+	}
 
 	return cert.Bytes, nil
 }
@@ -94,4 +309,67 @@ func StoreCertificate(out io.Writer, cert []byte) (err error) {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+func LoadCertificateRequest(in io.Reader) (c []byte, e error) {
+	buf, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, _ := pem.Decode(buf)
+	if csr == nil || (csr.Type != "CERTIFICATE REQUEST" && csr.Type != "NEW CERTIFICATE REQUEST") {
+		return nil, errors.New("no CERTIFICATE REQUEST PEM block found")
+	}
+
+	return csr.Bytes, nil
+}
+
+func StoreCertificateRequest(out io.Writer, csr []byte) (err error) {
+	var pemCertificateRequest = &pem.Block{
+		Type:    "CERTIFICATE REQUEST",
+		Bytes:   csr,
+	}
+	err = pem.Encode(out, pemCertificateRequest)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// LoadCRL reads a PEM or DER encoded CRL and returns it DER encoded
+func LoadCRL(in io.Reader) (c []byte, e error) {
+	buf, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	crl, _ := pem.Decode(buf)
+	if crl == nil {
+		// not PEM, so it must be DER
+		_, err = x509.ParseRevocationList(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	if crl.Type != "X509 CRL" {
+		return nil, errors.New("no X509 CRL PEM block found")
+	}
+
+	return crl.Bytes, nil
+}
+
+func StoreCRL(out io.Writer, crl []byte) (err error) {
+	var pemCRL = &pem.Block{
+		Type:    "X509 CRL",
+		Bytes:   crl,
+	}
+	return pem.Encode(out, pemCRL)
+}
+
+func StoreCRLDer(out io.Writer, crl []byte) (err error) {
+	_, err = out.Write(crl)
+	return err
+}
@@ -0,0 +1,574 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"strconv"
+)
+
+var (
+	oidCertificatePolicies = asn1.ObjectIdentifier{2, 5, 29, 32}
+	oidAnyPolicy           = asn1.ObjectIdentifier{2, 5, 29, 32, 0}
+	oidPolicyMappings      = asn1.ObjectIdentifier{2, 5, 29, 33}
+	oidPolicyConstraints   = asn1.ObjectIdentifier{2, 5, 29, 36}
+	oidInhibitAnyPolicy    = asn1.ObjectIdentifier{2, 5, 29, 54}
+	oidQualifierCPS        = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 1}
+	oidQualifierUserNotice = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 2}
+)
+
+// AnyPolicy is the special policy which stands for all policies
+var AnyPolicy = oidAnyPolicy
+
+// PolicyInformation is a certificate policy, the policy OIDs are the zones a certificate
+// belongs to
+type PolicyInformation struct {
+	OID asn1.ObjectIdentifier
+	// CPSURI points to the certification practice statement of the policy, it is optional
+	CPSURI string
+	// UserNotice is an optional text to display to relying parties
+	UserNotice string
+}
+
+// PolicyConstraints limit the policy processing of the chains through a CA certificate, a
+// negative value leaves the constraint out
+type PolicyConstraints struct {
+	// RequireExplicitPolicy is the number of certificates after which every certificate
+	// needs a valid policy
+	RequireExplicitPolicy int
+	// InhibitPolicyMapping is the number of certificates after which policy mapping stops
+	InhibitPolicyMapping int
+	// InhibitAnyPolicy is the number of certificates after which anyPolicy is no longer
+	// accepted
+	InhibitAnyPolicy int
+}
+
+// ---------- Encoding ----------
+
+type policyQualifierInfo struct {
+	PolicyQualifierId asn1.ObjectIdentifier
+	Qualifier         asn1.RawValue
+}
+
+type policyInformation struct {
+	Policy     asn1.ObjectIdentifier
+	Qualifiers []policyQualifierInfo `asn1:"optional,omitempty"`
+}
+
+type userNotice struct {
+	ExplicitText string `asn1:"utf8"`
+}
+
+type policyMapping struct {
+	IssuerDomainPolicy  asn1.ObjectIdentifier
+	SubjectDomainPolicy asn1.ObjectIdentifier
+}
+
+// certificatePoliciesExtension encodes the policies with their qualifiers, crypto/x509
+// only supports the policy OIDs
+func certificatePoliciesExtension(policies []PolicyInformation) (ext pkix.Extension, e error) {
+	var infos []policyInformation
+	for _, policy := range policies {
+		info := policyInformation{Policy: policy.OID}
+		if policy.CPSURI != "" {
+			cps, err := asn1.MarshalWithParams(policy.CPSURI, "ia5")
+			if err != nil {
+				return ext, err
+			}
+			info.Qualifiers = append(info.Qualifiers, policyQualifierInfo{oidQualifierCPS, asn1.RawValue{FullBytes: cps}})
+		}
+		if policy.UserNotice != "" {
+			notice, err := asn1.Marshal(userNotice{policy.UserNotice})
+			if err != nil {
+				return ext, err
+			}
+			info.Qualifiers = append(info.Qualifiers, policyQualifierInfo{oidQualifierUserNotice, asn1.RawValue{FullBytes: notice}})
+		}
+		infos = append(infos, info)
+	}
+
+	value, err := asn1.Marshal(infos)
+	if err != nil {
+		return ext, err
+	}
+	return pkix.Extension{Id: oidCertificatePolicies, Value: value}, nil
+}
+
+// extensions returns the critical policyConstraints and inhibitAnyPolicy extensions
+func (c *PolicyConstraints)extensions() (exts []pkix.Extension, e error) {
+	var constraints []byte
+	for tag, skipCerts := range []int{c.RequireExplicitPolicy, c.InhibitPolicyMapping} {
+		if skipCerts < 0 {
+			continue
+		}
+		b, err := asn1.MarshalWithParams(skipCerts, "tag:"+strconv.Itoa(tag))
+		if err != nil {
+			return nil, err
+		}
+		constraints = append(constraints, b...)
+	}
+	if constraints != nil {
+		value, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: constraints})
+		if err != nil {
+			return nil, err
+		}
+		exts = append(exts, pkix.Extension{Id: oidPolicyConstraints, Critical: true, Value: value})
+	}
+	if c.InhibitAnyPolicy >= 0 {
+		value, err := asn1.Marshal(c.InhibitAnyPolicy)
+		if err != nil {
+			return nil, err
+		}
+		exts = append(exts, pkix.Extension{Id: oidInhibitAnyPolicy, Critical: true, Value: value})
+	}
+	return exts, nil
+}
+
+// caPolicyExtensions returns the policy and name constraints extensions of a CA certificate
+func caPolicyExtensions(opts CAOptions) (exts []pkix.Extension, e error) {
+	if len(opts.Policies) > 0 {
+		ext, err := certificatePoliciesExtension(opts.Policies)
+		if err != nil {
+			return nil, err
+		}
+		exts = append(exts, ext)
+	}
+	if opts.PolicyConstraints != nil {
+		constraints, err := opts.PolicyConstraints.extensions()
+		if err != nil {
+			return nil, err
+		}
+		exts = append(exts, constraints...)
+	}
+	if opts.NameConstraints != nil {
+		ext, err := opts.NameConstraints.extension()
+		if err != nil {
+			return nil, err
+		}
+		exts = append(exts, ext)
+	}
+	return exts, nil
+}
+
+// ---------- Decoding ----------
+
+func findExtension(cert *x509.Certificate, oid asn1.ObjectIdentifier) (ext *pkix.Extension) {
+	for i := range cert.Extensions {
+		if cert.Extensions[i].Id.Equal(oid) {
+			return &cert.Extensions[i]
+		}
+	}
+	return nil
+}
+
+// CertificatePolicies returns the policies of the certificate with their qualifiers
+func CertificatePolicies(cert *x509.Certificate) (p []PolicyInformation, e error) {
+	ext := findExtension(cert, oidCertificatePolicies)
+	if ext == nil {
+		return nil, nil
+	}
+	var infos []policyInformation
+	rest, err := asn1.Unmarshal(ext.Value, &infos)
+	if err != nil || len(rest) != 0 {
+		return nil, errors.New("invalid certificate policies extension")
+	}
+
+	for _, info := range infos {
+		policy := PolicyInformation{OID: info.Policy}
+		for _, qualifier := range info.Qualifiers {
+			switch {
+			case qualifier.PolicyQualifierId.Equal(oidQualifierCPS):
+				asn1.Unmarshal(qualifier.Qualifier.FullBytes, &policy.CPSURI)
+			case qualifier.PolicyQualifierId.Equal(oidQualifierUserNotice):
+				policy.UserNotice = parseUserNotice(qualifier.Qualifier.FullBytes)
+			}
+		}
+		p = append(p, policy)
+	}
+	return p, nil
+}
+
+// parseUserNotice returns the explicit text of the user notice, the notice reference is
+// ignored
+func parseUserNotice(b []byte) (text string) {
+	var notice asn1.RawValue
+	_, err := asn1.Unmarshal(b, &notice)
+	if err != nil {
+		return ""
+	}
+	rest := notice.Bytes
+	for len(rest) > 0 {
+		var field asn1.RawValue
+		rest, err = asn1.Unmarshal(rest, &field)
+		if err != nil {
+			return ""
+		}
+		if field.Tag != asn1.TagSequence {
+			asn1.Unmarshal(field.FullBytes, &text)
+		}
+	}
+	return text
+}
+
+// certificatePolicyConstraints returns the constraints of the certificate, with -1 for the
+// constraints which are not present
+func certificatePolicyConstraints(cert *x509.Certificate) (c *PolicyConstraints, e error) {
+	c = &PolicyConstraints{-1, -1, -1}
+	if ext := findExtension(cert, oidPolicyConstraints); ext != nil {
+		var constraints asn1.RawValue
+		_, err := asn1.Unmarshal(ext.Value, &constraints)
+		if err != nil {
+			return nil, errors.New("invalid policy constraints extension")
+		}
+		rest := constraints.Bytes
+		for len(rest) > 0 {
+			var field asn1.RawValue
+			rest, err = asn1.Unmarshal(rest, &field)
+			if err != nil || field.Class != asn1.ClassContextSpecific || field.Tag > 1 {
+				return nil, errors.New("invalid policy constraints extension")
+			}
+			var skipCerts int
+			_, err = asn1.UnmarshalWithParams(field.FullBytes, &skipCerts, "tag:"+strconv.Itoa(field.Tag))
+			if err != nil || skipCerts < 0 {
+				return nil, errors.New("invalid policy constraints extension")
+			}
+			if field.Tag == 0 {
+				c.RequireExplicitPolicy = skipCerts
+			} else {
+				c.InhibitPolicyMapping = skipCerts
+			}
+		}
+	}
+	if ext := findExtension(cert, oidInhibitAnyPolicy); ext != nil {
+		_, err := asn1.Unmarshal(ext.Value, &c.InhibitAnyPolicy)
+		if err != nil || c.InhibitAnyPolicy < 0 {
+			return nil, errors.New("invalid inhibit any policy extension")
+		}
+	}
+	return c, nil
+}
+
+func certificatePolicyMappings(cert *x509.Certificate) (m []policyMapping, e error) {
+	ext := findExtension(cert, oidPolicyMappings)
+	if ext == nil {
+		return nil, nil
+	}
+	_, err := asn1.Unmarshal(ext.Value, &m)
+	if err != nil {
+		return nil, errors.New("invalid policy mappings extension")
+	}
+	for _, mapping := range m {
+		if mapping.IssuerDomainPolicy.Equal(oidAnyPolicy) || mapping.SubjectDomainPolicy.Equal(oidAnyPolicy) {
+			return nil, errors.New("policy mapping of anyPolicy")
+		}
+	}
+	return m, nil
+}
+
+// ---------- Verification ----------
+
+// PolicySet is the set of policies for which a chain is valid
+type PolicySet []asn1.ObjectIdentifier
+
+// Contains tells if the chain is valid for the policy, a set with anyPolicy contains
+// every policy as defined by RFC 5280
+func (s PolicySet)Contains(policy asn1.ObjectIdentifier) bool {
+	for _, oid := range s {
+		if oid.Equal(policy) || oid.Equal(oidAnyPolicy) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsOID(oids []asn1.ObjectIdentifier, oid asn1.ObjectIdentifier) bool {
+	for _, o := range oids {
+		if o.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyNode is a node of the valid_policy_tree of RFC 5280
+type policyNode struct {
+	parent   *policyNode
+	policy   asn1.ObjectIdentifier
+	expected []asn1.ObjectIdentifier
+}
+
+// PolicyVerifier computes the policies of peer certificates, which answers whether a peer
+// belongs to a zone. The inputs follow section 6.1.1 of RFC 5280 with anyPolicy as the
+// initial policy set.
+type PolicyVerifier struct {
+	Roots         *x509.CertPool
+	Intermediates *x509.CertPool
+	// RequireExplicitPolicy requires a valid policy for every chain
+	RequireExplicitPolicy bool
+	InhibitPolicyMapping  bool
+	InhibitAnyPolicy      bool
+}
+
+// NewPolicyVerifier creates a verifier for peers which chain up to one of the roots
+func NewPolicyVerifier(roots *x509.CertPool) (v *PolicyVerifier) {
+	return &PolicyVerifier{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+}
+
+// ValidPolicies runs the policy processing of RFC 5280 on a verified chain, which starts
+// with the peer and ends with the trust anchor like the chains of x509.Certificate.Verify.
+// The policies are the ones in the domain of the trust anchor, after policy mapping.
+func (v *PolicyVerifier)ValidPolicies(chain []*x509.Certificate) (s PolicySet, e error) {
+	if len(chain) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+	n := len(chain) - 1
+	initial := func(inhibit bool) int {
+		if inhibit {
+			return 0
+		}
+		return n + 1
+	}
+	explicitPolicy := initial(v.RequireExplicitPolicy)
+	policyMapping := initial(v.InhibitPolicyMapping)
+	inhibitAnyPolicy := initial(v.InhibitAnyPolicy)
+	level := []*policyNode{{policy: oidAnyPolicy, expected: []asn1.ObjectIdentifier{oidAnyPolicy}}}
+
+	// the trust anchor is not processed, i counts from the certificate it issued
+	for i := 1; i <= n; i++ {
+		cert := chain[n-i]
+		selfIssued := bytes.Equal(cert.RawIssuer, cert.RawSubject)
+		policies, err := CertificatePolicies(cert)
+		if err != nil {
+			return nil, err
+		}
+
+		if level != nil && policies != nil {
+			var next []*policyNode
+			hasAnyPolicy := false
+			for _, policy := range policies {
+				if policy.OID.Equal(oidAnyPolicy) {
+					hasAnyPolicy = true
+					continue
+				}
+				matched := false
+				for _, node := range level {
+					if containsOID(node.expected, policy.OID) {
+						next = append(next, &policyNode{node, policy.OID, []asn1.ObjectIdentifier{policy.OID}})
+						matched = true
+					}
+				}
+				if matched {
+					continue
+				}
+				for _, node := range level {
+					if node.policy.Equal(oidAnyPolicy) {
+						next = append(next, &policyNode{node, policy.OID, []asn1.ObjectIdentifier{policy.OID}})
+					}
+				}
+			}
+			if hasAnyPolicy && (inhibitAnyPolicy > 0 || (i < n && selfIssued)) {
+				for _, node := range level {
+					for _, expected := range node.expected {
+						exists := false
+						for _, child := range next {
+							exists = exists || (child.parent == node && child.policy.Equal(expected))
+						}
+						if !exists {
+							next = append(next, &policyNode{node, expected, []asn1.ObjectIdentifier{expected}})
+						}
+					}
+				}
+			}
+			level = next
+		} else {
+			level = nil
+		}
+		if len(level) == 0 {
+			level = nil
+		}
+		if explicitPolicy == 0 && level == nil {
+			return nil, errors.New("no valid policy for certificate " + cert.Subject.String())
+		}
+
+		constraints, err := certificatePolicyConstraints(cert)
+		if err != nil {
+			return nil, err
+		}
+		if i == n {
+			if explicitPolicy > 0 {
+				explicitPolicy--
+			}
+			if constraints.RequireExplicitPolicy == 0 {
+				explicitPolicy = 0
+			}
+			break
+		}
+
+		// preparation for the next certificate
+		mappings, err := certificatePolicyMappings(cert)
+		if err != nil {
+			return nil, err
+		}
+		level = mapPolicies(level, mappings, policyMapping > 0)
+		if !selfIssued {
+			for _, counter := range []*int{&explicitPolicy, &policyMapping, &inhibitAnyPolicy} {
+				if *counter > 0 {
+					*counter--
+				}
+			}
+		}
+		if constraints.RequireExplicitPolicy >= 0 && constraints.RequireExplicitPolicy < explicitPolicy {
+			explicitPolicy = constraints.RequireExplicitPolicy
+		}
+		if constraints.InhibitPolicyMapping >= 0 && constraints.InhibitPolicyMapping < policyMapping {
+			policyMapping = constraints.InhibitPolicyMapping
+		}
+		if constraints.InhibitAnyPolicy >= 0 && constraints.InhibitAnyPolicy < inhibitAnyPolicy {
+			inhibitAnyPolicy = constraints.InhibitAnyPolicy
+		}
+	}
+
+	// the policy in the domain of the trust anchor is the first one which is not anyPolicy
+	for _, node := range level {
+		policy := oidAnyPolicy
+		for ; node != nil; node = node.parent {
+			if !node.policy.Equal(oidAnyPolicy) {
+				policy = node.policy
+			}
+		}
+		if !containsOID(s, policy) {
+			s = append(s, policy)
+		}
+	}
+	if explicitPolicy == 0 && len(s) == 0 {
+		return nil, errors.New("no valid policy for the certificate chain")
+	}
+	return s, nil
+}
+
+// mapPolicies applies the policy mappings of a certificate to the nodes of the last level
+// of the valid_policy_tree, or deletes the mapped nodes when mapping is inhibited
+func mapPolicies(level []*policyNode, mappings []policyMapping, allowed bool) (l []*policyNode) {
+	if len(mappings) == 0 {
+		return level
+	}
+
+	var issuerPolicies []asn1.ObjectIdentifier
+	for _, mapping := range mappings {
+		if !containsOID(issuerPolicies, mapping.IssuerDomainPolicy) {
+			issuerPolicies = append(issuerPolicies, mapping.IssuerDomainPolicy)
+		}
+	}
+	for _, issuerPolicy := range issuerPolicies {
+		var subjectPolicies []asn1.ObjectIdentifier
+		for _, mapping := range mappings {
+			if mapping.IssuerDomainPolicy.Equal(issuerPolicy) {
+				subjectPolicies = append(subjectPolicies, mapping.SubjectDomainPolicy)
+			}
+		}
+
+		var kept []*policyNode
+		var anyNode *policyNode
+		mapped := false
+		for _, node := range level {
+			if node.policy.Equal(oidAnyPolicy) {
+				anyNode = node
+			}
+			if !node.policy.Equal(issuerPolicy) {
+				kept = append(kept, node)
+				continue
+			}
+			if allowed {
+				node.expected = subjectPolicies
+				kept = append(kept, node)
+				mapped = true
+			}
+		}
+		if allowed && !mapped && anyNode != nil {
+			kept = append(kept, &policyNode{anyNode.parent, issuerPolicy, subjectPolicies})
+		}
+		level = kept
+	}
+	if len(level) == 0 {
+		return nil
+	}
+	return level
+}
+
+// Verify builds the chains of the peer, which starts with the peer certificate followed by
+// the intermediate CAs it presented, and returns the policies of the valid chains
+func (v *PolicyVerifier)Verify(peer []*x509.Certificate) (s PolicySet, e error) {
+	if len(peer) == 0 {
+		return nil, errors.New("no peer certificate")
+	}
+	intermediates := x509.NewCertPool()
+	if v.Intermediates != nil {
+		intermediates = v.Intermediates.Clone()
+	}
+	for _, cert := range peer[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := peer[0].Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.chainsPolicies(chains)
+}
+
+func (v *PolicyVerifier)chainsPolicies(chains [][]*x509.Certificate) (s PolicySet, e error) {
+	var lastErr error
+	valid := false
+	for _, chain := range chains {
+		policies, err := v.ValidPolicies(chain)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		valid = true
+		for _, policy := range policies {
+			if !containsOID(s, policy) {
+				s = append(s, policy)
+			}
+		}
+	}
+	if !valid {
+		if lastErr == nil {
+			lastErr = errors.New("no verified certificate chain")
+		}
+		return nil, lastErr
+	}
+	return s, nil
+}
+
+// InZone tells if the peer certificate is valid for the policy of the zone
+func (v *PolicyVerifier)InZone(peer []*x509.Certificate, zone asn1.ObjectIdentifier) (b bool, e error) {
+	policies, err := v.Verify(peer)
+	if err != nil {
+		return false, err
+	}
+	return policies.Contains(zone), nil
+}
+
+// VerifyPeerZone returns a tls.Config.VerifyPeerCertificate function which only accepts
+// peers of the zone, on top of the chain verification of crypto/tls
+func (v *PolicyVerifier)VerifyPeerZone(zone asn1.ObjectIdentifier) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		policies, err := v.chainsPolicies(verifiedChains)
+		if err != nil {
+			return err
+		}
+		if !policies.Contains(zone) {
+			return errors.New("peer is not in zone " + zone.String())
+		}
+		return nil
+	}
+}
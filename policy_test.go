@@ -0,0 +1,292 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+var (
+	testZoneA = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1, 1}
+	testZoneB = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1, 2}
+	testZoneC = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2, 1}
+)
+
+// newPolicyTestHierarchy creates a root without policies and an issuing CA with the options
+func newPolicyTestHierarchy(t *testing.T, opts CAOptions) (root *CA, issuing *CA) {
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	root, err := NewCAWithOptions("CN=GoPKI Root,O=Cryptable,C=BE", 10, rootKey.Public(), rootKey, CAOptions{MaxPathLen: 2})
+	if err != nil {
+		t.Fatal("NewCAWithOptions failed: ", err)
+	}
+	issuingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	issuing, _, err = root.NewSubordinateCA("CN=GoPKI Issuing,O=Cryptable,C=BE", 5, issuingKey.Public(), issuingKey, opts)
+	if err != nil {
+		t.Fatal("NewSubordinateCA failed: ", err)
+	}
+	return root, issuing
+}
+
+// issueInZones issues a client certificate with the policies
+func issueInZones(t *testing.T, ca *CA, policies ...asn1.ObjectIdentifier) (cert *x509.Certificate) {
+	profile := &Profile{
+		Name:        "zone",
+		Validity:    time.Hour,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, policy := range policies {
+		profile.Policies = append(profile.Policies, PolicyInformation{OID: policy})
+	}
+	ca.AddProfile(profile)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certBytes, err := ca.Issue("zone", &IssuanceRequest{Subject: pkix.Name{CommonName: "peer"}, PublicKey: key.Public()})
+	if err != nil {
+		t.Fatal("Issue failed: ", err)
+	}
+	cert, _ = x509.ParseCertificate(certBytes)
+	return cert
+}
+
+func newTestPolicyVerifier(root *CA) (v *PolicyVerifier) {
+	roots := x509.NewCertPool()
+	roots.AddCert(root.Certificate)
+	return NewPolicyVerifier(roots)
+}
+
+// ---------- Testing Module ----------
+
+func TestCertificatePolicies_Qualifiers(t *testing.T) {
+	// Arrange
+	ca := newKeyGenTestCA(t)
+	policy := PolicyInformation{
+		OID:        testZoneA,
+		CPSURI:     "http://pki.cryptable.org/cps",
+		UserNotice: "Zone A of Cryptable",
+	}
+	ca.AddProfile(&Profile{Name: "zone", Validity: time.Hour, Policies: []PolicyInformation{policy, {OID: testZoneB}}})
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Act
+	certBytes, err := ca.Issue("zone", &IssuanceRequest{Subject: pkix.Name{CommonName: "peer"}, PublicKey: key.Public()})
+	if err != nil {
+		t.Error("Issue() failed: ", err)
+		return
+	}
+	cert, _ := x509.ParseCertificate(certBytes)
+	policies, err := CertificatePolicies(cert)
+
+	// Assert
+	if err != nil {
+		t.Error("CertificatePolicies() failed: ", err)
+		return
+	}
+	if len(policies) != 2 || !policies[0].OID.Equal(testZoneA) || !policies[1].OID.Equal(testZoneB) {
+		t.Error("wrong policies: ", policies)
+		return
+	}
+	if policies[0].CPSURI != policy.CPSURI || policies[0].UserNotice != policy.UserNotice {
+		t.Error("wrong qualifiers: ", policies[0])
+	}
+	if len(cert.PolicyIdentifiers) != 2 {
+		t.Error("policies not parsed by crypto/x509: ", cert.PolicyIdentifiers)
+	}
+}
+
+func TestPolicyConstraints_Extensions(t *testing.T) {
+	// Arrange
+	constraints := &PolicyConstraints{RequireExplicitPolicy: 0, InhibitPolicyMapping: 2, InhibitAnyPolicy: 1}
+	_, issuing := newPolicyTestHierarchy(t, CAOptions{
+		Policies:          []PolicyInformation{{OID: AnyPolicy}},
+		PolicyConstraints: constraints,
+	})
+
+	// Act
+	parsed, err := certificatePolicyConstraints(issuing.Certificate)
+
+	// Assert
+	if err != nil {
+		t.Error("certificatePolicyConstraints() failed: ", err)
+		return
+	}
+	if *parsed != *constraints {
+		t.Error("wrong policy constraints: ", *parsed)
+	}
+	if !findExtension(issuing.Certificate, oidPolicyConstraints).Critical {
+		t.Error("policy constraints are not critical")
+	}
+}
+
+func TestPolicyVerifier_InZone(t *testing.T) {
+	// Arrange
+	root, issuing := newPolicyTestHierarchy(t, CAOptions{
+		Policies:          []PolicyInformation{{OID: testZoneA}, {OID: testZoneB}},
+		PolicyConstraints: &PolicyConstraints{RequireExplicitPolicy: 0, InhibitPolicyMapping: -1, InhibitAnyPolicy: -1},
+	})
+	peer := issueInZones(t, issuing, testZoneA, testZoneC)
+	verifier := newTestPolicyVerifier(root)
+	chain := []*x509.Certificate{peer, issuing.Certificate}
+
+	// Act
+	policies, err := verifier.Verify(chain)
+
+	// Assert
+	if err != nil {
+		t.Error("Verify() failed: ", err)
+		return
+	}
+	if len(policies) != 1 || !policies.Contains(testZoneA) {
+		t.Error("wrong valid policies: ", policies)
+	}
+	if inZone, _ := verifier.InZone(chain, testZoneB); inZone {
+		t.Error("peer in zone B")
+	}
+	if inZone, _ := verifier.InZone(chain, testZoneC); inZone {
+		t.Error("peer in zone C, which is not allowed by the issuing CA")
+	}
+}
+
+func TestPolicyVerifier_RequireExplicitPolicy(t *testing.T) {
+	// Arrange
+	root, issuing := newPolicyTestHierarchy(t, CAOptions{
+		Policies:          []PolicyInformation{{OID: testZoneA}},
+		PolicyConstraints: &PolicyConstraints{RequireExplicitPolicy: 0, InhibitPolicyMapping: -1, InhibitAnyPolicy: -1},
+	})
+	peer := issueInZones(t, issuing)
+	verifier := newTestPolicyVerifier(root)
+
+	// Act
+	_, err := verifier.ValidPolicies([]*x509.Certificate{peer, issuing.Certificate, root.Certificate})
+
+	// Assert
+	if err == nil {
+		t.Error("certificate without policy accepted while an explicit policy is required")
+	}
+}
+
+func TestPolicyVerifier_InhibitAnyPolicy(t *testing.T) {
+	// Arrange
+	root, issuing := newPolicyTestHierarchy(t, CAOptions{
+		Policies:          []PolicyInformation{{OID: AnyPolicy}},
+		PolicyConstraints: &PolicyConstraints{RequireExplicitPolicy: -1, InhibitPolicyMapping: -1, InhibitAnyPolicy: 0},
+	})
+	zonePeer := issueInZones(t, issuing, testZoneA)
+	anyPeer := issueInZones(t, issuing, AnyPolicy)
+	verifier := newTestPolicyVerifier(root)
+
+	// Act
+	zonePolicies, errZone := verifier.ValidPolicies([]*x509.Certificate{zonePeer, issuing.Certificate, root.Certificate})
+	anyPolicies, errAny := verifier.ValidPolicies([]*x509.Certificate{anyPeer, issuing.Certificate, root.Certificate})
+
+	// Assert
+	if errZone != nil || errAny != nil {
+		t.Error("ValidPolicies() failed: ", errZone, errAny)
+		return
+	}
+	if len(zonePolicies) != 1 || !zonePolicies[0].Equal(testZoneA) {
+		t.Error("wrong valid policies: ", zonePolicies)
+	}
+	if len(anyPolicies) != 0 {
+		t.Error("anyPolicy accepted while it is inhibited: ", anyPolicies)
+	}
+}
+
+func TestPolicyVerifier_PolicyMapping(t *testing.T) {
+	// Arrange
+	root, issuing := newPolicyTestHierarchy(t, CAOptions{MaxPathLen: 1, Policies: []PolicyInformation{{OID: testZoneA}}})
+	mappings, _ := asn1.Marshal([]policyMapping{{testZoneA, testZoneC}})
+	issuing.AddProfile(&Profile{
+		Name:       "mapping-ca",
+		Validity:   time.Hour,
+		IsCA:       true,
+		MaxPathLen: 0,
+		Policies:   []PolicyInformation{{OID: testZoneA}},
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidPolicyMappings, Critical: true, Value: mappings},
+		},
+	})
+	mappingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	mappingBytes, err := issuing.Issue("mapping-ca", &IssuanceRequest{
+		Subject:   pkix.Name{CommonName: "GoPKI Mapping"},
+		PublicKey: mappingKey.Public(),
+	})
+	if err != nil {
+		t.Error("Issue() failed: ", err)
+		return
+	}
+	mappingCert, _ := x509.ParseCertificate(mappingBytes)
+	mappingCA, err := LoadCA(mappingBytes, mappingKey, *big.NewInt(1))
+	if err != nil {
+		t.Error("LoadCA() failed: ", err)
+		return
+	}
+	peer := issueInZones(t, mappingCA, testZoneC)
+	verifier := newTestPolicyVerifier(root)
+	chain := []*x509.Certificate{peer, mappingCert, issuing.Certificate, root.Certificate}
+
+	// Act
+	policies, err := verifier.ValidPolicies(chain)
+	verifier.InhibitPolicyMapping = true
+	inhibited, _ := verifier.ValidPolicies(chain)
+
+	// Assert
+	if err != nil {
+		t.Error("ValidPolicies() failed: ", err)
+		return
+	}
+	if len(policies) != 1 || !policies[0].Equal(testZoneA) {
+		t.Error("policy of the peer not mapped to the domain of the trust anchor: ", policies)
+	}
+	if len(inhibited) != 0 {
+		t.Error("policy mapped while mapping is inhibited: ", inhibited)
+	}
+}
+
+func TestPolicyVerifier_VerifyPeerZone(t *testing.T) {
+	// Arrange
+	root, issuing := newPolicyTestHierarchy(t, CAOptions{Policies: []PolicyInformation{{OID: AnyPolicy}}})
+	peer := issueInZones(t, issuing, testZoneB)
+	chains := [][]*x509.Certificate{{peer, issuing.Certificate, root.Certificate}}
+	verifier := newTestPolicyVerifier(root)
+
+	// Act
+	errB := verifier.VerifyPeerZone(testZoneB)([][]byte{peer.Raw}, chains)
+	errA := verifier.VerifyPeerZone(testZoneA)([][]byte{peer.Raw}, chains)
+
+	// Assert
+	if errB != nil {
+		t.Error("peer rejected from its zone: ", errB)
+	}
+	if errA == nil {
+		t.Error("peer accepted in another zone")
+	}
+}
+
+func TestProfile_PoliciesJSON(t *testing.T) {
+	// Arrange
+	profile := &Profile{
+		Name:     "zone",
+		Validity: time.Hour,
+		Policies: []PolicyInformation{{OID: testZoneA, CPSURI: "http://pki.cryptable.org/cps"}},
+	}
+	var out bytes.Buffer
+
+	// Act
+	StoreProfiles(&out, []*Profile{profile})
+	loaded, err := LoadProfiles(&out)
+
+	// Assert
+	if err != nil {
+		t.Error("LoadProfiles() failed: ", err)
+		return
+	}
+	if len(loaded[0].Policies) != 1 || !loaded[0].Policies[0].OID.Equal(testZoneA) || loaded[0].Policies[0].CPSURI != profile.Policies[0].CPSURI {
+		t.Error("policies not loaded: ", loaded[0].Policies)
+	}
+}
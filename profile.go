@@ -0,0 +1,383 @@
+package gopki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ProfileTLSServer = "tls-server"
+	ProfileTLSClient = "tls-client"
+)
+
+// Profile describes the content of the certificates a CA issues under its name
+type Profile struct {
+	Name     string
+	Validity time.Duration
+	// KeyUsage overrides the key usage derived from the type of the public key,
+	// key usages which the key cannot perform are dropped
+	KeyUsage    x509.KeyUsage
+	ExtKeyUsage []x509.ExtKeyUsage
+	IsCA        bool
+	// MaxPathLen is only used when IsCA is set, a negative value removes the limit
+	MaxPathLen      int
+	ExtraExtensions []pkix.Extension
+	// KeyAlgorithms lists the allowed public key algorithms, empty allows all of them
+	KeyAlgorithms []x509.PublicKeyAlgorithm
+	// CSRPolicy decides which values requested in a CSR end up in the certificate
+	CSRPolicy CSRPolicy
+	// Policies are the certificate policies, like the zones the certificates belong to
+	Policies []PolicyInformation
+	// Rekey renews the certificates with a new key instead of the key of the workload
+	Rekey bool
+}
+
+// CSRPolicy lists the values of a certificate signing request which are honored, the
+// zero value only takes the public key
+type CSRPolicy struct {
+	Subject        bool
+	DNSNames       bool
+	IPAddresses    bool
+	URIs           bool
+	EmailAddresses bool
+	// Extensions lists the OIDs of the requested extensions which are copied
+	Extensions []asn1.ObjectIdentifier
+}
+
+// IssuanceRequest holds the values of the requester which end up in the certificate
+type IssuanceRequest struct {
+	Subject   pkix.Name
+	PublicKey crypto.PublicKey
+	// Subject alternative names
+	DNSNames       []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	EmailAddresses []string
+	// Validity shortens the validity of the profile when it is set
+	Validity time.Duration
+	// Extensions are added after the extensions of the profile. An extension the profile
+	// already sets is refused, as is one the CA sets itself like the basic constraints or
+	// the subject alternative names.
+	Extensions []pkix.Extension
+	// Requester identifies who requested the certificate, it is recorded in the Store
+	Requester string
+}
+
+// DefaultProfiles returns the profiles every CA starts with
+func DefaultProfiles() (p []*Profile) {
+	return []*Profile{
+		{
+			Name:        ProfileTLSServer,
+			Validity:    365 * 24 * time.Hour,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			CSRPolicy:   CSRPolicy{Subject: true, DNSNames: true, IPAddresses: true},
+		},
+		{
+			Name:        ProfileTLSClient,
+			Validity:    365 * 24 * time.Hour,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			CSRPolicy: CSRPolicy{Subject: true, DNSNames: true, IPAddresses: true, URIs: true,
+				EmailAddresses: true},
+		},
+		x509SVIDProfile(),
+		ocspSigningProfile(),
+	}
+}
+
+// keyUsage returns the key usage of the profile which the public key is able to perform
+func (p *Profile)keyUsage(pub crypto.PublicKey) (k x509.KeyUsage) {
+	if p.IsCA {
+		return x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+
+	var possible x509.KeyUsage
+	var derived x509.KeyUsage
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		possible = x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment |
+			x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment
+		derived = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	case *ecdsa.PublicKey:
+		possible = x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment |
+			x509.KeyUsageKeyAgreement
+		derived = x509.KeyUsageDigitalSignature
+	default:
+		possible = x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment
+		derived = x509.KeyUsageDigitalSignature
+	}
+
+	if p.KeyUsage != 0 {
+		return p.KeyUsage & possible
+	}
+	return derived
+}
+
+func (p *Profile)checkKeyAlgorithm(pub crypto.PublicKey) (e error) {
+	algorithm := publicKeyAlgorithm(pub)
+	if algorithm == x509.UnknownPublicKeyAlgorithm {
+		return errors.New("unsupported public key type")
+	}
+	if len(p.KeyAlgorithms) == 0 {
+		return nil
+	}
+	for _, allowed := range p.KeyAlgorithms {
+		if allowed == algorithm {
+			return nil
+		}
+	}
+	return errors.New("key algorithm " + algorithm.String() + " not allowed by profile " + p.Name)
+}
+
+func publicKeyAlgorithm(pub crypto.PublicKey) (a x509.PublicKeyAlgorithm) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return x509.RSA
+	case *ecdsa.PublicKey:
+		return x509.ECDSA
+	case ed25519.PublicKey:
+		return x509.Ed25519
+	}
+	return x509.UnknownPublicKeyAlgorithm
+}
+
+// ---------- Configuration ----------
+
+var keyUsageNames = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+	"keyCertSign":       x509.KeyUsageCertSign,
+	"cRLSign":           x509.KeyUsageCRLSign,
+	"encipherOnly":      x509.KeyUsageEncipherOnly,
+	"decipherOnly":      x509.KeyUsageDecipherOnly,
+}
+
+var extKeyUsageNames = map[string]x509.ExtKeyUsage{
+	"any":             x509.ExtKeyUsageAny,
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"OCSPSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+var keyAlgorithmNames = map[string]x509.PublicKeyAlgorithm{
+	"RSA":     x509.RSA,
+	"ECDSA":   x509.ECDSA,
+	"Ed25519": x509.Ed25519,
+}
+
+type extensionConfig struct {
+	OID      string `json:"oid"`
+	Critical bool   `json:"critical,omitempty"`
+	Value    []byte `json:"value"`
+}
+
+type policyConfig struct {
+	OID        string `json:"oid"`
+	CPSURI     string `json:"cps,omitempty"`
+	UserNotice string `json:"userNotice,omitempty"`
+}
+
+type csrPolicyConfig struct {
+	Subject        bool     `json:"subject,omitempty"`
+	DNSNames       bool     `json:"dnsNames,omitempty"`
+	IPAddresses    bool     `json:"ipAddresses,omitempty"`
+	URIs           bool     `json:"uris,omitempty"`
+	EmailAddresses bool     `json:"emailAddresses,omitempty"`
+	Extensions     []string `json:"extensions,omitempty"`
+}
+
+type profileConfig struct {
+	Name          string            `json:"name"`
+	Validity      string            `json:"validity"`
+	KeyUsage      []string          `json:"keyUsage,omitempty"`
+	ExtKeyUsage   []string          `json:"extKeyUsage,omitempty"`
+	IsCA          bool              `json:"isCA,omitempty"`
+	MaxPathLen    int               `json:"maxPathLen,omitempty"`
+	Extensions    []extensionConfig `json:"extensions,omitempty"`
+	KeyAlgorithms []string          `json:"keyAlgorithms,omitempty"`
+	CSRPolicy     csrPolicyConfig   `json:"csr"`
+	Policies      []policyConfig    `json:"policies,omitempty"`
+	Rekey         bool              `json:"rekey,omitempty"`
+}
+
+// parseValidity accepts Go durations and a number of days like "90d"
+func parseValidity(validity string) (d time.Duration, e error) {
+	if strings.HasSuffix(validity, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(validity, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(validity)
+}
+
+func parseOID(oid string) (o asn1.ObjectIdentifier, e error) {
+	for _, number := range strings.Split(oid, ".") {
+		nbr, err := strconv.Atoi(number)
+		if err != nil {
+			return nil, errors.New("invalid oid: " + oid)
+		}
+		o = append(o, nbr)
+	}
+	if len(o) < 2 {
+		return nil, errors.New("invalid oid: " + oid)
+	}
+	return o, nil
+}
+
+func (p *Profile)MarshalJSON() (b []byte, e error) {
+	config := profileConfig{
+		Name:       p.Name,
+		Validity:   p.Validity.String(),
+		IsCA:       p.IsCA,
+		MaxPathLen: p.MaxPathLen,
+		Rekey:      p.Rekey,
+	}
+	for usage := x509.KeyUsageDigitalSignature; usage <= x509.KeyUsageDecipherOnly; usage <<= 1 {
+		if p.KeyUsage&usage == 0 {
+			continue
+		}
+		for name, known := range keyUsageNames {
+			if known == usage {
+				config.KeyUsage = append(config.KeyUsage, name)
+			}
+		}
+	}
+	for _, usage := range p.ExtKeyUsage {
+		for name, known := range extKeyUsageNames {
+			if known == usage {
+				config.ExtKeyUsage = append(config.ExtKeyUsage, name)
+			}
+		}
+	}
+	for _, ext := range p.ExtraExtensions {
+		config.Extensions = append(config.Extensions, extensionConfig{ext.Id.String(), ext.Critical, ext.Value})
+	}
+	for _, algorithm := range p.KeyAlgorithms {
+		config.KeyAlgorithms = append(config.KeyAlgorithms, algorithm.String())
+	}
+	config.CSRPolicy = csrPolicyConfig{
+		Subject:        p.CSRPolicy.Subject,
+		DNSNames:       p.CSRPolicy.DNSNames,
+		IPAddresses:    p.CSRPolicy.IPAddresses,
+		URIs:           p.CSRPolicy.URIs,
+		EmailAddresses: p.CSRPolicy.EmailAddresses,
+	}
+	for _, oid := range p.CSRPolicy.Extensions {
+		config.CSRPolicy.Extensions = append(config.CSRPolicy.Extensions, oid.String())
+	}
+	for _, policy := range p.Policies {
+		config.Policies = append(config.Policies, policyConfig{policy.OID.String(), policy.CPSURI, policy.UserNotice})
+	}
+	return json.Marshal(&config)
+}
+
+func (p *Profile)UnmarshalJSON(b []byte) (e error) {
+	var config profileConfig
+	err := json.Unmarshal(b, &config)
+	if err != nil {
+		return err
+	}
+	if config.Name == "" {
+		return errors.New("profile without name")
+	}
+
+	profile := Profile{
+		Name:       config.Name,
+		IsCA:       config.IsCA,
+		MaxPathLen: config.MaxPathLen,
+		Rekey:      config.Rekey,
+	}
+	profile.Validity, err = parseValidity(config.Validity)
+	if err != nil {
+		return errors.New("profile " + config.Name + ": invalid validity: " + err.Error())
+	}
+	if profile.Validity <= 0 {
+		return errors.New("profile " + config.Name + ": validity must be positive")
+	}
+	for _, name := range config.KeyUsage {
+		usage, ok := keyUsageNames[name]
+		if !ok {
+			return errors.New("profile " + config.Name + ": unknown key usage " + name)
+		}
+		profile.KeyUsage |= usage
+	}
+	for _, name := range config.ExtKeyUsage {
+		usage, ok := extKeyUsageNames[name]
+		if !ok {
+			return errors.New("profile " + config.Name + ": unknown extended key usage " + name)
+		}
+		profile.ExtKeyUsage = append(profile.ExtKeyUsage, usage)
+	}
+	for _, ext := range config.Extensions {
+		oid, err := parseOID(ext.OID)
+		if err != nil {
+			return errors.New("profile " + config.Name + ": " + err.Error())
+		}
+		profile.ExtraExtensions = append(profile.ExtraExtensions, pkix.Extension{Id: oid, Critical: ext.Critical, Value: ext.Value})
+	}
+	for _, name := range config.KeyAlgorithms {
+		algorithm, ok := keyAlgorithmNames[name]
+		if !ok {
+			return errors.New("profile " + config.Name + ": unknown key algorithm " + name)
+		}
+		profile.KeyAlgorithms = append(profile.KeyAlgorithms, algorithm)
+	}
+	profile.CSRPolicy = CSRPolicy{
+		Subject:        config.CSRPolicy.Subject,
+		DNSNames:       config.CSRPolicy.DNSNames,
+		IPAddresses:    config.CSRPolicy.IPAddresses,
+		URIs:           config.CSRPolicy.URIs,
+		EmailAddresses: config.CSRPolicy.EmailAddresses,
+	}
+	for _, extension := range config.CSRPolicy.Extensions {
+		oid, err := parseOID(extension)
+		if err != nil {
+			return errors.New("profile " + config.Name + ": " + err.Error())
+		}
+		profile.CSRPolicy.Extensions = append(profile.CSRPolicy.Extensions, oid)
+	}
+	for _, policy := range config.Policies {
+		oid, err := parseOID(policy.OID)
+		if err != nil {
+			return errors.New("profile " + config.Name + ": " + err.Error())
+		}
+		profile.Policies = append(profile.Policies, PolicyInformation{oid, policy.CPSURI, policy.UserNotice})
+	}
+
+	*p = profile
+	return nil
+}
+
+// LoadProfiles reads a JSON array of profiles, like
+//   [{"name": "tls-server", "validity": "90d", "extKeyUsage": ["serverAuth"], "keyAlgorithms": ["ECDSA"]}]
+func LoadProfiles(in io.Reader) (p []*Profile, e error) {
+	err := json.NewDecoder(in).Decode(&p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func StoreProfiles(out io.Writer, p []*Profile) (e error) {
+	return json.NewEncoder(out).Encode(p)
+}
@@ -0,0 +1,223 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadProfiles(t *testing.T) {
+	// Arrange
+	config := `[
+		{
+			"name": "internal-server",
+			"validity": "90d",
+			"keyUsage": ["digitalSignature", "keyAgreement"],
+			"extKeyUsage": ["serverAuth", "clientAuth"],
+			"keyAlgorithms": ["ECDSA", "Ed25519"],
+			"extensions": [{"oid": "1.3.6.1.4.1.99999.1", "value": "BQA="}]
+		}
+	]`
+
+	// Act
+	profiles, err := LoadProfiles(strings.NewReader(config))
+
+	// Assert
+	if err != nil {
+		t.Error("LoadProfiles failed: ", err)
+		return
+	}
+	if len(profiles) != 1 {
+		t.Error("Unexpected number of profiles: ", len(profiles))
+		return
+	}
+	p := profiles[0]
+	if p.Name != "internal-server" || p.Validity != 90*24*time.Hour {
+		t.Error("Unexpected name or validity: ", p.Name, p.Validity)
+	}
+	if p.KeyUsage != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyAgreement {
+		t.Error("Unexpected key usage: ", p.KeyUsage)
+	}
+	if len(p.ExtKeyUsage) != 2 || len(p.KeyAlgorithms) != 2 || len(p.ExtraExtensions) != 1 {
+		t.Error("Unexpected profile content: ", p)
+	}
+
+	// Round trip
+	var out bytes.Buffer
+	err = StoreProfiles(&out, profiles)
+	if err != nil {
+		t.Error("StoreProfiles failed: ", err)
+		return
+	}
+	reloaded, err := LoadProfiles(&out)
+	if err != nil {
+		t.Error("LoadProfiles of stored profiles failed: ", err)
+		return
+	}
+	if reloaded[0].KeyUsage != p.KeyUsage || reloaded[0].Validity != p.Validity {
+		t.Error("Round trip changed the profile: ", reloaded[0])
+	}
+}
+
+func TestLoadProfilesInvalid(t *testing.T) {
+	configs := []string{
+		`[{"name": "bad", "validity": "forever"}]`,
+		`[{"name": "bad", "validity": "1h", "extKeyUsage": ["flying"]}]`,
+		`[{"name": "bad", "validity": "1h", "keyAlgorithms": ["DSA"]}]`,
+		`[{"validity": "1h"}]`,
+	}
+
+	for _, config := range configs {
+		_, err := LoadProfiles(strings.NewReader(config))
+		if err == nil {
+			t.Error("LoadProfiles must fail on: ", config)
+		}
+	}
+}
+
+func TestCA_Issue(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI Profiles,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	ca.AddProfile(&Profile{
+		Name:          "short-lived",
+		Validity:      time.Hour,
+		ExtKeyUsage:   []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyAlgorithms: []x509.PublicKeyAlgorithm{x509.ECDSA, x509.Ed25519},
+	})
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	subject, _ := ConvertDNToPKIXName("CN=Workload,O=Cryptable")
+
+	// Act
+	ecCert, err := ca.Issue("short-lived", &IssuanceRequest{Subject: *subject, PublicKey: ecKey.Public()})
+	if err != nil {
+		t.Error("Issue failed: ", err)
+		return
+	}
+	edCert, err := ca.Issue("short-lived", &IssuanceRequest{Subject: *subject, PublicKey: edPub})
+	if err != nil {
+		t.Error("Issue failed: ", err)
+		return
+	}
+	_, rsaErr := ca.Issue("short-lived", &IssuanceRequest{Subject: *subject, PublicKey: rsaKey.Public()})
+	_, unknownErr := ca.Issue("no-such-profile", &IssuanceRequest{Subject: *subject, PublicKey: ecKey.Public()})
+
+	// Assert
+	ec, _ := x509.ParseCertificate(ecCert)
+	if ec.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Error("ECDSA certificate has unexpected key usage: ", ec.KeyUsage)
+	}
+	if ec.NotAfter.Sub(ec.NotBefore) != time.Hour {
+		t.Error("Unexpected validity: ", ec.NotAfter.Sub(ec.NotBefore))
+	}
+	ed, _ := x509.ParseCertificate(edCert)
+	if ed.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Error("Ed25519 certificate has unexpected key usage: ", ed.KeyUsage)
+	}
+	if rsaErr == nil {
+		t.Error("Issue must refuse a key algorithm not allowed by the profile")
+	}
+	if unknownErr == nil {
+		t.Error("Issue must refuse an unknown profile")
+	}
+}
+
+func TestCA_IssueDuplicateExtension(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI Profiles,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	ca.AddProfile(&Profile{
+		Name:            "with-extension",
+		Validity:        time.Hour,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		ExtraExtensions: []pkix.Extension{{Id: oid, Value: []byte{0x05, 0x00}}},
+		Policies:        []PolicyInformation{{OID: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}}},
+	})
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	subject, _ := ConvertDNToPKIXName("CN=Workload,O=Cryptable")
+	other := pkix.Extension{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 3}, Value: []byte{0x05, 0x00}}
+
+	// Act
+	_, profileErr := ca.Issue("with-extension", &IssuanceRequest{Subject: *subject, PublicKey: ecKey.Public(),
+		Extensions: []pkix.Extension{{Id: oid, Value: []byte{0x01, 0x01, 0xff}}}})
+	_, policyErr := ca.Issue("with-extension", &IssuanceRequest{Subject: *subject, PublicKey: ecKey.Public(),
+		Extensions: []pkix.Extension{{Id: oidCertificatePolicies, Value: []byte{0x30, 0x00}}}})
+	_, requestErr := ca.Issue("with-extension", &IssuanceRequest{Subject: *subject, PublicKey: ecKey.Public(),
+		Extensions: []pkix.Extension{other, other}})
+	cert, err := ca.Issue("with-extension", &IssuanceRequest{Subject: *subject, PublicKey: ecKey.Public(),
+		Extensions: []pkix.Extension{other}})
+
+	// Assert
+	if profileErr == nil || policyErr == nil || requestErr == nil {
+		t.Error("Issue must refuse a duplicate extension: ", profileErr, policyErr, requestErr)
+	}
+	if err != nil {
+		t.Error("Issue failed: ", err)
+		return
+	}
+	_, err = x509.ParseCertificate(cert)
+	if err != nil {
+		t.Error("Issued certificate does not parse: ", err)
+	}
+}
+
+func TestCA_IssueProtectedExtension(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI Profiles,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	subject, _ := ConvertDNToPKIXName("CN=Workload,O=Cryptable")
+	basicConstraints, _ := asn1.Marshal(struct {
+		IsCA bool
+	}{true})
+	subjectAltName, _ := asn1.Marshal([]asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte("evil.org")}})
+
+	// Act
+	_, caErr := ca.Issue(ProfileTLSServer, &IssuanceRequest{Subject: *subject, PublicKey: ecKey.Public(), DNSNames: []string{"www.cryptable.org"},
+		Extensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{2, 5, 29, 19}, Critical: true, Value: basicConstraints}}})
+	_, sanErr := ca.Issue(ProfileTLSServer, &IssuanceRequest{Subject: *subject, PublicKey: ecKey.Public(), DNSNames: []string{"www.cryptable.org"},
+		Extensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: subjectAltName}}})
+
+	// Assert
+	if caErr == nil {
+		t.Error("Issue must refuse a requested basic constraints extension")
+	}
+	if sanErr == nil {
+		t.Error("Issue must refuse a requested subject alternative name extension")
+	}
+}
+
+func TestCA_IssueRSAKeyUsage(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI Profiles,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	// Act
+	cert, err := ca.CreateTLSServerCertificate("CN=SSL Server", rsaKey.Public())
+
+	// Assert
+	if err != nil {
+		t.Error("CreateTLSServerCertificate failed: ", err)
+		return
+	}
+	certif, _ := x509.ParseCertificate(cert)
+	if certif.KeyUsage != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+		t.Error("RSA certificate has unexpected key usage: ", certif.KeyUsage)
+	}
+	if len(certif.ExtKeyUsage) != 1 || certif.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Error("Unexpected extended key usage: ", certif.ExtKeyUsage)
+	}
+}
@@ -0,0 +1,430 @@
+package gopki
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultRenewalFraction renews a certificate after two thirds of its lifetime
+const DefaultRenewalFraction = 2.0 / 3
+
+// DefaultScanInterval is the longest time between two scans of the inventory
+const DefaultScanInterval = time.Hour
+
+// minScanWait is the shortest time between two background scans
+const minScanWait = time.Second
+
+// RenewalPolicy decides when the certificates are renewed
+type RenewalPolicy struct {
+	// Fraction of the lifetime after which a certificate is renewed, zero is the
+	// DefaultRenewalFraction
+	Fraction float64
+	// Jitter moves the renewal up to this fraction of the lifetime earlier or later, so
+	// the certificates issued together are not renewed together
+	Jitter float64
+	// Interval is the longest time between two scans, zero is the DefaultScanInterval
+	Interval time.Duration
+}
+
+func (p RenewalPolicy)fraction() (f float64) {
+	if p.Fraction == 0 {
+		return DefaultRenewalFraction
+	}
+	return p.Fraction
+}
+
+func (p RenewalPolicy)interval() (d time.Duration) {
+	if p.Interval == 0 {
+		return DefaultScanInterval
+	}
+	return p.Interval
+}
+
+func (p RenewalPolicy)check() (e error) {
+	fraction := p.fraction()
+	if fraction <= 0 || fraction >= 1 {
+		return errors.New("renewal fraction must be between 0 and 1")
+	}
+	if p.Jitter < 0 || p.Jitter >= math.Min(fraction, 1-fraction) {
+		return errors.New("renewal jitter must be smaller than the renewal fraction and the rest of the lifetime")
+	}
+	if p.Interval < 0 {
+		return errors.New("scan interval must be positive")
+	}
+	return nil
+}
+
+// RenewalTime returns when the certificate is due for renewal. The jitter is derived from
+// the fingerprint of the certificate, so every scan finds the same renewal time.
+func (p RenewalPolicy)RenewalTime(r *CertificateRecord) (t time.Time) {
+	lifetime := float64(r.NotAfter.Sub(r.NotBefore))
+	offset := p.fraction() * lifetime
+	if p.Jitter > 0 {
+		sum := sha256.Sum256([]byte(r.Fingerprint))
+		spread := float64(binary.BigEndian.Uint64(sum[:8])) / math.Exp2(64)
+		offset += (2*spread - 1) * p.Jitter * lifetime
+	}
+	return r.NotBefore.Add(time.Duration(offset))
+}
+
+// Workload holds a certificate which the RenewalScheduler renews before it expires
+type Workload struct {
+	// Name identifies the workload, its certificates are requested in its name
+	Name    string
+	Profile string
+	// Request is the template of the certificates of the workload, its Requester is the
+	// Name. Without rekey the certificates certify its PublicKey.
+	Request IssuanceRequest
+	// KeySpec is the type of the new keys when the profile rekeys, the zero value keeps
+	// the type of the current key
+	KeySpec KeySpec
+	// KeyPassword encrypts the new keys, see KeyGenerator.Generate
+	KeyPassword []byte
+}
+
+type RenewalEventType int
+
+const (
+	// RenewalIssued is the first certificate of a registered workload
+	RenewalIssued RenewalEventType = iota + 1
+	// RenewalRenewed replaces a certificate due for renewal, which is superseded
+	RenewalRenewed
+	// RenewalExpiring is a certificate due for renewal which belongs to no workload or
+	// whose replacement would not outlive it because the CA expires, it is reported once
+	RenewalExpiring
+	// RenewalFailed reports an error, the renewal is retried at the next scan
+	RenewalFailed
+)
+
+func (t RenewalEventType)String() string {
+	switch t {
+	case RenewalIssued:
+		return "issued"
+	case RenewalRenewed:
+		return "renewed"
+	case RenewalExpiring:
+		return "expiring"
+	case RenewalFailed:
+		return "failed"
+	}
+	return "RenewalEventType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// RenewalEvent tells what the scheduler did
+type RenewalEvent struct {
+	Type     RenewalEventType
+	Time     time.Time
+	Workload string
+	// Previous is the certificate which is renewed or expiring
+	Previous *CertificateRecord
+	// Certificate is the DER encoded new certificate
+	Certificate []byte
+	// Key is the new key of a rekey, encrypted with the KeyPassword of the workload
+	Key *KeyBundle
+	Err error
+}
+
+// RenewalScheduler scans the inventory of the CA and renews the certificates of the
+// registered workloads when they are due, with the clock of the CA
+type RenewalScheduler struct {
+	ca        *CA
+	store     Store
+	policy    RenewalPolicy
+	notify    func(e *RenewalEvent)
+	generator *KeyGenerator
+	// mutex serializes the scans and protects the workloads
+	mutex     sync.Mutex
+	workloads map[string]*Workload
+	// expiring holds the fingerprints of the reported expiring certificates
+	expiring map[string]bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewRenewalScheduler creates the scheduler of the CA, which keeps its certificates in a
+// store. notify receives the events, it may be nil.
+func NewRenewalScheduler(ca *CA, policy RenewalPolicy, notify func(e *RenewalEvent)) (s *RenewalScheduler, e error) {
+	err := policy.check()
+	if err != nil {
+		return nil, err
+	}
+	ca.mutex.Lock()
+	store := ca.store
+	ca.mutex.Unlock()
+	if store == nil {
+		return nil, errors.New("CA " + ca.Name + " keeps no inventory, see SetStore")
+	}
+	if notify == nil {
+		notify = func(*RenewalEvent) {}
+	}
+	return &RenewalScheduler{
+		ca:        ca,
+		store:     store,
+		policy:    policy,
+		notify:    notify,
+		generator: NewKeyGenerator(ca, nil),
+		workloads: map[string]*Workload{},
+		expiring:  map[string]bool{},
+	}, nil
+}
+
+// SetKeyGenerator replaces the generator of the new keys, like one with key pools or a
+// KeyStore
+func (s *RenewalScheduler)SetKeyGenerator(g *KeyGenerator) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.generator = g
+}
+
+// Register adds the workload, it gets its first certificate at the next scan unless it
+// already has a valid one
+func (s *RenewalScheduler)Register(w *Workload) (e error) {
+	if w.Name == "" {
+		return errors.New("workload without name")
+	}
+	profile := s.ca.Profile(w.Profile)
+	if profile == nil {
+		return errors.New("unknown profile: " + w.Profile)
+	}
+	if !profile.Rekey && w.Request.PublicKey == nil {
+		return errors.New("workload " + w.Name + " has no public key and profile " + w.Profile + " doesn't rekey")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	registered := *w
+	s.workloads[w.Name] = &registered
+	return nil
+}
+
+// Unregister stops renewing the certificates of the workload
+func (s *RenewalScheduler)Unregister(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.workloads, name)
+}
+
+// Scan renews the certificates which are due and returns the next renewal time, zero
+// when nothing is scheduled after now. Errors of a renewal are reported as RenewalFailed
+// events.
+func (s *RenewalScheduler)Scan() (next time.Time, e error) {
+	s.mutex.Lock()
+	events, next, err := s.scan()
+	s.mutex.Unlock()
+
+	for _, event := range events {
+		s.notify(event)
+	}
+	return next, err
+}
+
+func (s *RenewalScheduler)scan() (events []*RenewalEvent, next time.Time, e error) {
+	now := s.ca.Clock().Now()
+	records, err := s.store.CertificatesByStatus(s.ca.Name, CertificateValid, now)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	schedule := func(t time.Time) {
+		if !t.After(now) {
+			return
+		}
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+
+	current := map[string]*CertificateRecord{}
+	expiring := map[string]bool{}
+	for _, r := range records {
+		w := s.workloads[r.Requester]
+		if w != nil && w.Profile == r.Profile {
+			if latest := current[w.Name]; latest == nil || r.NotAfter.After(latest.NotAfter) {
+				current[w.Name] = r
+			}
+			continue
+		}
+		if now.Before(s.policy.RenewalTime(r)) {
+			continue
+		}
+		expiring[r.Fingerprint] = true
+		if !s.expiring[r.Fingerprint] {
+			events = append(events, &RenewalEvent{Type: RenewalExpiring, Time: now, Previous: r})
+		}
+	}
+
+	names := make([]string, 0, len(s.workloads))
+	for name := range s.workloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		previous := current[name]
+		if previous != nil {
+			renewal := s.policy.RenewalTime(previous)
+			if now.Before(renewal) {
+				schedule(renewal)
+				continue
+			}
+			err := s.checkOutlives(s.workloads[name], previous)
+			if err != nil {
+				expiring[previous.Fingerprint] = true
+				if !s.expiring[previous.Fingerprint] {
+					events = append(events, &RenewalEvent{Type: RenewalExpiring, Time: now, Workload: name, Previous: previous, Err: err})
+				}
+				continue
+			}
+		}
+
+		event, err := s.renew(s.workloads[name], previous)
+		if err != nil {
+			events = append(events, &RenewalEvent{Type: RenewalFailed, Time: now, Workload: name, Previous: previous, Err: err})
+			continue
+		}
+		event.Time = now
+		events = append(events, event)
+		cert, err := x509.ParseCertificate(event.Certificate)
+		if err == nil {
+			schedule(s.policy.RenewalTime(newCertificateRecord(s.workloads[name].Profile, name, cert)))
+		}
+	}
+	s.expiring = expiring
+	return events, next, nil
+}
+
+// checkOutlives verifies a replacement of the certificate of the workload would expire
+// later than the certificate, which is not the case once it is capped to the NotAfter of
+// the CA. Renewing it anyway would issue a new certificate at every scan.
+func (s *RenewalScheduler)checkOutlives(w *Workload, previous *CertificateRecord) (e error) {
+	profile := s.ca.Profile(w.Profile)
+	if profile == nil {
+		return errors.New("unknown profile: " + w.Profile)
+	}
+	validity := profile.Validity
+	if w.Request.Validity > 0 && w.Request.Validity < validity {
+		validity = w.Request.Validity
+	}
+
+	issuer, _ := s.ca.Issuer()
+	_, notAfter, err := s.ca.validity(issuer, func(now time.Time) time.Time {
+		return now.Add(validity)
+	})
+	if err != nil {
+		return err
+	}
+	if !notAfter.After(previous.NotAfter) {
+		return errors.New("certificate of workload " + w.Name + " is not renewed, CA " + s.ca.Name +
+			" expires at " + issuer.NotAfter.UTC().Format(time.RFC3339) + " before a replacement would")
+	}
+	return nil
+}
+
+// renew issues a certificate for the workload and supersedes the previous one
+func (s *RenewalScheduler)renew(w *Workload, previous *CertificateRecord) (event *RenewalEvent, e error) {
+	event = &RenewalEvent{Type: RenewalIssued, Workload: w.Name, Previous: previous}
+	if previous != nil {
+		event.Type = RenewalRenewed
+	}
+	request := w.Request
+	request.Requester = w.Name
+
+	profile := s.ca.Profile(w.Profile)
+	if profile == nil {
+		return nil, errors.New("unknown profile: " + w.Profile)
+	}
+	if profile.Rekey {
+		spec := w.KeySpec
+		if spec.Algorithm == x509.UnknownPublicKeyAlgorithm {
+			spec = KeySpecP256
+			if previous != nil && previous.Certificate != nil {
+				spec, _ = PublicKeySpec(previous.Certificate.PublicKey)
+			} else if request.PublicKey != nil {
+				spec, _ = PublicKeySpec(request.PublicKey)
+			}
+		}
+		bundle, err := s.generator.Generate(w.Profile, &request, spec, w.KeyPassword)
+		if err != nil {
+			return nil, err
+		}
+		event.Certificate = bundle.Certificate
+		event.Key = bundle
+	} else {
+		cert, err := s.ca.Issue(w.Profile, &request)
+		if err != nil {
+			return nil, err
+		}
+		event.Certificate = cert
+	}
+
+	if previous != nil {
+		err := s.store.SupersedeCertificate(s.ca.Name, previous.SerialNumber)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return event, nil
+}
+
+// Start scans in the background until Stop, it sleeps until the next renewal time but at
+// most the scan interval of the policy
+func (s *RenewalScheduler)Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(s.stop, s.done)
+}
+
+// Stop ends the background scans started by Start and waits for the current scan
+func (s *RenewalScheduler)Stop() {
+	s.mutex.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mutex.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func (s *RenewalScheduler)run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	clock := s.ca.Clock()
+	for {
+		next, err := s.Scan()
+		if err != nil {
+			s.notify(&RenewalEvent{Type: RenewalFailed, Time: clock.Now(), Err: err})
+		}
+		wait := s.policy.interval()
+		if !next.IsZero() {
+			if untilNext := next.Sub(clock.Now()); untilNext < wait {
+				wait = untilNext
+			}
+		}
+		if wait < minScanWait {
+			wait = minScanWait
+		}
+
+		select {
+		case <-clock.After(wait):
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package gopki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"sync"
+	"testing"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// newRenewalTestCA creates a CA with a fake clock and a 30 days profile for workloads,
+// which rekeys when rekey is set
+func newRenewalTestCA(t *testing.T, rekey bool) (ca *CA, clock *FakeClock) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, err := NewCA("CN=GoPKI Renewal,O=Cryptable,C=BE", 5, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal("NewCA failed: ", err)
+	}
+	ca.SetStore(NewMemoryStore())
+	clock = NewFakeClock(time.Now())
+	ca.SetClock(clock)
+	ca.AddProfile(&Profile{
+		Name:        "workload",
+		Validity:    30 * day,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		Rekey:       rekey,
+	})
+	return ca, clock
+}
+
+func newTestWorkload(name string) (w *Workload) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return &Workload{
+		Name:        name,
+		Profile:     "workload",
+		Request:     IssuanceRequest{Subject: pkix.Name{CommonName: name}, PublicKey: key.Public()},
+		KeyPassword: []byte("system"),
+	}
+}
+
+// eventRecorder collects the events of a scheduler
+type eventRecorder struct {
+	mutex  sync.Mutex
+	events []*RenewalEvent
+	signal chan *RenewalEvent
+}
+
+func (r *eventRecorder)notify(e *RenewalEvent) {
+	r.mutex.Lock()
+	r.events = append(r.events, e)
+	r.mutex.Unlock()
+	if r.signal != nil {
+		r.signal <- e
+	}
+}
+
+func (r *eventRecorder)count(eventType RenewalEventType) (n int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, e := range r.events {
+		if e.Type == eventType {
+			n++
+		}
+	}
+	return n
+}
+
+// ---------- Testing Module ----------
+
+func TestFakeClock(t *testing.T) {
+	// Arrange
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	later := clock.After(time.Hour)
+
+	// Act
+	clock.Advance(30 * time.Minute)
+	var early bool
+	select {
+	case <-later:
+		early = true
+	default:
+	}
+	clock.Advance(30 * time.Minute)
+	fired := <-later
+
+	// Assert
+	if early {
+		t.Error("After fired too early")
+	}
+	if !fired.Equal(start.Add(time.Hour)) || !clock.Now().Equal(start.Add(time.Hour)) {
+		t.Error("wrong time: ", fired)
+	}
+}
+
+func TestRenewalPolicy_RenewalTime(t *testing.T) {
+	// Arrange
+	notBefore := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []*CertificateRecord{
+		{NotBefore: notBefore, NotAfter: notBefore.Add(90 * day), Fingerprint: "aa"},
+		{NotBefore: notBefore, NotAfter: notBefore.Add(90 * day), Fingerprint: "bb"},
+	}
+	plain := RenewalPolicy{Fraction: 0.5}
+	jittered := RenewalPolicy{Fraction: 0.5, Jitter: 0.1}
+
+	// Act
+	half := plain.RenewalTime(records[0])
+	first, again := jittered.RenewalTime(records[0]), jittered.RenewalTime(records[0])
+	second := jittered.RenewalTime(records[1])
+	_, errJitter := NewRenewalScheduler(nil, RenewalPolicy{Fraction: 0.9, Jitter: 0.2}, nil)
+
+	// Assert
+	if !half.Equal(notBefore.Add(45 * day)) {
+		t.Error("wrong renewal time: ", half)
+	}
+	if !first.Equal(again) || first.Equal(second) {
+		t.Error("jitter is not stable per certificate: ", first, again, second)
+	}
+	for _, renewal := range []time.Time{first, second} {
+		if renewal.Before(notBefore.Add(36*day)) || renewal.After(notBefore.Add(54*day)) {
+			t.Error("jitter out of range: ", renewal)
+		}
+	}
+	if errJitter == nil {
+		t.Error("jitter beyond the lifetime accepted")
+	}
+}
+
+func TestRenewalScheduler_Renew(t *testing.T) {
+	for _, rekey := range []bool{false, true} {
+		// Arrange
+		ca, clock := newRenewalTestCA(t, rekey)
+		recorder := &eventRecorder{}
+		scheduler, err := NewRenewalScheduler(ca, RenewalPolicy{Fraction: 2.0 / 3, Jitter: 0.05}, recorder.notify)
+		if err != nil {
+			t.Fatal("NewRenewalScheduler failed: ", err)
+		}
+		scheduler.Register(newTestWorkload("api"))
+		scheduler.Register(newTestWorkload("web"))
+
+		// Act: a year, one scan a day
+		for i := 0; i < 365; i++ {
+			_, err = scheduler.Scan()
+			if err != nil {
+				t.Fatal("Scan failed: ", err)
+			}
+			for _, e := range recorder.events {
+				if e.Type == RenewalRenewed && !e.Time.Before(e.Previous.NotAfter) {
+					t.Error("certificate renewed after it expired: ", e.Previous.NotAfter)
+				}
+			}
+			clock.Advance(day)
+		}
+		valid, _ := ca.store.CertificatesByStatus(ca.Name, CertificateValid, clock.Now())
+		superseded, _ := ca.store.CertificatesByStatus(ca.Name, CertificateSuperseded, clock.Now())
+		apiCerts, _ := ca.store.CertificatesBySubject(ca.Name, "CN=api")
+
+		// Assert
+		if recorder.count(RenewalIssued) != 2 || recorder.count(RenewalFailed) != 0 {
+			t.Error(rekey, ": wrong first issuance: ", recorder.count(RenewalIssued), recorder.count(RenewalFailed))
+		}
+		renewed := recorder.count(RenewalRenewed)
+		if renewed < 2*16 || renewed > 2*20 {
+			t.Error(rekey, ": wrong number of renewals in a year: ", renewed)
+		}
+		if len(superseded) != renewed {
+			t.Error(rekey, ": renewed certificates not superseded: ", len(superseded))
+		}
+		if len(valid) != 2 {
+			t.Error(rekey, ": workloads must have one valid certificate: ", len(valid))
+		}
+		keys := map[string]bool{}
+		for _, cert := range apiCerts {
+			keys[cert.KeyID] = true
+		}
+		if rekey && len(keys) != len(apiCerts) || !rekey && len(keys) != 1 {
+			t.Error(rekey, ": wrong keys: ", len(keys), " for ", len(apiCerts), " certificates")
+		}
+		for _, e := range recorder.events {
+			if e.Type == RenewalRenewed && (e.Key != nil) != rekey {
+				t.Error(rekey, ": new key not reported")
+				break
+			}
+		}
+	}
+}
+
+func TestRenewalScheduler_Expiring(t *testing.T) {
+	// Arrange
+	ca, clock := newRenewalTestCA(t, false)
+	recorder := &eventRecorder{}
+	scheduler, _ := NewRenewalScheduler(ca, RenewalPolicy{}, recorder.notify)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca.Issue("workload", &IssuanceRequest{Subject: pkix.Name{CommonName: "unregistered"}, PublicKey: key.Public()})
+
+	// Act
+	scheduler.Scan()
+	before := recorder.count(RenewalExpiring)
+	clock.Advance(21 * day)
+	scheduler.Scan()
+	scheduler.Scan()
+
+	// Assert
+	if before != 0 {
+		t.Error("expiring reported too early")
+	}
+	if recorder.count(RenewalExpiring) != 1 {
+		t.Error("expiring not reported once: ", recorder.count(RenewalExpiring))
+	}
+}
+
+func TestRenewalScheduler_CAExpires(t *testing.T) {
+	// Arrange
+	ca, clock := newRenewalTestCA(t, false)
+	ca.SetBackdate(2 * time.Hour)
+	recorder := &eventRecorder{}
+	scheduler, _ := NewRenewalScheduler(ca, RenewalPolicy{}, recorder.notify)
+	scheduler.Register(newTestWorkload("api"))
+	scheduler.Scan()
+	clock.Advance(ca.Certificate.NotAfter.Sub(clock.Now()) - 30*time.Minute)
+
+	// Act: the clock doesn't move
+	var next time.Time
+	for i := 0; i < 5; i++ {
+		next, _ = scheduler.Scan()
+	}
+	scheduler.Start()
+	waiting := make(chan struct{})
+	go func() {
+		clock.BlockUntil(1)
+		close(waiting)
+	}()
+	var spinning bool
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		spinning = true
+	}
+	scheduler.Stop()
+	superseded, _ := ca.store.CertificatesByStatus(ca.Name, CertificateSuperseded, clock.Now())
+
+	// Assert
+	if recorder.count(RenewalIssued) != 2 || recorder.count(RenewalRenewed) != 0 || len(superseded) != 0 {
+		t.Error("certificates issued while the clock stands still: ", recorder.count(RenewalIssued), recorder.count(RenewalRenewed))
+	}
+	if recorder.count(RenewalExpiring) != 1 {
+		t.Error("expiring CA not reported once: ", recorder.count(RenewalExpiring))
+	}
+	if !next.IsZero() && !next.After(clock.Now()) {
+		t.Error("next renewal time in the past: ", next)
+	}
+	if spinning {
+		t.Error("background scans don't wait")
+	}
+}
+
+func TestRenewalScheduler_Start(t *testing.T) {
+	// Arrange
+	ca, clock := newRenewalTestCA(t, false)
+	recorder := &eventRecorder{signal: make(chan *RenewalEvent, 10)}
+	scheduler, _ := NewRenewalScheduler(ca, RenewalPolicy{Interval: 7 * day}, recorder.notify)
+	scheduler.Register(newTestWorkload("api"))
+
+	// Act
+	scheduler.Start()
+	issued := <-recorder.signal
+	clock.BlockUntil(1)
+	clock.Advance(7 * day)
+	clock.BlockUntil(1)
+	clock.Advance(7 * day)
+	clock.BlockUntil(1)
+	clock.Advance(7 * day)
+	renewed := <-recorder.signal
+	scheduler.Stop()
+
+	// Assert
+	if issued.Type != RenewalIssued || renewed.Type != RenewalRenewed {
+		t.Error("wrong events: ", issued.Type, renewed.Type)
+	}
+	if renewed.Time.Before(issued.Time.Add(20 * day)) {
+		t.Error("renewed too early: ", renewed.Time)
+	}
+}
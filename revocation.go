@@ -0,0 +1,99 @@
+package gopki
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"time"
+)
+
+// RevocationReason is the CRLReason of RFC 5280
+type RevocationReason int
+
+const (
+	ReasonUnspecified          RevocationReason = 0
+	ReasonKeyCompromise        RevocationReason = 1
+	ReasonCACompromise         RevocationReason = 2
+	ReasonAffiliationChanged   RevocationReason = 3
+	ReasonSuperseded           RevocationReason = 4
+	ReasonCessationOfOperation RevocationReason = 5
+	ReasonCertificateHold      RevocationReason = 6
+	ReasonPrivilegeWithdrawn   RevocationReason = 9
+	ReasonAACompromise         RevocationReason = 10
+)
+
+var oidInvalidityDate = asn1.ObjectIdentifier{2, 5, 29, 24}
+
+// Revocation records the revocation of a certificate issued by a CA
+type Revocation struct {
+	SerialNumber *big.Int
+	// Profile is the name of the profile the certificate was issued with
+	Profile        string
+	RevocationTime time.Time
+	Reason         RevocationReason
+	// InvalidityDate is the time the key is suspected to be compromised, zero when unknown
+	InvalidityDate time.Time
+}
+
+func (r RevocationReason)valid() (b bool) {
+	return (r >= ReasonUnspecified && r <= ReasonCertificateHold) ||
+		r == ReasonPrivilegeWithdrawn || r == ReasonAACompromise
+}
+
+// Revoke revokes a certificate issued by the CA, the invalidity date may be zero
+func (ca *CA)Revoke(serial *big.Int, reason RevocationReason, invalidityDate time.Time) (e error) {
+	if !reason.valid() {
+		return errors.New("invalid revocation reason")
+	}
+
+	ca.mutex.Lock()
+	store := ca.store
+	ca.mutex.Unlock()
+
+	issued, err := store.SerialNumberExists(ca.Name, serial)
+	if err != nil {
+		return err
+	}
+	if !issued {
+		return errors.New("certificate " + serial.Text(16) + " is not issued by " + ca.Name)
+	}
+	revoked, err := store.Revocation(ca.Name, serial)
+	if err != nil {
+		return err
+	}
+	if revoked != nil {
+		return errors.New("certificate " + serial.Text(16) + " is already revoked")
+	}
+
+	profile, err := store.CertificateProfile(ca.Name, serial)
+	if err != nil {
+		return err
+	}
+
+	return store.AddRevocation(ca.Name, &Revocation{
+		SerialNumber:   new(big.Int).Set(serial),
+		Profile:        profile,
+		RevocationTime: ca.Clock().Now().UTC().Truncate(time.Second),
+		Reason:         reason,
+		InvalidityDate: invalidityDate,
+	})
+}
+
+// revocationListEntry converts the revocation into a CRL entry
+func (r *Revocation)revocationListEntry() (entry x509.RevocationListEntry, e error) {
+	entry = x509.RevocationListEntry{
+		SerialNumber:   r.SerialNumber,
+		RevocationTime: r.RevocationTime,
+		ReasonCode:     int(r.Reason),
+	}
+	if !r.InvalidityDate.IsZero() {
+		value, err := asn1.MarshalWithParams(r.InvalidityDate.UTC(), "generalized")
+		if err != nil {
+			return entry, err
+		}
+		entry.ExtraExtensions = append(entry.ExtraExtensions, pkix.Extension{Id: oidInvalidityDate, Value: value})
+	}
+	return entry, nil
+}
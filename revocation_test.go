@@ -0,0 +1,152 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newRevocationTestCA(t *testing.T) (ca *CA, serials []*big.Int) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, err := NewCA("CN=GoPKI CRL,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal("NewCA failed: ", err)
+	}
+	tlsKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	for i := 0; i < 2; i++ {
+		cert, err := ca.CreateTLSClientCertificate("CN=Client", tlsKey.Public())
+		if err != nil {
+			t.Fatal("CreateTLSClientCertificate failed: ", err)
+		}
+		certif, _ := x509.ParseCertificate(cert)
+		serials = append(serials, certif.SerialNumber)
+	}
+	return ca, serials
+}
+
+func TestCA_Revoke(t *testing.T) {
+	// Arrange
+	ca, serials := newRevocationTestCA(t)
+
+	// Act
+	err := ca.Revoke(serials[0], ReasonKeyCompromise, time.Time{})
+
+	// Assert
+	if err != nil {
+		t.Error("Revoke failed: ", err)
+		return
+	}
+	if ca.Revoke(serials[0], ReasonSuperseded, time.Time{}) == nil {
+		t.Error("Revoke must refuse a certificate which is already revoked")
+	}
+	if ca.Revoke(big.NewInt(42), ReasonSuperseded, time.Time{}) == nil {
+		t.Error("Revoke must refuse a certificate which is not issued by the CA")
+	}
+	if ca.Revoke(serials[1], RevocationReason(8), time.Time{}) == nil {
+		t.Error("Revoke must refuse removeFromCRL as reason")
+	}
+}
+
+func TestCA_CreateCRL(t *testing.T) {
+	// Arrange
+	ca, serials := newRevocationTestCA(t)
+	ca.SetCRLValidity(time.Hour)
+	invalidityDate := time.Now().Add(-24 * time.Hour).UTC().Truncate(time.Second)
+	ca.Revoke(serials[0], ReasonKeyCompromise, invalidityDate)
+
+	// Act
+	first, err := ca.CreateCRL()
+	if err != nil {
+		t.Error("CreateCRL failed: ", err)
+		return
+	}
+	second, err := ca.CreateCRL()
+	if err != nil {
+		t.Error("CreateCRL failed: ", err)
+		return
+	}
+
+	// Assert
+	crl, err := x509.ParseRevocationList(first)
+	if err != nil {
+		t.Error("ParseRevocationList failed: ", err)
+		return
+	}
+	err = crl.CheckSignatureFrom(ca.Certificate)
+	if err != nil {
+		t.Error("CRL signature is invalid: ", err)
+	}
+	if crl.Number.Cmp(big.NewInt(1)) != 0 {
+		t.Error("First CRL number is not 1: ", crl.Number)
+	}
+	if !bytes.Equal(crl.AuthorityKeyId, ca.Certificate.SubjectKeyId) {
+		t.Error("CRL has wrong authority key identifier")
+	}
+	if crl.NextUpdate.Sub(crl.ThisUpdate) != time.Hour {
+		t.Error("CRL has wrong next update: ", crl.NextUpdate.Sub(crl.ThisUpdate))
+	}
+	if len(crl.RevokedCertificateEntries) != 1 {
+		t.Error("CRL has wrong number of entries: ", len(crl.RevokedCertificateEntries))
+		return
+	}
+	entry := crl.RevokedCertificateEntries[0]
+	if entry.SerialNumber.Cmp(serials[0]) != 0 || entry.ReasonCode != int(ReasonKeyCompromise) {
+		t.Error("CRL entry is wrong: ", entry.SerialNumber, entry.ReasonCode)
+	}
+	found := false
+	for _, extension := range entry.Extensions {
+		if extension.Id.Equal(oidInvalidityDate) {
+			var date time.Time
+			asn1.UnmarshalWithParams(extension.Value, &date, "generalized")
+			found = date.Equal(invalidityDate)
+		}
+	}
+	if !found {
+		t.Error("CRL entry has no or a wrong invalidity date")
+	}
+
+	next, _ := x509.ParseRevocationList(second)
+	if next.Number.Cmp(big.NewInt(2)) != 0 {
+		t.Error("CRL number does not increment: ", next.Number)
+	}
+}
+
+func TestStoreCRL(t *testing.T) {
+	// Arrange
+	ca, _ := newRevocationTestCA(t)
+	crl, _ := ca.CreateCRL()
+	var pemOut, derOut bytes.Buffer
+
+	// Act
+	err := StoreCRL(&pemOut, crl)
+	if err != nil {
+		t.Error("StoreCRL failed: ", err)
+		return
+	}
+	err = StoreCRLDer(&derOut, crl)
+	if err != nil {
+		t.Error("StoreCRLDer failed: ", err)
+		return
+	}
+	fromPEM, err := LoadCRL(&pemOut)
+	if err != nil {
+		t.Error("LoadCRL of PEM failed: ", err)
+		return
+	}
+	fromDER, err := LoadCRL(&derOut)
+	if err != nil {
+		t.Error("LoadCRL of DER failed: ", err)
+		return
+	}
+
+	// Assert
+	if !bytes.Equal(fromPEM, crl) || !bytes.Equal(fromDER, crl) {
+		t.Error("CRL changed after store and load")
+	}
+}
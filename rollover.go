@@ -0,0 +1,485 @@
+package gopki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// RolloverState is the stage of the key rollover of a CA
+type RolloverState int
+
+const (
+	// RolloverPublished: the new CA certificate and the cross certificates are published,
+	// the old key still issues
+	RolloverPublished RolloverState = iota + 1
+	// RolloverSwitched: the new key issues, both CA certificates are still trusted
+	RolloverSwitched
+	// RolloverRetired: the old key is retired, only the new CA certificate is trusted
+	RolloverRetired
+)
+
+func (s RolloverState)String() string {
+	switch s {
+	case RolloverPublished:
+		return "published"
+	case RolloverSwitched:
+		return "switched"
+	case RolloverRetired:
+		return "retired"
+	}
+	return "RolloverState(" + strconv.Itoa(int(s)) + ")"
+}
+
+// RolloverOptions schedule the key rollover of a CA
+type RolloverOptions struct {
+	// Years is the lifetime of the new CA certificate
+	Years int
+	// SwitchAt is the time the new key takes over the issuance
+	SwitchAt time.Time
+	// RetireAt ends the overlap window, the old CA certificate leaves the trust bundle.
+	// It can't be later than the NotAfter of the old CA certificate.
+	RetireAt time.Time
+	// SignatureAlgorithm is the algorithm the new key signs with, the zero value selects
+	// DefaultSignatureAlgorithm
+	SignatureAlgorithm x509.SignatureAlgorithm
+}
+
+// Rollover tracks the replacement of the key of a root CA
+type Rollover struct {
+	State    RolloverState
+	SwitchAt time.Time
+	RetireAt time.Time
+	// OldCertificate is the CA certificate of the key which is replaced
+	OldCertificate *x509.Certificate
+	// NewCertificate is the self-signed CA certificate of the new key
+	NewCertificate *x509.Certificate
+	// OldWithNew certifies the old key with the new one, relying parties which only
+	// trust the new CA certificate use it for certificates issued by the old key
+	OldWithNew *x509.Certificate
+	// NewWithOld certifies the new key with the old one, relying parties which only
+	// trust the old CA certificate use it for certificates issued by the new key
+	NewWithOld *x509.Certificate
+}
+
+// TrustBundle returns the CA certificates to trust, both until the old key is retired
+func (r *Rollover)TrustBundle() (certs []*x509.Certificate) {
+	if r.State == RolloverRetired {
+		return []*x509.Certificate{r.NewCertificate}
+	}
+	return []*x509.Certificate{r.OldCertificate, r.NewCertificate}
+}
+
+// CrossCertificates returns the cross certificates to publish as intermediates, until
+// the old key is retired
+func (r *Rollover)CrossCertificates() (certs []*x509.Certificate) {
+	if r.State == RolloverRetired {
+		return nil
+	}
+	return []*x509.Certificate{r.OldWithNew, r.NewWithOld}
+}
+
+// keyRollover keeps the new key of the rollover until it takes over the issuance
+type keyRollover struct {
+	Rollover
+	// signer is nil when the new key is unknown, ResumeRollover provides it
+	signer    crypto.Signer
+	algorithm x509.SignatureAlgorithm
+	// old is the key which is replaced, it signs the revocation status of the certificates
+	// it issued until it is retired. It is nil when the signer of the old key is unknown.
+	old *issuingKey
+	// unsaved is set when the clock moved the rollover to a stage not yet in the Store
+	unsaved bool
+}
+
+// rolloverExtensions are copied from the old CA certificate, so the new key is
+// constrained in the same way
+var rolloverExtensions = []asn1.ObjectIdentifier{
+	oidCertificatePolicies,
+	oidPolicyConstraints,
+	oidInhibitAnyPolicy,
+	oidNameConstraints,
+}
+
+// rolloverTemplate creates a template with the subject and the constraints of the CA certificate
+func rolloverTemplate(cert *x509.Certificate, notBefore time.Time, notAfter time.Time) (template *x509.Certificate) {
+	template = &x509.Certificate{
+		RawSubject:            cert.RawSubject,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              cert.KeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            cert.MaxPathLen,
+		MaxPathLenZero:        cert.MaxPathLenZero,
+	}
+	for _, extension := range cert.Extensions {
+		for _, oid := range rolloverExtensions {
+			if extension.Id.Equal(oid) {
+				template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{
+					Id:       extension.Id,
+					Critical: extension.Critical,
+					Value:    extension.Value,
+				})
+			}
+		}
+	}
+	return template
+}
+
+func earliest(a time.Time, b time.Time) (t time.Time) {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// signRolloverCertificate signs the template with a reserved serial number of the CA and
+// stores the result, the issuer is the old or the new key
+func (ca *CA)signRolloverCertificate(profileName string, template *x509.Certificate, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) (certif *x509.Certificate, e error) {
+	serial, err := ca.nextSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	defer ca.releaseSerialNumber(serial)
+	template.SerialNumber = serial
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		return nil, err
+	}
+	certif, err = x509.ParseCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	ca.mutex.Lock()
+	store := ca.store
+	ca.mutex.Unlock()
+	err = store.AddCertificate(ca.Name, newCertificateRecord(profileName, "", certif))
+	if err != nil {
+		return nil, err
+	}
+	return certif, nil
+}
+
+// BeginRollover starts replacing the key of a root CA. It creates the self-signed CA
+// certificate of the new key and the cross certificates between the old and the new key,
+// which are published together during the overlap window. The old key continues issuing
+// until SwitchAt on the clock of the CA. The rollover is recorded in the Store of the CA.
+func (ca *CA)BeginRollover(pub crypto.PublicKey, priv crypto.PrivateKey, opts RolloverOptions) (r *Rollover, e error) {
+
+	ca.mutex.Lock()
+	current, old, skiMethod := ca.rollover, ca.currentKey(), ca.skiMethod
+	ca.mutex.Unlock()
+	oldCert := old.certificate
+
+	if current != nil && current.State != RolloverRetired {
+		return nil, errors.New("key rollover of CA " + ca.Name + " is already in progress")
+	}
+	if len(old.chain) != 1 {
+		return nil, errors.New("key of a subordinate CA is not rolled over, its issuer creates a new subordinate CA")
+	}
+	if !opts.SwitchAt.Before(opts.RetireAt) {
+		return nil, errors.New("switch time of the key rollover must be before the retire time")
+	}
+	if opts.RetireAt.After(oldCert.NotAfter) {
+		return nil, errors.New("old CA certificate expires before the retire time of the key rollover")
+	}
+
+	signer, err := NewMemorySigner(priv)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := selectSignatureAlgorithm(signer.Public(), opts.SignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	ski, err := SubjectKeyIdentifier(pub, skiMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	notBefore, newNotAfter, err := ca.validity(nil, func(now time.Time) time.Time {
+		return now.AddDate(opts.Years, 0, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	newTemplate := rolloverTemplate(oldCert, notBefore, newNotAfter)
+	newTemplate.SubjectKeyId = ski
+	newTemplate.AuthorityKeyId = ski
+	newTemplate.SignatureAlgorithm = algorithm
+	newCert, err := ca.signRolloverCertificate(ProfileRootCA, newTemplate, newTemplate, pub, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	// the cross certificates end with the old key
+	notAfter := earliest(oldCert.NotAfter, newCert.NotAfter)
+	newWithOldTemplate := rolloverTemplate(newCert, notBefore, notAfter)
+	newWithOldTemplate.SubjectKeyId = ski
+	newWithOldTemplate.SignatureAlgorithm = old.algorithm
+	newWithOld, err := ca.signRolloverCertificate(ProfileCrossCertificate, newWithOldTemplate, oldCert, pub, old.signer)
+	if err != nil {
+		return nil, err
+	}
+	oldWithNewTemplate := rolloverTemplate(oldCert, notBefore, notAfter)
+	oldWithNewTemplate.SubjectKeyId = oldCert.SubjectKeyId
+	oldWithNewTemplate.SignatureAlgorithm = algorithm
+	oldWithNew, err := ca.signRolloverCertificate(ProfileCrossCertificate, oldWithNewTemplate, newCert, oldCert.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	rollover := &keyRollover{
+		Rollover: Rollover{
+			State:          RolloverPublished,
+			SwitchAt:       opts.SwitchAt,
+			RetireAt:       opts.RetireAt,
+			OldCertificate: oldCert,
+			NewCertificate: newCert,
+			OldWithNew:     oldWithNew,
+			NewWithOld:     newWithOld,
+		},
+		signer:    signer,
+		algorithm: algorithm,
+		old:       &old,
+	}
+
+	ca.mutex.Lock()
+	if ca.rollover != current {
+		ca.mutex.Unlock()
+		return nil, errors.New("key rollover of CA " + ca.Name + " is already in progress")
+	}
+	ca.rollover = rollover
+	store := ca.store
+	ca.mutex.Unlock()
+
+	err = store.SetRollover(ca.Name, &rollover.Rollover)
+	if err != nil {
+		return nil, err
+	}
+	record := rollover.Rollover
+	return &record, nil
+}
+
+// switchKey lets the new key of the rollover take over the issuance, the caller holds
+// the mutex
+func (ca *CA)switchKey(r *keyRollover) {
+	ca.issuing = &issuingKey{
+		certificate: r.NewCertificate,
+		chain:       [][]byte{r.NewCertificate.Raw},
+		signer:      r.signer,
+		algorithm:   r.algorithm,
+	}
+}
+
+// advanceRollover moves the key rollover to the stage it is scheduled for at now, the
+// caller holds the mutex
+func (ca *CA)advanceRollover(now time.Time) (e error) {
+	rollover := ca.rollover
+	if rollover == nil {
+		return errors.New("CA " + ca.Name + " has no key rollover")
+	}
+	if rollover.State == RolloverPublished && !now.Before(rollover.SwitchAt) {
+		if rollover.signer == nil {
+			return errors.New("new key of the key rollover of CA " + ca.Name + " is unknown, resume the rollover with it")
+		}
+		ca.switchKey(rollover)
+		rollover.State = RolloverSwitched
+		rollover.unsaved = true
+	}
+	if rollover.State == RolloverSwitched && !now.Before(rollover.RetireAt) {
+		rollover.State = RolloverRetired
+		rollover.unsaved = true
+	}
+	return nil
+}
+
+// scheduleRollover moves a key rollover to the stage its schedule reached on the clock of
+// the CA, the caller holds the mutex. Without the new key the old key continues issuing,
+// AdvanceRollover reports it.
+func (ca *CA)scheduleRollover() {
+	if ca.rollover == nil || ca.rollover.State == RolloverRetired {
+		return
+	}
+	ca.advanceRollover(ca.now())
+}
+
+// saveRollover records the stage the key rollover moved to in the Store
+func (ca *CA)saveRollover() (e error) {
+	ca.mutex.Lock()
+	rollover := ca.rollover
+	if rollover == nil || !rollover.unsaved {
+		ca.mutex.Unlock()
+		return nil
+	}
+	rollover.unsaved = false
+	record, store := rollover.Rollover, ca.store
+	ca.mutex.Unlock()
+
+	err := store.SetRollover(ca.Name, &record)
+	if err == nil {
+		err = store.SetCA(ca.Name, record.NewCertificate)
+	}
+	if err != nil {
+		ca.mutex.Lock()
+		rollover.unsaved = true
+		ca.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// AdvanceRollover moves the key rollover to the stage it is scheduled for at now. From
+// SwitchAt on the CA issues with the new key and Issuer returns the new CA certificate,
+// Certificate, Bytes and Chain keep the one the CA was created with. The CA moves along
+// by itself when it issues at a time on its clock past SwitchAt or RetireAt, AdvanceRollover
+// moves it ahead of its clock or reports why it can't move.
+func (ca *CA)AdvanceRollover(now time.Time) (state RolloverState, e error) {
+	ca.mutex.Lock()
+	err := ca.advanceRollover(now)
+	if err != nil {
+		ca.mutex.Unlock()
+		return 0, err
+	}
+	state = ca.rollover.State
+	ca.mutex.Unlock()
+
+	err = ca.saveRollover()
+	if err != nil {
+		return 0, err
+	}
+	return state, nil
+}
+
+// ResumeRollover continues the key rollover recorded in the Store of the CA after a
+// restart, priv is the new key of the rollover. The CA is loaded with either the old or
+// the new CA certificate.
+func (ca *CA)ResumeRollover(priv crypto.PrivateKey) (r *Rollover, e error) {
+	ca.mutex.Lock()
+	store, cert := ca.store, ca.currentKey().certificate
+	ca.mutex.Unlock()
+
+	record, err := store.Rollover(ca.Name)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, errors.New("no key rollover recorded for CA " + ca.Name)
+	}
+	if !cert.Equal(record.OldCertificate) && !cert.Equal(record.NewCertificate) {
+		return nil, errors.New("recorded key rollover does not belong to the certificate of CA " + ca.Name)
+	}
+	signer, err := NewMemorySigner(priv)
+	if err != nil {
+		return nil, err
+	}
+	err = checkSignerMatches(signer, record.NewCertificate.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := selectSignatureAlgorithm(signer.Public(), record.NewCertificate.SignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	rollover := &keyRollover{Rollover: *record, signer: signer, algorithm: algorithm}
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	if current := ca.currentKey(); current.certificate.Equal(record.OldCertificate) {
+		rollover.old = &current
+	}
+	ca.rollover = rollover
+	if rollover.State != RolloverPublished {
+		ca.switchKey(rollover)
+	}
+	return record, nil
+}
+
+// restoreRollover attaches the key rollover recorded in the Store to a CA loaded with the
+// key of its saved configuration. A CA saved with the new key continues the rollover with
+// it. A CA saved with the old key only loads while the old key still issues, the new key
+// of the rollover is then provided by ResumeRollover before the switch.
+func (ca *CA)restoreRollover(record *Rollover) (e error) {
+	now := ca.Clock().Now()
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	current := ca.currentKey()
+	rollover := &keyRollover{Rollover: *record}
+	switch {
+	case current.certificate.Equal(record.NewCertificate):
+		rollover.signer, rollover.algorithm = current.signer, current.algorithm
+	case current.certificate.Equal(record.OldCertificate):
+		if record.State != RolloverPublished || !now.Before(record.SwitchAt) {
+			return errors.New("CA " + ca.Name + " is saved with the old key of its key rollover, which no longer issues: save it with the new key")
+		}
+		rollover.old = &current
+	default:
+		return errors.New("recorded key rollover does not belong to the certificate of CA " + ca.Name)
+	}
+	ca.rollover = rollover
+	return nil
+}
+
+// retiringKey returns the old key of a key rollover which switched to the new key but
+// is not retired yet, or nil. The caller holds the mutex.
+func (ca *CA)retiringKey() (k *issuingKey) {
+	ca.scheduleRollover()
+	r := ca.rollover
+	if r == nil || r.State != RolloverSwitched || r.old == nil {
+		return nil
+	}
+	old := *r.old
+	return &old
+}
+
+// revocationKeys returns the keys which sign the revocation status of the certificates
+// of the CA: the current key and during the overlap window of a key rollover the old key
+func (ca *CA)revocationKeys() (keys []issuingKey) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	keys = []issuingKey{ca.currentKey()}
+	if old := ca.retiringKey(); old != nil {
+		keys = append(keys, *old)
+	}
+	return keys
+}
+
+// Rollover returns the key rollover of the CA, or nil when there is none
+func (ca *CA)Rollover() (r *Rollover) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.scheduleRollover()
+	if ca.rollover == nil {
+		return nil
+	}
+	record := ca.rollover.Rollover
+	return &record
+}
+
+// TrustBundle returns the root CA certificates relying parties trust, during a key
+// rollover of the root these are the old and the new CA certificate
+func (ca *CA)TrustBundle() (certs []*x509.Certificate, e error) {
+	rollover := ca.Rollover()
+	if rollover != nil {
+		return rollover.TrustBundle(), nil
+	}
+
+	_, chain := ca.Issuer()
+	cert, err := x509.ParseCertificate(chain[len(chain)-1])
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{cert}, nil
+}
@@ -0,0 +1,402 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// verifyWithRoots verifies the certificate with Go's verifier against the roots
+func verifyWithRoots(cert *x509.Certificate, roots []*x509.Certificate, intermediates ...*x509.Certificate) (e error) {
+	rootPool := x509.NewCertPool()
+	for _, root := range roots {
+		rootPool.AddCert(root)
+	}
+	intermediatePool := x509.NewCertPool()
+	for _, intermediate := range intermediates {
+		intermediatePool.AddCert(intermediate)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         rootPool,
+		Intermediates: intermediatePool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+func issueRolloverTestLeaf(t *testing.T, ca *CA) (cert *x509.Certificate) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certBytes, err := ca.CreateTLSServerCertificate("CN=www.cryptable.org", key.Public(), "www.cryptable.org")
+	if err != nil {
+		t.Fatal("CreateTLSServerCertificate failed: ", err)
+	}
+	cert, _ = x509.ParseCertificate(certBytes)
+	return cert
+}
+
+func beginTestRollover(t *testing.T, ca *CA, now time.Time) (r *Rollover, key *ecdsa.PrivateKey) {
+	key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r, err := ca.BeginRollover(key.Public(), key, RolloverOptions{
+		Years:    10,
+		SwitchAt: now.Add(24 * time.Hour),
+		RetireAt: now.Add(30 * 24 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal("BeginRollover failed: ", err)
+	}
+	return r, key
+}
+
+// ---------- Testing Module ----------
+
+func TestCA_Rollover(t *testing.T) {
+	// Arrange
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCAWithOptions("CN=GoPKI Root,O=Cryptable,C=BE", 2, oldKey.Public(), oldKey, CAOptions{MaxPathLen: 1})
+	oldCert := ca.Certificate
+	oldLeaf := issueRolloverTestLeaf(t, ca)
+	now := time.Now()
+
+	// Act
+	rollover, newKey := beginTestRollover(t, ca, now)
+	publishedLeaf := issueRolloverTestLeaf(t, ca)
+	stateBefore, _ := ca.AdvanceRollover(now)
+	stateSwitched, errSwitch := ca.AdvanceRollover(now.Add(25 * time.Hour))
+	newLeaf := issueRolloverTestLeaf(t, ca)
+	issuer, _ := ca.Issuer()
+
+	// Assert
+	if errSwitch != nil {
+		t.Error("AdvanceRollover() failed: ", errSwitch)
+		return
+	}
+	if stateBefore != RolloverPublished || stateSwitched != RolloverSwitched {
+		t.Error("wrong rollover states: ", stateBefore, stateSwitched)
+	}
+	if !bytes.Equal(publishedLeaf.AuthorityKeyId, oldCert.SubjectKeyId) {
+		t.Error("new key issues before the switch time")
+	}
+	if !bytes.Equal(newLeaf.AuthorityKeyId, rollover.NewCertificate.SubjectKeyId) || !issuer.Equal(rollover.NewCertificate) {
+		t.Error("new key does not issue after the switch time")
+	}
+	if !ca.Certificate.Equal(oldCert) {
+		t.Error("Certificate of the CA changed by the rollover")
+	}
+	if !newKey.PublicKey.Equal(rollover.NewCertificate.PublicKey) || !bytes.Equal(rollover.NewCertificate.RawSubject, oldCert.RawSubject) {
+		t.Error("wrong new CA certificate")
+	}
+	if rollover.NewCertificate.MaxPathLen != 1 {
+		t.Error("path length of the old CA certificate not kept: ", rollover.NewCertificate.MaxPathLen)
+	}
+
+	// relying parties trusting either root accept both generations of leaves
+	oldRoots := []*x509.Certificate{oldCert}
+	newRoots := []*x509.Certificate{rollover.NewCertificate}
+	if err := verifyWithRoots(oldLeaf, newRoots, rollover.OldWithNew); err != nil {
+		t.Error("old leaf rejected by the new root: ", err)
+	}
+	if err := verifyWithRoots(newLeaf, oldRoots, rollover.NewWithOld); err != nil {
+		t.Error("new leaf rejected by the old root: ", err)
+	}
+	if err := verifyWithRoots(newLeaf, rollover.TrustBundle()); err != nil {
+		t.Error("new leaf rejected by the trust bundle: ", err)
+	}
+	if err := verifyWithRoots(oldLeaf, rollover.TrustBundle()); err != nil {
+		t.Error("old leaf rejected by the trust bundle: ", err)
+	}
+}
+
+func TestCA_RolloverOnClock(t *testing.T) {
+	// Arrange
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	clock := NewFakeClock(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	ca, _ := NewCAWithOptions("CN=GoPKI Root,O=Cryptable,C=BE", 2, oldKey.Public(), oldKey, CAOptions{Clock: clock})
+	oldCert := ca.Certificate
+	rollover, _ := beginTestRollover(t, ca, clock.Now())
+
+	// Act
+	beforeLeaf := issueRolloverTestLeaf(t, ca)
+	clock.Advance(25 * time.Hour)
+	afterLeaf := issueRolloverTestLeaf(t, ca)
+	recorded, err := ca.store.Rollover(ca.Name)
+	clock.Advance(30 * 24 * time.Hour)
+	bundle, _ := ca.TrustBundle()
+
+	// Assert
+	if !bytes.Equal(beforeLeaf.AuthorityKeyId, oldCert.SubjectKeyId) {
+		t.Error("new key issues before the switch time")
+	}
+	if !bytes.Equal(afterLeaf.AuthorityKeyId, rollover.NewCertificate.SubjectKeyId) {
+		t.Error("new key does not issue after the switch time")
+	}
+	if err != nil || recorded == nil || recorded.State != RolloverSwitched {
+		t.Error("switch not recorded in the store: ", recorded, err)
+	}
+	if len(bundle) != 1 || !bundle[0].Equal(rollover.NewCertificate) {
+		t.Error("old CA certificate still published after the retire time")
+	}
+}
+
+func TestCA_RolloverRetire(t *testing.T) {
+	// Arrange
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI Root,O=Cryptable,C=BE", 2, oldKey.Public(), oldKey)
+	now := time.Now()
+	rollover, _ := beginTestRollover(t, ca, now)
+
+	// Act
+	bundle, _ := ca.TrustBundle()
+	state, err := ca.AdvanceRollover(now.Add(31 * 24 * time.Hour))
+	retiredBundle, _ := ca.TrustBundle()
+
+	// Assert
+	if err != nil {
+		t.Error("AdvanceRollover() failed: ", err)
+		return
+	}
+	if state != RolloverRetired {
+		t.Error("old key not retired: ", state)
+	}
+	if len(bundle) != 2 || len(rollover.CrossCertificates()) != 2 {
+		t.Error("both CA certificates are not published during the overlap: ", len(bundle))
+	}
+	if len(retiredBundle) != 1 || !retiredBundle[0].Equal(rollover.NewCertificate) || ca.Rollover().CrossCertificates() != nil {
+		t.Error("old CA certificate still published after retirement")
+	}
+}
+
+func TestCA_RolloverDB(t *testing.T) {
+	// Arrange
+	db := newTestDB(t)
+	defer db.CloseDB()
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI Root,O=Cryptable,C=BE", 2, oldKey.Public(), oldKey)
+	ca.SetStore(db)
+	now := time.Now()
+	rollover, newKey := beginTestRollover(t, ca, now)
+	ca.AdvanceRollover(now.Add(25 * time.Hour))
+
+	// Act
+	recorded, err := db.Rollover(ca.Name)
+	restarted, _ := LoadCA(rollover.OldCertificate.Raw, oldKey, *big.NewInt(100))
+	restarted.SetStore(db)
+	resumed, errResume := restarted.ResumeRollover(newKey)
+	issuer, _ := restarted.Issuer()
+
+	// Assert
+	if err != nil || errResume != nil {
+		t.Error("rollover not recorded: ", err, errResume)
+		return
+	}
+	if recorded.State != RolloverSwitched || !recorded.NewWithOld.Equal(rollover.NewWithOld) ||
+		!recorded.SwitchAt.Equal(rollover.SwitchAt.Truncate(time.Second)) {
+		t.Error("wrong recorded rollover: ", recorded.State)
+	}
+	for _, cert := range []*x509.Certificate{rollover.NewCertificate, rollover.OldWithNew, rollover.NewWithOld} {
+		profile, _ := db.CertificateProfile(ca.Name, cert.SerialNumber)
+		if profile == "" {
+			t.Error("rollover certificate not stored: ", cert.SerialNumber)
+		}
+	}
+	if resumed.State != RolloverSwitched || !issuer.Equal(rollover.NewCertificate) {
+		t.Error("restarted CA does not issue with the new key")
+	}
+	if _, err := restarted.ResumeRollover(oldKey); err == nil {
+		t.Error("rollover resumed with the wrong key")
+	}
+}
+
+func TestCA_RolloverSaveAndExport(t *testing.T) {
+	// Arrange
+	db := newTestDB(t)
+	defer db.CloseDB()
+	kek := newTestKEK(t)
+	ca, _ := newBackupTestCA(t, db, kek)
+	now := time.Now()
+	rollover, newKey := beginTestRollover(t, ca, now)
+	ca.AdvanceRollover(now.Add(25 * time.Hour))
+
+	// Act
+	errSave := db.SaveCAWithKey(ca, newKey)
+	var backup bytes.Buffer
+	errExport := db.ExportCA(ca, nil, &backup)
+	restored := newTestDB(t)
+	defer restored.CloseDB()
+	restored.SetIntegrityKey(testIntegrityKey)
+	restored.SetKeyEncryptionKey(kek)
+	_, errImport := restored.ImportCA(&backup, ImportOptions{})
+
+	// Assert
+	if errSave != nil || errExport != nil || errImport != nil {
+		t.Error("switched CA not saved or backed up: ", errSave, errExport, errImport)
+		return
+	}
+	loaded, err := restored.LoadCA(ca.Name, nil)
+	if err != nil {
+		t.Error("LoadCA() failed: ", err)
+		return
+	}
+	if issuer, _ := loaded.Issuer(); !issuer.Equal(rollover.NewCertificate) {
+		t.Error("CA not saved with the new key")
+	}
+	leaf := issueRolloverTestLeaf(t, loaded)
+	if err := leaf.CheckSignatureFrom(rollover.NewCertificate); err != nil {
+		t.Error("loaded CA does not issue with the new key: ", err)
+	}
+}
+
+func TestDB_LoadCARollover(t *testing.T) {
+	// Arrange
+	db := newTestDB(t)
+	defer db.CloseDB()
+	ca, _ := newBackupTestCA(t, db, newTestKEK(t))
+	now := time.Now()
+	rollover, newKey := beginTestRollover(t, ca, now)
+
+	// Act
+	published, errPublished := db.LoadCA(ca.Name, nil)
+	_, errUnknownKey := published.AdvanceRollover(now.Add(25 * time.Hour))
+	ca.AdvanceRollover(now.Add(25 * time.Hour))
+	_, errOldKey := db.LoadCA(ca.Name, nil)
+	db.SaveCAWithKey(ca, newKey)
+	switched, errSwitched := db.LoadCA(ca.Name, nil)
+
+	// Assert
+	if errPublished != nil || published.Rollover() == nil || published.Rollover().State != RolloverPublished {
+		t.Error("published rollover not restored: ", errPublished)
+		return
+	}
+	if errUnknownKey == nil {
+		t.Error("rollover switched to an unknown key")
+	}
+	if errOldKey == nil {
+		t.Error("CA loaded with the old key after the switch")
+	}
+	if errSwitched != nil || switched.Rollover() == nil || switched.Rollover().State != RolloverSwitched {
+		t.Error("switched rollover not restored: ", errSwitched)
+		return
+	}
+	bundle, _ := switched.TrustBundle()
+	if issuer, _ := switched.Issuer(); !issuer.Equal(rollover.NewCertificate) || len(bundle) != 2 {
+		t.Error("loaded CA does not continue the rollover with the new key")
+	}
+}
+
+func TestCA_RolloverRevocationStatus(t *testing.T) {
+	// Arrange
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI Root,O=Cryptable,C=BE", 2, oldKey.Public(), oldKey)
+	oldLeaf := issueRolloverTestLeaf(t, ca)
+	now := time.Now()
+	rollover, _ := beginTestRollover(t, ca, now)
+	ca.AdvanceRollover(now.Add(25 * time.Hour))
+	newLeaf := issueRolloverTestLeaf(t, ca)
+	ca.Revoke(oldLeaf.SerialNumber, ReasonKeyCompromise, time.Time{})
+	responder, _ := NewOCSPResponder(ca)
+	oldRequest, _ := ocsp.CreateRequest(oldLeaf, rollover.OldCertificate, nil)
+	newRequest, _ := ocsp.CreateRequest(newLeaf, rollover.NewCertificate, nil)
+
+	// Act
+	oldStatus, errOld := ocsp.ParseResponseForCert(responder.Respond(oldRequest), oldLeaf, rollover.OldCertificate)
+	newStatus, errNew := ocsp.ParseResponseForCert(responder.Respond(newRequest), newLeaf, rollover.NewCertificate)
+	oldCRLBytes, errOldCRL := ca.CreateRolloverCRL()
+	oldCRL, _ := x509.ParseRevocationList(oldCRLBytes)
+	newCRLBytes, _ := ca.CreateCRL()
+	newCRL, _ := x509.ParseRevocationList(newCRLBytes)
+	ca.AdvanceRollover(now.Add(31 * 24 * time.Hour))
+	_, errRetired := ca.CreateRolloverCRL()
+	retired, _ := ocsp.ParseResponse(responder.Respond(oldRequest), nil)
+
+	// Assert
+	if errOld != nil || oldStatus.Status != ocsp.Revoked {
+		t.Error("no revocation status for the old key: ", errOld)
+	}
+	if errNew != nil || newStatus.Status != ocsp.Good {
+		t.Error("no revocation status for the new key: ", errNew)
+	}
+	if errOldCRL != nil || oldCRL.CheckSignatureFrom(rollover.OldCertificate) != nil ||
+		len(oldCRL.RevokedCertificateEntries) != 1 {
+		t.Error("CRL not signed by the old key: ", errOldCRL)
+	}
+	if newCRL.CheckSignatureFrom(rollover.NewCertificate) != nil {
+		t.Error("CRL not signed by the new key")
+	}
+	if errRetired == nil || retired != nil {
+		t.Error("retired key still signs the revocation status")
+	}
+}
+
+func TestCA_RolloverConcurrent(t *testing.T) {
+	// Arrange
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI Root,O=Cryptable,C=BE", 2, oldKey.Public(), oldKey)
+	now := time.Now()
+	rollover, _ := beginTestRollover(t, ca, now)
+	var wg sync.WaitGroup
+	crls := make([][]byte, 8)
+	errs := make([]error, 8)
+
+	// Act
+	for i := range crls {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			crls[i], errs[i] = ca.CreateCRL()
+			issueRolloverTestLeaf(t, ca)
+		}(i)
+	}
+	ca.AdvanceRollover(now.Add(25 * time.Hour))
+	wg.Wait()
+
+	// Assert
+	for i, der := range crls {
+		crl, err := x509.ParseRevocationList(der)
+		if errs[i] != nil || err != nil {
+			t.Error("CreateCRL() failed: ", errs[i], err)
+			continue
+		}
+		if crl.CheckSignatureFrom(rollover.OldCertificate) != nil && crl.CheckSignatureFrom(rollover.NewCertificate) != nil {
+			t.Error("CRL signed by a mix of the old and the new key")
+		}
+	}
+}
+
+func TestCA_RolloverErrors(t *testing.T) {
+	// Arrange
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	root, _ := NewCAWithOptions("CN=GoPKI Root,O=Cryptable,C=BE", 2, rootKey.Public(), rootKey, CAOptions{MaxPathLen: 1})
+	issuingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	issuing, _, _ := root.NewSubordinateCA("CN=GoPKI Issuing,O=Cryptable,C=BE", 1, issuingKey.Public(), issuingKey, CAOptions{})
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	now := time.Now()
+
+	// Act
+	_, errSubordinate := issuing.BeginRollover(key.Public(), key, RolloverOptions{Years: 1, SwitchAt: now, RetireAt: now.Add(time.Hour)})
+	_, errOrder := root.BeginRollover(key.Public(), key, RolloverOptions{Years: 1, SwitchAt: now.Add(time.Hour), RetireAt: now})
+	_, errExpired := root.BeginRollover(key.Public(), key, RolloverOptions{Years: 1, SwitchAt: now, RetireAt: now.AddDate(3, 0, 0)})
+	_, errNone := root.AdvanceRollover(now)
+	beginTestRollover(t, root, now)
+	_, errTwice := root.BeginRollover(key.Public(), key, RolloverOptions{Years: 1, SwitchAt: now, RetireAt: now.Add(time.Hour)})
+
+	// Assert
+	if errSubordinate == nil {
+		t.Error("key of a subordinate CA rolled over")
+	}
+	if errOrder == nil || errExpired == nil {
+		t.Error("invalid rollover schedule accepted")
+	}
+	if errNone == nil {
+		t.Error("CA without rollover advanced")
+	}
+	if errTwice == nil {
+		t.Error("second rollover started while one is in progress")
+	}
+}
@@ -0,0 +1,94 @@
+package gopki
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// DefaultSerialNumberBits is the entropy of the random serial numbers, CA/B forum
+// requires at least 64 bits
+var DefaultSerialNumberBits = 128
+
+// SerialNumberGenerator hands out the serial numbers of the certificates issued by a CA
+type SerialNumberGenerator interface {
+	NextSerialNumber() (serial *big.Int, e error)
+}
+
+// RandomSerialNumberGenerator creates positive random serial numbers of Bits bits, which
+// always fit in the 20 octets allowed by RFC 5280.
+type RandomSerialNumberGenerator struct {
+	Bits int
+}
+
+func NewRandomSerialNumberGenerator() (g *RandomSerialNumberGenerator) {
+	return &RandomSerialNumberGenerator{DefaultSerialNumberBits}
+}
+
+func (g *RandomSerialNumberGenerator)NextSerialNumber() (serial *big.Int, e error) {
+	if g.Bits < 64 || g.Bits > 159 {
+		return nil, errors.New("serial number size must be between 64 and 159 bits")
+	}
+
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(g.Bits))
+	for {
+		serial, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return nil, err
+		}
+		// 0 is not a valid serial number
+		if serial.Sign() > 0 {
+			return serial, nil
+		}
+	}
+}
+
+// SequentialSerialNumberGenerator hands out incrementing serial numbers. It leaks the
+// number of issued certificates and is meant for tests.
+type SequentialSerialNumberGenerator struct {
+	next *big.Int
+}
+
+func NewSequentialSerialNumberGenerator(start *big.Int) (g *SequentialSerialNumberGenerator) {
+	return &SequentialSerialNumberGenerator{new(big.Int).Set(start)}
+}
+
+func (g *SequentialSerialNumberGenerator)NextSerialNumber() (serial *big.Int, e error) {
+	serial = new(big.Int).Set(g.next)
+	g.next.Add(g.next, big.NewInt(1))
+	return serial, nil
+}
+
+// serialNumberState encodes the state of the generator, so the CA continues with it
+// after a restart
+func serialNumberState(g SerialNumberGenerator) (s string, e error) {
+	switch generator := g.(type) {
+	case *RandomSerialNumberGenerator:
+		return "random:" + strconv.Itoa(generator.Bits), nil
+	case *SequentialSerialNumberGenerator:
+		return "sequential:" + generator.next.Text(16), nil
+	}
+	return "", errors.New("state of the serial number generator can't be saved")
+}
+
+// parseSerialNumberState restores the generator encoded by serialNumberState
+func parseSerialNumberState(s string) (g SerialNumberGenerator, e error) {
+	kind, value, _ := strings.Cut(s, ":")
+	switch kind {
+	case "random":
+		bits, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.New("invalid serial number state: " + s)
+		}
+		return &RandomSerialNumberGenerator{bits}, nil
+	case "sequential":
+		next, ok := new(big.Int).SetString(value, 16)
+		if !ok {
+			return nil, errors.New("invalid serial number state: " + s)
+		}
+		return &SequentialSerialNumberGenerator{next}, nil
+	}
+	return nil, errors.New("invalid serial number state: " + s)
+}
@@ -0,0 +1,102 @@
+package gopki
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"math/big"
+	"testing"
+)
+
+func TestRandomSerialNumberGenerator(t *testing.T) {
+	// Arrange
+	g := NewRandomSerialNumberGenerator()
+	seen := map[string]bool{}
+
+	for i := 0; i < 1000; i++ {
+		// Act
+		serial, err := g.NextSerialNumber()
+
+		// Assert
+		if err != nil {
+			t.Error("NextSerialNumber failed: ", err)
+			return
+		}
+		if serial.Sign() <= 0 {
+			t.Error("Serial number is not positive: ", serial)
+		}
+		// DER encoding adds at most one leading zero octet
+		if len(serial.Bytes()) > 19 {
+			t.Error("Serial number too long: ", serial)
+		}
+		if seen[serial.String()] {
+			t.Error("Serial number repeated: ", serial)
+		}
+		seen[serial.String()] = true
+	}
+}
+
+func TestRandomSerialNumberGeneratorTooSmall(t *testing.T) {
+	// Arrange
+	g := &RandomSerialNumberGenerator{Bits: 32}
+
+	// Act
+	_, err := g.NextSerialNumber()
+
+	// Assert
+	if err == nil {
+		t.Error("NextSerialNumber must refuse less than 64 bits")
+	}
+}
+
+func TestSequentialSerialNumberGenerator(t *testing.T) {
+	// Arrange
+	g := NewSequentialSerialNumberGenerator(big.NewInt(1))
+
+	// Act
+	first, _ := g.NextSerialNumber()
+	second, _ := g.NextSerialNumber()
+
+	// Assert
+	if first.Cmp(big.NewInt(1)) != 0 || second.Cmp(big.NewInt(2)) != 0 {
+		t.Error("Unexpected serial numbers: ", first, second)
+	}
+}
+
+type repeatingSerialNumberGenerator struct {
+	serials []*big.Int
+}
+
+func (g *repeatingSerialNumberGenerator)NextSerialNumber() (serial *big.Int, e error) {
+	serial = g.serials[0]
+	g.serials = g.serials[1:]
+	return serial, nil
+}
+
+func TestCA_SerialNumberCollision(t *testing.T) {
+	// Arrange
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ca, _ := NewCA("CN=GoPKI,O=Cryptable,C=BE", 1, rsaKey.Public(), rsaKey)
+	ca.SetSerialNumberGenerator(&repeatingSerialNumberGenerator{
+		[]*big.Int{big.NewInt(10), big.NewInt(10), big.NewInt(11)},
+	})
+
+	// Act
+	cert1, err := ca.CreateTLSClientCertificate("CN=Client 1", rsaKey.Public())
+	if err != nil {
+		t.Error("CreateTLSClientCertificate failed: ", err)
+		return
+	}
+	cert2, err := ca.CreateTLSClientCertificate("CN=Client 2", rsaKey.Public())
+	if err != nil {
+		t.Error("CreateTLSClientCertificate failed: ", err)
+		return
+	}
+
+	// Assert
+	c1, _ := x509.ParseCertificate(cert1)
+	c2, _ := x509.ParseCertificate(cert2)
+	if c1.SerialNumber.Cmp(big.NewInt(10)) != 0 || c2.SerialNumber.Cmp(big.NewInt(11)) != 0 {
+		t.Error("Colliding serial number was not skipped: ", c1.SerialNumber, c2.SerialNumber)
+	}
+}
@@ -0,0 +1,157 @@
+package gopki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+)
+
+// signatureAlgorithms lists the signature algorithms the CA signs with per key algorithm,
+// SHA-1 and MD5 based algorithms are not supported
+var signatureAlgorithms = map[x509.PublicKeyAlgorithm][]x509.SignatureAlgorithm{
+	x509.RSA: {
+		x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA,
+		x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS,
+	},
+	x509.ECDSA:   {x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512},
+	x509.Ed25519: {x509.PureEd25519},
+}
+
+// DefaultSignatureAlgorithm returns the algorithm the CA signs with when none is selected:
+// PKCS#1 v1.5 with SHA-256 for RSA, the hash matching the curve for ECDSA and Ed25519
+func DefaultSignatureAlgorithm(pub crypto.PublicKey) (a x509.SignatureAlgorithm) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P384():
+			return x509.ECDSAWithSHA384
+		case elliptic.P521():
+			return x509.ECDSAWithSHA512
+		}
+		return x509.ECDSAWithSHA256
+	}
+	if publicKeyAlgorithm(pub) == x509.Ed25519 {
+		return x509.PureEd25519
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
+// selectSignatureAlgorithm returns the algorithm, or the default one when it is unknown,
+// after checking it can be used with the key
+func selectSignatureAlgorithm(pub crypto.PublicKey, algorithm x509.SignatureAlgorithm) (a x509.SignatureAlgorithm, e error) {
+	if algorithm == x509.UnknownSignatureAlgorithm {
+		algorithm = DefaultSignatureAlgorithm(pub)
+	}
+	for _, allowed := range signatureAlgorithms[publicKeyAlgorithm(pub)] {
+		if allowed == algorithm {
+			return algorithm, nil
+		}
+	}
+	return x509.UnknownSignatureAlgorithm, errors.New("signature algorithm " + algorithm.String() + " cannot be used with the key of the CA")
+}
+
+// ---------- Signing of other structures ----------
+
+var (
+	oidSignatureSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSignatureSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSignatureSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidSignatureRSAPSS          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidSignatureECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSignatureECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidSignatureECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidSignatureEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+	oidMGF1                     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+)
+
+var signatureAlgorithmDetails = map[x509.SignatureAlgorithm]struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+	// rsa algorithms have NULL parameters, unless they are pss
+	rsa bool
+	pss bool
+}{
+	x509.SHA256WithRSA:    {oidSignatureSHA256WithRSA, crypto.SHA256, true, false},
+	x509.SHA384WithRSA:    {oidSignatureSHA384WithRSA, crypto.SHA384, true, false},
+	x509.SHA512WithRSA:    {oidSignatureSHA512WithRSA, crypto.SHA512, true, false},
+	x509.SHA256WithRSAPSS: {oidSignatureRSAPSS, crypto.SHA256, true, true},
+	x509.SHA384WithRSAPSS: {oidSignatureRSAPSS, crypto.SHA384, true, true},
+	x509.SHA512WithRSAPSS: {oidSignatureRSAPSS, crypto.SHA512, true, true},
+	x509.ECDSAWithSHA256:  {oidSignatureECDSAWithSHA256, crypto.SHA256, false, false},
+	x509.ECDSAWithSHA384:  {oidSignatureECDSAWithSHA384, crypto.SHA384, false, false},
+	x509.ECDSAWithSHA512:  {oidSignatureECDSAWithSHA512, crypto.SHA512, false, false},
+	x509.PureEd25519:      {oidSignatureEd25519, crypto.Hash(0), false, false},
+}
+
+// pssParameters are the RSASSA-PSS-params of RFC 4055, the trailer field is the default
+type pssParameters struct {
+	Hash       pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MGF        pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+	SaltLength int                      `asn1:"explicit,tag:2"`
+}
+
+// signatureAlgorithmIdentifier returns the algorithm identifier and hash used to sign
+// structures which are not certificates or CRLs, RSA-PSS uses a salt as long as the hash
+func signatureAlgorithmIdentifier(algorithm x509.SignatureAlgorithm) (a pkix.AlgorithmIdentifier, h crypto.Hash, e error) {
+	details, ok := signatureAlgorithmDetails[algorithm]
+	if !ok {
+		return a, h, errors.New("unsupported signature algorithm: " + algorithm.String())
+	}
+
+	switch {
+	case details.pss:
+		hash := pkix.AlgorithmIdentifier{Algorithm: ocspHashOID(details.hash), Parameters: asn1.NullRawValue}
+		hashBytes, err := asn1.Marshal(hash)
+		if err != nil {
+			return a, h, err
+		}
+		params, err := asn1.Marshal(pssParameters{
+			Hash:       hash,
+			MGF:        pkix.AlgorithmIdentifier{Algorithm: oidMGF1, Parameters: asn1.RawValue{FullBytes: hashBytes}},
+			SaltLength: details.hash.Size(),
+		})
+		if err != nil {
+			return a, h, err
+		}
+		a = pkix.AlgorithmIdentifier{Algorithm: details.oid, Parameters: asn1.RawValue{FullBytes: params}}
+	case details.rsa:
+		a = pkix.AlgorithmIdentifier{Algorithm: details.oid, Parameters: asn1.NullRawValue}
+	default:
+		a = pkix.AlgorithmIdentifier{Algorithm: details.oid}
+	}
+	return a, details.hash, nil
+}
+
+// signData signs the DER encoded data with the signer and the signature algorithm
+func signData(signer crypto.Signer, algorithm x509.SignatureAlgorithm, data []byte) (a pkix.AlgorithmIdentifier, signature []byte, e error) {
+	identifier, hash, err := signatureAlgorithmIdentifier(algorithm)
+	if err != nil {
+		return a, nil, err
+	}
+
+	digest := data
+	var opts crypto.SignerOpts = hash
+	if hash != crypto.Hash(0) {
+		h := hash.New()
+		h.Write(data)
+		digest = h.Sum(nil)
+	}
+	if signatureAlgorithmDetails[algorithm].pss {
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}
+	}
+	signature, err = signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return a, nil, err
+	}
+	return identifier, signature, nil
+}
@@ -0,0 +1,223 @@
+package gopki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ---------- Testing Module ----------
+
+func TestNewCA_KeyTypes(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+	tests := []struct {
+		name      string
+		key       crypto.Signer
+		algorithm x509.SignatureAlgorithm
+	}{
+		{"P-256", p256, x509.ECDSAWithSHA256},
+		{"P-384", p384, x509.ECDSAWithSHA384},
+		{"Ed25519", ed25519Key, x509.PureEd25519},
+	}
+
+	for _, test := range tests {
+		// Arrange
+		ca, err := NewCA("CN=GoPKI "+test.name+",O=Cryptable,C=BE", 10, test.key.Public(), test.key)
+		if err != nil {
+			t.Error(test.name, ": NewCA() failed: ", err)
+			continue
+		}
+		leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+		// Act
+		certBytes, err := ca.CreateTLSServerCertificate("CN=www.cryptable.org", leafKey.Public(), "www.cryptable.org")
+
+		// Assert
+		if err != nil {
+			t.Error(test.name, ": CreateTLSServerCertificate() failed: ", err)
+			continue
+		}
+		cert, _ := x509.ParseCertificate(certBytes)
+		if ca.Certificate.SignatureAlgorithm != test.algorithm || cert.SignatureAlgorithm != test.algorithm {
+			t.Error(test.name, ": wrong signature algorithm: ", ca.Certificate.SignatureAlgorithm, cert.SignatureAlgorithm)
+		}
+		if err := cert.CheckSignatureFrom(ca.Certificate); err != nil {
+			t.Error(test.name, ": certificate not signed by the CA: ", err)
+		}
+	}
+}
+
+func TestCA_MixedHierarchy(t *testing.T) {
+	// Arrange
+	rootKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	root, err := NewCAWithOptions("CN=GoPKI RSA Root,O=Cryptable,C=BE", 10, rootKey.Public(), rootKey, CAOptions{MaxPathLen: 1})
+	if err != nil {
+		t.Error("NewCAWithOptions() failed: ", err)
+		return
+	}
+	issuingKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	issuing, chain, err := root.NewSubordinateCA("CN=GoPKI ECDSA Issuing,O=Cryptable,C=BE", 5, issuingKey.Public(), issuingKey, CAOptions{})
+	if err != nil {
+		t.Error("NewSubordinateCA() failed: ", err)
+		return
+	}
+	rsaLeaf, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecdsaLeaf, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ed25519Leaf, _, _ := ed25519.GenerateKey(rand.Reader)
+	leafs := []struct {
+		name     string
+		pub      crypto.PublicKey
+		keyUsage x509.KeyUsage
+	}{
+		{"RSA", rsaLeaf.Public(), x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment},
+		{"ECDSA", ecdsaLeaf.Public(), x509.KeyUsageDigitalSignature},
+		{"Ed25519", ed25519Leaf, x509.KeyUsageDigitalSignature},
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root.Certificate)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(issuing.Certificate)
+
+	for _, leaf := range leafs {
+		// Act
+		certBytes, err := issuing.CreateTLSServerCertificate("CN=www.cryptable.org", leaf.pub, "www.cryptable.org")
+		if err != nil {
+			t.Error(leaf.name, ": CreateTLSServerCertificate() failed: ", err)
+			continue
+		}
+		cert, _ := x509.ParseCertificate(certBytes)
+
+		// Assert
+		_, err = cert.Verify(x509.VerifyOptions{
+			DNSName:       "www.cryptable.org",
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			t.Error(leaf.name, ": chain does not verify: ", err)
+		}
+		if cert.SignatureAlgorithm != x509.ECDSAWithSHA384 {
+			t.Error(leaf.name, ": wrong signature algorithm: ", cert.SignatureAlgorithm)
+		}
+		if cert.KeyUsage != leaf.keyUsage {
+			t.Error(leaf.name, ": wrong key usage: ", cert.KeyUsage)
+		}
+	}
+	if issuing.Certificate.SignatureAlgorithm != x509.SHA256WithRSA {
+		t.Error("issuing CA not signed by the RSA root: ", issuing.Certificate.SignatureAlgorithm)
+	}
+	if len(chain) != 2 {
+		t.Error("wrong chain length: ", len(chain))
+	}
+}
+
+func TestCA_RSAPSS(t *testing.T) {
+	// Arrange
+	caKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ca, err := NewCAWithOptions("CN=GoPKI PSS,O=Cryptable,C=BE", 10, caKey.Public(), caKey, CAOptions{SignatureAlgorithm: x509.SHA256WithRSAPSS})
+	if err != nil {
+		t.Error("NewCAWithOptions() failed: ", err)
+		return
+	}
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certBytes, _ := ca.CreateTLSClientCertificate("CN=client", leafKey.Public())
+	cert, _ := x509.ParseCertificate(certBytes)
+	responder, _ := NewOCSPResponder(ca)
+	request, _ := ocsp.CreateRequest(cert, ca.Certificate, nil)
+
+	// Act
+	crlBytes, err := ca.CreateCRL()
+	if err != nil {
+		t.Error("CreateCRL() failed: ", err)
+		return
+	}
+	crl, _ := x509.ParseRevocationList(crlBytes)
+	var response ocspResponse
+	asn1.Unmarshal(responder.Respond(request), &response)
+	var basic ocspBasicResponse
+	asn1.Unmarshal(response.Response.Response, &basic)
+
+	// Assert
+	if ca.Certificate.SignatureAlgorithm != x509.SHA256WithRSAPSS || cert.SignatureAlgorithm != x509.SHA256WithRSAPSS {
+		t.Error("certificates not signed with RSA-PSS: ", ca.Certificate.SignatureAlgorithm, cert.SignatureAlgorithm)
+	}
+	if err := cert.CheckSignatureFrom(ca.Certificate); err != nil {
+		t.Error("certificate not signed by the CA: ", err)
+	}
+	if crl.SignatureAlgorithm != x509.SHA256WithRSAPSS {
+		t.Error("CRL not signed with RSA-PSS: ", crl.SignatureAlgorithm)
+	}
+	if err := crl.CheckSignatureFrom(ca.Certificate); err != nil {
+		t.Error("CRL not signed by the CA: ", err)
+	}
+	if !basic.SignatureAlgorithm.Algorithm.Equal(oidSignatureRSAPSS) {
+		t.Error("OCSP response not signed with RSA-PSS: ", basic.SignatureAlgorithm.Algorithm)
+	}
+	err = ca.Certificate.CheckSignature(x509.SHA256WithRSAPSS, basic.TBSResponseData.FullBytes, basic.Signature.Bytes)
+	if err != nil {
+		t.Error("OCSP response not signed by the CA: ", err)
+	}
+}
+
+func TestCA_SignatureAlgorithmMismatch(t *testing.T) {
+	// Arrange
+	ecdsaKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ca, _ := NewCA("CN=GoPKI,O=Cryptable,C=BE", 10, rsaKey.Public(), rsaKey)
+
+	// Act
+	_, errPSS := NewCAWithOptions("CN=GoPKI,O=Cryptable,C=BE", 10, ecdsaKey.Public(), ecdsaKey, CAOptions{SignatureAlgorithm: x509.SHA256WithRSAPSS})
+	errSHA1 := ca.SetSignatureAlgorithm(x509.SHA1WithRSA)
+	errSHA512 := ca.SetSignatureAlgorithm(x509.SHA512WithRSA)
+
+	// Assert
+	if errPSS == nil {
+		t.Error("RSA-PSS accepted for an ECDSA key")
+	}
+	if errSHA1 == nil {
+		t.Error("SHA-1 accepted as signature algorithm")
+	}
+	if errSHA512 != nil || ca.SignatureAlgorithm() != x509.SHA512WithRSA {
+		t.Error("SetSignatureAlgorithm() failed: ", errSHA512)
+	}
+}
+
+func TestLoadCAWithSignatureAlgorithm(t *testing.T) {
+	// Arrange
+	caKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ca, _ := NewCAWithOptions("CN=GoPKI PSS,O=Cryptable,C=BE", 10, caKey.Public(), caKey, CAOptions{SignatureAlgorithm: x509.SHA256WithRSAPSS})
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Act
+	loaded, err := LoadCAWithSignatureAlgorithm(ca.Bytes, caKey, *big.NewInt(100), x509.SHA256WithRSAPSS)
+	_, errMismatch := LoadCAWithSignatureAlgorithm(ca.Bytes, caKey, *big.NewInt(100), x509.ECDSAWithSHA256)
+	defaulted, _ := LoadCA(ca.Bytes, caKey, *big.NewInt(100))
+
+	// Assert
+	if err != nil {
+		t.Error("LoadCAWithSignatureAlgorithm() failed: ", err)
+		return
+	}
+	certBytes, _ := loaded.CreateTLSClientCertificate("CN=client", leafKey.Public())
+	cert, _ := x509.ParseCertificate(certBytes)
+	if loaded.SignatureAlgorithm() != x509.SHA256WithRSAPSS || cert.SignatureAlgorithm != x509.SHA256WithRSAPSS {
+		t.Error("loaded CA does not sign with RSA-PSS: ", loaded.SignatureAlgorithm(), cert.SignatureAlgorithm)
+	}
+	if errMismatch == nil {
+		t.Error("ECDSA signature algorithm accepted for an RSA key")
+	}
+	if defaulted.SignatureAlgorithm() != DefaultSignatureAlgorithm(caKey.Public()) {
+		t.Error("LoadCA() does not sign with the default algorithm: ", defaulted.SignatureAlgorithm())
+	}
+}
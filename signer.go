@@ -0,0 +1,272 @@
+package gopki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// signerServiceName is the name under which the remote signer protocol is registered
+const signerServiceName = "Signer"
+
+// NewMemorySigner returns the signer of a private key held in process memory. A key which
+// already is a crypto.Signer, like a RemoteSigner, is returned as is.
+func NewMemorySigner(priv crypto.PrivateKey) (s crypto.Signer, e error) {
+	if priv == nil {
+		return nil, errors.New("no private key for the CA")
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key of the CA cannot sign")
+	}
+	return signer, nil
+}
+
+// LoadKeyFileSigner unlocks a PEM encoded private key file with the password and keeps
+// the key in memory. A nil password is used for an unencrypted key file.
+func LoadKeyFileSigner(filename string, password []byte) (s crypto.Signer, e error) {
+	in, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	priv, err := LoadPrivateKeyPem(in, password)
+	if err != nil {
+		return nil, errors.New("cannot unlock key file " + filename + ": " + err.Error())
+	}
+	return NewMemorySigner(priv)
+}
+
+// OpenSigner opens a signer backend from its URI:
+//   file:/path/to/key.pem  an (encrypted) key file unlocked with the password
+//   unix:/path/to/socket   a remote signer listening on a Unix socket
+func OpenSigner(uri string, password []byte) (s crypto.Signer, e error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	path := u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return nil, errors.New("signer URI without path: " + uri)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return LoadKeyFileSigner(path, password)
+	case "unix":
+		return DialRemoteSigner("unix", path)
+	}
+	return nil, errors.New("unsupported signer backend: " + u.Scheme)
+}
+
+// checkSignerMatches verifies the signer holds the private key of the public key, like the
+// one of a CA certificate
+func checkSignerMatches(signer crypto.Signer, pub crypto.PublicKey) (e error) {
+	public, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(pub) {
+		return errors.New("signer does not match the public key of the CA")
+	}
+	return nil
+}
+
+// SignRequest is the request of the remote signer protocol
+type SignRequest struct {
+	Digest []byte
+	Hash   crypto.Hash
+	// PSS selects RSA-PSS with SaltLength, instead of PKCS#1 v1.5
+	PSS        bool
+	SaltLength int
+}
+
+// RemoteSigner signs through a signer daemon, the private key never leaves the daemon.
+// It reconnects when the connection is lost, like when the daemon restarted.
+type RemoteSigner struct {
+	network string
+	address string
+	public  crypto.PublicKey
+	// mutex protects client, nil until the next reconnect, and closed
+	mutex  sync.Mutex
+	client *rpc.Client
+	closed bool
+}
+
+// dialSigner connects to a signer daemon and fetches its public key
+func dialSigner(network string, address string) (client *rpc.Client, pub crypto.PublicKey, e error) {
+	client, err := rpc.Dial(network, address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var pubBytes []byte
+	err = client.Call(signerServiceName+".Public", 0, &pubBytes)
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	pub, err = x509.ParsePKIXPublicKey(pubBytes)
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, pub, nil
+}
+
+// DialRemoteSigner connects to a signer daemon, like gopki-signerd, and fetches its public key
+func DialRemoteSigner(network string, address string) (s *RemoteSigner, e error) {
+	client, pub, err := dialSigner(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RemoteSigner{
+		network: network,
+		address: address,
+		public:  pub,
+		client:  client,
+	}, nil
+}
+
+// connection returns the connection to the daemon, it reconnects after a lost connection
+// and refuses a daemon which holds another key
+func (s *RemoteSigner)connection() (client *rpc.Client, e error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, rpc.ErrShutdown
+	}
+	if s.client != nil {
+		return s.client, nil
+	}
+	client, pub, err := dialSigner(s.network, s.address)
+	if err != nil {
+		return nil, err
+	}
+	same, ok := pub.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !same.Equal(s.public) {
+		client.Close()
+		return nil, errors.New("signer daemon at " + s.address + " holds another key")
+	}
+	s.client = client
+	return client, nil
+}
+
+// disconnect drops the connection after a failed call, unless another call already did
+func (s *RemoteSigner)disconnect(client *rpc.Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.client == client {
+		s.client.Close()
+		s.client = nil
+	}
+}
+
+func (s *RemoteSigner)Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *RemoteSigner)Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) (signature []byte, e error) {
+	request := SignRequest{
+		Digest: digest,
+		Hash:   opts.HashFunc(),
+	}
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		request.PSS = true
+		request.SaltLength = pss.SaltLength
+	}
+
+	// a connection lost since the last call is only noticed by this call, so it is
+	// retried once on a new connection. Errors of the daemon itself are not retried.
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var client *rpc.Client
+		client, err = s.connection()
+		if err != nil {
+			return nil, err
+		}
+		err = client.Call(signerServiceName+".Sign", &request, &signature)
+		if err == nil {
+			return signature, nil
+		}
+		if _, ok := err.(rpc.ServerError); ok {
+			return nil, err
+		}
+		s.disconnect(client)
+	}
+	return nil, err
+}
+
+// Close closes the connection to the signer daemon, the signer doesn't reconnect anymore
+func (s *RemoteSigner)Close() (e error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
+
+// signerService exposes a crypto.Signer over net/rpc
+type signerService struct {
+	signer crypto.Signer
+}
+
+func (s *signerService)Public(_ int, pubBytes *[]byte) (e error) {
+	b, err := x509.MarshalPKIXPublicKey(s.signer.Public())
+	if err != nil {
+		return err
+	}
+	*pubBytes = b
+	return nil
+}
+
+func (s *signerService)Sign(request *SignRequest, signature *[]byte) (e error) {
+	var opts crypto.SignerOpts = request.Hash
+	if request.PSS {
+		opts = &rsa.PSSOptions{SaltLength: request.SaltLength, Hash: request.Hash}
+	}
+
+	b, err := s.signer.Sign(rand.Reader, request.Digest, opts)
+	if err != nil {
+		return err
+	}
+	*signature = b
+	return nil
+}
+
+// SignerServer serves a signer to RemoteSigner clients, it is the reference signer daemon
+type SignerServer struct {
+	server *rpc.Server
+}
+
+// NewSignerServer creates a server for the signer, which holds the private key
+func NewSignerServer(signer crypto.Signer) (s *SignerServer, e error) {
+	server := rpc.NewServer()
+	err := server.RegisterName(signerServiceName, &signerService{signer})
+	if err != nil {
+		return nil, err
+	}
+	return &SignerServer{server}, nil
+}
+
+// Serve accepts connections on the listener until it is closed
+func (s *SignerServer)Serve(l net.Listener) {
+	s.server.Accept(l)
+}
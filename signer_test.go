@@ -0,0 +1,273 @@
+package gopki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// startSignerDaemon serves the key on a temporary Unix socket, like gopki-signerd
+func startSignerDaemon(t *testing.T, priv crypto.Signer) (socket string) {
+	dir, err := os.MkdirTemp("", "gopki")
+	if err != nil {
+		t.Fatal("MkdirTemp failed: ", err)
+	}
+	socket = filepath.Join(dir, "signer.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal("Listen failed: ", err)
+	}
+	server, err := NewSignerServer(priv)
+	if err != nil {
+		t.Fatal("NewSignerServer failed: ", err)
+	}
+	go server.Serve(l)
+	t.Cleanup(func() {
+		l.Close()
+		os.RemoveAll(dir)
+	})
+	return socket
+}
+
+// restartableListener closes the accepted connections with the listener, like a daemon
+// which exits
+type restartableListener struct {
+	net.Listener
+	mutex sync.Mutex
+	conns []net.Conn
+}
+
+func (l *restartableListener)Accept() (c net.Conn, e error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mutex.Lock()
+	l.conns = append(l.conns, c)
+	l.mutex.Unlock()
+	return c, nil
+}
+
+func (l *restartableListener)Close() (e error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, c := range l.conns {
+		c.Close()
+	}
+	return l.Listener.Close()
+}
+
+// serveSignerDaemon serves the key on the Unix socket until the returned stop is called
+func serveSignerDaemon(t *testing.T, priv crypto.Signer, socket string) (stop func()) {
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal("Listen failed: ", err)
+	}
+	server, err := NewSignerServer(priv)
+	if err != nil {
+		t.Fatal("NewSignerServer failed: ", err)
+	}
+	listener := &restartableListener{Listener: l}
+	go server.Serve(listener)
+	return func() { listener.Close() }
+}
+
+// ---------- Testing Module ----------
+
+func TestRemoteSigner_CA(t *testing.T) {
+	// Arrange
+	caKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	socket := startSignerDaemon(t, caKey)
+	signer, err := OpenSigner("unix:"+socket, nil)
+	if err != nil {
+		t.Error("OpenSigner() failed: ", err)
+		return
+	}
+	defer signer.(*RemoteSigner).Close()
+
+	// Act
+	ca, err := NewCA("CN=GoPKI Remote,O=Cryptable,C=BE", 10, signer.Public(), signer)
+	if err != nil {
+		t.Error("NewCA() failed: ", err)
+		return
+	}
+	userKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certBytes, err := ca.CreateTLSServerCertificate("CN=www.cryptable.org", userKey.Public(), "www.cryptable.org")
+	if err != nil {
+		t.Error("CreateTLSServerCertificate() failed: ", err)
+		return
+	}
+
+	// Assert
+	cert, _ := x509.ParseCertificate(certBytes)
+	if err := cert.CheckSignatureFrom(ca.Certificate); err != nil {
+		t.Error("certificate not signed by the remote CA key: ", err)
+	}
+	if err := ca.Certificate.CheckSignatureFrom(ca.Certificate); err != nil {
+		t.Error("CA certificate not self-signed by the remote CA key: ", err)
+	}
+}
+
+func TestRemoteSigner_PSS(t *testing.T) {
+	// Arrange
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	signer, err := DialRemoteSigner("unix", startSignerDaemon(t, key))
+	if err != nil {
+		t.Error("DialRemoteSigner() failed: ", err)
+		return
+	}
+	defer signer.Close()
+	digest := sha256.Sum256([]byte("gopki"))
+	opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+
+	// Act
+	signature, err := signer.Sign(rand.Reader, digest[:], opts)
+
+	// Assert
+	if err != nil {
+		t.Error("Sign() failed: ", err)
+		return
+	}
+	if err := rsa.VerifyPSS(&key.PublicKey, crypto.SHA256, digest[:], signature, opts); err != nil {
+		t.Error("invalid PSS signature: ", err)
+	}
+}
+
+func TestLoadCA_KeyFileSigner(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI File,O=Cryptable,C=BE", 10, caKey.Public(), caKey)
+	filename := filepath.Join(t.TempDir(), "ca-key.pem")
+	var keyPem bytes.Buffer
+	StorePrivateKeyPem(&keyPem, caKey, []byte("system"))
+	os.WriteFile(filename, keyPem.Bytes(), 0600)
+
+	// Act
+	signer, err := OpenSigner("file:"+filename, []byte("system"))
+	if err != nil {
+		t.Error("OpenSigner() failed: ", err)
+		return
+	}
+	loaded, err := LoadCA(ca.Bytes, signer, *big.NewInt(100))
+	if err != nil {
+		t.Error("LoadCA() failed: ", err)
+		return
+	}
+	userKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certBytes, err := loaded.CreateTLSClientCertificate("CN=client", userKey.Public())
+
+	// Assert
+	if err != nil {
+		t.Error("CreateTLSClientCertificate() failed: ", err)
+		return
+	}
+	cert, _ := x509.ParseCertificate(certBytes)
+	if err := cert.CheckSignatureFrom(ca.Certificate); err != nil {
+		t.Error("certificate not signed by the CA key: ", err)
+	}
+}
+
+func TestLoadKeyFileSigner_WrongPassword(t *testing.T) {
+	// Arrange
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	filename := filepath.Join(t.TempDir(), "key.pem")
+	var keyPem bytes.Buffer
+	StorePrivateKeyPem(&keyPem, key, []byte("system"))
+	os.WriteFile(filename, keyPem.Bytes(), 0600)
+
+	// Act
+	_, err := LoadKeyFileSigner(filename, []byte("wrong"))
+
+	// Assert
+	if err == nil {
+		t.Error("key file unlocked with the wrong password")
+	}
+}
+
+func TestLoadKeyFileSigner_NotPEM(t *testing.T) {
+	// Arrange
+	filename := filepath.Join(t.TempDir(), "key.der")
+	os.WriteFile(filename, []byte("not a PEM encoded key"), 0600)
+
+	// Act
+	_, err := LoadKeyFileSigner(filename, nil)
+
+	// Assert
+	if err == nil {
+		t.Error("key file without PEM block accepted")
+	}
+}
+
+func TestRemoteSigner_Reconnect(t *testing.T) {
+	// Arrange
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dir, _ := os.MkdirTemp("", "gopki")
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "signer.sock")
+	stop := serveSignerDaemon(t, key, socket)
+	signer, err := DialRemoteSigner("unix", socket)
+	if err != nil {
+		t.Error("DialRemoteSigner() failed: ", err)
+		return
+	}
+	defer signer.Close()
+	digest := sha256.Sum256([]byte("Bytes needed to be signed"))
+
+	// Act
+	stop()
+	_, errDown := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	stop = serveSignerDaemon(t, key, socket)
+	signature, errRestarted := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	stop()
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	stop = serveSignerDaemon(t, otherKey, socket)
+	defer stop()
+	_, errOtherKey := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+
+	// Assert
+	if errDown == nil {
+		t.Error("signed without signer daemon")
+	}
+	if errRestarted != nil || !ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature) {
+		t.Error("no signature after the restart of the signer daemon: ", errRestarted)
+	}
+	if errOtherKey == nil {
+		t.Error("signed by a signer daemon with another key")
+	}
+}
+
+func TestLoadCA_SignerMismatch(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI,O=Cryptable,C=BE", 10, caKey.Public(), caKey)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Act
+	_, err := LoadCA(ca.Bytes, otherKey, *big.NewInt(100))
+
+	// Assert
+	if err == nil {
+		t.Error("CA loaded with a key which does not match its certificate")
+	}
+}
+
+func TestOpenSigner_UnsupportedBackend(t *testing.T) {
+	// Act
+	_, err := OpenSigner("pkcs11:token=gopki", nil)
+
+	// Assert
+	if err == nil {
+		t.Error("unsupported signer backend accepted")
+	}
+}
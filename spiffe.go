@@ -0,0 +1,200 @@
+package gopki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const ProfileX509SVID = "x509-svid"
+
+// DefaultX509SVIDValidity is the lifetime of an X509-SVID when no TTL is requested
+var DefaultX509SVIDValidity = time.Hour
+
+// x509SVIDProfile follows the X509-SVID specification: no CA, digital signature and
+// both TLS usages
+func x509SVIDProfile() (p *Profile) {
+	return &Profile{
+		Name:        ProfileX509SVID,
+		Validity:    DefaultX509SVIDValidity,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		CSRPolicy:   CSRPolicy{URIs: true},
+	}
+}
+
+// WorkloadSPIFFEID returns the SPIFFE ID of a Kubernetes service account
+func WorkloadSPIFFEID(trustDomain string, namespace string, serviceAccount string) (s string) {
+	return "spiffe://" + trustDomain + "/ns/" + namespace + "/sa/" + serviceAccount
+}
+
+// ParseSPIFFEID parses and validates the SPIFFE ID according to the SPIFFE-ID specification
+func ParseSPIFFEID(id string) (u *url.URL, e error) {
+	uri, err := url.Parse(id)
+	if err != nil {
+		return nil, err
+	}
+	if uri.Scheme != "spiffe" {
+		return nil, errors.New("SPIFFE ID must use the spiffe scheme: " + id)
+	}
+	if uri.User != nil || uri.Port() != "" || uri.RawQuery != "" || uri.Fragment != "" || uri.Opaque != "" {
+		return nil, errors.New("SPIFFE ID must not contain user info, port, query or fragment: " + id)
+	}
+	if uri.Host == "" {
+		return nil, errors.New("SPIFFE ID without trust domain: " + id)
+	}
+	for _, c := range uri.Host {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return nil, errors.New("invalid character in trust domain: " + id)
+		}
+	}
+	if uri.Path != "" {
+		for _, segment := range strings.Split(uri.Path[1:], "/") {
+			if segment == "" || segment == "." || segment == ".." {
+				return nil, errors.New("invalid path segment in SPIFFE ID: " + id)
+			}
+			for _, c := range segment {
+				if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+					c == '.' || c == '-' || c == '_') {
+					return nil, errors.New("invalid character in SPIFFE ID path: " + id)
+				}
+			}
+		}
+	}
+	return uri, nil
+}
+
+// checkX509SVID verifies the request has exactly one URI SAN, the SPIFFE ID of a
+// workload, as the X509-SVID specification requires
+func checkX509SVID(request *IssuanceRequest) (e error) {
+	if len(request.URIs) != 1 {
+		return errors.New("X509-SVID must have exactly one URI SAN, the SPIFFE ID")
+	}
+	uri, err := ParseSPIFFEID(request.URIs[0].String())
+	if err != nil {
+		return err
+	}
+	if uri.Path == "" {
+		return errors.New("SPIFFE ID of a workload must have a path: " + uri.String())
+	}
+	return nil
+}
+
+// CreateX509SVID issues an X509-SVID with the SPIFFE ID as only URI SAN. A zero TTL
+// takes the validity of the x509-svid profile.
+func (ca *CA)CreateX509SVID(spiffeID string, pub crypto.PublicKey, ttl time.Duration) (cert []byte, err error) {
+	uri, err := ParseSPIFFEID(spiffeID)
+	if err != nil {
+		return nil, err
+	}
+
+	return ca.Issue(ProfileX509SVID, &IssuanceRequest{
+		PublicKey: pub,
+		URIs:      []*url.URL{uri},
+		Validity:  ttl,
+	})
+}
+
+// ---------- Trust bundle ----------
+
+type jwk struct {
+	Use string   `json:"use"`
+	Kty string   `json:"kty"`
+	Crv string   `json:"crv,omitempty"`
+	X   string   `json:"x,omitempty"`
+	Y   string   `json:"y,omitempty"`
+	N   string   `json:"n,omitempty"`
+	E   string   `json:"e,omitempty"`
+	X5c []string `json:"x5c"`
+}
+
+type spiffeBundle struct {
+	Keys        []jwk  `json:"keys"`
+	Sequence    uint64 `json:"spiffe_sequence,omitempty"`
+	RefreshHint int64  `json:"spiffe_refresh_hint,omitempty"`
+}
+
+func x509SVIDJWK(cert *x509.Certificate) (j jwk, e error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	j = jwk{
+		Use: "x509-svid",
+		X5c: []string{base64.StdEncoding.EncodeToString(cert.Raw)},
+	}
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		j.Kty = "RSA"
+		j.N = encode(pub.N.Bytes())
+		j.E = encode(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		ecdhPub, err := pub.ECDH()
+		if err != nil {
+			return j, err
+		}
+		// uncompressed point: 0x04 || X || Y
+		point := ecdhPub.Bytes()
+		size := (len(point) - 1) / 2
+		j.Kty = "EC"
+		j.Crv = pub.Curve.Params().Name
+		j.X = encode(point[1 : 1+size])
+		j.Y = encode(point[1+size:])
+	case ed25519.PublicKey:
+		j.Kty = "OKP"
+		j.Crv = "Ed25519"
+		j.X = encode(pub)
+	default:
+		return j, errors.New("unsupported public key type in trust bundle")
+	}
+	return j, nil
+}
+
+// SPIFFEBundle returns the SPIFFE trust bundle of the CA in the JWKS format served by a
+// SPIFFE bundle endpoint. The roots of the TrustBundle are the X509 authorities, during
+// a key rollover both the old and the new root until the old key is retired.
+func (ca *CA)SPIFFEBundle(sequence uint64, refreshHint time.Duration) (b []byte, e error) {
+	roots, err := ca.TrustBundle()
+	if err != nil {
+		return nil, err
+	}
+	var keys []jwk
+	for _, root := range roots {
+		key, err := x509SVIDJWK(root)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return json.Marshal(&spiffeBundle{
+		Keys:        keys,
+		Sequence:    sequence,
+		RefreshHint: int64(refreshHint / time.Second),
+	})
+}
+
+// SPIFFEBundleHandler serves the SPIFFE trust bundle of the CA, the sequence number is
+// the time the bundle was served which always increases
+func (ca *CA)SPIFFEBundleHandler(refreshHint time.Duration) (h http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		bundle, err := ca.SPIFFEBundle(uint64(ca.Clock().Now().Unix()), refreshHint)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bundle)
+	})
+}
@@ -0,0 +1,210 @@
+package gopki
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseSPIFFEID(t *testing.T) {
+	valid := []string{
+		"spiffe://cluster.local/ns/default/sa/web",
+		"spiffe://example.org",
+	}
+	for _, id := range valid {
+		_, err := ParseSPIFFEID(id)
+		if err != nil {
+			t.Error("ParseSPIFFEID failed on ", id, ": ", err)
+		}
+	}
+
+	invalid := []string{
+		"https://cluster.local/ns/default/sa/web",
+		"spiffe:///ns/default",
+		"spiffe://Cluster.Local/ns/default",
+		"spiffe://cluster.local:8443/ns/default",
+		"spiffe://user@cluster.local/ns/default",
+		"spiffe://cluster.local/ns/../sa/web",
+		"spiffe://cluster.local/ns//sa",
+		"spiffe://cluster.local/ns/default?x=1",
+		"spiffe://cluster.local/ns/default#frag",
+	}
+	for _, id := range invalid {
+		_, err := ParseSPIFFEID(id)
+		if err == nil {
+			t.Error("ParseSPIFFEID must fail on: ", id)
+		}
+	}
+}
+
+func TestCA_CreateX509SVID(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI SPIFFE,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	workloadKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	id := WorkloadSPIFFEID("cluster.local", "default", "web")
+
+	// Act
+	cert, err := ca.CreateX509SVID(id, workloadKey.Public(), 5*time.Minute)
+
+	// Assert
+	if err != nil {
+		t.Error("CreateX509SVID failed: ", err)
+		return
+	}
+	svid, _ := x509.ParseCertificate(cert)
+	if len(svid.URIs) != 1 || svid.URIs[0].String() != id {
+		t.Error("X509-SVID does not have the SPIFFE ID as only URI SAN: ", svid.URIs)
+	}
+	if svid.IsCA || svid.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Error("X509-SVID has wrong key usage or basic constraints")
+	}
+	if svid.NotAfter.Sub(svid.NotBefore) != 5*time.Minute {
+		t.Error("X509-SVID has wrong TTL: ", svid.NotAfter.Sub(svid.NotBefore))
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate)
+	for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+		_, err = svid.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{usage}})
+		if err != nil {
+			t.Error("Verify failed: ", err)
+		}
+	}
+
+	// TTL beyond the profile and IDs without a path are refused
+	_, err = ca.CreateX509SVID(id, workloadKey.Public(), 24*time.Hour)
+	if err == nil {
+		t.Error("CreateX509SVID must refuse a TTL longer than the profile")
+	}
+	_, err = ca.CreateX509SVID("spiffe://cluster.local", workloadKey.Public(), 0)
+	if err == nil {
+		t.Error("CreateX509SVID must refuse the SPIFFE ID of a trust domain")
+	}
+}
+
+func TestCA_X509SVIDSingleSPIFFEID(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI SPIFFE,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	workloadKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	spiffeID, _ := url.Parse(WorkloadSPIFFEID("cluster.local", "default", "web"))
+	website, _ := url.Parse("https://www.cryptable.org/")
+	createCSR := func(uris ...*url.URL) (csr []byte) {
+		csr, _ = x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{URIs: uris}, workloadKey)
+		return csr
+	}
+
+	// Act
+	cert, err := ca.SignCSR(createCSR(spiffeID), ProfileX509SVID)
+	_, errTwo := ca.SignCSR(createCSR(spiffeID, website), ProfileX509SVID)
+	_, errHTTPS := ca.SignCSR(createCSR(website), ProfileX509SVID)
+	_, errNone := ca.SignCSR(createCSR(), ProfileX509SVID)
+	_, errDirect := ca.Issue(ProfileX509SVID, &IssuanceRequest{PublicKey: workloadKey.Public(), URIs: []*url.URL{website}})
+
+	// Assert
+	svid, _ := x509.ParseCertificate(cert)
+	if err != nil || len(svid.URIs) != 1 || svid.URIs[0].String() != spiffeID.String() {
+		t.Error("SignCSR failed for a single SPIFFE ID: ", err)
+	}
+	if errTwo == nil || errHTTPS == nil || errNone == nil {
+		t.Error("CSR without exactly one SPIFFE ID signed as X509-SVID")
+	}
+	if errDirect == nil {
+		t.Error("X509-SVID issued for an https URI")
+	}
+}
+
+func TestCA_SPIFFEBundle(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	cases := map[string]*CA{}
+	cases["RSA"], _ = NewCA("CN=GoPKI RSA", 1, rsaKey.Public(), rsaKey)
+	cases["EC"], _ = NewCA("CN=GoPKI EC", 1, ecKey.Public(), ecKey)
+	cases["OKP"], _ = NewCA("CN=GoPKI OKP", 1, edPub, edKey)
+
+	for kty, ca := range cases {
+		// Act
+		data, err := ca.SPIFFEBundle(1, 5*time.Minute)
+
+		// Assert
+		if err != nil {
+			t.Error("SPIFFEBundle failed: ", err)
+			continue
+		}
+		var bundle spiffeBundle
+		err = json.Unmarshal(data, &bundle)
+		if err != nil {
+			t.Error("Bundle is not valid JSON: ", err)
+			continue
+		}
+		if len(bundle.Keys) != 1 || bundle.Keys[0].Kty != kty || bundle.Keys[0].Use != "x509-svid" {
+			t.Error("Unexpected bundle keys: ", bundle.Keys)
+			continue
+		}
+		if bundle.RefreshHint != 300 || bundle.Sequence != 1 {
+			t.Error("Unexpected refresh hint or sequence: ", bundle.RefreshHint, bundle.Sequence)
+		}
+		der, _ := base64.StdEncoding.DecodeString(bundle.Keys[0].X5c[0])
+		root, err := x509.ParseCertificate(der)
+		if err != nil || !root.Equal(ca.Certificate) {
+			t.Error("x5c does not contain the root CA: ", err)
+		}
+	}
+}
+
+func TestCA_SPIFFEBundleRollover(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI SPIFFE,O=Cryptable,C=BE", 2, caKey.Public(), caKey)
+	now := time.Now()
+	rollover, _ := beginTestRollover(t, ca, now)
+	roots := func() (certs []*x509.Certificate) {
+		data, _ := ca.SPIFFEBundle(1, time.Minute)
+		var bundle spiffeBundle
+		json.Unmarshal(data, &bundle)
+		for _, key := range bundle.Keys {
+			der, _ := base64.StdEncoding.DecodeString(key.X5c[0])
+			cert, _ := x509.ParseCertificate(der)
+			certs = append(certs, cert)
+		}
+		return certs
+	}
+
+	// Act
+	published := roots()
+	ca.AdvanceRollover(now.Add(31 * 24 * time.Hour))
+	retired := roots()
+
+	// Assert
+	if len(published) != 2 || !published[0].Equal(rollover.OldCertificate) || !published[1].Equal(rollover.NewCertificate) {
+		t.Error("bundle doesn't publish both roots during the rollover: ", len(published))
+	}
+	if len(retired) != 1 || !retired[0].Equal(rollover.NewCertificate) {
+		t.Error("bundle still publishes the retired root: ", len(retired))
+	}
+}
+
+func TestCA_SPIFFEBundleHandler(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI SPIFFE,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	recorder := httptest.NewRecorder()
+
+	// Act
+	ca.SPIFFEBundleHandler(time.Minute).ServeHTTP(recorder, httptest.NewRequest("GET", "/bundle", nil))
+
+	// Assert
+	if recorder.Code != 200 || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Error("Unexpected response: ", recorder.Code, recorder.Header())
+	}
+}
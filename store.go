@@ -0,0 +1,494 @@
+package gopki
+
+import (
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Store persists everything of a CA per CA name: what it records while it issues and
+// revokes, its certificate, the issued certificates, revocations, CRL numbers and key
+// rollovers, and what CAStore saves, loads and backs up with it, the configuration and
+// the encrypted private keys. DB and MemoryStore implement it and embed a CAStore, another
+// implementation gets one with NewCAStore.
+type Store interface {
+	// SetCA records the current certificate of the CA, it replaces the previous one
+	SetCA(caname string, cert *x509.Certificate) (e error)
+	// CACertificate returns nil when the CA is unknown
+	CACertificate(caname string) (cert *x509.Certificate, e error)
+	SerialNumberExists(caname string, serial *big.Int) (b bool, e error)
+	AddCertificate(caname string, r *CertificateRecord) (e error)
+	// CertificateProfile returns the name of the profile the certificate was issued with
+	CertificateProfile(caname string, serial *big.Int) (p string, e error)
+	// Certificate returns nil when the certificate is unknown
+	Certificate(caname string, serial *big.Int) (r *CertificateRecord, e error)
+	// CertificatesBySubject returns the certificates with the subject, as returned by
+	// pkix.Name.String, in the order they were issued
+	CertificatesBySubject(caname string, subject string) (r []*CertificateRecord, e error)
+	// CertificateByFingerprint searches the certificates of all CAs, it returns nil when
+	// the certificate is unknown
+	CertificateByFingerprint(fingerprint string) (r *CertificateRecord, e error)
+	// CertificatesByStatus returns the certificates with the status at now, in the order
+	// they were issued
+	CertificatesByStatus(caname string, status CertificateStatus, now time.Time) (r []*CertificateRecord, e error)
+	// SupersedeCertificate marks a valid certificate as replaced by its renewal
+	SupersedeCertificate(caname string, serial *big.Int) (e error)
+	// Revocation returns nil when the certificate is not revoked
+	Revocation(caname string, serial *big.Int) (r *Revocation, e error)
+	// AddRevocation records the revocation and changes the status of the certificate
+	AddRevocation(caname string, r *Revocation) (e error)
+	Revocations(caname string) (r []*Revocation, e error)
+	// NextCRLNumber increments and returns the CRL number, the first one is 1
+	NextCRLNumber(caname string) (n *big.Int, e error)
+	// SetBaseCRL records the last base CRL of a partition, on which delta CRLs are based
+	SetBaseCRL(caname string, partition string, number *big.Int, thisUpdate time.Time) (e error)
+	// BaseCRL returns a nil number when the partition has no base CRL yet
+	BaseCRL(caname string, partition string) (number *big.Int, thisUpdate time.Time, e error)
+	// SetRollover records the key rollover of the CA, it replaces the previous one
+	SetRollover(caname string, r *Rollover) (e error)
+	// Rollover returns nil when no key rollover is recorded for the CA
+	Rollover(caname string) (r *Rollover, e error)
+
+	// SetConfig replaces the configuration of the CA, see CAStore.SaveCA
+	SetConfig(caname string, config []ConfigEntry) (e error)
+	// Config returns the configuration of the CA, none when the CA is unknown
+	Config(caname string) (config []ConfigEntry, e error)
+	// SetPrivateKey stores an encrypted private key, it replaces the key of the CA with
+	// the same KeyID
+	SetPrivateKey(caname string, k *StoredPrivateKey) (e error)
+	// StoredPrivateKey returns nil when the key is unknown
+	StoredPrivateKey(caname string, keyID string) (k *StoredPrivateKey, e error)
+	// RewrapDataKeys replaces the data key of every private key which is not wrapped by the
+	// KEK kekID by the one rewrap returns and returns how many were replaced, all of them
+	// or none when rewrap fails
+	RewrapDataKeys(kekID string, rewrap func(caname string, k *StoredPrivateKey) (dataKey []byte, e error)) (n int, e error)
+	// Certificates returns all certificates of the CA in the order they were issued
+	Certificates(caname string) (r []*CertificateRecord, e error)
+	// CRLNumber returns the last CRL number, nil before the first CRL
+	CRLNumber(caname string) (n *big.Int, e error)
+	// RestoreCA replaces the CA by the state at once, see CAState
+	RestoreCA(caname string, state *CAState) (e error)
+
+	// SchemaVersion returns the version of the schema of the store, see
+	// LatestSchemaVersion
+	SchemaVersion() (version int, e error)
+	// CheckSchema returns an error unless the store has the schema of this package
+	CheckSchema() (e error)
+	// Migrate upgrades the schema and returns how many migrations were applied
+	Migrate() (applied int, e error)
+	// MigrationStatus returns the migrations of the schema, ordered by version
+	MigrationStatus() (s []MigrationStatus, e error)
+}
+
+// ConfigEntry is a value of the configuration of a CA, Integrity is the HMAC which
+// CAStore puts on every entry
+type ConfigEntry struct {
+	Key       string
+	Value     []byte
+	Integrity string
+}
+
+// StoredPrivateKey is an encrypted private key, DataKey is wrapped by the KEK with KEKID
+// and encrypts PrivateKey
+type StoredPrivateKey struct {
+	KeyID      string
+	KeyType    string
+	KEKID      string
+	DataKey    []byte
+	PrivateKey []byte
+}
+
+// CAState is what RestoreCA puts in place of a CA. The certificates, revocations and
+// rollover replace those of the CA, a nil Rollover removes the recorded one. PrivateKey is
+// added to the private keys of the CA when it is set. The CRL number only goes up to
+// CRLNumber, it never goes back.
+type CAState struct {
+	Config       []ConfigEntry
+	Certificate  *x509.Certificate
+	Certificates []*CertificateRecord
+	Revocations  []*Revocation
+	PrivateKey   *StoredPrivateKey
+	Rollover     *Rollover
+	CRLNumber    *big.Int
+}
+
+type baseCRL struct {
+	number     *big.Int
+	thisUpdate time.Time
+}
+
+// MemoryStore is a Store which keeps everything in memory, it is lost on exit
+type MemoryStore struct {
+	CAStore
+	mutex        sync.Mutex
+	cas          map[string]*x509.Certificate
+	certificates map[string]map[string]*CertificateRecord
+	// issued keeps the certificates of a CA in the order they were issued
+	issued       map[string][]*CertificateRecord
+	revocations  map[string][]*Revocation
+	crlNumbers   map[string]*big.Int
+	baseCRLs     map[string]*baseCRL
+	rollovers    map[string]Rollover
+	configs      map[string][]ConfigEntry
+	privateKeys  map[string]map[string]StoredPrivateKey
+	createdAt    time.Time
+}
+
+var _ Store = (*MemoryStore)(nil)
+var _ KeyStore = (*MemoryStore)(nil)
+
+// NewMemoryStore returns an empty MemoryStore, like a DB it saves, loads and backs up CAs
+// once it has an integrity key and a KEK
+func NewMemoryStore() (m *MemoryStore) {
+	m = &MemoryStore{
+		cas:          map[string]*x509.Certificate{},
+		certificates: map[string]map[string]*CertificateRecord{},
+		issued:       map[string][]*CertificateRecord{},
+		revocations:  map[string][]*Revocation{},
+		crlNumbers:   map[string]*big.Int{},
+		baseCRLs:     map[string]*baseCRL{},
+		rollovers:    map[string]Rollover{},
+		configs:      map[string][]ConfigEntry{},
+		privateKeys:  map[string]map[string]StoredPrivateKey{},
+		createdAt:    time.Now(),
+	}
+	m.store = m
+	return m
+}
+
+func (m *MemoryStore)SerialNumberExists(caname string, serial *big.Int) (b bool, e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.certificates[caname][serial.Text(16)]
+	return ok, nil
+}
+
+func (m *MemoryStore)SetCA(caname string, cert *x509.Certificate) (e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.cas[caname] = cert
+	return nil
+}
+
+func (m *MemoryStore)CACertificate(caname string) (cert *x509.Certificate, e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.cas[caname], nil
+}
+
+func (m *MemoryStore)AddCertificate(caname string, r *CertificateRecord) (e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.certificates[caname] == nil {
+		m.certificates[caname] = map[string]*CertificateRecord{}
+	}
+	if _, ok := m.certificates[caname][r.SerialNumber.Text(16)]; ok {
+		return errors.New("certificate " + r.SerialNumber.Text(16) + " of " + caname + " is already stored")
+	}
+	record := *r
+	m.certificates[caname][r.SerialNumber.Text(16)] = &record
+	m.issued[caname] = append(m.issued[caname], &record)
+	return nil
+}
+
+func (m *MemoryStore)CertificateProfile(caname string, serial *big.Int) (p string, e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	record, ok := m.certificates[caname][serial.Text(16)]
+	if !ok {
+		return "", nil
+	}
+	return record.Profile, nil
+}
+
+func (m *MemoryStore)Certificate(caname string, serial *big.Int) (r *CertificateRecord, e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	record, ok := m.certificates[caname][serial.Text(16)]
+	if !ok {
+		return nil, nil
+	}
+	copied := *record
+	return &copied, nil
+}
+
+// selectCertificates returns copies of the certificates of the CA which match
+func (m *MemoryStore)selectCertificates(caname string, match func(r *CertificateRecord) bool) (r []*CertificateRecord) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, record := range m.issued[caname] {
+		if match(record) {
+			copied := *record
+			r = append(r, &copied)
+		}
+	}
+	return r
+}
+
+func (m *MemoryStore)CertificatesBySubject(caname string, subject string) (r []*CertificateRecord, e error) {
+	return m.selectCertificates(caname, func(record *CertificateRecord) bool {
+		return record.Subject == subject
+	}), nil
+}
+
+func (m *MemoryStore)CertificateByFingerprint(fingerprint string) (r *CertificateRecord, e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, records := range m.issued {
+		for _, record := range records {
+			if record.Fingerprint == fingerprint {
+				copied := *record
+				return &copied, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore)CertificatesByStatus(caname string, status CertificateStatus, now time.Time) (r []*CertificateRecord, e error) {
+	return m.selectCertificates(caname, func(record *CertificateRecord) bool {
+		return record.StatusAt(now) == status
+	}), nil
+}
+
+func (m *MemoryStore)SupersedeCertificate(caname string, serial *big.Int) (e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	record, ok := m.certificates[caname][serial.Text(16)]
+	if !ok {
+		return errors.New("certificate " + serial.Text(16) + " of " + caname + " is unknown")
+	}
+	if record.Status == CertificateValid {
+		record.Status = CertificateSuperseded
+	}
+	return nil
+}
+
+func (m *MemoryStore)Revocation(caname string, serial *big.Int) (r *Revocation, e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, revocation := range m.revocations[caname] {
+		if revocation.SerialNumber.Cmp(serial) == 0 {
+			return revocation, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore)AddRevocation(caname string, r *Revocation) (e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, revocation := range m.revocations[caname] {
+		if revocation.SerialNumber.Cmp(r.SerialNumber) == 0 {
+			return errors.New("revocation of " + r.SerialNumber.Text(16) + " of " + caname + " is already stored")
+		}
+	}
+	m.revocations[caname] = append(m.revocations[caname], r)
+	if record, ok := m.certificates[caname][r.SerialNumber.Text(16)]; ok {
+		record.Status = CertificateRevoked
+	}
+	return nil
+}
+
+func (m *MemoryStore)Revocations(caname string) (r []*Revocation, e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return append(r, m.revocations[caname]...), nil
+}
+
+func (m *MemoryStore)NextCRLNumber(caname string) (n *big.Int, e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.crlNumbers[caname] == nil {
+		m.crlNumbers[caname] = big.NewInt(0)
+	}
+	m.crlNumbers[caname].Add(m.crlNumbers[caname], big.NewInt(1))
+	return new(big.Int).Set(m.crlNumbers[caname]), nil
+}
+
+func (m *MemoryStore)SetBaseCRL(caname string, partition string, number *big.Int, thisUpdate time.Time) (e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.baseCRLs[caname+"/"+partition] = &baseCRL{new(big.Int).Set(number), thisUpdate}
+	return nil
+}
+
+func (m *MemoryStore)BaseCRL(caname string, partition string) (number *big.Int, thisUpdate time.Time, e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	base, ok := m.baseCRLs[caname+"/"+partition]
+	if !ok {
+		return nil, time.Time{}, nil
+	}
+	return new(big.Int).Set(base.number), base.thisUpdate, nil
+}
+
+func (m *MemoryStore)SetRollover(caname string, r *Rollover) (e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.rollovers[caname] = *r
+	return nil
+}
+
+func (m *MemoryStore)Rollover(caname string) (r *Rollover, e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	rollover, ok := m.rollovers[caname]
+	if !ok {
+		return nil, nil
+	}
+	return &rollover, nil
+}
+
+func (m *MemoryStore)SetConfig(caname string, config []ConfigEntry) (e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.configs[caname] = append([]ConfigEntry{}, config...)
+	return nil
+}
+
+func (m *MemoryStore)Config(caname string) (config []ConfigEntry, e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return append(config, m.configs[caname]...), nil
+}
+
+func (m *MemoryStore)SetPrivateKey(caname string, k *StoredPrivateKey) (e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.privateKeys[caname] == nil {
+		m.privateKeys[caname] = map[string]StoredPrivateKey{}
+	}
+	m.privateKeys[caname][k.KeyID] = *k
+	return nil
+}
+
+func (m *MemoryStore)StoredPrivateKey(caname string, keyID string) (k *StoredPrivateKey, e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored, ok := m.privateKeys[caname][keyID]
+	if !ok {
+		return nil, nil
+	}
+	return &stored, nil
+}
+
+func (m *MemoryStore)RewrapDataKeys(kekID string, rewrap func(caname string, k *StoredPrivateKey) (dataKey []byte, e error)) (n int, e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	rewrapped := map[string]map[string]StoredPrivateKey{}
+	for caname, keys := range m.privateKeys {
+		for keyID, stored := range keys {
+			if stored.KEKID == kekID {
+				continue
+			}
+			dataKey, err := rewrap(caname, &stored)
+			if err != nil {
+				return 0, err
+			}
+			stored.KEKID, stored.DataKey = kekID, dataKey
+			if rewrapped[caname] == nil {
+				rewrapped[caname] = map[string]StoredPrivateKey{}
+			}
+			rewrapped[caname][keyID] = stored
+			n++
+		}
+	}
+	for caname, keys := range rewrapped {
+		for keyID, stored := range keys {
+			m.privateKeys[caname][keyID] = stored
+		}
+	}
+	return n, nil
+}
+
+func (m *MemoryStore)Certificates(caname string) (r []*CertificateRecord, e error) {
+	return m.selectCertificates(caname, func(record *CertificateRecord) bool {
+		return true
+	}), nil
+}
+
+func (m *MemoryStore)CRLNumber(caname string) (n *big.Int, e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.crlNumbers[caname] == nil {
+		return nil, nil
+	}
+	return new(big.Int).Set(m.crlNumbers[caname]), nil
+}
+
+func (m *MemoryStore)RestoreCA(caname string, state *CAState) (e error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.configs[caname] = append([]ConfigEntry{}, state.Config...)
+	m.cas[caname] = state.Certificate
+	m.certificates[caname] = map[string]*CertificateRecord{}
+	m.issued[caname] = nil
+	for _, r := range state.Certificates {
+		record := *r
+		m.certificates[caname][r.SerialNumber.Text(16)] = &record
+		m.issued[caname] = append(m.issued[caname], &record)
+	}
+	m.revocations[caname] = append([]*Revocation{}, state.Revocations...)
+	if state.PrivateKey != nil {
+		if m.privateKeys[caname] == nil {
+			m.privateKeys[caname] = map[string]StoredPrivateKey{}
+		}
+		m.privateKeys[caname][state.PrivateKey.KeyID] = *state.PrivateKey
+	}
+	delete(m.rollovers, caname)
+	if state.Rollover != nil {
+		m.rollovers[caname] = *state.Rollover
+	}
+	if state.CRLNumber != nil && (m.crlNumbers[caname] == nil || m.crlNumbers[caname].Cmp(state.CRLNumber) < 0) {
+		m.crlNumbers[caname] = new(big.Int).Set(state.CRLNumber)
+	}
+	return nil
+}
+
+// SchemaVersion of a MemoryStore is always the latest, it has nothing to migrate
+func (m *MemoryStore)SchemaVersion() (version int, e error) {
+	return LatestSchemaVersion(), nil
+}
+
+func (m *MemoryStore)CheckSchema() (e error) {
+	return nil
+}
+
+func (m *MemoryStore)Migrate() (applied int, e error) {
+	return 0, nil
+}
+
+// MigrationStatus reports every migration as applied when the store was created
+func (m *MemoryStore)MigrationStatus() (s []MigrationStatus, e error) {
+	for _, migration := range migrations {
+		s = append(s, MigrationStatus{Version: migration.version, Description: migration.description, AppliedAt: m.createdAt})
+	}
+	return s, nil
+}
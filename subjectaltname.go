@@ -0,0 +1,144 @@
+package gopki
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// AddSubjectAltNames adds the names to the subject alternative names of the request.
+// IP addresses, URIs (containing "://") and email addresses (containing "@") are
+// recognized, everything else is taken as a DNS name.
+func (r *IssuanceRequest)AddSubjectAltNames(names ...string) (e error) {
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			r.IPAddresses = append(r.IPAddresses, ip)
+			continue
+		}
+		if strings.Contains(name, "://") {
+			uri, err := url.Parse(name)
+			if err != nil {
+				return err
+			}
+			r.URIs = append(r.URIs, uri)
+			continue
+		}
+		if strings.Contains(name, "@") {
+			r.EmailAddresses = append(r.EmailAddresses, name)
+			continue
+		}
+		r.DNSNames = append(r.DNSNames, name)
+	}
+	return nil
+}
+
+// normalizeSubjectAltNames validates the subject alternative names of the request and
+// converts them to the form in which they are put in the certificate. The slices of the
+// request are replaced, not modified.
+func (r *IssuanceRequest)normalizeSubjectAltNames() (e error) {
+	var dnsNames []string
+	for _, name := range r.DNSNames {
+		dnsName, err := normalizeDNSName(name)
+		if err != nil {
+			return err
+		}
+		dnsNames = append(dnsNames, dnsName)
+	}
+	var ipAddresses []net.IP
+	for _, ip := range r.IPAddresses {
+		ipAddress, err := normalizeIPAddress(ip)
+		if err != nil {
+			return err
+		}
+		ipAddresses = append(ipAddresses, ipAddress)
+	}
+	for _, uri := range r.URIs {
+		err := checkURI(uri)
+		if err != nil {
+			return err
+		}
+	}
+	var emailAddresses []string
+	for _, email := range r.EmailAddresses {
+		emailAddress, err := normalizeEmailAddress(email)
+		if err != nil {
+			return err
+		}
+		emailAddresses = append(emailAddresses, emailAddress)
+	}
+
+	r.DNSNames = dnsNames
+	r.IPAddresses = ipAddresses
+	r.EmailAddresses = emailAddresses
+	return nil
+}
+
+// normalizeDNSName converts the name to its lower case punycode form, only the
+// leftmost label may be a wildcard
+func normalizeDNSName(name string) (s string, e error) {
+	wildcard := strings.HasPrefix(name, "*.")
+	if wildcard {
+		name = name[2:]
+	}
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(name, "."))
+	if err != nil {
+		return "", errors.New("invalid DNS name " + name + ": " + err.Error())
+	}
+	if ascii == "" || strings.Contains(ascii, "*") {
+		return "", errors.New("invalid DNS name: " + name)
+	}
+	if wildcard {
+		if !strings.Contains(ascii, ".") {
+			return "", errors.New("wildcard on top level domain: " + name)
+		}
+		ascii = "*." + ascii
+	}
+	return ascii, nil
+}
+
+// normalizeIPAddress returns the 4 byte form of IPv4 (also IPv4 mapped) addresses,
+// the unspecified addresses are refused
+func normalizeIPAddress(ip net.IP) (i net.IP, e error) {
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return nil, errors.New("invalid IP address")
+	}
+	if ip.IsUnspecified() {
+		return nil, errors.New("unspecified IP address: " + ip.String())
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+	return ip, nil
+}
+
+func checkURI(uri *url.URL) (e error) {
+	if uri.Scheme == "" {
+		return errors.New("URI without scheme: " + uri.String())
+	}
+	if uri.Host == "" && uri.Opaque == "" {
+		return errors.New("URI without host: " + uri.String())
+	}
+	return nil
+}
+
+// normalizeEmailAddress converts the domain of the address to its lower case punycode form
+func normalizeEmailAddress(email string) (s string, e error) {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return "", errors.New("invalid email address: " + email)
+	}
+	local := email[:at]
+	for _, c := range local {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune("()<>[]:;@\\,\"", c) {
+			return "", errors.New("invalid email address: " + email)
+		}
+	}
+	domain, err := idna.Lookup.ToASCII(email[at+1:])
+	if err != nil {
+		return "", errors.New("invalid email address " + email + ": " + err.Error())
+	}
+	return local + "@" + domain, nil
+}
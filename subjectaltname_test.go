@@ -0,0 +1,138 @@
+package gopki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+)
+
+func TestAddSubjectAltNames(t *testing.T) {
+	// Arrange
+	request := IssuanceRequest{}
+
+	// Act
+	err := request.AddSubjectAltNames("svc.namespace.svc.cluster.local", "10.0.0.1", "::1",
+		"spiffe://cluster.local/ns/default/sa/web", "admin@cryptable.org")
+
+	// Assert
+	if err != nil {
+		t.Error("AddSubjectAltNames failed: ", err)
+		return
+	}
+	if len(request.DNSNames) != 1 || len(request.IPAddresses) != 2 ||
+		len(request.URIs) != 1 || len(request.EmailAddresses) != 1 {
+		t.Error("Names are not classified correctly: ", request)
+	}
+}
+
+func TestNormalizeDNSName(t *testing.T) {
+	valid := map[string]string{
+		"Example.COM":        "example.com",
+		"bücher.example":     "xn--bcher-kva.example",
+		"*.svc.cluster.local": "*.svc.cluster.local",
+		"host.example.":      "host.example",
+	}
+	for name, expected := range valid {
+		normalized, err := normalizeDNSName(name)
+		if err != nil || normalized != expected {
+			t.Error("normalizeDNSName failed on ", name, ": ", normalized, err)
+		}
+	}
+
+	invalid := []string{"", "*.com", "a.*.example", "bad_label..example", "a b.example"}
+	for _, name := range invalid {
+		_, err := normalizeDNSName(name)
+		if err == nil {
+			t.Error("normalizeDNSName must fail on: ", name)
+		}
+	}
+}
+
+func TestNormalizeIPAddress(t *testing.T) {
+	// Act
+	mapped, err := normalizeIPAddress(net.ParseIP("::ffff:10.0.0.1"))
+	_, unspecified := normalizeIPAddress(net.ParseIP("::"))
+	_, unspecified4 := normalizeIPAddress(net.ParseIP("0.0.0.0"))
+	_, unspecified4Short := normalizeIPAddress(net.IPv4(0, 0, 0, 0).To4())
+
+	// Assert
+	if err != nil || len(mapped) != net.IPv4len {
+		t.Error("IPv4 address is not in canonical form: ", mapped, err)
+	}
+	if unspecified == nil {
+		t.Error("normalizeIPAddress must refuse the unspecified address")
+	}
+	if unspecified4 == nil || unspecified4Short == nil {
+		t.Error("normalizeIPAddress must refuse the unspecified IPv4 address")
+	}
+}
+
+func TestNormalizeEmailAddress(t *testing.T) {
+	normalized, err := normalizeEmailAddress("admin@bücher.example")
+	if err != nil || normalized != "admin@xn--bcher-kva.example" {
+		t.Error("normalizeEmailAddress failed: ", normalized, err)
+	}
+
+	invalid := []string{"admin", "@example.com", "admin@", "ad min@example.com"}
+	for _, email := range invalid {
+		_, err := normalizeEmailAddress(email)
+		if err == nil {
+			t.Error("normalizeEmailAddress must fail on: ", email)
+		}
+	}
+}
+
+func TestCA_CreateTLSServerCertificateWithSANs(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI SAN,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	tlsKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Act
+	cert, err := ca.CreateTLSServerCertificate("CN=web", tlsKey.Public(),
+		"web.default.svc.cluster.local", "10.96.0.10")
+
+	// Assert
+	if err != nil {
+		t.Error("CreateTLSServerCertificate failed: ", err)
+		return
+	}
+	certif, _ := x509.ParseCertificate(cert)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate)
+	for _, name := range []string{"web.default.svc.cluster.local", "10.96.0.10"} {
+		_, err = certif.Verify(x509.VerifyOptions{DNSName: name, Roots: roots})
+		if err != nil {
+			t.Error("Verify failed for ", name, ": ", err)
+		}
+	}
+	_, err = certif.Verify(x509.VerifyOptions{DNSName: "other.default.svc.cluster.local", Roots: roots})
+	if err == nil {
+		t.Error("Verify must fail for a name which is not in the certificate")
+	}
+
+	// crypto/tls accepts the certificate for the host name
+	_, err = tls.X509KeyPair(pemCertificate(cert), pemPrivateKey(t, tlsKey))
+	if err != nil {
+		t.Error("X509KeyPair failed: ", err)
+	}
+}
+
+func TestCA_CreateTLSServerCertificateInvalidSAN(t *testing.T) {
+	// Arrange
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, _ := NewCA("CN=GoPKI SAN,O=Cryptable,C=BE", 1, caKey.Public(), caKey)
+	tlsKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Act
+	_, err := ca.CreateTLSServerCertificate("CN=web", tlsKey.Public(), "*.*.example.com")
+
+	// Assert
+	if err == nil {
+		t.Error("CreateTLSServerCertificate must refuse an invalid DNS name")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"os"
+	"testing"
 )
 
 func overwriteFile(filename string) (f *os.File, err error){
@@ -51,3 +52,15 @@ func storePrivateKey(priv crypto.PrivateKey, filename string) (err error) {
 
 	return nil
 }
+
+func pemCertificate(cert []byte) (b []byte) {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+}
+
+func pemPrivateKey(t *testing.T, priv crypto.PrivateKey) (b []byte) {
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal("MarshalPKCS8PrivateKey failed: ", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes})
+}